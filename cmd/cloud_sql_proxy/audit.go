@@ -0,0 +1,227 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file contains code for writing an audit log of proxied connections to
+// Cloud Logging.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/util"
+	cloudlogging "google.golang.org/api/logging/v2"
+	"google.golang.org/api/option"
+)
+
+// loggingWriteScope is the OAuth2 scope needed to write the audit log.
+const loggingWriteScope = cloudlogging.LoggingWriteScope
+
+const (
+	// auditBufferSize is the number of audit log entries which may wait to
+	// be written. Entries beyond it are dropped rather than holding up
+	// connections.
+	auditBufferSize = 10000
+	// auditBatchSize is the largest number of entries written at once.
+	auditBatchSize = 500
+	// auditFlushInterval is the longest an entry waits to be written.
+	auditFlushInterval = time.Second
+)
+
+// loggingEndpoint is the Cloud Logging API endpoint. For overriding in
+// unittests.
+var loggingEndpoint = ""
+
+// logNameRegexp matches the log IDs accepted by Cloud Logging.
+var logNameRegexp = regexp.MustCompile(`^[A-Za-z0-9/_.-]{1,512}$`)
+
+// validLogName reports whether name may be used as the ID of the audit log.
+func validLogName(name string) bool {
+	return logNameRegexp.MatchString(name)
+}
+
+// auditLogger is a proxy.Auditor which writes an entry to the Cloud Logging
+// log logName, in the project of the instance, for every connection opened
+// and closed. Entries are written in batches in the background.
+type auditLogger struct {
+	svc     *cloudlogging.Service
+	logName string
+	entries chan *cloudlogging.LogEntry
+	// dropped counts the entries dropped since the last write because the
+	// buffer was full. It must be accessed atomically.
+	dropped uint64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// newAuditLogger returns an auditLogger which writes to logName with cl.
+func newAuditLogger(ctx context.Context, cl *http.Client, logName string) (*auditLogger, error) {
+	opts := []option.ClientOption{option.WithHTTPClient(cl)}
+	if loggingEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(loggingEndpoint))
+	}
+	svc, err := cloudlogging.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLogger{
+		svc:     svc,
+		logName: logName,
+		entries: make(chan *cloudlogging.LogEntry, auditBufferSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go a.run(ctx)
+	return a, nil
+}
+
+// ConnOpened records that a connection from client to instance was opened.
+func (a *auditLogger) ConnOpened(instance string, client net.Addr, opened time.Time) {
+	a.add(instance, opened, map[string]interface{}{
+		"event":     "open",
+		"instance":  instance,
+		"source_ip": sourceIP(client),
+	})
+}
+
+// ConnClosed records that a connection from client to instance was closed.
+// bytes_received counts the bytes received from the client, and bytes_sent
+// those sent to it.
+func (a *auditLogger) ConnClosed(instance string, client net.Addr, d time.Duration, bytesIn, bytesOut uint64) {
+	a.add(instance, time.Now(), map[string]interface{}{
+		"event":            "close",
+		"instance":         instance,
+		"source_ip":        sourceIP(client),
+		"duration_seconds": d.Seconds(),
+		"bytes_sent":       bytesOut,
+		"bytes_received":   bytesIn,
+	})
+}
+
+// sourceIP returns the IP address of a TCP client, or otherwise the address
+// of the socket the client connected to.
+func sourceIP(client net.Addr) string {
+	if tcp, ok := client.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	return client.String()
+}
+
+// add queues an entry for instance with payload, dropping it if too many
+// entries are already waiting to be written.
+func (a *auditLogger) add(instance string, at time.Time, payload map[string]interface{}) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		logging.Errorf("couldn't encode audit log entry: %v", err)
+		return
+	}
+	project, region, name := util.SplitName(instance)
+	e := &cloudlogging.LogEntry{
+		LogName: fmt.Sprintf("projects/%s/logs/%s", project, url.PathEscape(a.logName)),
+		Resource: &cloudlogging.MonitoredResource{
+			Type: "cloudsql_database",
+			Labels: map[string]string{
+				"project_id":  project,
+				"database_id": project + ":" + name,
+				"region":      region,
+			},
+		},
+		Timestamp:   at.UTC().Format(time.RFC3339Nano),
+		Severity:    "NOTICE",
+		JsonPayload: raw,
+	}
+	select {
+	case a.entries <- e:
+	default:
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
+
+// run writes the queued entries whenever a batch is full or
+// auditFlushInterval has passed, until Close is called.
+func (a *auditLogger) run(ctx context.Context) {
+	defer close(a.done)
+	t := time.NewTicker(auditFlushInterval)
+	defer t.Stop()
+	var batch []*cloudlogging.LogEntry
+	for {
+		select {
+		case e := <-a.entries:
+			if batch = append(batch, e); len(batch) < auditBatchSize {
+				continue
+			}
+		case <-t.C:
+		case <-a.stop:
+			for {
+				select {
+				case e := <-a.entries:
+					if batch = append(batch, e); len(batch) == auditBatchSize {
+						a.write(ctx, batch)
+						batch = nil
+					}
+				default:
+					a.write(ctx, batch)
+					return
+				}
+			}
+		}
+		a.write(ctx, batch)
+		batch = nil
+	}
+}
+
+// write writes batch to Cloud Logging, logging any failure.
+func (a *auditLogger) write(ctx context.Context, batch []*cloudlogging.LogEntry) {
+	if n := atomic.SwapUint64(&a.dropped, 0); n > 0 {
+		logging.Errorf("WARNING: dropped %d audit log entries: too many were waiting to be written", n)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	// With PartialSuccess, entries for other projects are written even if
+	// those for one project cannot be.
+	req := &cloudlogging.WriteLogEntriesRequest{Entries: batch, PartialSuccess: true}
+	if _, err := a.svc.Entries.Write(req).Context(ctx).Do(); err != nil {
+		logging.Errorf("couldn't write %d audit log entries: %v", len(batch), err)
+	}
+}
+
+// Close writes the queued entries, waiting up to timeout for them to be
+// written. Entries added afterwards are dropped. It is a no-op on a nil
+// auditLogger.
+func (a *auditLogger) Close(timeout time.Duration) {
+	if a == nil {
+		return
+	}
+	a.stopOnce.Do(func() { close(a.stop) })
+	select {
+	case <-a.done:
+	case <-time.After(timeout):
+		logging.Errorf("WARNING: audit log entries were not written within %v", timeout)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	cloudlogging "google.golang.org/api/logging/v2"
+)
+
+func TestAuditLogger(t *testing.T) {
+	var mu sync.Mutex
+	var entries []*cloudlogging.LogEntry
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if want := "/v2/entries:write"; r.URL.Path != want {
+			t.Errorf("API request path = %q, want %q", r.URL.Path, want)
+		}
+		var req cloudlogging.WriteLogEntriesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("couldn't decode request: %v", err)
+		}
+		mu.Lock()
+		entries = append(entries, req.Entries...)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	defer api.Close()
+	oldEndpoint := loggingEndpoint
+	loggingEndpoint = api.URL + "/"
+	defer func() { loggingEndpoint = oldEndpoint }()
+
+	a, err := newAuditLogger(context.Background(), http.DefaultClient, "my-audit")
+	if err != nil {
+		t.Fatalf("newAuditLogger: %v", err)
+	}
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 54321}
+	a.ConnOpened("proj:reg:db", client, time.Now())
+	a.ConnClosed("proj:reg:db", &net.UnixAddr{Name: "/cloudsql/proj:reg:db", Net: "unix"}, 2*time.Second, 100, 2000)
+	a.Close(5 * time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries written, want 2", len(entries))
+	}
+	wantResource := &cloudlogging.MonitoredResource{
+		Type: "cloudsql_database",
+		Labels: map[string]string{
+			"project_id":  "proj",
+			"database_id": "proj:db",
+			"region":      "reg",
+		},
+	}
+	for i, want := range []map[string]interface{}{
+		{
+			"event":     "open",
+			"instance":  "proj:reg:db",
+			"source_ip": "10.0.0.1",
+		},
+		{
+			"event":            "close",
+			"instance":         "proj:reg:db",
+			"source_ip":        "/cloudsql/proj:reg:db",
+			"duration_seconds": 2.0,
+			"bytes_sent":       2000.0,
+			"bytes_received":   100.0,
+		},
+	} {
+		e := entries[i]
+		if want := "projects/proj/logs/my-audit"; e.LogName != want {
+			t.Errorf("entry %d: LogName = %q, want %q", i, e.LogName, want)
+		}
+		if !reflect.DeepEqual(e.Resource, wantResource) {
+			t.Errorf("entry %d: Resource = %+v, want %+v", i, e.Resource, wantResource)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, e.Timestamp); err != nil {
+			t.Errorf("entry %d: invalid Timestamp: %v", i, err)
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal(e.JsonPayload, &got); err != nil {
+			t.Errorf("entry %d: couldn't decode payload: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("entry %d: payload = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestValidLogName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"cloudsql-proxy-audit": true,
+		"audit/db_1.conns":     true,
+		"":                     false,
+		"my audit":             false,
+		"audit%2Flog":          false,
+	} {
+		if got := validLogName(name); got != want {
+			t.Errorf("validLogName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -20,24 +20,33 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/cmd/cloud_sql_proxy/internal/config"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/cmd/cloud_sql_proxy/internal/healthcheck"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/cmd/cloud_sql_proxy/internal/systemd"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/cmd/cloud_sql_proxy/internal/version"
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/broker"
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/certs"
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/fuse"
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/limits"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/metrics"
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/util"
 
@@ -47,28 +56,64 @@ import (
 	"golang.org/x/oauth2"
 	goauth "golang.org/x/oauth2/google"
 	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+	"google.golang.org/grpc"
 )
 
 var (
-	version = flag.Bool("version", false, "Print the version of the proxy and exit")
-	verbose = flag.Bool("verbose", true,
+	showVersion = flag.Bool("version", false, "Print the version of the proxy and how it was built, and exit")
+	verbose     = flag.Bool("verbose", true,
 		`If false, verbose output such as information about when connections are
 created/closed without error are suppressed`,
+	)
+	configFile = flag.String("config", "",
+		`If provided, the path to a YAML file holding the proxy's configuration.
+Each top-level key is the name of a flag, except for 'instances', which is a
+list of instances to connect to. Flags passed on the command line take
+precedence over the file.`,
 	)
 	quiet          = flag.Bool("quiet", false, "Disable log messages")
 	logDebugStdout = flag.Bool("log_debug_stdout", false, "If true, log messages that are not errors will output to stdout instead of stderr")
-	structuredLogs = flag.Bool("structured_logs", false, "Configures all log messages to be emitted as JSON.")
+	structuredLogs = flag.Bool("structured_logs", false, `Configures all log messages to be emitted as JSON. You may set the
+LOG_FORMAT=json environment variable for the same effect.`)
 
 	refreshCfgThrottle = flag.Duration("refresh_config_throttle", proxy.DefaultRefreshCfgThrottle,
 		`If set, this flag specifies the amount of forced sleep between successive
 API calls in order to protect client API quota. Minimum allowed value is
 	`+minimumRefreshCfgThrottle.String(),
+	)
+	certRefreshLead = flag.Duration("cert_refresh_lead", 0,
+		`How long before an ephemeral certificate expires to start refreshing it.
+The current certificate is used for new connections until its replacement has
+been fetched. Must be less than the certificate lifetime of one hour. Defaults
+to `+proxy.DefaultRefreshCfgBuffer.String()+`, or `+proxy.IAMLoginRefreshCfgBuffer.String()+` with -enable_iam_login, whose
+certificates expire with the OAuth2 token they hold.`,
+	)
+	retryInitialDelay = flag.Duration("retry_initial_delay", certs.DefaultBackoff.InitialDelay,
+		`How long to wait before retrying a Cloud SQL Admin API call which failed
+with a server error, e.g. while refreshing a certificate, or a failed dial to
+an instance when -dial_retries is set. Each further retry waits
+-retry_multiplier times longer, with some random jitter, up to
+-retry_max_delay`,
+	)
+	retryMaxDelay = flag.Duration("retry_max_delay", certs.DefaultBackoff.MaxDelay,
+		`The longest to wait between retries of a failed Cloud SQL Admin API call
+or dial. Must be at least -retry_initial_delay`,
+	)
+	retryMultiplier = flag.Float64("retry_multiplier", certs.DefaultBackoff.Multiplier,
+		`The factor by which the delay between retries of a failed Cloud SQL Admin
+API call or dial grows. Must be at least 1`,
+	)
+	dialRetries = flag.Int("dial_retries", 0,
+		`If provided, the number of times a failed TCP dial to an instance is
+retried before the client connection is closed, waiting between attempts as
+configured by -retry_initial_delay, -retry_max_delay and -retry_multiplier.
+Defaults to 0, which disables retries`,
 	)
 	checkRegion = flag.Bool("check_region", false, `If specified, the 'region' portion of the connection string is required for
 Unix socket-based connections.`)
 
 	// Settings for how to choose which instance to connect to.
-	dir      = flag.String("dir", "", "Directory to use for placing Unix sockets representing database instances")
+	dir      = flag.String("dir", "", "Directory to use for placing Unix sockets representing database instances. It is created with mode 0700 if it does not exist")
 	projects = flag.String("projects", "",
 		`Open sockets for each Cloud SQL Instance in the projects specified
 (comma-separated list)`,
@@ -78,14 +123,81 @@ Unix socket-based connections.`)
 to connect to. If the name has the suffix '=tcp:port', a TCP server is opened
 on the specified port on localhost to proxy to that instance. It is also possible
 to listen on a custom address by providing a host, e.g., '=tcp:0.0.0.0:port'. If
-no value is provided for 'tcp', one socket file per instance is opened in 'dir'.
+no value is provided for 'tcp', one socket file per instance is opened in 'dir',
+or, if -dir is not set or on Windows, a TCP port chosen by the system is
+listened on; see -discovery_file.
+On Linux, '=unix:@name' listens on a socket in the abstract namespace, which
+has no file and is removed automatically when the proxy exits.
 You may use INSTANCES environment variable for the same effect. Using both will
 use value from flag, Not compatible with -fuse.`,
 	)
 	instanceSrc = flag.String("instances_metadata", "", `If provided, it is treated as a path to a metadata value which
-is polled for a comma-separated list of instances to connect to. For example,
+is watched for a comma-separated list of instances to connect to. For example,
 to use the instance metadata value named 'cloud-sql-instances' you would
-provide 'instance/attributes/cloud-sql-instances'. Not compatible with -fuse`)
+provide 'instance/attributes/cloud-sql-instances', or just
+'cloud-sql-instances'. Not compatible with -fuse`)
+	instancesDNS = flag.String("instances_dns", "", `If provided, it is treated as a DNS name whose TXT records are polled
+for the instances to connect to. Each record holds an instance, or a
+comma-separated list of them, in the same form as -instances. Instances
+removed from the records are drained as set by -drain_timeout. Not compatible
+with -fuse or -instances_metadata`)
+	instancesDNSInterval = flag.Duration("instances_dns_interval", 30*time.Second,
+		`How often the TXT records of -instances_dns are looked up`,
+	)
+	lazy = flag.Bool("lazy", false,
+		`If set, instances listening on TCP or named pipes are not looked up in the
+Cloud SQL Admin API at startup, and no certificates are fetched before the
+first connection to each instance, so that the proxy starts quickly with many
+instances. Listeners are still opened at startup. Instances listening on Unix
+sockets are still looked up, as the socket's name depends on the database
+engine. Not compatible with -verify_on_startup`,
+	)
+	socketPermissions = flag.String("socket_permissions", "0777",
+		`The permissions, as an octal file mode, of the Unix sockets the proxy
+listens on. The default allows every local user to connect, as applications
+often run as a different user than the proxy; use e.g. 0600 to allow only the
+user the proxy runs as, or 0660 to allow the members of its group as well`,
+	)
+	listenerCount = flag.Int("listener_goroutines", 1,
+		`The number of listeners on each TCP address, each accepting connections in
+a goroutine of its own. On Linux, values above 1 share the address with
+SO_REUSEPORT so that the kernel spreads new connections across them, which may
+help with very high connection rates. Other platforms always use a single
+listener`,
+	)
+	socketPoolSize = flag.Int("socket_pool_size", 1,
+		`The number of Unix sockets for each instance listening on a socket file,
+each accepting connections in a goroutine of its own. Values above 1 create
+sockets named '<instance>.0' to '<instance>.N-1', with '<instance>' a symlink
+to '<instance>.0'; applications spread their connections by choosing among
+them`,
+	)
+	maxConnBacklog = flag.Int("max_conn_backlog", 0,
+		`Linux only. If positive, the number of new connections the kernel queues
+on each socket the proxy listens on until they are accepted. The kernel caps it
+at net.core.somaxconn, which Go already uses by default`,
+	)
+	upgradeSocket = flag.String("upgrade_socket", "",
+		`If provided, the path of a Unix socket through which proxy processes hand
+their listening sockets over to one another, for upgrades without refused
+connections. A proxy started while another listens on the socket takes over
+its sockets, after which the other drains its connections as on SIGTERM and
+exits. Not supported on Windows or with -fuse`,
+	)
+	portFilePath = flag.String("port_file", "",
+		`If provided, the proxy writes the TCP port of each instance to this file,
+one "<instance> <port>" line per instance, each time the instances change.
+Combined with an instance option of tcp:0, which listens on a port chosen by
+the system, this lets tests run proxies in parallel without port conflicts.
+The file is replaced atomically`,
+	)
+	discoveryFilePath = flag.String("discovery_file", "",
+		`If provided, the proxy writes the address of each instance to this file as
+a JSON object, keyed by instance, of {"network": ..., "address": ...} entries,
+each time the instances change. This lets applications find the Unix socket or
+TCP port of an instance, including one the proxy chose itself, without
+hardcoding it. The file is replaced atomically`,
+	)
 	useFuse = flag.Bool("fuse", false, `Mount a directory at 'dir' using FUSE for accessing instances. Note that the
 directory at 'dir' must be empty before this program is started.`)
 	fuseTmp = flag.String("fuse_tmp", defaultTmp, `Used as a temporary directory if -fuse is set. Note that files in this directory
@@ -93,8 +205,18 @@ can be removed automatically by this program.`)
 
 	// Settings for limits
 	maxConnections = flag.Uint64("max_connections", 0,
-		`If provided, the maximum number of connections to establish before refusing
-new connections. Defaults to 0 (no limit)`,
+		`If provided, the maximum number of connections to establish across all
+instances before refusing new connections. Refused MySQL and Postgres clients
+receive a "too many connections" error. If not provided, and the
+CONTAINER_MEMORY_LIMIT environment variable holds the container's memory limit
+in bytes, a limit which fits in that much memory is used. Otherwise defaults to
+0 (no limit)`,
+	)
+	projectMaxConns = flag.String("project_max_connections", "",
+		`If provided, a comma-separated list of project=N limits, e.g.
+'my-project=100,other-project=20'. Once N connections are open across all of a
+project's instances, new connections to any instance in the project are
+refused until some close, so that one busy project cannot starve the others`,
 	)
 	fdRlimit = flag.Uint64("fd_rlimit", limits.ExpectedFDs,
 		`Sets the rlimit on the number of open file descriptors for the proxy to
@@ -102,9 +224,176 @@ the provided value. If set to zero, disables attempts to set the rlimit.
 Defaults to a value which can support 4K connections to one instance`,
 	)
 	termTimeout = flag.Duration("term_timeout", 0,
-		`When set, the proxy will wait for existing connections to close before
-terminating. Any connections that haven't closed after the timeout will be
-dropped`,
+		`When set, the proxy will stop accepting new connections and wait for
+existing connections to close before terminating. Any connections that haven't
+closed after the timeout will be dropped`,
+	)
+	drainTimeout = flag.Duration("drain_timeout", 30*time.Second,
+		`When the proxy receives SIGHUP and an instance has been removed from the
+-config file, or an instance is no longer listed by -instances_metadata or
+-instances_dns, how long the connections to the instance may continue before
+they are closed. The instance's socket is closed immediately`,
+	)
+	keepAliveInterval = flag.Duration("tcp_keepalive_interval", time.Minute,
+		`How long the TCP connections on both sides of a proxied connection may be
+idle before keepalive probes are sent, and the interval between probes. This
+stops NAT gateways from dropping idle connections`,
+	)
+	keepAliveCount = flag.Int("tcp_keepalive_count", 0,
+		`The number of unanswered keepalive probes after which a TCP connection is
+considered dead. Defaults to 0, which uses the system default. Not supported on
+Windows`,
+	)
+	tcpUserTimeout = flag.Duration("tcp_user_timeout", 30*time.Second,
+		`How long data sent on the TCP connections on both sides of a proxied
+connection may go unacknowledged before the connection is closed, rather than
+being retried for up to about 15 minutes, e.g. when an instance becomes
+unreachable. Linux only; ignored on other platforms. 0 uses the system default`,
+	)
+	exitZeroOnIdle = flag.Bool("exit_zero_on_idle", false,
+		`When set, the proxy exits with status 0 once it has handled at least one
+connection and then had no open connections for -idle_exit_delay. This lets a
+batch job finish when the proxy runs as its sidecar`,
+	)
+	idleExitDelay = flag.Duration("idle_exit_delay", 5*time.Second,
+		`How long the proxy waits with no open connections before exiting, when
+-exit_zero_on_idle is set`,
+	)
+	idleTimeout = flag.Duration("idle_timeout", 0,
+		`When set, proxied connections through which no data has passed in either
+direction for this long are closed, releasing their slot on the instance. 0
+disables the timeout`,
+	)
+	maxConnAge = flag.Duration("max_connection_age", 0,
+		`When set, proxied connections are closed once they have been open for this
+long, after any response being written to the client has been sent, so that
+clients reconnect. 0 disables the limit`,
+	)
+	rotationDrainTimeout = flag.Duration("rotation_drain_timeout", 0,
+		`When set, each time an instance's ephemeral certificate is replaced, the
+connections made with the previous certificate are closed once they are idle
+between transactions, so that clients reconnect with the new one. Connections
+which do not become idle within this long are closed regardless. 0 leaves
+connections open until they close`,
+	)
+	allowedCIDRs = flag.String("allowed_cidrs", "",
+		`If provided, a comma-separated list of networks in CIDR notation, e.g.
+'127.0.0.1/32,10.0.0.0/8'. Connections to TCP listeners from addresses outside
+these networks are closed immediately. Unix sockets are not affected`,
+	)
+	maxNewConnsPerIP = flag.Int("max_new_connections_per_ip", 0,
+		`If provided, the maximum number of new connections per second accepted on
+TCP listeners from any single client IP address. Connections beyond the limit
+are refused right away, and MySQL and Postgres clients receive a "too many
+connections" error. Unix sockets are not affected. 0 means no limit`,
+	)
+	tlsMinVersion = flag.String("tls_min_version", "",
+		`If provided, the minimum TLS version used for connections to instances,
+either TLS12 or TLS13`,
+	)
+	tlsCipherSuites = flag.String("tls_cipher_suites", "",
+		`If provided, a comma-separated list of the cipher suites which may be used for
+TLS 1.2 connections to instances, by their Go names, e.g.
+'TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256'. TLS 1.3 cipher suites are not
+configurable`,
+	)
+	proxyAddress = flag.String("proxy_address", "",
+		`If provided, the URL of a proxy through which to make all outbound
+connections, both to instances and to Google APIs, e.g.
+'http://proxy.example.com:3128'. HTTP and HTTPS proxies must support the
+CONNECT method; socks5:// URLs are also accepted. If not provided, connections
+to instances honor the ALL_PROXY, HTTPS_PROXY and NO_PROXY environment
+variables`,
+	)
+	socks5Proxy = flag.String("socks5_proxy", "",
+		`If provided, the host:port of a SOCKS5 proxy through which to make all
+outbound connections, both to instances and to Google APIs. Equivalent to
+-proxy_address=socks5://host:port, and may not be used with -proxy_address`,
+	)
+	socks5Username = flag.String("socks5_username", "", "The username for the proxy given by -socks5_proxy, if it requires authentication")
+	socks5Password = flag.String("socks5_password", "", "The password for the proxy given by -socks5_proxy, if it requires authentication")
+	useIAP         = flag.Bool("use_iap", false,
+		`Connect to instances through a Cloud Identity-Aware Proxy TCP forwarding
+tunnel, so that instances with only a private IP address can be reached from
+outside their VPC network without a VPN or VPC peering. Requires
+-iap_dest_group and -iap_network, and implies -private_ip unless -psc is set.
+May not be used with -proxy_address or -socks5_proxy`,
+	)
+	iapDestGroup = flag.String("iap_dest_group", "",
+		`The IAP TCP forwarding destination group which includes the instances'
+IP addresses, in the form projects/PROJECT/regions/REGION/destGroups/GROUP.
+Used with -use_iap`,
+	)
+	iapNetwork  = flag.String("iap_network", "", "The name of the VPC network of the instances' IP addresses. Used with -use_iap")
+	dnsResolver = flag.String("dns_resolver", "",
+		`If provided, the IP address, with an optional port which defaults to 53,
+of the DNS server used for every hostname the proxy looks up, in place of the
+system's resolver`,
+	)
+	dnsSearchDomains = flag.String("dns_search_domains", "",
+		`A comma-separated list of domains with which hostnames are qualified
+when they are looked up, as with the search list of resolv.conf. Applies to
+the Admin API and other Google APIs, and to -instances_dns`,
+	)
+	namedPipes = flag.Bool("named_pipes", false,
+		`Windows only. If set, the proxy also listens for connections to each
+instance on a named pipe, \\.\pipe\cloudsql\<instance connection name>,
+in addition to its socket. A single instance's pipe can be given with the
+instance option 'pipe', e.g. 'my-project:my-region:my-instance=pipe:mydb'`,
+	)
+	namedPipeSDDL = flag.String("named_pipe_sddl", "",
+		`The security descriptor, in SDDL form, controlling which users may connect
+to the proxy's named pipes. Defaults to allowing only the user the proxy runs
+as`,
+	)
+	statsFile = flag.String("stats_file", "",
+		`If provided, the path of a file to which a JSON summary of the proxy's
+connections and certificate refreshes is written, replacing its contents, each
+time the proxy receives SIGUSR1. If not provided, the summary is written to
+stderr`,
+	)
+	requireFIPS = flag.Bool("require_fips", false,
+		`Exit at startup unless the proxy is using the FIPS 140-2 validated
+BoringCrypto module for all cryptography, which requires a binary built with
+'make fips'`,
+	)
+	warmConnections = flag.Int("warm_connections", 0,
+		`If provided, the number of connections to each instance which are
+established in advance and handed to new client connections, so that they
+need not wait for a TLS handshake. Instances given by -instances are warmed at
+startup. Defaults to 0 (disabled)`,
+	)
+	warmIdleTimeout = flag.Duration("warm_idle_timeout", proxy.DefaultWarmIdleTimeout,
+		`How long a connection established by -warm_connections may go unused
+before it is closed. This should be shorter than the database's timeout for
+unauthenticated connections (MySQL's connect_timeout or Postgres's
+authentication_timeout)`,
+	)
+	handshakeTimeout = flag.Duration("handshake_timeout", 30*time.Second,
+		`How long setting up the connection to an instance for a new client
+connection may take, including waiting for the instance's certificate from the
+Cloud SQL Admin API, dialing the instance and the TLS handshake. The client
+connection is closed if it is exceeded. 0 disables the timeout`,
+	)
+	breakerThreshold = flag.Int("circuit_breaker_threshold", 0,
+		`If provided, the number of consecutive failed connections to an instance
+after which the proxy stops connecting to it for a while, closing new client
+connections immediately. The wait starts at one second and doubles with each
+further failure, up to -circuit_breaker_max_backoff; a successful connection
+resets it. Defaults to 0, which disables the circuit breaker.`,
+	)
+	breakerMaxBackoff = flag.Duration("circuit_breaker_max_backoff", proxy.DefaultBreakerMaxBackoff,
+		`The longest the proxy waits before trying again to connect to an instance
+whose circuit breaker is open.`,
+	)
+	maxConnBandwidth = flag.String("max_bandwidth_per_conn", "",
+		`If provided, the most data per second each connection may transfer in each
+direction, in bytes or with a unit, e.g. '10MB' or '512KiB'. Defaults to no
+limit`,
+	)
+	maxTotalBandwidth = flag.String("max_total_bandwidth", "",
+		`If provided, the most data per second all connections together may transfer
+in each direction, in bytes or with a unit, e.g. '100MB'. Defaults to no limit`,
 	)
 
 	// Settings for authentication.
@@ -112,14 +401,61 @@ dropped`,
 	tokenFile = flag.String("credential_file", "",
 		`If provided, this json file will be used to retrieve Service Account
 credentials.  You may set the GOOGLE_APPLICATION_CREDENTIALS environment
-variable for the same effect.`,
+variable for the same effect. The file is reloaded when it changes.`,
+	)
+	credentialsSecret = flag.String("credentials_secret", "",
+		`If provided, the Secret Manager secret version holding the Service Account
+credentials, e.g. 'projects/my-project/secrets/my-secret/versions/latest'. The
+secret is read at startup and on SIGHUP using the gcloud or Application Default
+Credentials, and is never written to disk.`,
+	)
+	impersonateServiceAccount = flag.String("impersonate_service_account", "",
+		`If provided, the email address of a service account the proxy impersonates,
+using its credentials to obtain short-lived tokens for the service account from
+the IAM Service Account Credentials API. A comma-separated list is a delegation
+chain, as with gcloud: the last service account is impersonated, and each of
+the others must be allowed to create tokens for the next. A single instance
+may impersonate a service account of its own with the option
+'=impersonate:SA_EMAIL'; see -instances.`,
+	)
+	debugCredentials = flag.Bool("debug_credentials", false,
+		`Log the account, expiry and scopes of the proxy's access token at startup,
+as reported by Google's tokeninfo endpoint, to help diagnose authentication
+failures. The token itself is not logged.`,
 	)
 	ipAddressTypes = flag.String("ip_address_types", "PUBLIC,PRIVATE",
 		`Default to be 'PUBLIC,PRIVATE'. Options: a list of strings separated by
 ',', e.g. 'PUBLIC,PRIVATE' `,
 	)
+	usePSC = flag.Bool("psc", false, `Connect to every instance through its Private Service Connect endpoint.
+Equivalent to -ip_address_types=PSC. To use PSC for some instances only, add
+the psc option to those instances instead; see -instances.`)
+	privateIP = flag.Bool("private_ip", false, `Connect to every instance through its private IP address, failing if it
+has none, even if it also has a public IP address. Equivalent to
+-ip_address_types=PRIVATE. To require private IP for some instances only, add
+the option 'ip:private' to those instances instead; see -instances.`)
+	autoIPType = flag.Bool("auto_ip_type", false, `On Compute Engine and GKE, connect to each instance through its private IP
+address if its private network is the VM's VPC network, and through its public
+IP address otherwise. The choice for each instance is logged. Not compatible
+with -ip_address_types, -psc or -private_ip.`)
 	// Settings for IAM db proxy authentication
 	enableIAMLogin = flag.Bool("enable_iam_login", false, "Enables database user authentication using Cloud SQL's IAM DB Authentication (Postgres only).")
+	enableIAMAuthn = flag.Bool("enable_iam_authn", false,
+		`Log clients in as IAM database users by answering the instance's request
+for a password with an access token from the proxy's credentials. Clients
+connect with the IAM user name and no password. Works with MySQL and Postgres,
+and for connections over TCP or Unix sockets alike.`)
+	applicationName = flag.String("application_name", "cloud-sql-proxy/"+version.Semantic(),
+		`Label each session with this application name, sent as the Postgres
+application_name parameter or the MySQL program_name connection attribute, so
+that proxied connections can be identified in the instance's logs and Cloud
+Audit Logs. Clients which set their own name keep it, unless
+-override_application_name is set. A single instance's name can be given with
+the instance option 'appname', e.g.
+'my-project:my-region:my-instance=appname:my-app'. Set to "" to disable.`)
+	overrideAppName = flag.Bool("override_application_name", false,
+		`When set, the name given by -application_name, or an instance's appname
+option, replaces any application name the client sets itself`)
 
 	skipInvalidInstanceConfigs = flag.Bool("skip_failed_instance_config", false,
 		`Setting this flag will allow you to prevent the proxy from terminating
@@ -127,6 +463,75 @@ when some instance configurations could not be parsed and/or are
 unavailable.`,
 	)
 
+	// Settings for observability.
+	metricsPort = flag.Int("metrics_port", 0,
+		`If provided, the proxy serves Prometheus metrics at /metrics on the given
+port. Defaults to 0 (disabled)`,
+	)
+	gmpExport = flag.Bool("gmp_export", false,
+		`On GKE, create a PodMonitoring resource through the Kubernetes API so that
+Google Cloud Managed Service for Prometheus scrapes the metrics served on
+-metrics_port by the pods of the proxy's workload. The pod's service account
+must be allowed to get its pod and create podmonitorings in its namespace`,
+	)
+	cloudMonitoringProject = flag.String("cloud_monitoring_project", "",
+		`If provided, the project to which the proxy writes the number of active
+connections, failed connections and failed certificate refreshes of each
+instance as Cloud Monitoring custom metrics every minute. The proxy's
+credentials need the Monitoring Metric Writer role in the project`,
+	)
+	metricLabels = flag.String("metric_labels", "",
+		`A comma-separated list of key=value labels added to every Prometheus metric,
+e.g. env=prod,team=payments. Instances in the -config file may override the
+values with metric_labels`,
+	)
+	verifyOnStartup = flag.Bool("verify_on_startup", false,
+		`If set, the proxy connects to each instance at startup, completing a TLS
+handshake and closing the connection cleanly, before listening for
+connections. If any instance cannot be reached, the proxy logs the error and
+exits with a non-zero status`,
+	)
+	startupTimeout = flag.Duration("startup_timeout", 60*time.Second,
+		`How long the proxy may take to start: to obtain credentials, look up
+instances, open listeners and, with -verify_on_startup, reach every instance.
+If it has not finished starting in that time, it logs an error and exits with
+a non-zero status instead of hanging. 0 disables the limit`,
+	)
+	healthCheckPort = flag.Int("health_check_port", 0,
+		`If provided, the proxy serves health checks on the given port. /liveness
+always reports success, while /readiness only reports success once the proxy
+holds a valid certificate for every instance configured with -instances.
+Defaults to 0 (disabled)`,
+	)
+	cloudRunSidecar = flag.Bool("cloud_run_sidecar", false,
+		`If set, configures the proxy to run as a sidecar container of a Cloud Run
+service. Instances without a listener option listen on 127.0.0.1 at their
+database engine's usual port (5432, 3306 or 1433), which the service's other
+containers share. Health checks are served on the port in the PORT environment
+variable unless -health_check_port is set, and -term_timeout defaults to 7s so
+that the proxy exits before Cloud Run kills it, 10s after SIGTERM`,
+	)
+	grpcPort = flag.Int("grpc_port", 0,
+		`If provided, the proxy serves the gRPC Broker service defined in
+proxy/broker/broker.proto on the given port of 127.0.0.1, so that gRPC clients
+can connect to instances with a ConnectToInstance stream instead of a socket.
+Defaults to 0 (disabled)`,
+	)
+	pprofPort = flag.Int("pprof_port", 0,
+		`If provided, the proxy serves Go runtime profiles at /debug/pprof/ on the
+given port of 127.0.0.1, for diagnosing performance problems. It should not be
+left enabled in production. Defaults to 0 (disabled)`,
+	)
+	auditLog = flag.Bool("audit_log", false,
+		`If set, the proxy writes an entry to Cloud Logging, in the project of the
+instance, when each connection is opened and when it is closed, recording the
+instance, the client's IP address, and on close the connection's duration and
+the bytes sent and received. The credentials need the logging.write scope`,
+	)
+	auditLogName = flag.String("audit_log_name", "cloudsql-proxy-audit",
+		`The name of the Cloud Logging log -audit_log writes to`,
+	)
+
 	// Setting to choose what API to connect to
 	host = flag.String("host", "",
 		`When set, the proxy uses this host as the base API path. Example:
@@ -136,6 +541,14 @@ unavailable.`,
 
 const (
 	minimumRefreshCfgThrottle = time.Second
+	// maximumCertRefreshLead is the lifetime of an ephemeral certificate.
+	maximumCertRefreshLead = time.Hour
+	// startupVerifyTimeout bounds the connection attempts made by
+	// -verify_on_startup.
+	startupVerifyTimeout = 30 * time.Second
+	// auditCloseTimeout bounds the wait for the audit log to be written when
+	// the proxy exits.
+	auditCloseTimeout = 10 * time.Second
 
 	port = 3307
 )
@@ -183,7 +596,8 @@ General:
     first-time startup messages (e.g. when new connections are established).
 
   -structured_logs
-    When set to true, all log messages are written out as JSON.
+    When set to true, all log messages are written out as JSON. Setting the
+    LOG_FORMAT environment variable to "json" has the same effect.
 
 Connection:
   -instances
@@ -212,15 +626,32 @@ Connection:
 
         -instances=my-project:my-region:my-instance=unix:custom-socket-name
 
-    Note: The directory specified by -dir must exist and the socket file path
-    (i.e., dir plus INSTANCE_CONNECTION_NAME) must be under your platform's
-    limit (typically 108 characters on many Unix systems, but varies by platform).
+    Note: If the directory specified by -dir does not exist, it is created and
+    made accessible only to the user running the proxy; create it beforehand if
+    other users need to connect. The socket file path (i.e., dir plus
+    INSTANCE_CONNECTION_NAME) must be under your platform's limit (typically 108
+    characters on many Unix systems, but varies by platform).
 
     To override the -dir parameter, specify an absolute path as shown in the
     following example:
 
         -instances=my-project:my-region:my-instance=unix:/my/custom/sql-socket
 
+    To limit the number of simultaneous connections to one instance, add a
+    maxconns option. It may be combined with a tcp or unix option:
+
+        -instances=my-project:my-region:my-instance=tcp:3306=maxconns:10
+
+    To connect to one instance through its Private Service Connect endpoint,
+    add a psc option:
+
+        -instances=my-project:my-region:my-instance=tcp:3306=psc:true
+
+    To label the sessions of one instance with their own application name
+    rather than -application_name, add an appname option:
+
+        -instances=my-project:my-region:my-instance=tcp:3306=appname:my-app
+
      Supplying INSTANCES environment variable achieves the same effect.  One can
      use that to keep k8s manifest files constant across multiple environments
 
@@ -232,6 +663,12 @@ Connection:
      parameter. Updates to the metadata value will be observed and acted on by
      the Proxy.
 
+  -instances_dns
+     Rather than a static list of instances, the Proxy can look up the TXT
+     records of a DNS name, such as one provided by a service mesh. Each record
+     is interpreted as a list of instances in the same way as the -instances
+     parameter. The records are looked up again every -instances_dns_interval.
+
   -projects
     To direct the proxy to allow connections to all instances in specific
     projects, set the projects parameter:
@@ -249,6 +686,22 @@ Connection:
     When using Unix sockets (the default for systems which support them), the
     Proxy places the sockets in the directory specified by the -dir parameter.
 
+Diagnosis:
+  cloud_sql_proxy doctor [flags]
+    Checks the proxy's credentials, its access to the Cloud SQL Admin API, the
+    state and reachability of each instance given by -instances or -config, the
+    file descriptor limit, and whether a newer release is available, then
+    exits. Takes the same flags as the proxy. The exit status is 0 only if
+    every check passes.
+
+Shell completion:
+  cloud_sql_proxy completion bash|zsh|fish
+    Writes a script which completes the proxy's flags in the given shell, and
+    completes -instances with the instances in the projects given by -projects,
+    or else gcloud's active project. Load it with, for example:
+
+        source <(cloud_sql_proxy completion bash)
+
 Automatic instance discovery:
    If the Google Cloud SQL is installed on the local machine and no instance
    connection flags are specified, the proxy connects to all instances in the
@@ -267,26 +720,15 @@ Information for all flags:
 
 var defaultTmp = filepath.Join(os.TempDir(), "cloudsql-proxy-tmp")
 
-// versionString indiciates the version of the proxy currently in use.
-var versionString = "1.23.1-dev"
-
-// metadataString indiciates additional build or distribution metadata.
-var metadataString = ""
-
-// semanticVersion returns the version of the proxy in a semver format.
-func semanticVersion() string {
-	v := versionString
-	if metadataString != "" {
-		v += "+" + metadataString
-	}
-	return v
-}
-
 // userAgentFromVersionString returns an appropriate user agent string for identifying this proxy process.
 func userAgentFromVersionString() string {
-	return "cloud_sql_proxy/" + semanticVersion()
+	return "cloud_sql_proxy/" + version.Semantic()
 }
 
+// secretManagerScope is the OAuth2 scope needed to read the secret named by
+// -credentials_secret.
+const secretManagerScope = "https://www.googleapis.com/auth/cloud-platform"
+
 const accountErrorSuffix = `Please create a new VM with Cloud SQL access (scope) enabled under "Identity and API access". Alternatively, create a new "service account key" and specify it using the -credential_file parameter`
 
 func checkFlags(onGCE bool) error {
@@ -297,7 +739,7 @@ func checkFlags(onGCE bool) error {
 		return nil
 	}
 
-	if *token != "" || *tokenFile != "" || os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") != "" {
+	if *token != "" || *tokenFile != "" || *credentialsSecret != "" || os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") != "" {
 		return nil
 	}
 
@@ -328,44 +770,87 @@ func checkFlags(onGCE bool) error {
 	return nil
 }
 
+// authenticatedClientFromPath returns a client authenticated with the
+// credentials in the file f. The file is watched for changes, so that rotated
+// credentials are used without restarting the proxy.
 func authenticatedClientFromPath(ctx context.Context, f string) (*http.Client, oauth2.TokenSource, error) {
-	all, err := ioutil.ReadFile(f)
+	src, err := newReloadingTokenSource(ctx, f)
 	if err != nil {
-		return nil, nil, fmt.Errorf("invalid json file %q: %v", f, err)
+		return nil, nil, err
 	}
-	// First try and load this as a service account config, which allows us to see the service account email:
-	if cfg, err := goauth.JWTConfigFromJSON(all, proxy.SQLScope); err == nil {
-		logging.Infof("using credential file for authentication; email=%s", cfg.Email)
-		return cfg.Client(ctx), cfg.TokenSource(ctx), nil
+	if err := src.watch(ctx); err != nil {
+		logging.Errorf("WARNING: credential file %q will not be reloaded if it changes: %v", f, err)
 	}
+	return oauth2.NewClient(ctx, src), src, nil
+}
 
-	cred, err := goauth.CredentialsFromJSON(ctx, all, proxy.SQLScope)
+// authenticatedClientFromSecret returns a client authenticated with the
+// credentials in the Secret Manager secret version name, which is read with
+// the default credentials.
+func authenticatedClientFromSecret(ctx context.Context, name string) (*http.Client, oauth2.TokenSource, error) {
+	def, _, err := defaultTokenSource(ctx, secretManagerScope)
 	if err != nil {
-		return nil, nil, fmt.Errorf("invalid json file %q: %v", f, err)
+		return nil, nil, err
 	}
-	logging.Infof("using credential file for authentication; path=%q", f)
-	return oauth2.NewClient(ctx, cred.TokenSource), cred.TokenSource, nil
+	src, err := newSecretTokenSource(ctx, name, oauth2.NewClient(ctx, def))
+	if err != nil {
+		return nil, nil, err
+	}
+	return oauth2.NewClient(ctx, src), src, nil
 }
 
+// defaultTokenSource returns the gcloud user credentials if they are
+// available, and otherwise the application default credentials with scopes.
+// It also returns where the credentials came from, as described by
+// credentialsSource.
+func defaultTokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, string, error) {
+	if src, err := util.GcloudTokenSource(ctx); err == nil {
+		return src, "gcloud", nil
+	}
+	cred, err := goauth.FindDefaultCredentials(ctx, scopes...)
+	if err != nil {
+		return nil, "", err
+	}
+	source := "file"
+	if len(cred.JSON) == 0 {
+		// The credentials of the metadata server, which in a Kubernetes pod
+		// are those of its Kubernetes service account.
+		source = "metadata"
+		if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+			source = "workload-identity"
+		}
+	}
+	return cred.TokenSource, source, nil
+}
+
+// credentialsSource describes where the proxy's default credentials came
+// from: "token", "file", "secret", "gcloud", "metadata" or
+// "workload-identity". It is set by authenticatedClient.
+var credentialsSource string
+
 func authenticatedClient(ctx context.Context) (*http.Client, oauth2.TokenSource, error) {
 	if *tokenFile != "" {
+		credentialsSource = "file"
 		return authenticatedClientFromPath(ctx, *tokenFile)
 	} else if tok := *token; tok != "" {
+		credentialsSource = "token"
 		src := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tok})
 		return oauth2.NewClient(ctx, src), src, nil
+	} else if *credentialsSecret != "" {
+		credentialsSource = "secret"
+		return authenticatedClientFromSecret(ctx, *credentialsSecret)
 	} else if f := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); f != "" {
+		credentialsSource = "file"
 		return authenticatedClientFromPath(ctx, f)
 	}
 
 	// If flags or env don't specify an auth source, try either gcloud or application default
 	// credentials.
-	src, err := util.GcloudTokenSource(ctx)
-	if err != nil {
-		src, err = goauth.DefaultTokenSource(ctx, proxy.SQLScope)
-	}
+	src, source, err := defaultTokenSource(ctx, baseScopes()...)
 	if err != nil {
 		return nil, nil, err
 	}
+	credentialsSource = source
 
 	return oauth2.NewClient(ctx, src), src, nil
 }
@@ -438,6 +923,118 @@ func gcloudProject() ([]string, error) {
 	return []string{cfg.Configuration.Properties.Core.Project}, nil
 }
 
+// serveMetrics serves the Prometheus metrics collected in m on the provided
+// port. It only returns if the server fails.
+func serveMetrics(port int, m *metrics.Metrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	addr := fmt.Sprintf(":%d", port)
+	logging.Infof("Serving Prometheus metrics on %s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logging.Errorf("Metrics server on %s exited: %v", addr, err)
+	}
+}
+
+// instanceMetricLabelNames returns the sorted names of the metric_labels of
+// insts, the instances in the -config file.
+func instanceMetricLabelNames(insts []config.Instance) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, inst := range insts {
+		for name := range inst.MetricLabels {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setInstanceMetricLabels sets the metric labels of each of insts, the
+// instances in the -config file, in m. It returns the first error for an
+// instance whose labels are unknown to m or differ from those already set,
+// after setting the labels of the others.
+func setInstanceMetricLabels(m *metrics.Metrics, insts []config.Instance) error {
+	var firstErr error
+	for _, inst := range insts {
+		if len(inst.MetricLabels) == 0 {
+			continue
+		}
+		name, err := canonicalInstance(inst.Name)
+		if err != nil {
+			// Invalid names are reported when the instance is parsed.
+			continue
+		}
+		if err := m.SetInstanceLabels(name, inst.MetricLabels); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// servePprof serves the net/http/pprof endpoints on the provided port of the
+// loopback interface only. It only returns if the server fails.
+func servePprof(port int) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	logging.Errorf("WARNING: serving runtime profiles on %s/debug/pprof/; -pprof_port should not be left enabled in production", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logging.Errorf("Profiling server on %s exited: %v", addr, err)
+	}
+}
+
+// serveHealthCheck serves the liveness and readiness endpoints for the
+// provided instances on port. It only returns if the server fails.
+func serveHealthCheck(port int, c *proxy.Client, instances []string) {
+	addr := fmt.Sprintf(":%d", port)
+	logging.Infof("Serving health checks on %s", addr)
+	if err := http.ListenAndServe(addr, healthcheck.Handler(c, instances)); err != nil {
+		logging.Errorf("Health check server on %s exited: %v", addr, err)
+	}
+}
+
+// serveGRPC serves the gRPC connection broker on port of 127.0.0.1. It
+// returns a chan which receives the connections from src as well as those
+// made through the broker, and is closed once src is closed.
+func serveGRPC(port int, src <-chan proxy.Conn) <-chan proxy.Conn {
+	s := grpc.NewServer()
+	brokered := broker.NewConnSrc(s)
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	go func() {
+		l, err := net.Listen("tcp", addr)
+		if err == nil {
+			logging.Infof("Serving gRPC connection broker on %s", addr)
+			err = s.Serve(l)
+		}
+		logging.Errorf("gRPC server on %s exited: %v", addr, err)
+	}()
+
+	ch := make(chan proxy.Conn)
+	go func() {
+		defer close(ch)
+		for {
+			select {
+			case c, ok := <-src:
+				if !ok {
+					s.Stop()
+					return
+				}
+				ch <- c
+			case c := <-brokered:
+				ch <- c
+			}
+		}
+	}()
+	return ch
+}
+
 // Main executes the main function of the proxy, allowing it to be called from tests.
 //
 // Setting timeout to a value greater than 0 causes the process to panic after
@@ -455,11 +1052,69 @@ func Main(timeout time.Duration) {
 	main()
 }
 
+// applyConfigFile applies the flags set in the -config file, if any, and
+// returns its instances.
+func applyConfigFile() ([]config.Instance, error) {
+	if *configFile == "" {
+		return nil, nil
+	}
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Apply(flag.CommandLine); err != nil {
+		return nil, err
+	}
+	return cfg.Instances, nil
+}
+
+// startupDeadline returns a context which expires after timeout, for calls
+// made while the proxy starts, and a function to call once it has started.
+// If that function has not been called by the deadline, onTimeout is. A zero
+// timeout sets no deadline.
+func startupDeadline(ctx context.Context, timeout time.Duration, onTimeout func()) (context.Context, func()) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	t := time.AfterFunc(timeout, onTimeout)
+	return ctx, func() {
+		t.Stop()
+		cancel()
+	}
+}
+
+// ipAddrTypes returns the types of IP address used to reach instances, in
+// order of preference, as set by -ip_address_types, -psc, -private_ip or
+// -use_iap.
+func ipAddrTypes() []string {
+	switch {
+	case *usePSC:
+		return []string{certs.PSCIPAddrType}
+	case *privateIP, *useIAP:
+		return []string{"PRIVATE"}
+	}
+	return strings.Split(*ipAddressTypes, ",")
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		flag.CommandLine.Parse(os.Args[2:])
+		os.Exit(runDoctor())
+	}
+	if len(os.Args) > 1 && os.Args[1] == "completion" {
+		os.Exit(runCompletion(os.Args[2:]))
+	}
 	flag.Parse()
 
-	if *version {
-		fmt.Println("Cloud SQL Auth proxy:", semanticVersion())
+	fileInstances, err := applyConfigFile()
+	if err != nil {
+		logging.Errorf("%v", err)
+		os.Exit(1)
+	}
+
+	if *showVersion {
+		fmt.Println(version.String())
 		return
 	}
 
@@ -477,7 +1132,7 @@ func main() {
 		logging.LogVerboseToNowhere()
 	}
 
-	if *structuredLogs {
+	if *structuredLogs || strings.EqualFold(os.Getenv("LOG_FORMAT"), "json") {
 		cleanup, err := logging.EnableStructuredLogs(*logDebugStdout, *verbose)
 		if err != nil {
 			logging.Errorf("failed to enable structured logs: %v", err)
@@ -491,8 +1146,269 @@ func main() {
 		logging.DisableLogging()
 	}
 
-	// Split the input ipAddressTypes to the slice of string
-	ipAddrTypeOptsInput := strings.Split(*ipAddressTypes, ",")
+	switch {
+	case fipsEnabled():
+		logging.Infof("Using BoringCrypto for FIPS 140-2 validated cryptography")
+	case fipsBuild:
+		logging.Errorf("WARNING: the proxy was built with BoringCrypto, but it is not active; cryptography is not FIPS 140-2 validated")
+	}
+	if *requireFIPS && !fipsEnabled() {
+		logging.Errorf("-require_fips is set, but BoringCrypto is not active; build the proxy with `make fips`")
+		os.Exit(1)
+	}
+
+	if *cloudRunSidecar {
+		if err := configureCloudRunSidecar(); err != nil {
+			logging.Errorf("invalid -cloud_run_sidecar: %v", err)
+			os.Exit(1)
+		}
+	}
+	if *pprofPort != 0 && (*pprofPort == *healthCheckPort || *pprofPort == *metricsPort) {
+		logging.Errorf("-pprof_port must differ from -health_check_port and -metrics_port")
+		os.Exit(1)
+	}
+	if *grpcPort != 0 && (*grpcPort == *healthCheckPort || *grpcPort == *metricsPort || *grpcPort == *pprofPort) {
+		logging.Errorf("-grpc_port must differ from -health_check_port, -metrics_port and -pprof_port")
+		os.Exit(1)
+	}
+	if *gmpExport && *metricsPort == 0 {
+		logging.Errorf("-gmp_export requires -metrics_port")
+		os.Exit(1)
+	}
+	if *namedPipes && runtime.GOOS != "windows" {
+		logging.Errorf("-named_pipes is only supported on Windows")
+		os.Exit(1)
+	}
+
+	allowedNets, err := parseCIDRs(*allowedCIDRs)
+	if err != nil {
+		logging.Errorf("invalid -allowed_cidrs: %v", err)
+		os.Exit(1)
+	}
+
+	minTLSVersion, err := parseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		logging.Errorf("invalid -tls_min_version: %v", err)
+		os.Exit(1)
+	}
+	cipherSuites, err := parseCipherSuites(*tlsCipherSuites)
+	if err != nil {
+		logging.Errorf("invalid -tls_cipher_suites: %v", err)
+		os.Exit(1)
+	}
+	metricLabelValues, err := parseMetricLabels(*metricLabels)
+	if err != nil {
+		logging.Errorf("invalid -metric_labels: %v", err)
+		os.Exit(1)
+	}
+	projectLimits, err := parseProjectMaxConns(*projectMaxConns)
+	if err != nil {
+		logging.Errorf("invalid -project_max_connections: %v", err)
+		os.Exit(1)
+	}
+	if minTLSVersion == tls.VersionTLS13 && len(cipherSuites) > 0 {
+		logging.Errorf("WARNING: -tls_cipher_suites has no effect with -tls_min_version=TLS13")
+	}
+
+	connBandwidth, err := parseBandwidth(*maxConnBandwidth)
+	if err != nil {
+		logging.Errorf("invalid -max_bandwidth_per_conn: %v", err)
+		os.Exit(1)
+	}
+	totalBandwidth, err := parseBandwidth(*maxTotalBandwidth)
+	if err != nil {
+		logging.Errorf("invalid -max_total_bandwidth: %v", err)
+		os.Exit(1)
+	}
+
+	if socketPerm, err = parseSocketPermissions(*socketPermissions); err != nil {
+		logging.Errorf("invalid -socket_permissions: %v", err)
+		os.Exit(1)
+	}
+	permSet := false
+	flag.Visit(func(f *flag.Flag) { permSet = permSet || f.Name == "socket_permissions" })
+	if permSet && socketPerm&0077 != 0 {
+		logging.Errorf("WARNING: -socket_permissions=%s allows users other than the one the proxy runs as to connect to its Unix sockets", *socketPermissions)
+	}
+
+	if *listenerCount < 1 {
+		logging.Errorf("invalid -listener_goroutines: must be at least 1, got %d", *listenerCount)
+		os.Exit(1)
+	}
+	if *listenerCount > 1 && !reusePortSupported {
+		logging.Errorf("WARNING: -listener_goroutines is only supported on Linux; using a single listener for each address")
+	}
+	listenerGoroutines = *listenerCount
+	if *socketPoolSize < 1 {
+		logging.Errorf("invalid -socket_pool_size: must be at least 1, got %d", *socketPoolSize)
+		os.Exit(1)
+	}
+	socketPool = *socketPoolSize
+	if *maxConnBacklog < 0 {
+		logging.Errorf("invalid -max_conn_backlog: must not be negative, got %d", *maxConnBacklog)
+		os.Exit(1)
+	}
+	if *maxConnBacklog > 0 {
+		if runtime.GOOS != "linux" {
+			logging.Errorf("WARNING: -max_conn_backlog is only supported on Linux; using the default backlog")
+		} else {
+			if max := maxBacklog(); max > 0 && *maxConnBacklog > max {
+				logging.Errorf("WARNING: -max_conn_backlog=%d exceeds the kernel's limit, net.core.somaxconn=%d, which is used instead; raise it with sysctl", *maxConnBacklog, max)
+			}
+			listenBacklog = *maxConnBacklog
+		}
+	}
+	portFile = *portFilePath
+	discoveryFile = *discoveryFilePath
+	if inheritedSockets, err = systemd.Inherited(); err != nil {
+		logging.Errorf("couldn't use the sockets passed by systemd: %v", err)
+		os.Exit(1)
+	}
+	if n := inheritedSockets.Len(); n > 0 {
+		logging.Infof("Received %d sockets from systemd socket activation", n)
+	}
+	// upgradeConn is the connection to the proxy process this one replaces,
+	// if any.
+	var upgradeConn *net.UnixConn
+	var upgradeSocks []net.Listener
+	if *upgradeSocket != "" {
+		if runtime.GOOS == "windows" {
+			logging.Errorf("-upgrade_socket is not supported on Windows")
+			os.Exit(1)
+		}
+		if *useFuse {
+			logging.Errorf("-upgrade_socket and -fuse may not be used together")
+			os.Exit(1)
+		}
+		if upgradeConn, upgradeSocks, err = receiveSockets(*upgradeSocket); err != nil {
+			logging.Errorf("couldn't take over the sockets of the proxy on -upgrade_socket=%s: %v", *upgradeSocket, err)
+			os.Exit(1)
+		}
+		if upgradeConn != nil {
+			inheritedSockets.Add(upgradeSocks)
+			logging.Infof("Received %d sockets from the proxy process on %s", len(upgradeSocks), *upgradeSocket)
+		}
+	}
+
+	backoff, err := parseBackoff(*retryInitialDelay, *retryMaxDelay, *retryMultiplier)
+	if err != nil {
+		logging.Errorf("invalid retry flags: %v", err)
+		os.Exit(1)
+	}
+	if *dialRetries < 0 {
+		logging.Errorf("invalid -dial_retries: must not be negative, got %d", *dialRetries)
+		os.Exit(1)
+	}
+	if *idleTimeout < 0 {
+		logging.Errorf("invalid -idle_timeout: must not be negative, got %v", *idleTimeout)
+		os.Exit(1)
+	}
+	if *maxConnAge < 0 {
+		logging.Errorf("invalid -max_connection_age: must not be negative, got %v", *maxConnAge)
+		os.Exit(1)
+	}
+	if *rotationDrainTimeout < 0 {
+		logging.Errorf("invalid -rotation_drain_timeout: must not be negative, got %v", *rotationDrainTimeout)
+		os.Exit(1)
+	}
+	if *keepAliveInterval < time.Second {
+		logging.Errorf("invalid -tcp_keepalive_interval: must be at least 1s, got %v", *keepAliveInterval)
+		os.Exit(1)
+	}
+	if *keepAliveCount < 0 {
+		logging.Errorf("invalid -tcp_keepalive_count: must not be negative, got %d", *keepAliveCount)
+		os.Exit(1)
+	}
+	if *keepAliveCount > 0 && runtime.GOOS == "windows" {
+		logging.Errorf("WARNING: -tcp_keepalive_count is not supported on Windows; using the system default")
+	}
+	if *tcpUserTimeout < 0 {
+		logging.Errorf("invalid -tcp_user_timeout: must not be negative, got %v", *tcpUserTimeout)
+		os.Exit(1)
+	}
+	if *handshakeTimeout < 0 {
+		logging.Errorf("invalid -handshake_timeout: must not be negative, got %v", *handshakeTimeout)
+		os.Exit(1)
+	}
+	if *maxNewConnsPerIP < 0 {
+		logging.Errorf("invalid -max_new_connections_per_ip: must not be negative, got %d", *maxNewConnsPerIP)
+		os.Exit(1)
+	}
+	if *idleExitDelay < 0 {
+		logging.Errorf("invalid -idle_exit_delay: must not be negative, got %v", *idleExitDelay)
+		os.Exit(1)
+	}
+	if *instancesDNSInterval < time.Second {
+		logging.Errorf("invalid -instances_dns_interval: must be at least 1s, got %v", *instancesDNSInterval)
+		os.Exit(1)
+	}
+	if *startupTimeout < 0 {
+		logging.Errorf("invalid -startup_timeout: %v is negative", *startupTimeout)
+		os.Exit(1)
+	}
+	if *lazy && *verifyOnStartup {
+		logging.Errorf("-lazy and -verify_on_startup may not be used together")
+		os.Exit(1)
+	}
+	if *auditLog && !validLogName(*auditLogName) {
+		logging.Errorf("invalid -audit_log_name: %q must be at most 512 letters, digits and the characters /_.-", *auditLogName)
+		os.Exit(1)
+	}
+
+	if err := configureDNS(); err != nil {
+		logging.Errorf("%v", err)
+		os.Exit(1)
+	}
+	proxyURL, err := parseProxyAddress(*proxyAddress)
+	if err != nil {
+		logging.Errorf("invalid -proxy_address: %v", err)
+		os.Exit(1)
+	}
+	socksURL, err := socks5URL(*socks5Proxy, *socks5Username, *socks5Password)
+	if err != nil {
+		logging.Errorf("invalid -socks5_proxy: %v", err)
+		os.Exit(1)
+	}
+	if socksURL != nil {
+		if proxyURL != nil {
+			logging.Errorf("-proxy_address and -socks5_proxy may not be used together")
+			os.Exit(1)
+		}
+		proxyURL = socksURL
+	}
+	var iap iapTarget
+	if *useIAP {
+		if proxyURL != nil {
+			logging.Errorf("-use_iap may not be used together with -proxy_address or -socks5_proxy")
+			os.Exit(1)
+		}
+		if *autoIPType {
+			logging.Errorf("-use_iap and -auto_ip_type may not be used together")
+			os.Exit(1)
+		}
+		if *iapNetwork == "" {
+			logging.Errorf("-use_iap requires -iap_network")
+			os.Exit(1)
+		}
+		if iap, err = parseIAPTarget(*iapDestGroup, *iapNetwork); err != nil {
+			logging.Errorf("invalid -iap_dest_group: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if *usePSC && *privateIP {
+		logging.Errorf("-psc and -private_ip may not be used together")
+		os.Exit(1)
+	}
+	if *autoIPType {
+		ipTypesSet := false
+		flag.Visit(func(f *flag.Flag) { ipTypesSet = ipTypesSet || f.Name == "ip_address_types" })
+		if *usePSC || *privateIP || ipTypesSet {
+			logging.Errorf("-auto_ip_type may not be used together with -ip_address_types, -psc or -private_ip")
+			os.Exit(1)
+		}
+	}
+	ipAddrTypeOptsInput := ipAddrTypes()
 
 	if *fdRlimit != 0 {
 		if err := limits.SetupFDLimits(*fdRlimit); err != nil {
@@ -500,6 +1416,26 @@ func main() {
 		}
 	}
 
+	// In Kubernetes, the container's resource limits may be exposed through
+	// the Downward API; size the proxy to fit them.
+	if procs, err := limits.SetMaxProcsFromContainer(); err != nil {
+		logging.Errorf("WARNING: %v", err)
+	} else if procs > 0 {
+		logging.Infof("Set GOMAXPROCS to %d from the container CPU limit", procs)
+	}
+	maxConns := *maxConnections
+	maxConnsSet := false
+	flag.Visit(func(f *flag.Flag) { maxConnsSet = maxConnsSet || f.Name == "max_connections" })
+	if !maxConnsSet {
+		n, err := limits.MaxConnectionsFromContainer()
+		if err != nil {
+			logging.Errorf("WARNING: %v", err)
+		} else if n > 0 {
+			logging.Infof("Limiting connections to %d to fit the container memory limit; set -max_connections to override", n)
+			maxConns = n
+		}
+	}
+
 	if *host != "" && !strings.HasSuffix(*host, "/") {
 		logging.Errorf("Flag host should always end with /")
 		flag.PrintDefaults()
@@ -512,10 +1448,14 @@ func main() {
 		*instances = envInstances
 	}
 
-	instList := stringList(*instances)
+	flagInstList := stringList(*instances)
+	instList := flagInstList
+	for _, inst := range fileInstances {
+		instList = append(instList, inst.Arg())
+	}
 	projList := stringList(*projects)
 	// TODO: it'd be really great to consolidate flag verification in one place.
-	if len(instList) == 0 && *instanceSrc == "" && len(projList) == 0 && !*useFuse {
+	if len(instList) == 0 && *instanceSrc == "" && *instancesDNS == "" && len(projList) == 0 && !*useFuse {
 		var err error
 		projList, err = gcloudProject()
 		if err == nil {
@@ -534,21 +1474,109 @@ func main() {
 		logging.Errorf(err.Error())
 		os.Exit(1)
 	}
+	var localNet string
+	if *autoIPType {
+		if !onGCE {
+			logging.Errorf("WARNING: -auto_ip_type has no effect when not running on Google Cloud; using -ip_address_types")
+		} else if localNet, err = localNetwork(); err != nil {
+			logging.Errorf("WARNING: couldn't find the VM's VPC network for -auto_ip_type, using -ip_address_types: %v", err)
+		} else {
+			logging.Infof("Running in VPC network %v; instances on it are reached through their private IP address", localNet)
+		}
+	}
 
 	ctx := context.Background()
+	// Calls made while starting up use startupCtx, which expires with
+	// -startup_timeout; the proxy exits if starting takes longer still.
+	startupCtx, startupDone := startupDeadline(ctx, *startupTimeout, func() {
+		logging.Errorf("The proxy did not finish starting within -startup_timeout=%v; exiting", *startupTimeout)
+		os.Exit(1)
+	})
+	if proxyURL != nil {
+		// Route API and token requests through the proxy too.
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.Proxy = http.ProxyURL(proxyURL)
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: t})
+	}
+	impersonating = *impersonateServiceAccount != ""
+	for _, inst := range instList {
+		if _, _, sa := instanceCredentials(inst); sa != "" {
+			impersonating = true
+		}
+	}
 	client, tokSrc, err := authenticatedClient(ctx)
 	if err != nil {
 		logging.Errorf(err.Error())
 		os.Exit(1)
 	}
+	// Instances impersonating a service account of their own do so with the
+	// proxy's own credentials, not those of -impersonate_service_account.
+	baseTokSrc := tokSrc
+	if *impersonateServiceAccount != "" {
+		if tokSrc, err = newImpersonatedTokenSource(ctx, baseTokSrc, stringList(*impersonateServiceAccount)); err != nil {
+			logging.Errorf("invalid -impersonate_service_account: %v", err)
+			os.Exit(1)
+		}
+		client = oauth2.NewClient(ctx, tokSrc)
+	}
+	if *debugCredentials {
+		if err := logTokenInfo(ctx, tokSrc); err != nil {
+			logging.Errorf("WARNING: could not inspect the proxy's credentials: %v", err)
+		}
+	}
+
+	// Instances given by -instances or the config file may have their own
+	// credentials, or impersonate a service account of their own, each with
+	// a token source refreshed independently of the others. Each instance's
+	// credentials are loaded once, and again only if a reload of the config
+	// file changes them.
+	instClients := make(map[string]*http.Client)
+	instTokSrcs := make(map[string]oauth2.TokenSource)
+	// instCreds holds the credentials option and impersonate option each
+	// instance's credentials were loaded with.
+	instCreds := make(map[string][2]string)
+	loadInstanceCredentials := func(insts []string) error {
+		for _, inst := range insts {
+			name, path, sa := instanceCredentials(inst)
+			if path == "" && sa == "" {
+				delete(instClients, name)
+				delete(instTokSrcs, name)
+				delete(instCreds, name)
+				continue
+			}
+			if instCreds[name] == [2]string{path, sa} {
+				continue
+			}
+			cl, src := client, baseTokSrc
+			if path != "" {
+				var err error
+				if cl, src, err = authenticatedClientFromPath(ctx, path); err != nil {
+					return fmt.Errorf("credentials for %q: %v", name, err)
+				}
+			}
+			if sa != "" {
+				var err error
+				if src, err = newImpersonatedTokenSource(ctx, src, []string{sa}); err != nil {
+					return fmt.Errorf("credentials for %q: %v", name, err)
+				}
+				cl = oauth2.NewClient(ctx, src)
+			}
+			instClients[name], instTokSrcs[name], instCreds[name] = cl, src, [2]string{path, sa}
+		}
+		return nil
+	}
+	if err := loadInstanceCredentials(instList); err != nil {
+		logging.Errorf("%v", err)
+		os.Exit(1)
+	}
 
-	ins, err := listInstances(ctx, client, projList)
+	ins, err := listInstances(startupCtx, client, projList)
 	if err != nil {
 		logging.Errorf(err.Error())
 		os.Exit(1)
 	}
 	instList = append(instList, ins...)
-	cfgs, err := CreateInstanceConfigs(*dir, *useFuse, instList, *instanceSrc, client, *skipInvalidInstanceConfigs)
+	cfgs, err := CreateInstanceConfigs(*dir, *useFuse, instList, *instanceSrc, *instancesDNS, client, instClients, *skipInvalidInstanceConfigs)
 	if err != nil {
 		logging.Errorf(err.Error())
 		os.Exit(1)
@@ -571,24 +1599,166 @@ func main() {
 		refreshCfgThrottle = proxy.IAMLoginRefreshThrottle
 		refreshCfgBuffer = proxy.IAMLoginRefreshCfgBuffer
 	}
+	if *certRefreshLead != 0 {
+		if *certRefreshLead < 0 || *certRefreshLead >= maximumCertRefreshLead {
+			logging.Errorf("-cert_refresh_lead must be between 0 and %v, got %v", maximumCertRefreshLead, *certRefreshLead)
+			os.Exit(1)
+		}
+		refreshCfgBuffer = *certRefreshLead
+	}
+	var m *metrics.Metrics
+	if *pprofPort != 0 {
+		go servePprof(*pprofPort)
+	}
+	if *metricsPort != 0 || *cloudMonitoringProject != "" {
+		m, err = metrics.NewWithOptions(metrics.Options{
+			Labels:         metricLabelValues,
+			InstanceLabels: instanceMetricLabelNames(fileInstances),
+		})
+		if err == nil {
+			err = setInstanceMetricLabels(m, fileInstances)
+		}
+		if err != nil {
+			logging.Errorf("invalid metric labels: %v", err)
+			os.Exit(1)
+		}
+	}
+	if *metricsPort != 0 {
+		go serveMetrics(*metricsPort, m)
+		if *gmpExport {
+			go func() {
+				if err := exportToGMP(*metricsPort); err != nil {
+					logging.Errorf("WARNING: couldn't set up Managed Service for Prometheus to scrape the proxy's metrics: %v", err)
+				}
+			}()
+		}
+	}
+	if *cloudMonitoringProject != "" {
+		e, err := newMonitoringExporter(ctx, client, *cloudMonitoringProject, m.Registry())
+		if err != nil {
+			logging.Errorf("couldn't set up Cloud Monitoring: %v", err)
+			os.Exit(1)
+		}
+		go e.run(ctx, monitoringInterval)
+	}
+	var auditor *auditLogger
+	if *auditLog {
+		if auditor, err = newAuditLogger(ctx, client, *auditLogName); err != nil {
+			logging.Errorf("couldn't set up the audit log: %v", err)
+			os.Exit(1)
+		}
+	}
+	certOpts := certs.RemoteOpts{
+		APIBasePath:    *host,
+		IgnoreRegion:   !*checkRegion,
+		UserAgent:      userAgentFromVersionString(),
+		IPAddrTypeOpts: ipAddrTypeOptsInput,
+		EnableIAMLogin: *enableIAMLogin,
+		TokenSource:    tokSrc,
+		Metrics:        m,
+		Backoff:        backoff,
+		LocalNetwork:   localNet,
+	}
+	certSrc := &instanceCertSource{
+		CertSource: certs.NewCertSourceOpts(client, certOpts),
+		byInstance: make(map[string]proxy.CertSource),
+	}
+	// Instances with their own credentials, or which connect through Private
+	// Service Connect or a single type of IP address, need a CertSource of
+	// their own.
+	setCertSource := func(cfg instanceConfig) {
+		cl, opts := client, certOpts
+		c, ok := instClients[cfg.Instance]
+		if ok {
+			cl, opts.TokenSource = c, instTokSrcs[cfg.Instance]
+		}
+		switch {
+		case cfg.PSC:
+			opts.IPAddrTypeOpts = []string{certs.PSCIPAddrType}
+			opts.LocalNetwork = ""
+		case cfg.IPType != "":
+			opts.IPAddrTypeOpts = []string{cfg.IPType}
+			opts.LocalNetwork = ""
+		}
+		if !ok && !cfg.PSC && cfg.IPType == "" {
+			certSrc.set(cfg.Instance, nil)
+			return
+		}
+		certSrc.set(cfg.Instance, certs.NewCertSourceOpts(cl, opts))
+	}
+	for _, cfg := range cfgs {
+		setCertSource(cfg)
+	}
 	proxyClient := &proxy.Client{
-		Port:           port,
-		MaxConnections: *maxConnections,
-		Certs: certs.NewCertSourceOpts(client, certs.RemoteOpts{
-			APIBasePath:    *host,
-			IgnoreRegion:   !*checkRegion,
-			UserAgent:      userAgentFromVersionString(),
-			IPAddrTypeOpts: ipAddrTypeOptsInput,
-			EnableIAMLogin: *enableIAMLogin,
-			TokenSource:    tokSrc,
-		}),
-		Conns:              connset,
-		RefreshCfgThrottle: refreshCfgThrottle,
-		RefreshCfgBuffer:   refreshCfgBuffer,
+		Port:                 port,
+		MaxConnections:       maxConns,
+		Certs:                certSrc,
+		Conns:                connset,
+		RefreshCfgThrottle:   refreshCfgThrottle,
+		RefreshCfgBuffer:     refreshCfgBuffer,
+		ProxyURL:             proxyURL,
+		AllowedNetworks:      allowedNets,
+		MaxNewConnsPerIP:     *maxNewConnsPerIP,
+		HandshakeTimeout:     *handshakeTimeout,
+		DialRetries:          *dialRetries,
+		DialBackoff:          backoff,
+		MinTLSVersion:        minTLSVersion,
+		CipherSuites:         cipherSuites,
+		WarmConnections:      *warmConnections,
+		WarmIdleTimeout:      *warmIdleTimeout,
+		BreakerThreshold:     *breakerThreshold,
+		BreakerMaxBackoff:    *breakerMaxBackoff,
+		IdleTimeout:          *idleTimeout,
+		KeepAliveInterval:    *keepAliveInterval,
+		KeepAliveCount:       *keepAliveCount,
+		TCPUserTimeout:       *tcpUserTimeout,
+		MaxConnAge:           *maxConnAge,
+		RotationDrainTimeout: *rotationDrainTimeout,
+		MaxConnBandwidth:     connBandwidth,
+		MaxTotalBandwidth:    totalBandwidth,
+		Metrics:              m,
+	}
+	if *useIAP {
+		proxyClient.ContextDialer = iapDialer(iap, tokSrc)
+	}
+	if auditor != nil {
+		proxyClient.Auditor = auditor
+	}
+	for project, max := range projectLimits {
+		proxyClient.SetProjectMaxConnections(project, max)
+	}
+	if *enableIAMAuthn {
+		proxyClient.IAMAuthnTokenSource = tokSrc
+	}
+	proxyClient.ApplicationName = *applicationName
+	proxyClient.OverrideApplicationName = *overrideAppName
+
+	var names []string
+	for _, cfg := range cfgs {
+		names = append(names, cfg.Instance)
+	}
+	if *verifyOnStartup {
+		// Listeners are only opened once every instance is known to be
+		// reachable, so that a misconfigured proxy fails before any
+		// application connects to it.
+		if *useFuse {
+			logging.Errorf("WARNING: -verify_on_startup has no effect with -fuse")
+		}
+		vctx, cancel := context.WithTimeout(startupCtx, startupVerifyTimeout)
+		err := proxyClient.VerifyAll(vctx, names)
+		cancel()
+		if err != nil {
+			logging.Errorf("Startup verification failed: %v", err)
+			os.Exit(1)
+		}
+		logging.Infof("Verified connectivity to %d instances", len(names))
 	}
 
 	// Initialize a source of new connections to Cloud SQL instances.
 	var connSrc <-chan proxy.Conn
+	// reloads receives the instances to listen on after the config file is
+	// reloaded. It is nil if instances cannot be reloaded.
+	var reloads chan []instanceConfig
 	if *useFuse {
 		c, fuse, err := fuse.NewConnSrc(*dir, *fuseTmp, proxyClient, connset)
 		if err != nil {
@@ -602,7 +1772,7 @@ func main() {
 		if *instanceSrc != "" {
 			go func() {
 				for {
-					err := metadata.Subscribe(*instanceSrc, func(v string, ok bool) error {
+					err := metadata.Subscribe(metadataInstancesPath(*instanceSrc), func(v string, ok bool) error {
 						if ok {
 							updates <- v
 						}
@@ -615,17 +1785,128 @@ func main() {
 				}
 			}()
 		}
+		if *instancesDNS != "" {
+			go watchDNSInstances(*instancesDNS, *instancesDNSInterval, updates)
+		}
 
-		c, err := WatchInstances(*dir, cfgs, updates, client)
+		if *configFile != "" {
+			reloads = make(chan []instanceConfig)
+		}
+		c, err := WatchInstances(*dir, cfgs, updates, reloads, *drainTimeout, client, proxyClient)
 		if err != nil {
 			logging.Errorf(err.Error())
 			os.Exit(1)
 		}
 		connSrc = c
+		// Sockets of the previous proxy process which no instance uses are
+		// closed, so that no connections wait on them.
+		for _, l := range upgradeSocks {
+			if inheritedSockets.Take(l.Addr().Network(), l.Addr().String()) == l {
+				logging.Infof("No instance is configured to listen on %s; closing the socket from the previous proxy process", l.Addr())
+				l.Close()
+			}
+		}
+		for _, addr := range inheritedSockets.Unused() {
+			logging.Errorf("WARNING: no instance is configured to listen on %s, the address of a socket passed by systemd", addr)
+		}
 	}
 
+	if *grpcPort != 0 {
+		connSrc = serveGRPC(*grpcPort, connSrc)
+	}
+
+	if (*healthCheckPort != 0 || *warmConnections > 0) && !*lazy {
+		// Fetch certificates up front so readiness does not depend on the
+		// first connection to each instance, and so that warm connections
+		// are established right away.
+		go func() {
+			if err := proxyClient.PrefetchAll(ctx, names); err != nil {
+				logging.Errorf("Failed to fetch certificates: %v", err)
+			}
+		}()
+	}
+	if *healthCheckPort != 0 {
+		// With -lazy, certificates are only fetched on demand, so readiness
+		// cannot wait for them.
+		ready := names
+		if *lazy {
+			ready = nil
+		}
+		go serveHealthCheck(*healthCheckPort, proxyClient, ready)
+	}
+
+	statsSignals := make(chan os.Signal, 1)
+	notifyStats(statsSignals)
+	go func() {
+		for range statsSignals {
+			if err := dumpStats(*statsFile, proxyClient, names); err != nil {
+				logging.Errorf("Failed to write statistics: %v", err)
+			}
+		}
+	}()
+
+	startupDone()
 	logging.Infof("Ready for new connections")
 
+	if *exitZeroOnIdle {
+		go func() {
+			proxyClient.WaitIdle(*idleExitDelay)
+			logging.Infof("No connections for %v after the last one closed; exiting.", *idleExitDelay)
+			auditor.Close(auditCloseTimeout)
+			os.Exit(0)
+		}()
+	}
+
+	reloadInstances := func() ([]instanceConfig, error) {
+		file, err := config.Load(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		list := append([]string(nil), flagInstList...)
+		for _, inst := range file.Instances {
+			list = append(list, inst.Arg())
+		}
+		if err := loadInstanceCredentials(list); err != nil {
+			return nil, err
+		}
+		if err := setInstanceMetricLabels(m, file.Instances); err != nil {
+			logging.Errorf("WARNING: %v; restart the proxy to change metric labels", err)
+		}
+		list = append(list, ins...)
+		cfgs, err := parseInstanceConfigs(*dir, list, client, instClients, *skipInvalidInstanceConfigs)
+		if err != nil {
+			return nil, err
+		}
+		for _, cfg := range cfgs {
+			setCertSource(cfg)
+		}
+		return cfgs, nil
+	}
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			logging.Infof("Received HUP signal. Reloading credentials and configuration.")
+			reloadCredentials(ctx, tokSrc)
+			for _, src := range instTokSrcs {
+				reloadCredentials(ctx, src)
+			}
+			if *configFile == "" {
+				continue
+			}
+			if reloads == nil {
+				logging.Errorf("WARNING: instances cannot be reloaded from the config file when -fuse is set")
+				continue
+			}
+			cfgs, err := reloadInstances()
+			if err != nil {
+				logging.Errorf("Failed to reload config file, continuing with previous instances: %v", err)
+				continue
+			}
+			reloads <- cfgs
+		}
+	}()
+
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 
@@ -639,6 +1920,11 @@ func main() {
 		}()
 
 		err := proxyClient.Shutdown(*termTimeout)
+		closeTimeout := auditCloseTimeout
+		if *cloudRunSidecar {
+			closeTimeout = cloudRunAuditCloseTimeout
+		}
+		auditor.Close(closeTimeout)
 		if err == nil {
 			os.Exit(0)
 		}
@@ -646,6 +1932,23 @@ func main() {
 		os.Exit(2)
 	}()
 
+	if *upgradeSocket != "" {
+		go func() {
+			if upgradeConn != nil {
+				if err := takeOver(upgradeConn); err != nil {
+					logging.Errorf("WARNING: the previous proxy process did not hand over %s: %v", *upgradeSocket, err)
+				}
+			}
+			err := serveUpgrades(*upgradeSocket, func() {
+				logging.Infof("A new proxy process has taken over; draining connections.")
+				signals <- syscall.SIGTERM
+			})
+			if err != nil {
+				logging.Errorf("WARNING: couldn't listen for upgrades on %s: %v", *upgradeSocket, err)
+			}
+		}()
+	}
+
 	// If running under systemd with Type=notify, we'll send a message to the
 	// service manager that we are ready to handle connections now, and any other
 	// units that are waiting for us can start.
@@ -0,0 +1,96 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file contains code for running as a sidecar container on Cloud Run.
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+const (
+	// cloudRunKillDelay is how long Cloud Run waits after sending SIGTERM
+	// to a container before killing it.
+	cloudRunKillDelay = 10 * time.Second
+	// cloudRunTermTimeout is the -term_timeout used with -cloud_run_sidecar
+	// unless it is set. Together with cloudRunAuditCloseTimeout, it leaves
+	// time to exit before the container is killed.
+	cloudRunTermTimeout = 7 * time.Second
+	// cloudRunAuditCloseTimeout replaces auditCloseTimeout with
+	// -cloud_run_sidecar.
+	cloudRunAuditCloseTimeout = 2 * time.Second
+)
+
+// configureCloudRunSidecar applies the defaults of -cloud_run_sidecar to the
+// flags which were not set: health checks are served on the port in the
+// PORT environment variable, and -term_timeout fits within the time Cloud
+// Run allows after SIGTERM.
+func configureCloudRunSidecar() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if !set["health_check_port"] {
+		if p := os.Getenv("PORT"); p != "" {
+			n, err := strconv.Atoi(p)
+			if err != nil || n <= 0 || n > 65535 {
+				return fmt.Errorf("PORT must be a port number, got %q", p)
+			}
+			*healthCheckPort = n
+		} else {
+			logging.Errorf("WARNING: PORT is not set, so no health checks are served; set PORT or -health_check_port")
+		}
+	}
+	if !set["term_timeout"] {
+		*termTimeout = cloudRunTermTimeout
+	} else if *termTimeout+cloudRunAuditCloseTimeout >= cloudRunKillDelay {
+		logging.Errorf("WARNING: -term_timeout is %v, but Cloud Run kills the proxy %v after sending SIGTERM", *termTimeout, cloudRunKillDelay)
+	}
+	return nil
+}
+
+// defaultDatabasePort returns the port on which a database engine listens by
+// default, given an instance's database version, e.g. "POSTGRES_13".
+func defaultDatabasePort(databaseVersion string) (int, error) {
+	v := strings.ToUpper(databaseVersion)
+	switch {
+	case strings.HasPrefix(v, "POSTGRES"):
+		return 5432, nil
+	case strings.HasPrefix(v, "MYSQL"):
+		return 3306, nil
+	case strings.HasPrefix(v, "SQLSERVER"):
+		return 1433, nil
+	}
+	return 0, fmt.Errorf("no default port for database version %q", databaseVersion)
+}
+
+// sidecarAddress returns the local address on which an instance with
+// databaseVersion listens with -cloud_run_sidecar when no listener is
+// configured for it: the engine's usual port on the loopback address, which
+// the other containers of a Cloud Run service share.
+func sidecarAddress(databaseVersion string) (string, error) {
+	port, err := defaultDatabasePort(databaseVersion)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(loopbackForNet["tcp"], strconv.Itoa(port)), nil
+}
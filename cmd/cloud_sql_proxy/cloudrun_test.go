@@ -0,0 +1,89 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// versionTripper answers every request with an instance of the given
+// database version.
+type versionTripper string
+
+func (v versionTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	body := `{"databaseVersion":"` + string(v) + `"}`
+	return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader([]byte(body)))}, nil
+}
+
+func TestParseInstanceConfigCloudRunSidecar(t *testing.T) {
+	*cloudRunSidecar = true
+	defer func() { *cloudRunSidecar = false }()
+
+	const inst = "my-proj:my-reg:my-instance"
+	for _, v := range []struct {
+		in, version, want string
+		wantErr           bool
+	}{
+		{in: inst, version: "POSTGRES_13", want: "127.0.0.1:5432"},
+		{in: inst, version: "MYSQL_8_0", want: "127.0.0.1:3306"},
+		{in: inst, version: "SQLSERVER_2019_STANDARD", want: "127.0.0.1:1433"},
+		{in: inst + "=tcp:6000", version: "POSTGRES_13", want: "127.0.0.1:6000"},
+		{in: inst, version: "UNKNOWN", wantErr: true},
+	} {
+		cl := &http.Client{Transport: versionTripper(v.version)}
+		got, err := parseInstanceConfig("", v.in, cl)
+		if v.wantErr {
+			if err == nil {
+				t.Errorf("parseInstanceConfig(%q) for %v = %+v, want error", v.in, v.version, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseInstanceConfig(%q) for %v: %v", v.in, v.version, err)
+			continue
+		}
+		if got.Network != "tcp" || got.Address != v.want {
+			t.Errorf("parseInstanceConfig(%q) for %v listens on %v:%v, want tcp:%v", v.in, v.version, got.Network, got.Address, v.want)
+		}
+	}
+}
+
+func TestConfigureCloudRunSidecar(t *testing.T) {
+	defer func(port int, d time.Duration) {
+		*healthCheckPort, *termTimeout = port, d
+	}(*healthCheckPort, *termTimeout)
+	defer os.Unsetenv("PORT")
+
+	os.Setenv("PORT", "8081")
+	if err := configureCloudRunSidecar(); err != nil {
+		t.Fatalf("configureCloudRunSidecar: %v", err)
+	}
+	if *healthCheckPort != 8081 {
+		t.Errorf("-health_check_port = %v, want 8081 from PORT", *healthCheckPort)
+	}
+	if *termTimeout != cloudRunTermTimeout {
+		t.Errorf("-term_timeout = %v, want %v", *termTimeout, cloudRunTermTimeout)
+	}
+
+	os.Setenv("PORT", "http")
+	if err := configureCloudRunSidecar(); err == nil {
+		t.Errorf("configureCloudRunSidecar succeeded with PORT=http, want error")
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file contains code for the completion subcommand, which writes shell
+// completion scripts and lists the instances they offer for -instances.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"golang.org/x/net/context"
+)
+
+// completionTimeout bounds the time taken to list instances, so that a shell
+// waiting for completions is not left hanging.
+const completionTimeout = 10 * time.Second
+
+// subcommands are the words completed in place of the first argument.
+var subcommands = []string{"completion", "doctor"}
+
+// completionShells are the shells for which scripts can be written.
+var completionShells = []string{"bash", "fish", "zsh"}
+
+// completionFlag describes a flag to a completion script.
+type completionFlag struct {
+	Name string
+	// Description is the first line of the flag's help text.
+	Description string
+	// Bool is set if the flag takes no value.
+	Bool bool
+}
+
+// completionFlags returns the flags defined in fs, sorted by name.
+func completionFlags(fs *flag.FlagSet) []completionFlag {
+	var ret []completionFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		desc := strings.TrimSpace(strings.SplitN(f.Usage, "\n", 2)[0])
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		ret = append(ret, completionFlag{Name: f.Name, Description: desc, Bool: ok && b.IsBoolFlag()})
+	})
+	return ret
+}
+
+// completionFuncs are the functions available to the completion scripts.
+var completionFuncs = template.FuncMap{
+	"join": strings.Join,
+	// fishQuote quotes s as a single-quoted fish string.
+	"fishQuote": func(s string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+	},
+}
+
+// The completion scripts of each shell. Every script completes the
+// subcommands and flags, and completes -instances, as either -instances=VALUE
+// or -instances VALUE, with the connection names printed by
+// "cloud_sql_proxy completion instances". Each comma-separated instance in the
+// value is completed in turn. The -projects and -credential_file flags
+// already given are passed along, so that the instances listed are those the
+// proxy would see.
+var completionScripts = map[string]*template.Template{
+	"bash": template.Must(template.New("bash").Funcs(completionFuncs).Parse(bashCompletion)),
+	"zsh":  template.Must(template.New("zsh").Funcs(completionFuncs).Parse(zshCompletion)),
+	"fish": template.Must(template.New("fish").Funcs(completionFuncs).Parse(fishCompletion)),
+}
+
+const bashCompletion = `# bash completion for cloud_sql_proxy.
+# Load it with: source <(cloud_sql_proxy completion bash)
+
+_cloud_sql_proxy_instances() {
+    local args=() w
+    for w in "${COMP_WORDS[@]:1}"; do
+        case "$w" in
+        -projects=*|--projects=*|-credential_file=*|--credential_file=*)
+            args+=("$w") ;;
+        esac
+    done
+    "${COMP_WORDS[0]}" completion instances "${args[@]}" 2>/dev/null
+}
+
+_cloud_sql_proxy() {
+    local line="${COMP_LINE:0:COMP_POINT}"
+    local word="${line##*[[:space:]]}"
+    local prev="${line%"$word"}"
+    prev="${prev%"${prev##*[![:space:]]}"}"
+    prev="${prev##*[[:space:]]}"
+    local value
+    case "$word" in
+    -instances=*|--instances=*)
+        # '=' separates words for bash, so only the text after it is
+        # replaced.
+        value="${word#*=}" ;;
+    -*)
+        COMPREPLY=($(compgen -W "{{range .Flags}}-{{.Name}} {{end}}" -- "$word"))
+        return ;;
+    *)
+        case "$prev" in
+        -instances|--instances)
+            value="$word" ;;
+        completion)
+            COMPREPLY=($(compgen -W "{{join .Shells " "}}" -- "$word"))
+            return ;;
+        *)
+            if [[ $COMP_CWORD -eq 1 ]]; then
+                COMPREPLY=($(compgen -W "{{join .Subcommands " "}}" -- "$word"))
+            fi
+            return ;;
+        esac ;;
+    esac
+    local head="" name
+    [[ "$value" == *,* ]] && head="${value%,*},"
+    COMPREPLY=()
+    for name in $(_cloud_sql_proxy_instances); do
+        [[ "$head$name" == "$value"* ]] && COMPREPLY+=("$head$name")
+    done
+}
+
+complete -o default -F _cloud_sql_proxy cloud_sql_proxy
+`
+
+const zshCompletion = `# zsh completion for cloud_sql_proxy.
+# Load it with: source <(cloud_sql_proxy completion zsh)
+
+autoload -U +X bashcompinit && bashcompinit
+
+` + bashCompletion
+
+const fishCompletion = `# fish completion for cloud_sql_proxy.
+# Load it with: cloud_sql_proxy completion fish | source
+
+function __cloud_sql_proxy_instances
+    set -l tokens (commandline -opc)
+    set -l args
+    for t in $tokens[2..-1]
+        if string match -qr -- '^--?(projects|credential_file)=' $t
+            set -a args $t
+        end
+    end
+    set -l value (string replace -r -- '^--?instances=' '' (commandline -ct))
+    set -l head (string match -r -- '^.*,' $value)
+    for name in ($tokens[1] completion instances $args 2>/dev/null)
+        echo $head$name
+    end
+end
+
+complete -c cloud_sql_proxy -f
+complete -c cloud_sql_proxy -n '__fish_use_subcommand' -a '{{join .Subcommands " "}}'
+complete -c cloud_sql_proxy -n '__fish_seen_subcommand_from completion' -a '{{join .Shells " "}}'
+{{range .Flags}}complete -c cloud_sql_proxy -o {{.Name}}{{if not .Bool}} -r{{end}}{{if eq .Name "instances"}} -a '(__cloud_sql_proxy_instances)'{{end}} -d {{fishQuote .Description}}
+{{end}}`
+
+// writeCompletion writes the completion script for shell to w.
+func writeCompletion(w io.Writer, shell string) error {
+	t, ok := completionScripts[shell]
+	if !ok {
+		return fmt.Errorf("unsupported shell %q, want one of %v", shell, strings.Join(completionShells, ", "))
+	}
+	return t.Execute(w, struct {
+		Flags       []completionFlag
+		Subcommands []string
+		Shells      []string
+	}{completionFlags(flag.CommandLine), subcommands, completionShells})
+}
+
+// completionProjects returns the projects whose instances are completed:
+// those given by -projects, or else gcloud's active project, or else the
+// project named by GOOGLE_CLOUD_PROJECT.
+func completionProjects() []string {
+	if p := stringList(*projects); len(p) > 0 {
+		return p
+	}
+	if p, err := gcloudProject(); err == nil {
+		return p
+	}
+	return stringList(os.Getenv("GOOGLE_CLOUD_PROJECT"))
+}
+
+// writeInstances writes the connection names of the instances in the
+// completion projects to w, one per line, using the proxy's credentials.
+func writeInstances(w io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+	defer cancel()
+
+	projs := completionProjects()
+	if len(projs) == 0 {
+		return fmt.Errorf("no project to list instances in, set one with -projects")
+	}
+	client, _, err := authenticatedClient(ctx)
+	if err != nil {
+		return err
+	}
+	names, err := listInstances(ctx, client, projs)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintln(w, n)
+	}
+	return nil
+}
+
+// runCompletion runs the completion subcommand with args, the arguments
+// following it, and returns the exit status.
+func runCompletion(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: cloud_sql_proxy completion %s\n", strings.Join(completionShells, "|"))
+		return 2
+	}
+	if args[0] == "instances" {
+		flag.CommandLine.Parse(args[1:])
+		// Anything logged would be taken for a completion.
+		logging.DisableLogging()
+		if err := writeInstances(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		return 0
+	}
+	if err := writeCompletion(os.Stdout, args[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	return 0
+}
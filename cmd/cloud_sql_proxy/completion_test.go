@@ -0,0 +1,119 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteCompletion(t *testing.T) {
+	for _, shell := range completionShells {
+		var buf bytes.Buffer
+		if err := writeCompletion(&buf, shell); err != nil {
+			t.Fatalf("writeCompletion(%q): %v", shell, err)
+		}
+		for _, want := range []string{"completion instances", "instances", "credential_file", "doctor"} {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("%s script does not contain %q", shell, want)
+			}
+		}
+	}
+	if err := writeCompletion(&bytes.Buffer{}, "tcsh"); err == nil {
+		t.Error("writeCompletion(tcsh) succeeded, want error")
+	}
+}
+
+func TestCompletionFlags(t *testing.T) {
+	var gotInstances, gotVersion *completionFlag
+	fs := completionFlags(flag.CommandLine)
+	for i := range fs {
+		switch fs[i].Name {
+		case "instances":
+			gotInstances = &fs[i]
+		case "version":
+			gotVersion = &fs[i]
+		}
+	}
+	if gotInstances == nil || gotInstances.Bool || gotInstances.Description == "" {
+		t.Errorf("-instances = %+v, want a described flag taking a value", gotInstances)
+	}
+	if gotVersion == nil || !gotVersion.Bool {
+		t.Errorf("-version = %+v, want a bool flag", gotVersion)
+	}
+}
+
+func TestBashCompletion(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	var script bytes.Buffer
+	if err := writeCompletion(&script, "bash"); err != nil {
+		t.Fatal(err)
+	}
+	// complete runs the completion function with the cursor at the end of
+	// line. A shell function stands in for the proxy listing instances.
+	complete := func(line string) []string {
+		words := strings.Fields(line)
+		if strings.HasSuffix(line, " ") {
+			words = append(words, "")
+		}
+		prog := script.String() + `
+cloud_sql_proxy() {
+    if [ "$3" = -projects=q ]; then echo q:r:c; return; fi
+    echo p:r:a; echo p:r:b
+}
+COMP_LINE="$1"
+COMP_POINT=${#COMP_LINE}
+shift
+COMP_WORDS=("$@")
+COMP_CWORD=$(($# - 1))
+_cloud_sql_proxy
+printf '%s\n' "${COMPREPLY[@]}"
+`
+		out, err := exec.Command("bash", append([]string{"-c", prog, "bash", line}, words...)...).Output()
+		if err != nil {
+			t.Fatalf("completing %q: %v", line, err)
+		}
+		return strings.Fields(string(out))
+	}
+
+	tcs := []struct {
+		line string
+		want []string
+	}{
+		{"cloud_sql_proxy do", []string{"doctor"}},
+		{"cloud_sql_proxy completion z", []string{"zsh"}},
+		{"cloud_sql_proxy -instances_dns_", []string{"-instances_dns_interval"}},
+		{"cloud_sql_proxy -instances=", []string{"p:r:a", "p:r:b"}},
+		{"cloud_sql_proxy -instances=p:r:a,p:r:", []string{"p:r:a,p:r:a", "p:r:a,p:r:b"}},
+		{"cloud_sql_proxy -instances p:r:b", []string{"p:r:b"}},
+		{"cloud_sql_proxy -projects=q -instances=", []string{"q:r:c"}},
+		{"cloud_sql_proxy -dir ", nil},
+	}
+	for _, tc := range tcs {
+		got := complete(tc.line)
+		if len(got) == 0 {
+			got = nil
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("completing %q = %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	goauth "golang.org/x/oauth2/google"
+	iamcredentials "google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// credentialScopes returns the OAuth2 scopes the proxy's access tokens need:
+// the Cloud SQL scope, the Cloud Logging scope if -audit_log is set, the
+// Cloud Monitoring scope if -cloud_monitoring_project is set, and the Cloud
+// Platform scope, which IAP tunnels require, if -use_iap is set.
+func credentialScopes() []string {
+	scopes := []string{proxy.SQLScope}
+	if *auditLog {
+		scopes = append(scopes, loggingWriteScope)
+	}
+	if *cloudMonitoringProject != "" {
+		scopes = append(scopes, monitoringWriteScope)
+	}
+	if *useIAP {
+		scopes = append(scopes, cloudPlatformScope)
+	}
+	return scopes
+}
+
+// impersonating is set if any credentials are used to impersonate a service
+// account, as set by -impersonate_service_account or an instance's
+// impersonate option.
+var impersonating bool
+
+// baseScopes returns the OAuth2 scopes requested for credentials loaded from
+// files, secrets or the environment. Credentials used to impersonate a
+// service account need the Cloud Platform scope to call the IAM Service
+// Account Credentials API.
+func baseScopes() []string {
+	if impersonating {
+		return []string{cloudPlatformScope}
+	}
+	return credentialScopes()
+}
+
+// tokenSourceFromJSON returns a TokenSource for the credentials in all, which
+// were read from f, a "credential file" or "secret" according to kind.
+func tokenSourceFromJSON(ctx context.Context, kind, f string, all []byte) (oauth2.TokenSource, error) {
+	// First try and load this as a service account config, which allows us to see the service account email:
+	if cfg, err := goauth.JWTConfigFromJSON(all, baseScopes()...); err == nil {
+		logging.Infof("using %s for authentication; email=%s", kind, cfg.Email)
+		return cfg.TokenSource(ctx), nil
+	}
+
+	// Otherwise, the file may hold any type of credentials supported by
+	// CredentialsFromJSON, including external account credentials used by
+	// Workload Identity Federation. For those, the returned TokenSource
+	// exchanges the external subject token with Google's Security Token
+	// Service when a token is first requested.
+	cred, err := goauth.CredentialsFromJSON(ctx, all, baseScopes()...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid json in %s %q: %v", kind, f, err)
+	}
+	var key struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(all, &key) == nil && key.Type == "external_account" {
+		logging.Infof("using external account %s for authentication; path=%q", kind, f)
+	} else {
+		logging.Infof("using %s for authentication; path=%q", kind, f)
+	}
+	return cred.TokenSource, nil
+}
+
+// tokenInfoURL is the endpoint describing an access token. It is replaced in
+// tests.
+var tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+// logTokenInfo logs the account, expiry and scopes of an access token from
+// src, as reported by the tokeninfo endpoint. The token is sent in the
+// request body so that it does not appear in any request logs.
+func logTokenInfo(ctx context.Context, src oauth2.TokenSource) error {
+	tok, err := src.Token()
+	if err != nil {
+		return fmt.Errorf("could not get an access token: %v", err)
+	}
+	cl := http.DefaultClient
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		cl = c
+	}
+	resp, err := cl.PostForm(tokenInfoURL, url.Values{"access_token": {tok.AccessToken}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var info struct {
+		Email string `json:"email"`
+		Exp   string `json:"exp"`
+		Scope string `json:"scope"`
+		Error string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return fmt.Errorf("invalid tokeninfo response (status %v): %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tokeninfo rejected the access token (status %v): %s", resp.Status, info.Error)
+	}
+
+	email := info.Email
+	if email == "" {
+		email = "unknown (the token lacks the userinfo.email scope)"
+	}
+	exp := info.Exp
+	if sec, err := strconv.ParseInt(info.Exp, 10, 64); err == nil {
+		exp = time.Unix(sec, 0).UTC().Format(time.RFC3339)
+	}
+	logging.Infof("credentials: email=%s exp=%s scope=%q", email, exp, info.Scope)
+	if !hasScope(info.Scope, proxy.SQLScope) && !hasScope(info.Scope, cloudPlatformScope) {
+		logging.Errorf("WARNING: the access token has neither the %s nor the %s scope; calls to the Cloud SQL Admin API will fail", proxy.SQLScope, cloudPlatformScope)
+	}
+	return nil
+}
+
+// cloudPlatformScope grants access to all Google Cloud APIs, including the
+// Cloud SQL Admin API.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// hasScope reports whether the space-separated scopes include scope.
+func hasScope(scopes, scope string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadingTokenSource is an oauth2.TokenSource for the credentials stored in
+// a file or a Secret Manager secret. If they change, tokens are retrieved
+// using the new credentials from then on.
+type reloadingTokenSource struct {
+	// kind is "credential file" or "secret".
+	kind string
+	// name is the path of the credential file, or the resource name of the
+	// secret version holding the credentials.
+	name string
+	// load reads the current credentials.
+	load func() ([]byte, error)
+
+	mu       sync.Mutex
+	contents []byte
+	src      oauth2.TokenSource
+}
+
+// newReloadingTokenSource reads the credentials from the file at path.
+func newReloadingTokenSource(ctx context.Context, path string) (*reloadingTokenSource, error) {
+	return newLoadedTokenSource(ctx, "credential file", path, func() ([]byte, error) {
+		all, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid json file %q: %v", path, err)
+		}
+		return all, nil
+	})
+}
+
+// newLoadedTokenSource returns a reloadingTokenSource for the credentials
+// returned by load, which are read from the credential file or secret name.
+func newLoadedTokenSource(ctx context.Context, kind, name string, load func() ([]byte, error)) (*reloadingTokenSource, error) {
+	all, err := load()
+	if err != nil {
+		return nil, err
+	}
+	src, err := tokenSourceFromJSON(ctx, kind, name, all)
+	if err != nil {
+		return nil, err
+	}
+	return &reloadingTokenSource{kind: kind, name: name, load: load, contents: all, src: src}, nil
+}
+
+// Token returns a token from the most recently loaded credentials.
+func (r *reloadingTokenSource) Token() (*oauth2.Token, error) {
+	r.mu.Lock()
+	src := r.src
+	r.mu.Unlock()
+	return src.Token()
+}
+
+// reload re-reads the credentials. If they cannot be read or parsed, an error
+// is logged and the previous credentials remain in use.
+func (r *reloadingTokenSource) reload(ctx context.Context) {
+	all, err := r.load()
+	if err != nil {
+		logging.Errorf("WARNING: Failed to reload credentials, continuing with previous credentials: %v", err)
+		return
+	}
+	r.mu.Lock()
+	unchanged := bytes.Equal(all, r.contents)
+	r.mu.Unlock()
+	if unchanged {
+		return
+	}
+	src, err := tokenSourceFromJSON(ctx, r.kind, r.name, all)
+	if err != nil {
+		logging.Errorf("WARNING: Failed to reload credentials, continuing with previous credentials: %v", err)
+		return
+	}
+	r.mu.Lock()
+	r.contents, r.src = all, src
+	r.mu.Unlock()
+	logging.Infof("Reloaded credentials from %q", r.name)
+}
+
+// secretManagerEndpoint is the Secret Manager API endpoint. For overriding in
+// unittests.
+var secretManagerEndpoint = ""
+
+// newSecretTokenSource reads the credentials from the Secret Manager secret
+// version name, e.g. "projects/my-project/secrets/my-secret/versions/latest",
+// using cl. A name without a version refers to the latest version. The
+// credentials are kept in memory only.
+func newSecretTokenSource(ctx context.Context, name string, cl *http.Client) (*reloadingTokenSource, error) {
+	if !strings.HasPrefix(name, "projects/") || !strings.Contains(name, "/secrets/") {
+		return nil, fmt.Errorf("invalid secret %q: must be in the form projects/PROJECT/secrets/SECRET[/versions/VERSION]", name)
+	}
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	opts := []option.ClientOption{option.WithHTTPClient(cl)}
+	if secretManagerEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(secretManagerEndpoint))
+	}
+	svc, err := secretmanager.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newLoadedTokenSource(ctx, "secret", name, func() ([]byte, error) {
+		resp, err := svc.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't access secret %q: %v", name, err)
+		}
+		if resp.Payload == nil {
+			return nil, fmt.Errorf("secret %q has no payload", name)
+		}
+		all, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload in secret %q: %v", name, err)
+		}
+		return all, nil
+	})
+}
+
+// reloadCredentials re-reads the credential file or secret behind src, if
+// there is one.
+func reloadCredentials(ctx context.Context, src oauth2.TokenSource) {
+	switch s := src.(type) {
+	case *reloadingTokenSource:
+		s.reload(ctx)
+	case *impersonatedTokenSource:
+		reloadCredentials(ctx, s.base)
+	}
+}
+
+// watch reloads the credentials whenever the credential file changes, until
+// ctx is done. The file's directory is watched rather than the file itself so
+// that files replaced by a rename (as done by Kubernetes when updating a
+// mounted secret) continue to be followed.
+func (r *reloadingTokenSource) watch(ctx context.Context) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(filepath.Dir(r.name)); err != nil {
+		w.Close()
+		return err
+	}
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				// Events for other files in the directory are harmless:
+				// reload ignores them if the file's contents are unchanged.
+				r.reload(ctx)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logging.Errorf("Error watching credential file %q: %v", r.name, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// iamCredentialsEndpoint is the IAM Service Account Credentials API endpoint.
+// For overriding in unittests.
+var iamCredentialsEndpoint = ""
+
+// impersonatedTokenSource is a TokenSource of access tokens for a service
+// account, generated with the credentials of base.
+type impersonatedTokenSource struct {
+	base oauth2.TokenSource
+	oauth2.TokenSource
+}
+
+// newImpersonatedTokenSource returns a TokenSource of access tokens for the
+// last service account in chain, generated with the IAM Service Account
+// Credentials API using the credentials of base. As with gcloud's
+// --impersonate-service-account, any earlier service accounts in chain are
+// delegates: base must be allowed to create tokens for the first of them,
+// and each of them for the next.
+func newImpersonatedTokenSource(ctx context.Context, base oauth2.TokenSource, chain []string) (oauth2.TokenSource, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("no service account to impersonate")
+	}
+	for _, sa := range chain {
+		if !strings.Contains(sa, "@") {
+			return nil, fmt.Errorf("invalid service account %q: must be an email address", sa)
+		}
+	}
+	opts := []option.ClientOption{option.WithHTTPClient(oauth2.NewClient(ctx, base))}
+	if iamCredentialsEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(iamCredentialsEndpoint))
+	}
+	svc, err := iamcredentials.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	target := chain[len(chain)-1]
+	var delegates []string
+	for _, sa := range chain[:len(chain)-1] {
+		delegates = append(delegates, "projects/-/serviceAccounts/"+sa)
+	}
+	logging.Infof("impersonating service account %s for authentication", target)
+	gen := tokenSourceFunc(func() (*oauth2.Token, error) {
+		resp, err := svc.Projects.ServiceAccounts.GenerateAccessToken("projects/-/serviceAccounts/"+target, &iamcredentials.GenerateAccessTokenRequest{
+			Delegates: delegates,
+			Scope:     credentialScopes(),
+		}).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't impersonate service account %s: %v", target, err)
+		}
+		exp, err := time.Parse(time.RFC3339, resp.ExpireTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry of token for service account %s: %v", target, err)
+		}
+		return &oauth2.Token{AccessToken: resp.AccessToken, TokenType: "Bearer", Expiry: exp}, nil
+	})
+	return &impersonatedTokenSource{base: base, TokenSource: oauth2.ReuseTokenSource(nil, gen)}, nil
+}
+
+// tokenSourceFunc is a function implementing oauth2.TokenSource.
+type tokenSourceFunc func() (*oauth2.Token, error)
+
+func (f tokenSourceFunc) Token() (*oauth2.Token, error) {
+	return f()
+}
@@ -0,0 +1,327 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+func userCredentials(id string) []byte {
+	return []byte(fmt.Sprintf(`{
+  "type": "authorized_user",
+  "client_id": %q,
+  "client_secret": "secret",
+  "refresh_token": "refresh"
+}`, id))
+}
+
+func writeCredentials(t *testing.T, path string, contents []byte) {
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func currentSource(r *reloadingTokenSource) oauth2.TokenSource {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.src
+}
+
+func TestReloadingTokenSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key.json")
+	writeCredentials(t, path, userCredentials("first"))
+
+	ctx := context.Background()
+	r, err := newReloadingTokenSource(ctx, path)
+	if err != nil {
+		t.Fatalf("newReloadingTokenSource: %v", err)
+	}
+	first := currentSource(r)
+
+	r.reload(ctx)
+	if currentSource(r) != first {
+		t.Fatal("reload replaced the credentials although the file was unchanged")
+	}
+
+	writeCredentials(t, path, []byte("not json"))
+	r.reload(ctx)
+	if currentSource(r) != first {
+		t.Fatal("reload replaced the credentials with an invalid file")
+	}
+
+	writeCredentials(t, path, userCredentials("second"))
+	r.reload(ctx)
+	if currentSource(r) == first {
+		t.Fatal("reload did not pick up the new credentials")
+	}
+}
+
+func TestReloadingTokenSourceWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key.json")
+	writeCredentials(t, path, userCredentials("first"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, err := newReloadingTokenSource(ctx, path)
+	if err != nil {
+		t.Fatalf("newReloadingTokenSource: %v", err)
+	}
+	first := currentSource(r)
+	if err := r.watch(ctx); err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	// Replace the file by renaming over it, as secret managers commonly do.
+	tmp := filepath.Join(dir, "key.json.tmp")
+	writeCredentials(t, tmp, userCredentials("second"))
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for currentSource(r) == first {
+		if time.Now().After(deadline) {
+			t.Fatal("credentials were not reloaded after the file changed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestExternalAccountCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// exchanges counts the token exchanges made with the fake Security Token
+	// Service.
+	var exchanges int32
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("STS request: %v", err)
+		}
+		if got := r.Form.Get("subject_token"); got != "external-token" {
+			t.Errorf("STS request subject_token = %q, want %q", got, "external-token")
+		}
+		atomic.AddInt32(&exchanges, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{
+  "access_token": "federated-token",
+  "issued_token_type": "urn:ietf:params:oauth:token-type:access_token",
+  "token_type": "Bearer",
+  "expires_in": 3600
+}`)
+	}))
+	defer sts.Close()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&exchanges) == 0 {
+			t.Error("API called before the token exchange")
+		}
+		if got, want := r.Header.Get("Authorization"), "Bearer federated-token"; got != want {
+			t.Errorf("API request Authorization = %q, want %q", got, want)
+		}
+	}))
+	defer api.Close()
+
+	subject := filepath.Join(dir, "subject-token")
+	writeCredentials(t, subject, []byte("external-token"))
+	path := filepath.Join(dir, "external.json")
+	writeCredentials(t, path, []byte(fmt.Sprintf(`{
+  "type": "external_account",
+  "audience": "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/provider",
+  "subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+  "token_url": %q,
+  "credential_source": {"file": %q}
+}`, sts.URL, subject)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, _, err := authenticatedClientFromPath(ctx, path)
+	if err != nil {
+		t.Fatalf("authenticatedClientFromPath: %v", err)
+	}
+	resp, err := client.Get(api.URL)
+	if err != nil {
+		t.Fatalf("API request failed: %v", err)
+	}
+	resp.Body.Close()
+	if got := atomic.LoadInt32(&exchanges); got != 1 {
+		t.Errorf("got %d token exchanges, want 1", got)
+	}
+}
+
+func TestSecretTokenSource(t *testing.T) {
+	// secret is the current payload of the fake secret; an empty payload
+	// makes the fake API fail.
+	var secret atomic.Value
+	secret.Store(userCredentials("first"))
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if want := "/v1/projects/p/secrets/s/versions/latest:access"; r.URL.Path != want {
+			t.Errorf("API request path = %q, want %q", r.URL.Path, want)
+		}
+		payload := secret.Load().([]byte)
+		if len(payload) == 0 {
+			http.Error(w, `{"error": {"code": 403, "message": "denied"}}`, http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"name": "projects/p/secrets/s/versions/1", "payload": {"data": %q}}`, base64.StdEncoding.EncodeToString(payload))
+	}))
+	defer api.Close()
+	oldEndpoint := secretManagerEndpoint
+	secretManagerEndpoint = api.URL + "/"
+	defer func() { secretManagerEndpoint = oldEndpoint }()
+
+	ctx := context.Background()
+	if _, err := newSecretTokenSource(ctx, "my-secret", http.DefaultClient); err == nil {
+		t.Error("newSecretTokenSource succeeded with an invalid secret name")
+	}
+	r, err := newSecretTokenSource(ctx, "projects/p/secrets/s", http.DefaultClient)
+	if err != nil {
+		t.Fatalf("newSecretTokenSource: %v", err)
+	}
+	first := currentSource(r)
+
+	secret.Store([]byte(nil))
+	r.reload(ctx)
+	if currentSource(r) != first {
+		t.Fatal("reload replaced the credentials although the secret could not be read")
+	}
+
+	secret.Store(userCredentials("second"))
+	r.reload(ctx)
+	if currentSource(r) == first {
+		t.Fatal("reload did not pick up the new credentials")
+	}
+}
+
+func TestLogTokenInfo(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("tokeninfo request method = %v, want POST", r.Method)
+		}
+		if r.URL.RawQuery != "" {
+			t.Errorf("tokeninfo request has query %q; the token must not be in the URL", r.URL.RawQuery)
+		}
+		if tok := r.PostFormValue("access_token"); tok != "good" {
+			http.Error(w, `{"error": "invalid_token", "error_description": "Invalid Value"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"email": "sa@p.iam.gserviceaccount.com", "exp": "1633089600", "scope": "https://www.googleapis.com/auth/sqlservice.admin"}`)
+	}))
+	defer api.Close()
+	oldURL := tokenInfoURL
+	tokenInfoURL = api.URL
+	defer func() { tokenInfoURL = oldURL }()
+
+	ctx := context.Background()
+	if err := logTokenInfo(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "good"})); err != nil {
+		t.Errorf("logTokenInfo with a valid token: %v", err)
+	}
+	if err := logTokenInfo(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "expired"})); err == nil {
+		t.Error("logTokenInfo succeeded with a token tokeninfo rejects")
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	scopes := "openid https://www.googleapis.com/auth/cloud-platform"
+	if !hasScope(scopes, cloudPlatformScope) {
+		t.Errorf("hasScope(%q, %q) = false, want true", scopes, cloudPlatformScope)
+	}
+	if hasScope(scopes, "https://www.googleapis.com/auth/cloud") {
+		t.Errorf("hasScope(%q) matched a prefix of a scope", scopes)
+	}
+}
+
+func TestImpersonatedTokenSource(t *testing.T) {
+	var calls int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if want := "/v1/projects/-/serviceAccounts/target@p.iam.gserviceaccount.com:generateAccessToken"; r.URL.Path != want {
+			t.Errorf("API request path = %q, want %q", r.URL.Path, want)
+		}
+		if got, want := r.Header.Get("Authorization"), "Bearer base"; got != want {
+			t.Errorf("Authorization = %q, want %q", got, want)
+		}
+		var req struct {
+			Delegates []string `json:"delegates"`
+			Scope     []string `json:"scope"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("couldn't decode request: %v", err)
+		}
+		if want := []string{"projects/-/serviceAccounts/delegate@p.iam.gserviceaccount.com"}; !reflect.DeepEqual(req.Delegates, want) {
+			t.Errorf("delegates = %q, want %q", req.Delegates, want)
+		}
+		if !reflect.DeepEqual(req.Scope, credentialScopes()) {
+			t.Errorf("scope = %q, want %q", req.Scope, credentialScopes())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"accessToken": "impersonated", "expireTime": %q}`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer api.Close()
+	oldEndpoint := iamCredentialsEndpoint
+	iamCredentialsEndpoint = api.URL + "/"
+	defer func() { iamCredentialsEndpoint = oldEndpoint }()
+
+	ctx := context.Background()
+	base := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "base"})
+	if _, err := newImpersonatedTokenSource(ctx, base, []string{"not-an-email"}); err == nil {
+		t.Error("newImpersonatedTokenSource succeeded with an invalid service account")
+	}
+	src, err := newImpersonatedTokenSource(ctx, base, []string{"delegate@p.iam.gserviceaccount.com", "target@p.iam.gserviceaccount.com"})
+	if err != nil {
+		t.Fatalf("newImpersonatedTokenSource: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		tok, err := src.Token()
+		if err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+		if tok.AccessToken != "impersonated" {
+			t.Errorf("Token() = %q, want the impersonated token", tok.AccessToken)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("generated %d tokens, want 1 reused until it expires", n)
+	}
+}
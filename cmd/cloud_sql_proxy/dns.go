@@ -0,0 +1,75 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file contains code for discovering instances from DNS TXT records.
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// lookupTXT is replaced in tests.
+var lookupTXT = net.LookupTXT
+
+// lookupDNSInstances returns the instances listed in the TXT records of name
+// as a sorted, comma-separated list. Each record holds an instance, or a
+// comma-separated list of them, in the same form as -instances.
+func lookupDNSInstances(name string) (string, error) {
+	records, err := lookupTXT(name)
+	if err != nil {
+		return "", err
+	}
+	seen := make(map[string]bool)
+	var instances []string
+	for _, r := range records {
+		for _, inst := range strings.Split(r, ",") {
+			inst = strings.TrimSpace(inst)
+			if inst == "" || seen[inst] {
+				continue
+			}
+			seen[inst] = true
+			instances = append(instances, inst)
+		}
+	}
+	if len(instances) == 0 {
+		return "", errors.New("no instances found in TXT records of " + name)
+	}
+	sort.Strings(instances)
+	return strings.Join(instances, ","), nil
+}
+
+// watchDNSInstances looks up the instances listed by name every interval and
+// sends them to updates whenever they change. Failed lookups are logged and
+// leave the current instances in place.
+func watchDNSInstances(name string, interval time.Duration, updates chan<- string) {
+	var last string
+	for {
+		instances, err := lookupDNSInstances(name)
+		if err != nil {
+			logging.Errorf("Error on looking up instances from DNS: %v", err)
+		} else if instances != last {
+			logging.Infof("Instances listed in DNS for %v: %v", name, instances)
+			updates <- instances
+			last = instances
+		}
+		time.Sleep(interval)
+	}
+}
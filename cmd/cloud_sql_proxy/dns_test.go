@@ -0,0 +1,79 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLookupDNSInstances(t *testing.T) {
+	defer func(old func(string) ([]string, error)) { lookupTXT = old }(lookupTXT)
+
+	for _, v := range []struct {
+		desc    string
+		records []string
+		err     error
+		want    string
+		wantErr bool
+	}{
+		{
+			desc:    "one instance",
+			records: []string{"proj:reg:db"},
+			want:    "proj:reg:db",
+		},
+		{
+			desc:    "a record per instance",
+			records: []string{"proj:reg:db2=tcp:5433", "proj:reg:db1=tcp:5432"},
+			want:    "proj:reg:db1=tcp:5432,proj:reg:db2=tcp:5433",
+		},
+		{
+			desc:    "lists and duplicates",
+			records: []string{"proj:reg:b, proj:reg:a", "proj:reg:a,,"},
+			want:    "proj:reg:a,proj:reg:b",
+		},
+		{
+			desc:    "no instances",
+			records: []string{"", " , "},
+			wantErr: true,
+		},
+		{
+			desc:    "lookup failure",
+			err:     errors.New("no such host"),
+			wantErr: true,
+		},
+	} {
+		lookupTXT = func(name string) ([]string, error) {
+			if name != "db.example.com" {
+				t.Errorf("%s: looked up %q, want db.example.com", v.desc, name)
+			}
+			return v.records, v.err
+		}
+		got, err := lookupDNSInstances("db.example.com")
+		if v.wantErr {
+			if err == nil {
+				t.Errorf("%s: lookupDNSInstances succeeded with %q, want error", v.desc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: lookupDNSInstances: %v", v.desc, err)
+			continue
+		}
+		if got != v.want {
+			t.Errorf("%s: lookupDNSInstances = %q, want %q", v.desc, got, v.want)
+		}
+	}
+}
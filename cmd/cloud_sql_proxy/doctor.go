@@ -0,0 +1,339 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file contains code for the doctor subcommand, which checks that the
+// proxy is able to run without starting it.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/cmd/cloud_sql_proxy/internal/version"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/certs"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/limits"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/util"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+// latestReleaseURL describes the latest release of the proxy. It is replaced
+// in tests.
+var latestReleaseURL = "https://api.github.com/repos/GoogleCloudPlatform/cloudsql-proxy/releases/latest"
+
+// doctorDialTimeout bounds each attempt to reach an instance.
+const doctorDialTimeout = 5 * time.Second
+
+// doctorCheck is one of the checks made by the doctor subcommand.
+type doctorCheck struct {
+	name string
+	// run makes the check, returning a description of what was found if it
+	// passes.
+	run func() (string, error)
+	// fix suggests how to make a failed check pass.
+	fix string
+}
+
+// runChecks makes each check in turn and writes its outcome to w. It reports
+// whether every check passed.
+func runChecks(w io.Writer, checks []doctorCheck) bool {
+	failed := 0
+	for _, c := range checks {
+		detail, err := c.run()
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "✗ %s: %v\n", c.name, err)
+			if c.fix != "" {
+				fmt.Fprintf(w, "    %s\n", c.fix)
+			}
+			continue
+		}
+		fmt.Fprintf(w, "✓ %s: %s\n", c.name, detail)
+	}
+	if failed > 0 {
+		fmt.Fprintf(w, "\n%d of %d checks failed.\n", failed, len(checks))
+		return false
+	}
+	fmt.Fprintf(w, "\nAll %d checks passed.\n", len(checks))
+	return true
+}
+
+// runDoctor checks the proxy's credentials, its access to the Admin API, each
+// instance given by -instances or -config, its file descriptor limit and its
+// version. It returns the exit status of the doctor subcommand.
+func runDoctor() int {
+	fileInstances, err := applyConfigFile()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if err := configureDNS(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if envInstances := os.Getenv("INSTANCES"); *instances == "" && envInstances != "" {
+		*instances = envInstances
+	}
+	instList := stringList(*instances)
+	for _, inst := range fileInstances {
+		instList = append(instList, inst.Arg())
+	}
+
+	ctx := context.Background()
+	var (
+		client *http.Client
+		tokSrc oauth2.TokenSource
+	)
+	checks := []doctorCheck{{
+		name: "credentials",
+		run: func() (string, error) {
+			var err error
+			if client, tokSrc, err = authenticatedClient(ctx); err != nil {
+				return "", err
+			}
+			if *impersonateServiceAccount != "" {
+				if tokSrc, err = newImpersonatedTokenSource(ctx, tokSrc, stringList(*impersonateServiceAccount)); err != nil {
+					return "", err
+				}
+				client = oauth2.NewClient(ctx, tokSrc)
+			}
+			return checkToken(tokSrc)
+		},
+		fix: "Run `gcloud auth application-default login`, or pass a service account key with -credential_file.",
+	}}
+	if !runChecks(os.Stdout, checks) {
+		// Without credentials, the remaining checks can't be made.
+		return 1
+	}
+	fmt.Println()
+
+	checks = []doctorCheck{{
+		name: "Cloud SQL Admin API",
+		run: func() (string, error) {
+			sql, err := newAdminService(client)
+			if err != nil {
+				return "", err
+			}
+			if _, err := sql.Flags.List().Context(ctx).Do(); err != nil {
+				return "", err
+			}
+			return "reachable at " + sql.BasePath, nil
+		},
+		fix: "Enable the Cloud SQL Admin API for the project, and allow connections to sqladmin.googleapis.com:443.",
+	}}
+	for _, inst := range instList {
+		checks = append(checks, instanceChecks(ctx, inst, client, tokSrc)...)
+	}
+	checks = append(checks, doctorCheck{
+		name: "file descriptor limit",
+		run: func() (string, error) {
+			want := *fdRlimit
+			if want == 0 {
+				want = limits.ExpectedFDs
+			}
+			if err := limits.SetupFDLimits(want); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("able to open %d file descriptors", want), nil
+		},
+		fix: "Raise the hard limit on open files, e.g. with `ulimit -Hn`, or lower -fd_rlimit.",
+	}, doctorCheck{
+		name: "version",
+		run: func() (string, error) {
+			return checkVersion(http.DefaultClient, version.Version)
+		},
+		fix: "Download the latest release from https://github.com/GoogleCloudPlatform/cloudsql-proxy/releases.",
+	})
+	if !runChecks(os.Stdout, checks) {
+		return 1
+	}
+	return 0
+}
+
+// instanceChecks returns the checks that inst, a value of the -instances
+// flag, exists, is running and can be reached.
+func instanceChecks(ctx context.Context, inst string, client *http.Client, tokSrc oauth2.TokenSource) []doctorCheck {
+	name, path, sa := instanceCredentials(inst)
+	c, err := canonicalInstance(inst)
+	if err == nil {
+		_, _, n := util.SplitName(name)
+		if n == "" {
+			err = fmt.Errorf("%q is not in the form `project:region:instance-name`", name)
+		}
+	}
+	if err == nil && (path != "" || sa != "") {
+		if path != "" {
+			client, tokSrc, err = authenticatedClientFromPath(ctx, path)
+		}
+		if err == nil && sa != "" {
+			if tokSrc, err = newImpersonatedTokenSource(ctx, tokSrc, []string{sa}); err == nil {
+				client = oauth2.NewClient(ctx, tokSrc)
+			}
+		}
+	}
+	if err != nil {
+		return []doctorCheck{{
+			name: "instance " + name,
+			run:  func() (string, error) { return "", err },
+			fix:  "Correct the instance's entry in -instances or -config.",
+		}}
+	}
+
+	ipTypes := ipAddrTypes()
+	for _, arg := range strings.Split(c, "=")[1:] {
+		opts := strings.SplitN(arg, ":", 2)
+		if len(opts) != 2 {
+			continue
+		}
+		switch {
+		case opts[0] == "psc" && opts[1] == "true":
+			ipTypes = []string{certs.PSCIPAddrType}
+		case opts[0] == "ip":
+			ipTypes = []string{strings.ToUpper(opts[1])}
+		}
+	}
+
+	var running bool
+	return []doctorCheck{{
+		name: "instance " + name,
+		run: func() (string, error) {
+			sql, err := newAdminService(client)
+			if err != nil {
+				return "", err
+			}
+			proj, region, n := util.SplitName(name)
+			data, err := sql.Instances.Get(proj, region+"~"+n).Context(ctx).Do()
+			if err != nil {
+				return "", err
+			}
+			if data.State != "RUNNABLE" {
+				return "", fmt.Errorf("instance is %v, want RUNNABLE", data.State)
+			}
+			running = true
+			return fmt.Sprintf("%v instance is RUNNABLE", data.DatabaseVersion), nil
+		},
+		fix: "Check the instance connection name, that the account has the Cloud SQL Client role, and that the instance is started.",
+	}, {
+		name: "connectivity to " + name,
+		run: func() (string, error) {
+			if !running {
+				return "", errors.New("skipped because the instance could not be found or is not running")
+			}
+			src := certs.NewCertSourceOpts(client, certs.RemoteOpts{
+				APIBasePath:    *host,
+				IgnoreRegion:   !*checkRegion,
+				UserAgent:      userAgentFromVersionString(),
+				IPAddrTypeOpts: ipTypes,
+				TokenSource:    tokSrc,
+			})
+			_, addr, _, _, err := src.Remote(name)
+			if err != nil {
+				return "", err
+			}
+			hostport := net.JoinHostPort(addr, "3307")
+			conn, err := net.DialTimeout("tcp", hostport, doctorDialTimeout)
+			if err != nil {
+				return "", err
+			}
+			conn.Close()
+			return "reached " + hostport, nil
+		},
+		fix: "Allow outbound connections to port 3307, and for a private IP, run in the instance's VPC network.",
+	}}
+}
+
+// newAdminService returns a client of the Admin API which honors -host.
+func newAdminService(cl *http.Client) (*sqladmin.Service, error) {
+	sql, err := sqladmin.New(cl)
+	if err != nil {
+		return nil, err
+	}
+	if *host != "" {
+		sql.BasePath = *host
+	}
+	return sql, nil
+}
+
+// checkToken reports when the access token from src expires, or an error if
+// src can't provide a valid one.
+func checkToken(src oauth2.TokenSource) (string, error) {
+	tok, err := src.Token()
+	if err != nil {
+		return "", err
+	}
+	if !tok.Valid() {
+		return "", errors.New("the access token has expired")
+	}
+	if tok.Expiry.IsZero() {
+		return "obtained an access token", nil
+	}
+	return "obtained an access token valid until " + tok.Expiry.UTC().Format(time.RFC3339), nil
+}
+
+// checkVersion compares current with the version of the latest release.
+func checkVersion(cl *http.Client, current string) (string, error) {
+	resp, err := cl.Get(latestReleaseURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("couldn't find the latest release: %v", resp.Status)
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", fmt.Errorf("couldn't find the latest release: %v", err)
+	}
+	latest := strings.TrimPrefix(release.TagName, "v")
+	if olderVersion(current, latest) {
+		return "", fmt.Errorf("version %v is older than the latest release, %v", current, latest)
+	}
+	return fmt.Sprintf("version %v is up to date", current), nil
+}
+
+// olderVersion reports whether version a, e.g. "1.23.1-dev", precedes version
+// b. Pre-release and build suffixes are ignored, so that a development build
+// is up to date with the release it leads to.
+func olderVersion(a, b string) bool {
+	parse := func(v string) [3]int {
+		var n [3]int
+		if i := strings.IndexAny(v, "-+"); i >= 0 {
+			v = v[:i]
+		}
+		for i, p := range strings.SplitN(v, ".", 3) {
+			n[i], _ = strconv.Atoi(p)
+		}
+		return n
+	}
+	va, vb := parse(a), parse(b)
+	for i := range va {
+		if va[i] != vb[i] {
+			return va[i] < vb[i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestRunChecks(t *testing.T) {
+	pass := doctorCheck{
+		name: "good",
+		run:  func() (string, error) { return "looks fine", nil },
+		fix:  "not shown",
+	}
+	fail := doctorCheck{
+		name: "bad",
+		run:  func() (string, error) { return "", errors.New("broken") },
+		fix:  "Repair it.",
+	}
+
+	var buf bytes.Buffer
+	if !runChecks(&buf, []doctorCheck{pass}) {
+		t.Errorf("runChecks reported a failure for a passing check")
+	}
+	if want := "✓ good: looks fine\n\nAll 1 checks passed.\n"; buf.String() != want {
+		t.Errorf("runChecks wrote %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	if runChecks(&buf, []doctorCheck{pass, fail}) {
+		t.Errorf("runChecks reported success with a failing check")
+	}
+	if want := "✓ good: looks fine\n✗ bad: broken\n    Repair it.\n\n1 of 2 checks failed.\n"; buf.String() != want {
+		t.Errorf("runChecks wrote %q, want %q", buf.String(), want)
+	}
+}
+
+func TestOlderVersion(t *testing.T) {
+	for _, v := range []struct {
+		a, b string
+		want bool
+	}{
+		{"1.23.0", "1.23.1", true},
+		{"1.9.0", "1.23.0", true},
+		{"1.23.1", "1.23.1", false},
+		{"1.23.1-dev", "1.23.1", false},
+		{"1.23.1+container", "1.23.0", false},
+		{"2.0.0", "1.99.9", false},
+	} {
+		if got := olderVersion(v.a, v.b); got != v.want {
+			t.Errorf("olderVersion(%q, %q) = %v, want %v", v.a, v.b, got, v.want)
+		}
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	defer func(old string) { latestReleaseURL = old }(latestReleaseURL)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"tag_name": "v1.24.0"}`)
+	}))
+	defer srv.Close()
+	latestReleaseURL = srv.URL
+
+	if _, err := checkVersion(srv.Client(), "1.24.0"); err != nil {
+		t.Errorf("checkVersion of the latest release: %v", err)
+	}
+	if _, err := checkVersion(srv.Client(), "1.23.1"); err == nil {
+		t.Errorf("checkVersion of an old release succeeded, want error")
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	valid := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "tok", Expiry: time.Now().Add(time.Hour)})
+	if _, err := checkToken(valid); err != nil {
+		t.Errorf("checkToken of a valid token: %v", err)
+	}
+	expired := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "tok", Expiry: time.Now().Add(-time.Hour)})
+	if _, err := checkToken(expired); err == nil {
+		t.Errorf("checkToken of an expired token succeeded, want error")
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !goexperiment.boringcrypto
+// +build !goexperiment.boringcrypto
+
+package main
+
+// fipsBuild is true if the proxy was built with GOEXPERIMENT=boringcrypto.
+const fipsBuild = false
+
+// fipsEnabled reports whether cryptographic operations are performed by the
+// FIPS 140-2 validated BoringCrypto module. It is always false unless the
+// proxy is built with `make fips`.
+func fipsEnabled() bool {
+	return false
+}
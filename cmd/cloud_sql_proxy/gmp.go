@@ -0,0 +1,276 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file contains code for having Google Cloud Managed Service for
+// Prometheus scrape the proxy's metrics on GKE, by creating a PodMonitoring
+// resource through the Kubernetes API.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// gmpScrapeInterval is how often Managed Service for Prometheus scrapes the
+// proxy's metrics.
+const gmpScrapeInterval = "30s"
+
+var (
+	// kubernetesServiceAccountDir holds the credentials Kubernetes mounts
+	// into each pod. It is replaced in tests.
+	kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// kubernetesAPIServer is the base URL of the Kubernetes API. If empty,
+	// it is built from KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT.
+	// It is replaced in tests.
+	kubernetesAPIServer = ""
+)
+
+// perPodLabels are labels which differ between the pods of a workload, and
+// so are left out of the PodMonitoring's selector.
+var perPodLabels = map[string]bool{
+	"pod-template-hash":                  true,
+	"controller-revision-hash":           true,
+	"pod-template-generation":            true,
+	"statefulset.kubernetes.io/pod-name": true,
+}
+
+// kubeClient makes requests to the Kubernetes API with the pod's service
+// account.
+type kubeClient struct {
+	base      string
+	token     string
+	namespace string
+	cl        *http.Client
+}
+
+func newKubeClient() (*kubeClient, error) {
+	dir := kubernetesServiceAccountDir
+	token, err := ioutil.ReadFile(filepath.Join(dir, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("no Kubernetes service account token: %v", err)
+	}
+	ns, err := ioutil.ReadFile(filepath.Join(dir, "namespace"))
+	if err != nil {
+		return nil, fmt.Errorf("no Kubernetes namespace: %v", err)
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("no Kubernetes CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid Kubernetes CA certificate")
+	}
+	base := kubernetesAPIServer
+	if base == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+		}
+		base = "https://" + net.JoinHostPort(host, port)
+	}
+	return &kubeClient{
+		base:      base,
+		token:     strings.TrimSpace(string(token)),
+		namespace: strings.TrimSpace(string(ns)),
+		cl: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+			Timeout:   30 * time.Second,
+		},
+	}, nil
+}
+
+// do sends in, if not nil, as JSON to path, and decodes the response into
+// out, if not nil. It returns the response's status code, if any.
+func (k *kubeClient) do(method, path string, in, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, k.base+path, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := k.cl.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// The following types hold the fields of Kubernetes objects used here.
+
+type ownerReference struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	UID        string `json:"uid"`
+	Controller *bool  `json:"controller,omitempty"`
+}
+
+type objectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	OwnerReferences []ownerReference  `json:"ownerReferences,omitempty"`
+}
+
+type kubePod struct {
+	Metadata objectMeta `json:"metadata"`
+}
+
+type podMonitoring struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   objectMeta        `json:"metadata"`
+	Spec       podMonitoringSpec `json:"spec"`
+}
+
+type podMonitoringSpec struct {
+	Selector  labelSelector    `json:"selector"`
+	Endpoints []scrapeEndpoint `json:"endpoints"`
+}
+
+type labelSelector struct {
+	MatchLabels map[string]string `json:"matchLabels"`
+}
+
+type scrapeEndpoint struct {
+	Port     int    `json:"port"`
+	Path     string `json:"path"`
+	Interval string `json:"interval"`
+}
+
+// podName returns the name of the pod the proxy runs in: POD_NAME if set,
+// e.g. through the Downward API, and otherwise the hostname, which
+// Kubernetes sets to the pod's name.
+func podName() (string, error) {
+	if n := os.Getenv("POD_NAME"); n != "" {
+		return n, nil
+	}
+	return os.Hostname()
+}
+
+// newPodMonitoring returns a PodMonitoring which scrapes port of the pods of
+// p's workload: those with the same labels as p, other than perPodLabels. It
+// is named after its selector, so that every pod of a workload describes the
+// same PodMonitoring, and is owned by p's controller, e.g. its ReplicaSet, so
+// that it is deleted along with the workload.
+func newPodMonitoring(p kubePod, port int) (podMonitoring, error) {
+	sel := make(map[string]string)
+	var keys []string
+	for k, v := range p.Metadata.Labels {
+		if !perPodLabels[k] {
+			sel[k] = v
+			keys = append(keys, k)
+		}
+	}
+	if len(sel) == 0 {
+		return podMonitoring{}, fmt.Errorf("pod %v has no labels to select it by", p.Metadata.Name)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\n", k, sel[k])
+	}
+
+	pm := podMonitoring{
+		APIVersion: "monitoring.googleapis.com/v1",
+		Kind:       "PodMonitoring",
+		Metadata: objectMeta{
+			Name:   "cloud-sql-proxy-" + hex.EncodeToString(h.Sum(nil))[:10],
+			Labels: map[string]string{"app.kubernetes.io/managed-by": "cloud-sql-proxy"},
+		},
+		Spec: podMonitoringSpec{
+			Selector:  labelSelector{MatchLabels: sel},
+			Endpoints: []scrapeEndpoint{{Port: port, Path: "/metrics", Interval: gmpScrapeInterval}},
+		},
+	}
+	for _, o := range p.Metadata.OwnerReferences {
+		if o.Controller != nil && *o.Controller {
+			o.Controller = nil
+			pm.Metadata.OwnerReferences = []ownerReference{o}
+		}
+	}
+	return pm, nil
+}
+
+// exportToGMP creates a PodMonitoring so that Managed Service for Prometheus
+// scrapes the metrics served on port by the pods of the proxy's workload. A
+// PodMonitoring already created by another of the pods is left in place.
+func exportToGMP(port int) error {
+	name, err := podName()
+	if err != nil {
+		return err
+	}
+	k, err := newKubeClient()
+	if err != nil {
+		return err
+	}
+	var p kubePod
+	if _, err := k.do("GET", "/api/v1/namespaces/"+k.namespace+"/pods/"+name, nil, &p); err != nil {
+		return err
+	}
+	pm, err := newPodMonitoring(p, port)
+	if err != nil {
+		return err
+	}
+	pm.Metadata.Namespace = k.namespace
+	code, err := k.do("POST", "/apis/monitoring.googleapis.com/v1/namespaces/"+k.namespace+"/podmonitorings", pm, nil)
+	if code == http.StatusConflict {
+		logging.Infof("PodMonitoring %v/%v already exists; Managed Service for Prometheus scrapes the proxy's metrics", k.namespace, pm.Metadata.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logging.Infof("Created PodMonitoring %v/%v so that Managed Service for Prometheus scrapes the proxy's metrics", k.namespace, pm.Metadata.Name)
+	return nil
+}
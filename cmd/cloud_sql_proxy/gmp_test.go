@@ -0,0 +1,109 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExportToGMP(t *testing.T) {
+	var created []podMonitoring
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer secret-token" {
+			t.Errorf("Authorization = %q, want the service account token", got)
+		}
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/v1/namespaces/prod/pods/web-5d4f-abcde":
+			w.Write([]byte(`{"metadata": {
+				"name": "web-5d4f-abcde",
+				"labels": {"app": "web", "pod-template-hash": "5d4f"},
+				"ownerReferences": [{"apiVersion": "apps/v1", "kind": "ReplicaSet", "name": "web-5d4f", "uid": "1234", "controller": true}]
+			}}`))
+		case r.Method == "POST" && r.URL.Path == "/apis/monitoring.googleapis.com/v1/namespaces/prod/podmonitorings":
+			var pm podMonitoring
+			if err := json.NewDecoder(r.Body).Decode(&pm); err != nil {
+				t.Errorf("invalid PodMonitoring: %v", err)
+			}
+			if len(created) > 0 {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			created = append(created, pm)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			t.Errorf("unexpected request %v %v", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "serviceaccount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	for name, content := range map[string][]byte{"token": []byte("secret-token\n"), "namespace": []byte("prod"), "ca.crt": ca} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(dir, api string) {
+		kubernetesServiceAccountDir, kubernetesAPIServer = dir, api
+	}(kubernetesServiceAccountDir, kubernetesAPIServer)
+	kubernetesServiceAccountDir, kubernetesAPIServer = dir, ts.URL
+	defer os.Unsetenv("POD_NAME")
+	os.Setenv("POD_NAME", "web-5d4f-abcde")
+
+	if err := exportToGMP(9090); err != nil {
+		t.Fatalf("exportToGMP: %v", err)
+	}
+	if len(created) != 1 {
+		t.Fatalf("created %d PodMonitorings, want 1", len(created))
+	}
+	pm := created[0]
+	if want := map[string]string{"app": "web"}; !reflect.DeepEqual(pm.Spec.Selector.MatchLabels, want) {
+		t.Errorf("selector = %v, want %v", pm.Spec.Selector.MatchLabels, want)
+	}
+	if want := []scrapeEndpoint{{Port: 9090, Path: "/metrics", Interval: gmpScrapeInterval}}; !reflect.DeepEqual(pm.Spec.Endpoints, want) {
+		t.Errorf("endpoints = %+v, want %+v", pm.Spec.Endpoints, want)
+	}
+	if len(pm.Metadata.OwnerReferences) != 1 || pm.Metadata.OwnerReferences[0].Name != "web-5d4f" {
+		t.Errorf("owner references = %+v, want the pod's ReplicaSet", pm.Metadata.OwnerReferences)
+	}
+	if pm.Metadata.Namespace != "prod" {
+		t.Errorf("namespace = %q, want prod", pm.Metadata.Namespace)
+	}
+
+	// Another pod of the workload finds the PodMonitoring already exists.
+	if err := exportToGMP(9090); err != nil {
+		t.Errorf("exportToGMP with an existing PodMonitoring: %v", err)
+	}
+}
+
+func TestNewPodMonitoringWithoutLabels(t *testing.T) {
+	p := kubePod{Metadata: objectMeta{Name: "web", Labels: map[string]string{"pod-template-hash": "5d4f"}}}
+	if _, err := newPodMonitoring(p, 9090); err == nil {
+		t.Error("newPodMonitoring succeeded for a pod without workload labels, want error")
+	}
+}
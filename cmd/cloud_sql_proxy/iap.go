@@ -0,0 +1,256 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file contains code for connecting to instances through Cloud
+// Identity-Aware Proxy TCP forwarding, as set by -use_iap.
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"golang.org/x/oauth2"
+)
+
+// iapTunnelURL is the endpoint of IAP TCP forwarding tunnels. It is replaced
+// in tests.
+var iapTunnelURL = "wss://tunnel.cloudproxy.app/v4/connect"
+
+const (
+	// iapSubprotocol is the WebSocket subprotocol of IAP tunnels.
+	iapSubprotocol = "relay.tunnel.cloudproxy.app"
+	// iapOrigin is the origin IAP expects of tunnel clients.
+	iapOrigin = "bot:iap-tunneler"
+
+	// The tags introducing each message sent through a tunnel.
+	iapTagConnectSuccessSID = 0x0001
+	iapTagData              = 0x0004
+	iapTagAck               = 0x0007
+
+	// iapMaxDataFrame is the largest payload of a data message.
+	iapMaxDataFrame = 16384
+	// iapAckInterval is how many bytes are received before they are
+	// acknowledged.
+	iapAckInterval = 2 * iapMaxDataFrame
+)
+
+// iapDestGroupRegexp matches the -iap_dest_group flag.
+var iapDestGroupRegexp = regexp.MustCompile(`^projects/([^/]+)/regions/([^/]+)/destGroups/([^/]+)$`)
+
+// iapTarget is the tunnel destination group through which instances are
+// reached.
+type iapTarget struct {
+	project, region, network, group string
+}
+
+// parseIAPTarget parses -iap_dest_group, in the form
+// "projects/PROJECT/regions/REGION/destGroups/GROUP", for instances in the
+// named VPC network.
+func parseIAPTarget(destGroup, network string) (iapTarget, error) {
+	m := iapDestGroupRegexp.FindStringSubmatch(destGroup)
+	if m == nil {
+		return iapTarget{}, fmt.Errorf("destination group %q is not in the form projects/PROJECT/regions/REGION/destGroups/GROUP", destGroup)
+	}
+	return iapTarget{project: m[1], region: m[2], network: network, group: m[3]}, nil
+}
+
+// url returns the URL of a tunnel to addr, a host and port.
+func (t iapTarget) url(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"project":      {t.project},
+		"region":       {t.region},
+		"network":      {t.network},
+		"group":        {t.group},
+		"host":         {host},
+		"port":         {port},
+		"newWebsocket": {"true"},
+	}
+	return iapTunnelURL + "?" + q.Encode(), nil
+}
+
+// iapDialer returns a dial function which connects to addresses through an
+// IAP tunnel to t, authenticated with tokens from src.
+func iapDialer(t iapTarget, src oauth2.TokenSource) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		u, err := t.url(addr)
+		if err != nil {
+			return nil, err
+		}
+		tok, err := src.Token()
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := websocket.NewConfig(u, iapOrigin)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Protocol = []string{iapSubprotocol}
+		cfg.Header.Set("Authorization", "Bearer "+tok.AccessToken)
+		cfg.Header.Set("User-Agent", userAgentFromVersionString())
+		cfg.Dialer = &net.Dialer{}
+		deadline, hasDeadline := ctx.Deadline()
+		if hasDeadline {
+			cfg.Dialer.Deadline = deadline
+		}
+		ws, err := websocket.DialConfig(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("IAP tunnel to %v: %v", addr, err)
+		}
+		if hasDeadline {
+			ws.SetDeadline(deadline)
+		}
+		c := &iapConn{ws: ws}
+		if err := c.awaitConnected(); err != nil {
+			ws.Close()
+			return nil, fmt.Errorf("IAP tunnel to %v: %v", addr, err)
+		}
+		ws.SetDeadline(time.Time{})
+		if raddr, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+			c.raddr = raddr
+		}
+		return c, nil
+	}
+}
+
+// iapConn is a connection through an IAP tunnel. Data is exchanged in
+// messages, each introduced by a tag.
+type iapConn struct {
+	ws    *websocket.Conn
+	raddr net.Addr
+
+	// pending holds received data not yet returned by Read. received counts
+	// the bytes received, and acked those acknowledged. They are only
+	// accessed by Read.
+	pending  []byte
+	received uint64
+	acked    uint64
+
+	// sendL serializes the messages sent by Read and Write.
+	sendL sync.Mutex
+}
+
+// awaitConnected waits for the message confirming that the tunnel is
+// connected.
+func (c *iapConn) awaitConnected() error {
+	var msg []byte
+	if err := websocket.Message.Receive(c.ws, &msg); err != nil {
+		return err
+	}
+	if len(msg) < 2 || binary.BigEndian.Uint16(msg) != iapTagConnectSuccessSID {
+		return errors.New("unexpected first message from the tunnel")
+	}
+	return nil
+}
+
+func (c *iapConn) send(msg []byte) error {
+	c.sendL.Lock()
+	defer c.sendL.Unlock()
+	return websocket.Message.Send(c.ws, msg)
+}
+
+func (c *iapConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		var msg []byte
+		if err := websocket.Message.Receive(c.ws, &msg); err != nil {
+			return 0, err
+		}
+		if len(msg) < 2 {
+			return 0, errors.New("IAP tunnel sent a truncated message")
+		}
+		if binary.BigEndian.Uint16(msg) != iapTagData {
+			// Acknowledgements of the data sent need no action.
+			continue
+		}
+		if len(msg) < 6 || uint32(len(msg)-6) < binary.BigEndian.Uint32(msg[2:]) {
+			return 0, errors.New("IAP tunnel sent a truncated data message")
+		}
+		c.pending = msg[6 : 6+binary.BigEndian.Uint32(msg[2:])]
+		c.received += uint64(len(c.pending))
+		if c.received-c.acked >= iapAckInterval {
+			ack := make([]byte, 10)
+			binary.BigEndian.PutUint16(ack, iapTagAck)
+			binary.BigEndian.PutUint64(ack[2:], c.received)
+			if err := c.send(ack); err != nil {
+				return 0, err
+			}
+			c.acked = c.received
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *iapConn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		n := len(b)
+		if n > iapMaxDataFrame {
+			n = iapMaxDataFrame
+		}
+		msg := make([]byte, 6+n)
+		binary.BigEndian.PutUint16(msg, iapTagData)
+		binary.BigEndian.PutUint32(msg[2:], uint32(n))
+		copy(msg[6:], b[:n])
+		if err := c.send(msg); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *iapConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *iapConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+// RemoteAddr returns the address at the far end of the tunnel.
+func (c *iapConn) RemoteAddr() net.Addr {
+	if c.raddr != nil {
+		return c.raddr
+	}
+	return c.ws.RemoteAddr()
+}
+
+func (c *iapConn) SetDeadline(t time.Time) error {
+	return c.ws.SetDeadline(t)
+}
+
+func (c *iapConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *iapConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+var _ net.Conn = (*iapConn)(nil)
@@ -0,0 +1,143 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"golang.org/x/oauth2"
+)
+
+func TestParseIAPTarget(t *testing.T) {
+	got, err := parseIAPTarget("projects/proj/regions/us-central1/destGroups/sql", "default")
+	if err != nil {
+		t.Fatalf("parseIAPTarget: %v", err)
+	}
+	if want := (iapTarget{"proj", "us-central1", "default", "sql"}); got != want {
+		t.Errorf("parseIAPTarget = %+v, want %+v", got, want)
+	}
+	for _, bad := range []string{"", "proj/us-central1/sql", "projects/proj/regions/us-central1/destGroups/"} {
+		if _, err := parseIAPTarget(bad, "default"); err == nil {
+			t.Errorf("parseIAPTarget(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+// iapEchoServer is a fake IAP tunnel endpoint which echoes the data sent to
+// it. It sends each tunnel request on reqs, and the byte count of each
+// acknowledgement on acks.
+type iapEchoServer struct {
+	reqs chan *http.Request
+	acks chan uint64
+}
+
+func (s *iapEchoServer) serve(ws *websocket.Conn) {
+	s.reqs <- ws.Request()
+	sid := []byte{0, iapTagConnectSuccessSID, 0, 0, 0, 3, 's', 'i', 'd'}
+	if err := websocket.Message.Send(ws, sid); err != nil {
+		return
+	}
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			return
+		}
+		switch binary.BigEndian.Uint16(msg) {
+		case iapTagAck:
+			s.acks <- binary.BigEndian.Uint64(msg[2:])
+		case iapTagData:
+			if err := websocket.Message.Send(ws, msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestIAPDialer(t *testing.T) {
+	fake := &iapEchoServer{reqs: make(chan *http.Request, 1), acks: make(chan uint64, 10)}
+	srv := httptest.NewServer(websocket.Server{
+		Handshake: func(cfg *websocket.Config, r *http.Request) error {
+			cfg.Protocol = []string{iapSubprotocol}
+			return nil
+		},
+		Handler: fake.serve,
+	})
+	defer srv.Close()
+	defer func(old string) { iapTunnelURL = old }(iapTunnelURL)
+	iapTunnelURL = "ws" + strings.TrimPrefix(srv.URL, "http") + "/v4/connect"
+
+	target := iapTarget{"proj", "us-central1", "default", "sql"}
+	src := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "my-token"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := iapDialer(target, src)(ctx, "tcp", "10.0.0.5:3307")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// More than a message of data is split across messages, and echoed back
+	// in full.
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*iapMaxDataFrame/16)
+	if _, err := c.Write(data); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data read through the tunnel differs from the data written")
+	}
+	if got := c.RemoteAddr().String(); got != "10.0.0.5:3307" {
+		t.Errorf("RemoteAddr = %q, want the instance's address", got)
+	}
+	// The data received is acknowledged every iapAckInterval bytes.
+	select {
+	case n := <-fake.acks:
+		if n < iapAckInterval {
+			t.Errorf("acknowledged %d bytes, want at least %d", n, iapAckInterval)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the data received was not acknowledged")
+	}
+
+	req := <-fake.reqs
+	q := req.URL.Query()
+	for k, want := range map[string]string{
+		"project": "proj", "region": "us-central1", "network": "default",
+		"group": "sql", "host": "10.0.0.5", "port": "3307",
+	} {
+		if got := q.Get(k); got != want {
+			t.Errorf("tunnel request %s = %q, want %q", k, got, want)
+		}
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer my-token" {
+		t.Errorf("tunnel request Authorization = %q, want the access token", got)
+	}
+	if got := req.Header.Get("Origin"); got != iapOrigin {
+		t.Errorf("tunnel request Origin = %q, want %q", got, iapOrigin)
+	}
+}
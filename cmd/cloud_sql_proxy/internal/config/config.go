@@ -0,0 +1,253 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config reads the Cloud SQL Auth proxy's YAML configuration file.
+//
+// Every top-level key other than "instances" names a command line flag, and
+// its value is used as if it had been passed to that flag. The "instances" key
+// holds a list of instance objects:
+//
+//	log_debug_stdout: true
+//	max_connections: 100
+//	instances:
+//	- name: my-project:us-central1:my-db
+//	  port: 5432
+//	  max_connections: 10
+//	- name: my-project:us-central1:other-db
+//	  socket: /cloudsql/other-db
+//	  credential_file: /secrets/other-db.json
+//	  application_name: reporting
+//	  metric_labels:
+//	    team: reporting
+//	- name: my-project:us-central1:private-db
+//	  port: 5433
+//	  ip_type: private
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Instance configures the connections to a single Cloud SQL instance.
+type Instance struct {
+	// Name is the instance connection name, e.g. "project:region:instance".
+	Name string `yaml:"name"`
+	// Port, if set, is the port on 127.0.0.1 to listen on for connections to
+	// the instance.
+	Port int `yaml:"port"`
+	// Socket, if set, is the path of a Unix socket to listen on. Relative
+	// paths are relative to the -dir flag. If neither Port nor Socket is set,
+	// a Unix socket named after the instance is created in -dir.
+	Socket string `yaml:"socket"`
+	// MaxConnections, if set, limits the number of simultaneous connections
+	// to the instance.
+	MaxConnections uint64 `yaml:"max_connections"`
+	// CredentialFile, if set, is the path to a credentials file used for
+	// this instance instead of the proxy's default credentials.
+	CredentialFile string `yaml:"credential_file"`
+	// ImpersonateServiceAccount, if set, is the email address of a service
+	// account impersonated to connect to this instance.
+	ImpersonateServiceAccount string `yaml:"impersonate_service_account"`
+	// PSC, if set, connects to the instance through its Private Service
+	// Connect endpoint.
+	PSC bool `yaml:"psc"`
+	// IPType, if set, is the only type of IP address, "public" or "private",
+	// used to connect to the instance.
+	IPType string `yaml:"ip_type"`
+	// ApplicationName, if set, labels the instance's sessions in place of
+	// the -application_name flag.
+	ApplicationName string `yaml:"application_name"`
+	// MetricLabels, if set, are the values of labels added to the instance's
+	// metrics, in place of those of the -metric_labels flag.
+	MetricLabels map[string]string `yaml:"metric_labels"`
+}
+
+// Arg returns the instance in the form accepted by the -instances flag.
+func (i Instance) Arg() string {
+	arg := i.Name
+	switch {
+	case i.Port != 0:
+		arg += fmt.Sprintf("=tcp:%d", i.Port)
+	case i.Socket != "":
+		arg += "=unix:" + i.Socket
+	}
+	if i.MaxConnections != 0 {
+		arg += fmt.Sprintf("=maxconns:%d", i.MaxConnections)
+	}
+	if i.PSC {
+		arg += "=psc:true"
+	}
+	if i.IPType != "" {
+		arg += "=ip:" + i.IPType
+	}
+	if i.ApplicationName != "" {
+		arg += "=appname:" + i.ApplicationName
+	}
+	if i.CredentialFile != "" {
+		arg += "=credentials:" + i.CredentialFile
+	}
+	if i.ImpersonateServiceAccount != "" {
+		arg += "=impersonate:" + i.ImpersonateServiceAccount
+	}
+	return arg
+}
+
+func (i Instance) validate() error {
+	if i.Name == "" {
+		return errors.New("name is required")
+	}
+	if i.Port != 0 && i.Socket != "" {
+		return fmt.Errorf("instance %q: only one of port or socket may be set", i.Name)
+	}
+	if i.Port < 0 || i.Port > 65535 {
+		return fmt.Errorf("instance %q: invalid port %d", i.Name, i.Port)
+	}
+	if strings.Contains(i.Socket, "=") {
+		return fmt.Errorf("instance %q: socket path may not contain \"=\"", i.Name)
+	}
+	switch strings.ToLower(i.IPType) {
+	case "", "public", "private":
+	default:
+		return fmt.Errorf("instance %q: ip_type must be public or private, got %q", i.Name, i.IPType)
+	}
+	if i.PSC && i.IPType != "" {
+		return fmt.Errorf("instance %q: only one of psc or ip_type may be set", i.Name)
+	}
+	if strings.Contains(i.CredentialFile, "=") {
+		return fmt.Errorf("instance %q: credential_file path may not contain \"=\"", i.Name)
+	}
+	if strings.ContainsAny(i.ImpersonateServiceAccount, "=,") {
+		return fmt.Errorf("instance %q: impersonate_service_account may not contain \"=\" or \",\"", i.Name)
+	}
+	if strings.Contains(i.ApplicationName, "=") {
+		return fmt.Errorf("instance %q: application_name may not contain \"=\"", i.Name)
+	}
+	return nil
+}
+
+// Config is the contents of a configuration file.
+type Config struct {
+	// Flags maps flag names to values, in the form they would be passed on
+	// the command line.
+	Flags map[string]string
+	// Instances lists the instances to connect to.
+	Instances []Instance
+}
+
+// file describes the layout of a configuration file.
+type file struct {
+	Instances []Instance             `yaml:"instances"`
+	Flags     map[string]interface{} `yaml:",inline"`
+}
+
+// Load reads and validates the configuration file at path.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %v", err)
+	}
+	cfg, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %q: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse parses and validates the contents of a configuration file.
+func Parse(b []byte) (*Config, error) {
+	var f file
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	cfg := &Config{Flags: make(map[string]string), Instances: f.Instances}
+	for i, inst := range f.Instances {
+		if err := inst.validate(); err != nil {
+			return nil, fmt.Errorf("instances[%d]: %v", i, err)
+		}
+	}
+	for name, v := range f.Flags {
+		s, err := flagValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %v", name, err)
+		}
+		cfg.Flags[name] = s
+	}
+	return cfg, nil
+}
+
+// flagValue converts a YAML value to the string that would be passed on the
+// command line. Lists are joined with commas, which is how flags such as
+// -projects accept multiple values.
+func flagValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case map[string]interface{}:
+		return "", errors.New("value must not be an object")
+	case []interface{}:
+		var vals []string
+		for _, e := range v {
+			s, err := flagValue(e)
+			if err != nil {
+				return "", err
+			}
+			if _, ok := e.([]interface{}); ok {
+				return "", errors.New("value must not be a nested list")
+			}
+			vals = append(vals, s)
+		}
+		return strings.Join(vals, ","), nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// Apply sets each flag in fs named in the configuration to its configured
+// value. Flags already set, e.g. on the command line, take precedence over
+// the configuration file and are left unchanged. It returns an error for any
+// name that is not a flag in fs.
+func (c *Config) Apply(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	names := make([]string, 0, len(c.Flags))
+	for name := range c.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown field %q in config file", name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, c.Flags[name]); err != nil {
+			return fmt.Errorf("invalid value for %q in config file: %v", name, err)
+		}
+	}
+	return nil
+}
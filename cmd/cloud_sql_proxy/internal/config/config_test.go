@@ -0,0 +1,165 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const example = `
+verbose: false
+max_connections: 100
+term_timeout: 30s
+projects: [proj1, proj2]
+instances:
+- name: proj:region:tcp
+  port: 5432
+  max_connections: 10
+  psc: true
+- name: proj:region:unix
+  socket: /cloudsql/unix
+  credential_file: /secrets/unix.json
+  application_name: reporting
+  ip_type: private
+  metric_labels:
+    team: reporting
+- name: proj:region:default
+  impersonate_service_account: sa@proj.iam.gserviceaccount.com
+`
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]byte(example))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	wantFlags := map[string]string{
+		"verbose":         "false",
+		"max_connections": "100",
+		"term_timeout":    "30s",
+		"projects":        "proj1,proj2",
+	}
+	if !reflect.DeepEqual(cfg.Flags, wantFlags) {
+		t.Errorf("Flags = %v, want %v", cfg.Flags, wantFlags)
+	}
+	wantInstances := []Instance{
+		{Name: "proj:region:tcp", Port: 5432, MaxConnections: 10, PSC: true},
+		{Name: "proj:region:unix", Socket: "/cloudsql/unix", CredentialFile: "/secrets/unix.json", ApplicationName: "reporting", IPType: "private", MetricLabels: map[string]string{"team": "reporting"}},
+		{Name: "proj:region:default", ImpersonateServiceAccount: "sa@proj.iam.gserviceaccount.com"},
+	}
+	if !reflect.DeepEqual(cfg.Instances, wantInstances) {
+		t.Errorf("Instances = %+v, want %+v", cfg.Instances, wantInstances)
+	}
+
+	var args []string
+	for _, inst := range cfg.Instances {
+		args = append(args, inst.Arg())
+	}
+	wantArgs := []string{
+		"proj:region:tcp=tcp:5432=maxconns:10=psc:true",
+		"proj:region:unix=unix:/cloudsql/unix=ip:private=appname:reporting=credentials:/secrets/unix.json",
+		"proj:region:default=impersonate:sa@proj.iam.gserviceaccount.com",
+	}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("Arg() = %v, want %v", args, wantArgs)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tcs := []struct {
+		desc, in, wantErr string
+	}{
+		{"unknown instance field", "instances:\n- name: a:b:c\n  prot: 5432\n", "prot"},
+		{"missing name", "instances:\n- port: 5432\n", "name is required"},
+		{"port and socket", "instances:\n- name: a:b:c\n  port: 1\n  socket: s\n", "only one of port or socket"},
+		{"bad port", "instances:\n- name: a:b:c\n  port: 70000\n", "invalid port"},
+		{"bad application name", "instances:\n- name: a:b:c\n  application_name: a=b\n", "application_name"},
+		{"bad ip type", "instances:\n- name: a:b:c\n  ip_type: psc\n", "ip_type"},
+		{"psc and ip type", "instances:\n- name: a:b:c\n  psc: true\n  ip_type: private\n", "only one of psc or ip_type"},
+		{"bad credential file", "instances:\n- name: a:b:c\n  credential_file: /a=b.json\n", "credential_file"},
+		{"bad impersonated service account", "instances:\n- name: a:b:c\n  impersonate_service_account: a@b,c@d\n", "impersonate_service_account"},
+		{"object flag", "verbose:\n  a: b\n", "must not be an object"},
+		{"instances as string", "instances: a:b:c\n", "cannot unmarshal"},
+		{"malformed", "verbose: [\n", "yaml"},
+	}
+	for _, tc := range tcs {
+		_, err := Parse([]byte(tc.in))
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%v: Parse() error = %v, want error containing %q", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func TestParseEmpty(t *testing.T) {
+	cfg, err := Parse(nil)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(cfg.Flags) != 0 || len(cfg.Instances) != 0 {
+		t.Fatalf("Parse(nil) = %+v, want empty config", cfg)
+	}
+}
+
+func TestApply(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	verbose := fs.Bool("verbose", true, "")
+	maxConns := fs.Uint64("max_connections", 0, "")
+	timeout := fs.Duration("term_timeout", 0, "")
+	if err := fs.Parse([]string{"-max_connections=5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Parse([]byte("verbose: false\nmax_connections: 100\nterm_timeout: 30s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Apply(fs); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if *verbose {
+		t.Error("verbose = true, want false from config file")
+	}
+	if *maxConns != 5 {
+		t.Errorf("max_connections = %d, want 5 from command line", *maxConns)
+	}
+	if *timeout != 30*time.Second {
+		t.Errorf("term_timeout = %v, want 30s from config file", *timeout)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Uint64("max_connections", 0, "")
+
+	tcs := []struct {
+		desc, in, wantErr string
+	}{
+		{"unknown flag", "max_conections: 5\n", `unknown field "max_conections"`},
+		{"invalid value", "max_connections: lots\n", `invalid value for "max_connections"`},
+	}
+	for _, tc := range tcs {
+		cfg, err := Parse([]byte(tc.in))
+		if err != nil {
+			t.Fatalf("%v: Parse: %v", tc.desc, err)
+		}
+		err = cfg.Apply(fs)
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%v: Apply() error = %v, want error containing %q", tc.desc, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package healthcheck serves HTTP endpoints reporting the health of the
+// Cloud SQL Auth proxy, suitable for use as Kubernetes liveness and readiness
+// probes.
+package healthcheck
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/cmd/cloud_sql_proxy/internal/version"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+)
+
+// instanceStatus is the readiness detail reported for a single instance.
+type instanceStatus struct {
+	Healthy         bool   `json:"healthy"`
+	LastRefreshUnix int64  `json:"last_refresh_unix"`
+	Circuit         string `json:"circuit"`
+	DatabaseVersion string `json:"database_version,omitempty"`
+	Region          string `json:"region,omitempty"`
+}
+
+// buildStatus is the body of a /liveness response, identifying the build of
+// the proxy so that monitoring can detect version drift.
+type buildStatus struct {
+	Status    string `json:"status"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// Handler returns an http.Handler serving /liveness and /readiness.
+//
+// /liveness always responds with 200 OK while the process is able to serve
+// requests, with a JSON object describing the build of the proxy. /readiness
+// responds with 200 OK only if c holds a valid certificate for every instance
+// in instances and none of their circuit breakers is open, and with 503
+// Service Unavailable otherwise. In both cases the body of a /readiness
+// response is a JSON object keyed by instance connection name describing each
+// instance.
+func Handler(c *proxy.Client, instances []string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/liveness", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		resp := buildStatus{
+			Status:    "ok",
+			Version:   version.Semantic(),
+			Commit:    version.Commit,
+			BuildDate: version.BuildDate,
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			logging.Errorf("Failed to write liveness response: %v", err)
+		}
+	})
+	mux.HandleFunc("/readiness", func(w http.ResponseWriter, _ *http.Request) {
+		ready := true
+		resp := make(map[string]instanceStatus, len(instances))
+		for _, inst := range instances {
+			s := c.RefreshStatus(inst)
+			var last int64
+			if !s.LastRefresh.IsZero() {
+				last = s.LastRefresh.Unix()
+			}
+			circuit := c.CircuitState(inst)
+			healthy := s.Healthy && circuit != proxy.CircuitOpen
+			resp[inst] = instanceStatus{
+				Healthy:         healthy,
+				LastRefreshUnix: last,
+				Circuit:         circuit.String(),
+				DatabaseVersion: s.DatabaseVersion,
+				Region:          s.Region,
+			}
+			ready = ready && healthy
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if ready {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			logging.Errorf("Failed to write readiness response: %v", err)
+		}
+	})
+	return mux
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/cmd/cloud_sql_proxy/internal/version"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+)
+
+const (
+	goodInstance = "proj:region:good"
+	badInstance  = "proj:region:bad"
+)
+
+// fakeCertSource returns certificates valid for an hour for goodInstance and
+// fails for every other instance.
+type fakeCertSource struct{}
+
+func (fakeCertSource) Local(instance string) (tls.Certificate, error) {
+	if instance != goodInstance {
+		return tls.Certificate{}, errors.New("instance not available")
+	}
+	return tls.Certificate{
+		Leaf: &x509.Certificate{NotAfter: time.Now().Add(time.Hour)},
+	}, nil
+}
+
+func (fakeCertSource) Remote(string) (*x509.Certificate, string, string, string, error) {
+	return &x509.Certificate{}, "fake address", "fake name", "POSTGRES_14", nil
+}
+
+func (fakeCertSource) Region(instance string) string {
+	if instance != goodInstance {
+		return ""
+	}
+	return "us-central1"
+}
+
+func get(h http.Handler, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+func TestLiveness(t *testing.T) {
+	h := Handler(&proxy.Client{Certs: fakeCertSource{}}, []string{badInstance})
+	rec := get(h, "/liveness")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/liveness returned %v, want %v", rec.Code, http.StatusOK)
+	}
+	var got buildStatus
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decoding /liveness response: %v", err)
+	}
+	want := buildStatus{Status: "ok", Version: version.Semantic(), Commit: version.Commit, BuildDate: version.BuildDate}
+	if got != want {
+		t.Errorf("/liveness returned %+v, want %+v", got, want)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	c := &proxy.Client{Certs: fakeCertSource{}}
+	ctx := context.Background()
+	if err := c.Prefetch(ctx, goodInstance); err != nil {
+		t.Fatalf("Prefetch(%q): %v", goodInstance, err)
+	}
+	if err := c.Prefetch(ctx, badInstance); err == nil {
+		t.Fatalf("Prefetch(%q) succeeded, want error", badInstance)
+	}
+
+	tcs := []struct {
+		desc      string
+		instances []string
+		wantCode  int
+	}{
+		{"no instances", nil, http.StatusOK},
+		{"healthy instance", []string{goodInstance}, http.StatusOK},
+		{"unhealthy instance", []string{goodInstance, badInstance}, http.StatusServiceUnavailable},
+	}
+	for _, tc := range tcs {
+		rec := get(Handler(c, tc.instances), "/readiness")
+		if rec.Code != tc.wantCode {
+			t.Errorf("%v: /readiness returned %v, want %v", tc.desc, rec.Code, tc.wantCode)
+		}
+		var got map[string]instanceStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%v: invalid response body %q: %v", tc.desc, rec.Body.String(), err)
+		}
+		if len(got) != len(tc.instances) {
+			t.Errorf("%v: got %d instances in response, want %d", tc.desc, len(got), len(tc.instances))
+		}
+	}
+
+	rec := get(Handler(c, []string{goodInstance, badInstance}), "/readiness")
+	var got map[string]instanceStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid response body %q: %v", rec.Body.String(), err)
+	}
+	if g := got[goodInstance]; !g.Healthy || g.LastRefreshUnix == 0 || g.Circuit != "closed" {
+		t.Errorf("status of %q = %+v, want healthy with a refresh time and a closed circuit", goodInstance, g)
+	}
+	if g := got[goodInstance]; g.DatabaseVersion != "POSTGRES_14" || g.Region != "us-central1" {
+		t.Errorf("status of %q = %+v, want database version POSTGRES_14 in us-central1", goodInstance, g)
+	}
+	if b := got[badInstance]; b.Healthy || b.LastRefreshUnix != 0 || b.DatabaseVersion != "" || b.Region != "" {
+		t.Errorf("status of %q = %+v, want unhealthy, never refreshed and with no metadata", badInstance, b)
+	}
+}
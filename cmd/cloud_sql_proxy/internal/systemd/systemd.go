@@ -0,0 +1,138 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package systemd hands the listening sockets passed to the proxy by systemd
+// socket activation to the instances configured to listen on their addresses.
+//
+// systemd opens the sockets of a .socket unit before starting its service, and
+// keeps them open while the service restarts, so that connections made during
+// an upgrade wait in the socket's backlog instead of being refused. The
+// sockets are passed as file descriptors 3 onwards (SD_LISTEN_FDS_START), with
+// their number in LISTEN_FDS and the process they are meant for in
+// LISTEN_PID.
+package systemd
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-systemd/v22/activation"
+)
+
+// Sockets holds the listening sockets inherited from systemd which have not
+// yet been taken. A nil *Sockets holds none.
+type Sockets struct {
+	mu     sync.Mutex
+	byAddr map[string]net.Listener
+}
+
+// Inherited returns the listening sockets passed to the process by systemd,
+// or an empty Sockets if the process was not socket activated. The
+// LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES environment variables are unset,
+// so that they are not inherited by child processes.
+func Inherited() (*Sockets, error) {
+	ls, err := activation.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	return newSockets(ls), nil
+}
+
+// newSockets returns a Sockets holding ls. Nil listeners, which stand for
+// passed file descriptors which are not stream sockets, are skipped.
+func newSockets(ls []net.Listener) *Sockets {
+	s := &Sockets{byAddr: make(map[string]net.Listener)}
+	for _, l := range ls {
+		if l == nil {
+			continue
+		}
+		s.byAddr[key(l.Addr().Network(), l.Addr().String())] = l
+	}
+	return s
+}
+
+// Add adds ls, listening sockets obtained by other means than socket
+// activation, to s, which must not be nil. A socket on an address s already
+// holds one for is closed instead.
+func (s *Sockets) Add(ls []net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range ls {
+		k := key(l.Addr().Network(), l.Addr().String())
+		if _, ok := s.byAddr[k]; ok {
+			l.Close()
+			continue
+		}
+		s.byAddr[k] = l
+	}
+}
+
+// key identifies a socket by network and address. TCP addresses are
+// resolved, so that e.g. "localhost:5432" matches a socket on
+// "127.0.0.1:5432".
+func key(network, address string) string {
+	if strings.HasPrefix(network, "tcp") {
+		if a, err := net.ResolveTCPAddr(network, address); err == nil {
+			address = a.String()
+		}
+		network = "tcp"
+	}
+	return network + " " + address
+}
+
+// Take returns the inherited socket listening on address, removing it from s,
+// or nil if there is none. Addresses must match exactly: a socket on all
+// interfaces is not used for an instance configured to listen on 127.0.0.1.
+func (s *Sockets) Take(network, address string) net.Listener {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := key(network, address)
+	l, ok := s.byAddr[k]
+	if !ok {
+		return nil
+	}
+	delete(s.byAddr, k)
+	return l
+}
+
+// Len returns the number of sockets which have not been taken.
+func (s *Sockets) Len() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.byAddr)
+}
+
+// Unused returns the addresses of the sockets which have not been taken,
+// sorted.
+func (s *Sockets) Unused() []string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addrs []string
+	for _, l := range s.byAddr {
+		addrs = append(addrs, l.Addr().String())
+	}
+	sort.Strings(addrs)
+	return addrs
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package systemd
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestInheritedNotActivated(t *testing.T) {
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	s, err := Inherited()
+	if err != nil {
+		t.Fatalf("Inherited: %v", err)
+	}
+	if n := s.Len(); n != 0 {
+		t.Errorf("Inherited returned %d sockets without socket activation, want none", n)
+	}
+}
+
+func TestTake(t *testing.T) {
+	a, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	s := newSockets([]net.Listener{a, nil, b})
+
+	_, port, _ := net.SplitHostPort(a.Addr().String())
+	if l := s.Take("tcp", "0.0.0.0:"+port); l != nil {
+		t.Errorf("Take on all interfaces returned the socket on %v", l.Addr())
+	}
+	if l := s.Take("tcp", "localhost:"+port); l != a {
+		t.Errorf("Take(%q) = %v, want the socket on %v", "localhost:"+port, l, a.Addr())
+	}
+	if l := s.Take("tcp", a.Addr().String()); l != nil {
+		t.Errorf("Take returned the socket on %v a second time", a.Addr())
+	}
+	if got, want := s.Unused(), []string{b.Addr().String()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unused() = %v, want %v", got, want)
+	}
+}
+
+func TestNilSockets(t *testing.T) {
+	var s *Sockets
+	if l := s.Take("tcp", "127.0.0.1:5432"); l != nil {
+		t.Errorf("Take on nil Sockets = %v, want nil", l)
+	}
+	if s.Len() != 0 || s.Unused() != nil {
+		t.Error("nil Sockets is not empty")
+	}
+}
+
+func TestAdd(t *testing.T) {
+	a, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	s := newSockets([]net.Listener{a})
+
+	b, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	// A second socket on a's address, as handed over by another process.
+	f, err := a.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add([]net.Listener{b, dup})
+
+	if l := s.Take("tcp", b.Addr().String()); l != b {
+		t.Errorf("Take(%q) = %v, want the added socket", b.Addr(), l)
+	}
+	if l := s.Take("tcp", a.Addr().String()); l != a {
+		t.Errorf("Take(%q) = %v, want the socket held before", a.Addr(), l)
+	}
+	if _, err := dup.Accept(); err == nil {
+		t.Error("the added socket on an address already held was not closed")
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package version describes the build of the proxy. Release builds set its
+// variables at link time, e.g.
+//
+//	go build -ldflags "-X github.com/GoogleCloudPlatform/cloudsql-proxy/cmd/cloud_sql_proxy/internal/version.Commit=$(git rev-parse HEAD)" ./cmd/cloud_sql_proxy
+package version
+
+import "fmt"
+
+var (
+	// Version indicates the version of the proxy currently in use.
+	Version = "1.23.1-dev"
+	// Metadata indicates additional build or distribution metadata, e.g.
+	// "container" or "linux.amd64".
+	Metadata = ""
+	// Commit is the git commit the proxy was built from.
+	Commit = "unknown"
+	// BuildDate is the time at which the proxy was built, preferably in RFC
+	// 3339 format.
+	BuildDate = "unknown"
+)
+
+// Semantic returns the version of the proxy in a semver format, including any
+// build metadata.
+func Semantic() string {
+	v := Version
+	if Metadata != "" {
+		v += "+" + Metadata
+	}
+	return v
+}
+
+// String describes the build of the proxy as printed by -version, e.g.
+// "cloud-sql-proxy 1.23.1 (commit 0f9fa26, built 2021-10-01T12:00:00Z)".
+func String() string {
+	return fmt.Sprintf("cloud-sql-proxy %s (commit %s, built %s)", Semantic(), Commit, BuildDate)
+}
@@ -0,0 +1,41 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import "testing"
+
+func TestString(t *testing.T) {
+	defer func(v, m, c, d string) {
+		Version, Metadata, Commit, BuildDate = v, m, c, d
+	}(Version, Metadata, Commit, BuildDate)
+
+	tcs := []struct {
+		metadata      string
+		wantSemantic  string
+		wantFormatted string
+	}{
+		{"", "1.2.3", "cloud-sql-proxy 1.2.3 (commit abc123, built 2021-10-01T12:00:00Z)"},
+		{"container", "1.2.3+container", "cloud-sql-proxy 1.2.3+container (commit abc123, built 2021-10-01T12:00:00Z)"},
+	}
+	for _, tc := range tcs {
+		Version, Metadata, Commit, BuildDate = "1.2.3", tc.metadata, "abc123", "2021-10-01T12:00:00Z"
+		if got := Semantic(); got != tc.wantSemantic {
+			t.Errorf("Semantic() with metadata %q = %q, want %q", tc.metadata, got, tc.wantSemantic)
+		}
+		if got := String(); got != tc.wantFormatted {
+			t.Errorf("String() with metadata %q = %q, want %q", tc.metadata, got, tc.wantFormatted)
+		}
+	}
+}
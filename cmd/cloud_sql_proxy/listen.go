@@ -0,0 +1,49 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// reusePortSupported reports whether listenTCP can create more than one
+// listener on the same address.
+const reusePortSupported = false
+
+// maxBacklog returns 0, as the kernel's limit on the listen backlog is only
+// read on Linux.
+func maxBacklog() int {
+	return 0
+}
+
+// setBacklog returns an error, as the backlog of a listening socket can only
+// be changed on Linux.
+func setBacklog(l net.Listener, n int) error {
+	return errors.New("the listen backlog can only be set on Linux")
+}
+
+// listenTCP returns a single listener on addr, whatever n is, as SO_REUSEPORT
+// is only used on Linux.
+func listenTCP(network, addr string, n int) ([]net.Listener, error) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortSupported reports whether listenTCP can create more than one
+// listener on the same address.
+const reusePortSupported = true
+
+// somaxconnPath holds the kernel's limit on the listen backlog of a socket.
+var somaxconnPath = "/proc/sys/net/core/somaxconn"
+
+// maxBacklog returns the kernel's limit on the listen backlog, or 0 if it
+// can't be read.
+func maxBacklog() int {
+	b, err := ioutil.ReadFile(somaxconnPath)
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// setBacklog sets the queue of connections waiting to be accepted by l to n.
+// Linux allows listen to be called again on a listening socket, which only
+// changes its backlog.
+func setBacklog(l net.Listener, n int) error {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	c, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.Listen(int(fd), n)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// listenTCP returns n listeners on addr, which share the address with
+// SO_REUSEPORT so that the kernel spreads incoming connections across them.
+// If addr has port 0, all of the listeners use the port chosen for the first.
+func listenTCP(network, addr string, n int) ([]net.Listener, error) {
+	if n <= 1 {
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	lc := net.ListenConfig{Control: setReusePort}
+	var ls []net.Listener
+	for i := 0; i < n; i++ {
+		l, err := lc.Listen(context.Background(), network, addr)
+		if err != nil {
+			multiListener(ls).Close()
+			return nil, err
+		}
+		if i == 0 {
+			addr = l.Addr().String()
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
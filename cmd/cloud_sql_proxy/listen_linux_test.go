@@ -0,0 +1,66 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMaxBacklog(t *testing.T) {
+	defer func(old string) { somaxconnPath = old }(somaxconnPath)
+	dir, err := ioutil.TempDir("", "somaxconn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	somaxconnPath = filepath.Join(dir, "somaxconn")
+	if got := maxBacklog(); got != 0 {
+		t.Errorf("maxBacklog without the file = %d, want 0", got)
+	}
+	if err := ioutil.WriteFile(somaxconnPath, []byte("4096\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := maxBacklog(); got != 4096 {
+		t.Errorf("maxBacklog = %d, want 4096", got)
+	}
+}
+
+func TestSetBacklog(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := setBacklog(l, 1024); err != nil {
+		t.Fatalf("setBacklog: %v", err)
+	}
+
+	// The socket still accepts connections.
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+	defer c.Close()
+	ac, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	ac.Close()
+}
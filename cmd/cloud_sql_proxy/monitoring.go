@@ -0,0 +1,243 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file contains code for writing some of the proxy's metrics to Cloud
+// Monitoring as custom metrics.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	monitoring "google.golang.org/api/monitoring/v3"
+	"google.golang.org/api/option"
+)
+
+// monitoringWriteScope is the OAuth2 scope needed to write to Cloud
+// Monitoring.
+const monitoringWriteScope = monitoring.MonitoringWriteScope
+
+const (
+	// monitoringInterval is how often metrics are written.
+	monitoringInterval = 60 * time.Second
+	// monitoringMetricPrefix introduces the type of each custom metric.
+	monitoringMetricPrefix = "custom.googleapis.com/cloudsql_proxy/"
+	// monitoringBatchSize is the most time series Cloud Monitoring accepts in
+	// one request.
+	monitoringBatchSize = 200
+)
+
+// monitoringEndpoint is the Cloud Monitoring API endpoint. For overriding in
+// unittests.
+var monitoringEndpoint = ""
+
+// monitoredMetric is a Prometheus metric written to Cloud Monitoring, with a
+// time series for each instance.
+type monitoredMetric struct {
+	// prom is the name of the Prometheus metric.
+	prom string
+	// name is the custom metric's name, after monitoringMetricPrefix.
+	name string
+	// kind is the custom metric's kind, GAUGE or CUMULATIVE.
+	kind        string
+	description string
+}
+
+var monitoredMetrics = []monitoredMetric{
+	{"cloudsql_proxy_active_connections", "active_connections", "GAUGE", "Number of active client connections to an instance."},
+	{"cloudsql_proxy_connections_failed_total", "failed_connections_total", "CUMULATIVE", "Total number of client connections which could not be connected to an instance."},
+	{"cloudsql_proxy_cert_refresh_errors_total", "cert_refresh_errors_total", "CUMULATIVE", "Total number of failed certificate refreshes for an instance."},
+}
+
+// monitoringExporter writes the monitoredMetrics gathered from a Prometheus
+// registry to Cloud Monitoring.
+type monitoringExporter struct {
+	svc      *monitoring.Service
+	project  string
+	gatherer prometheus.Gatherer
+	// node identifies the proxy among those writing to the project, as the
+	// node_id of its generic_node monitored resource.
+	node string
+	// start is the start of the interval of every cumulative point.
+	start time.Time
+	// described is set once the metric descriptors have been created.
+	described bool
+}
+
+// newMonitoringExporter returns a monitoringExporter which writes the metrics
+// in g to project with cl.
+func newMonitoringExporter(ctx context.Context, cl *http.Client, project string, g prometheus.Gatherer) (*monitoringExporter, error) {
+	opts := []option.ClientOption{option.WithHTTPClient(cl)}
+	if monitoringEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(monitoringEndpoint))
+	}
+	svc, err := monitoring.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	node, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &monitoringExporter{
+		svc:      svc,
+		project:  project,
+		gatherer: g,
+		node:     node,
+		start:    time.Now(),
+	}, nil
+}
+
+// run writes the metrics every interval. Failures are logged, and the metrics
+// are written again at the next interval.
+func (e *monitoringExporter) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			if err := e.push(ctx, now); err != nil {
+				logging.Errorf("WARNING: couldn't write metrics to Cloud Monitoring: %v", err)
+			}
+		}
+	}
+}
+
+// push writes the current value of each metric, first creating the metric
+// descriptors if that has not yet succeeded.
+func (e *monitoringExporter) push(ctx context.Context, now time.Time) error {
+	if !e.described {
+		if err := e.describe(ctx); err != nil {
+			return fmt.Errorf("creating metric descriptors: %v", err)
+		}
+		e.described = true
+	}
+	series, err := e.timeSeries(now)
+	if err != nil {
+		return err
+	}
+	for len(series) > 0 {
+		n := len(series)
+		if n > monitoringBatchSize {
+			n = monitoringBatchSize
+		}
+		req := &monitoring.CreateTimeSeriesRequest{TimeSeries: series[:n]}
+		if _, err := e.svc.Projects.TimeSeries.Create("projects/"+e.project, req).Context(ctx).Do(); err != nil {
+			return err
+		}
+		series = series[n:]
+	}
+	return nil
+}
+
+// describe creates the descriptor of each custom metric. Creating a
+// descriptor which already exists has no effect.
+func (e *monitoringExporter) describe(ctx context.Context) error {
+	for _, m := range monitoredMetrics {
+		d := &monitoring.MetricDescriptor{
+			Type:        monitoringMetricPrefix + m.name,
+			DisplayName: m.name,
+			Description: m.description,
+			MetricKind:  m.kind,
+			ValueType:   "INT64",
+			Labels: []*monitoring.LabelDescriptor{{
+				Key:         "instance",
+				ValueType:   "STRING",
+				Description: "The instance connection name.",
+			}},
+		}
+		if _, err := e.svc.Projects.MetricDescriptors.Create("projects/"+e.project, d).Context(ctx).Do(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timeSeries returns a time series for each instance of each monitored
+// metric, with its value at now.
+func (e *monitoringExporter) timeSeries(now time.Time) ([]*monitoring.TimeSeries, error) {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]monitoredMetric)
+	for _, m := range monitoredMetrics {
+		byName[m.prom] = m
+	}
+	end := now.UTC().Format(time.RFC3339Nano)
+	resource := &monitoring.MonitoredResource{
+		Type: "generic_node",
+		Labels: map[string]string{
+			"project_id": e.project,
+			"location":   "global",
+			"namespace":  "cloudsql-proxy",
+			"node_id":    e.node,
+		},
+	}
+
+	var series []*monitoring.TimeSeries
+	for _, f := range families {
+		m, ok := byName[f.GetName()]
+		if !ok {
+			continue
+		}
+		// Sum the samples of each instance, which may have other labels.
+		values := make(map[string]float64)
+		for _, s := range f.GetMetric() {
+			var inst string
+			for _, l := range s.GetLabel() {
+				if l.GetName() == "instance" {
+					inst = l.GetValue()
+				}
+			}
+			values[inst] += s.GetGauge().GetValue() + s.GetCounter().GetValue()
+		}
+		insts := make([]string, 0, len(values))
+		for inst := range values {
+			insts = append(insts, inst)
+		}
+		sort.Strings(insts)
+
+		interval := &monitoring.TimeInterval{EndTime: end}
+		if m.kind == "CUMULATIVE" {
+			interval.StartTime = e.start.UTC().Format(time.RFC3339Nano)
+		}
+		for _, inst := range insts {
+			v := int64(values[inst])
+			series = append(series, &monitoring.TimeSeries{
+				Metric: &monitoring.Metric{
+					Type:   monitoringMetricPrefix + m.name,
+					Labels: map[string]string{"instance": inst},
+				},
+				Resource:   resource,
+				MetricKind: m.kind,
+				ValueType:  "INT64",
+				Points: []*monitoring.Point{{
+					Interval: interval,
+					Value:    &monitoring.TypedValue{Int64Value: &v},
+				}},
+			})
+		}
+	}
+	return series, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/metrics"
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+func TestMonitoringExporter(t *testing.T) {
+	var descriptors []*monitoring.MetricDescriptor
+	var series []*monitoring.TimeSeries
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/projects/my-project/metricDescriptors":
+			var d monitoring.MetricDescriptor
+			if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+				t.Errorf("couldn't decode request: %v", err)
+			}
+			descriptors = append(descriptors, &d)
+		case "/v3/projects/my-project/timeSeries":
+			var req monitoring.CreateTimeSeriesRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("couldn't decode request: %v", err)
+			}
+			series = append(series, req.TimeSeries...)
+		default:
+			t.Errorf("unexpected API request to %q", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	defer api.Close()
+	oldEndpoint := monitoringEndpoint
+	monitoringEndpoint = api.URL + "/"
+	defer func() { monitoringEndpoint = oldEndpoint }()
+
+	m := metrics.New()
+	m.ConnOpened("proj:reg:a")
+	m.ConnOpened("proj:reg:b")
+	m.ConnOpened("proj:reg:b")
+	m.ConnFailed("proj:reg:a")
+	m.RefreshFailed("proj:reg:b")
+
+	e, err := newMonitoringExporter(context.Background(), http.DefaultClient, "my-project", m.Registry())
+	if err != nil {
+		t.Fatalf("newMonitoringExporter: %v", err)
+	}
+	if err := e.push(context.Background(), time.Now()); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if err := e.push(context.Background(), time.Now()); err != nil {
+		t.Fatalf("second push: %v", err)
+	}
+
+	if len(descriptors) != len(monitoredMetrics) {
+		t.Errorf("created %d metric descriptors, want %d, once each", len(descriptors), len(monitoredMetrics))
+	}
+	type point struct {
+		metric, instance, kind string
+		value                  int64
+	}
+	var got []point
+	for _, s := range series[:len(series)/2] {
+		got = append(got, point{s.Metric.Type, s.Metric.Labels["instance"], s.MetricKind, *s.Points[0].Value.Int64Value})
+		if s.Resource.Type != "generic_node" || s.Resource.Labels["project_id"] != "my-project" {
+			t.Errorf("time series written for resource %+v, want a generic_node in my-project", s.Resource)
+		}
+		if s.MetricKind == "CUMULATIVE" && s.Points[0].Interval.StartTime == "" {
+			t.Errorf("cumulative time series %v has no start time", s.Metric.Type)
+		}
+	}
+	want := []point{
+		{"custom.googleapis.com/cloudsql_proxy/active_connections", "proj:reg:a", "GAUGE", 1},
+		{"custom.googleapis.com/cloudsql_proxy/active_connections", "proj:reg:b", "GAUGE", 2},
+		{"custom.googleapis.com/cloudsql_proxy/cert_refresh_errors_total", "proj:reg:b", "CUMULATIVE", 1},
+		{"custom.googleapis.com/cloudsql_proxy/failed_connections_total", "proj:reg:a", "CUMULATIVE", 1},
+	}
+	if len(series) != 2*len(want) {
+		t.Fatalf("wrote %d time series in two pushes, want %d", len(series), 2*len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("time series %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
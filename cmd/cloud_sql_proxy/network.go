@@ -0,0 +1,51 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file contains code for choosing the type of IP address used to reach
+// instances from the network the proxy runs on.
+
+import (
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+// metadataGet is replaced in tests.
+var metadataGet = metadata.Get
+
+// localNetwork returns the VPC network of the Compute Engine VM the proxy
+// runs on, in the form used for a Cloud SQL instance's private network:
+// "projects/PROJECT/global/networks/NETWORK". The metadata server names the
+// network's project by number, which is replaced by the project ID when it is
+// the VM's own project.
+func localNetwork() (string, error) {
+	n, err := metadataGet("instance/network-interfaces/0/network")
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(n, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "networks" {
+		return "", fmt.Errorf("unexpected network %q from the metadata server", n)
+	}
+	proj := parts[1]
+	if num, err := metadataGet("project/numeric-project-id"); err == nil && num == proj {
+		if id, err := metadataGet("project/project-id"); err == nil {
+			proj = id
+		}
+	}
+	return fmt.Sprintf("projects/%s/global/networks/%s", proj, parts[3]), nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLocalNetwork(t *testing.T) {
+	defer func(old func(string) (string, error)) { metadataGet = old }(metadataGet)
+
+	for _, v := range []struct {
+		desc    string
+		network string
+		want    string
+		wantErr bool
+	}{
+		{
+			desc:    "VM's own project",
+			network: "projects/123/networks/default",
+			want:    "projects/my-proj/global/networks/default",
+		},
+		{
+			desc:    "shared VPC",
+			network: "projects/456/networks/shared",
+			want:    "projects/456/global/networks/shared",
+		},
+		{
+			desc:    "unexpected form",
+			network: "default",
+			wantErr: true,
+		},
+	} {
+		metadataGet = func(path string) (string, error) {
+			switch path {
+			case "instance/network-interfaces/0/network":
+				return v.network, nil
+			case "project/numeric-project-id":
+				return "123", nil
+			case "project/project-id":
+				return "my-proj", nil
+			}
+			return "", errors.New("unexpected path " + path)
+		}
+		got, err := localNetwork()
+		if v.wantErr {
+			if err == nil {
+				t.Errorf("%s: localNetwork succeeded with %q, want error", v.desc, got)
+			}
+			continue
+		}
+		if err != nil || got != v.want {
+			t.Errorf("%s: localNetwork = %q, %v; want %q", v.desc, got, err, v.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Microsoft/go-winio"
+	"golang.org/x/sys/windows"
+)
+
+// listenPipe listens on the named pipe at path. Clients are admitted by the
+// security descriptor sddl, or if it is empty, only clients running as the
+// current user are.
+func listenPipe(path, sddl string) (net.Listener, error) {
+	if sddl == "" {
+		var err error
+		if sddl, err = currentUserSDDL(); err != nil {
+			return nil, err
+		}
+	}
+	return winio.ListenPipe(path, &winio.PipeConfig{SecurityDescriptor: sddl})
+}
+
+// currentUserSDDL returns a security descriptor which grants full access to
+// the user the proxy runs as, and to nobody else.
+func currentUserSDDL() (string, error) {
+	tok := windows.GetCurrentProcessToken()
+	u, err := tok.GetTokenUser()
+	if err != nil {
+		return "", fmt.Errorf("looking up the current user: %v", err)
+	}
+	return fmt.Sprintf("D:P(A;;GA;;;%s)", u.User.Sid.String()), nil
+}
@@ -18,17 +18,28 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/cmd/cloud_sql_proxy/internal/systemd"
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/certs"
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/fuse"
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/util"
@@ -39,144 +50,532 @@ import (
 // local connections.  Values received from the updates channel are
 // interpretted as a comma-separated list of instances.  The set of sockets in
 // 'dir' is the union of 'instances' and the most recent list from 'updates'.
-func WatchInstances(dir string, cfgs []instanceConfig, updates <-chan string, cl *http.Client) (<-chan proxy.Conn, error) {
+// Per-instance connection limits are registered with client.
+//
+// Each list received from reloads replaces 'instances': sockets are opened for
+// new instances, and the sockets of instances which are no longer listed are
+// closed, after which their connections are given drainTimeout to finish
+// before they are closed too. Instances dropped from 'updates' are drained in
+// the same way.
+func WatchInstances(dir string, cfgs []instanceConfig, updates <-chan string, reloads <-chan []instanceConfig, drainTimeout time.Duration, cl *http.Client, client *proxy.Client) (<-chan proxy.Conn, error) {
 	ch := make(chan proxy.Conn, 1)
 
 	// Instances specified statically (e.g. as flags to the binary) will always
-	// be available. They are ignored if also returned by the GCE metadata since
-	// the socket will already be open.
-	staticInstances := make(map[string]net.Listener, len(cfgs))
+	// be available, unless removed by a reload. They are ignored if also
+	// returned by the GCE metadata since the socket will already be open.
+	staticInstances := make(map[string]instanceListener, len(cfgs))
 	for _, v := range cfgs {
+		client.SetInstanceMaxConnections(v.Instance, v.MaxConnections)
+		client.SetInstanceApplicationName(v.Instance, v.ApplicationName)
 		l, err := listenInstance(ch, v)
 		if err != nil {
 			return nil, err
 		}
-		staticInstances[v.Instance] = l
+		staticInstances[v.Instance] = instanceListener{v, l}
 	}
+	logStartupSummary(staticInstances)
 
-	if updates != nil {
-		go watchInstancesLoop(dir, ch, updates, staticInstances, cl)
+	w := &instanceWatcher{
+		dir:          dir,
+		dst:          ch,
+		cl:           cl,
+		client:       client,
+		drainTimeout: drainTimeout,
+		static:       staticInstances,
+		dynamic:      make(map[string]net.Listener),
+	}
+	w.writePorts()
+	if updates != nil || reloads != nil {
+		go w.loop(updates, reloads)
 	}
 	return ch, nil
 }
 
-func watchInstancesLoop(dir string, dst chan<- proxy.Conn, updates <-chan string, static map[string]net.Listener, cl *http.Client) {
-	dynamicInstances := make(map[string]net.Listener)
-	for instances := range updates {
-		// All instances were legal when we started, so we pass false below to ensure we don't skip them
-		// later if they became unhealthy for some reason; this would be a serious enough problem.
-		list, err := parseInstanceConfigs(dir, strings.Split(instances, ","), cl, false)
-		if err != nil {
-			logging.Errorf("%v", err)
-			// If we do not have a valid list of instances, skip this update
-			continue
-		}
+// instanceListener is the socket opened for an instance's configuration.
+type instanceListener struct {
+	cfg instanceConfig
+	l   net.Listener
+}
+
+// instanceWatcher maintains the sockets opened by WatchInstances. Its maps
+// are only accessed by its loop.
+type instanceWatcher struct {
+	dir          string
+	dst          chan<- proxy.Conn
+	cl           *http.Client
+	client       *proxy.Client
+	drainTimeout time.Duration
 
-		stillOpen := make(map[string]net.Listener)
-		for _, cfg := range list {
-			instance := cfg.Instance
+	static  map[string]instanceListener
+	dynamic map[string]net.Listener
+}
 
-			// If the instance is specified in the static list don't do anything:
-			// it's already open and should stay open forever.
-			if _, ok := static[instance]; ok {
+func (w *instanceWatcher) loop(updates <-chan string, reloads <-chan []instanceConfig) {
+	for updates != nil || reloads != nil {
+		select {
+		case instances, ok := <-updates:
+			if !ok {
+				updates = nil
 				continue
 			}
-
-			if l, ok := dynamicInstances[instance]; ok {
-				delete(dynamicInstances, instance)
-				stillOpen[instance] = l
+			w.update(instances)
+		case cfgs, ok := <-reloads:
+			if !ok {
+				reloads = nil
 				continue
 			}
+			w.reload(cfgs)
+		}
+		w.writePorts()
+	}
 
-			l, err := listenInstance(dst, cfg)
-			if err != nil {
-				logging.Errorf("Couldn't open socket for %q: %v", instance, err)
+	for _, v := range w.static {
+		if err := v.l.Close(); err != nil {
+			logging.Errorf("Error closing %q: %v", v.l.Addr(), err)
+		}
+	}
+	for _, v := range w.dynamic {
+		if err := v.Close(); err != nil {
+			logging.Errorf("Error closing %q: %v", v.Addr(), err)
+		}
+	}
+}
+
+// update replaces the dynamic instances with those in the comma-separated list
+// instances.
+func (w *instanceWatcher) update(instances string) {
+	// All instances were legal when we started, so we pass false below to ensure we don't skip them
+	// later if they became unhealthy for some reason; this would be a serious enough problem.
+	list, err := parseInstanceConfigs(w.dir, strings.Split(instances, ","), w.cl, nil, false)
+	if err != nil {
+		logging.Errorf("%v", err)
+		// If we do not have a valid list of instances, skip this update
+		return
+	}
+
+	stillOpen := make(map[string]net.Listener)
+	for _, cfg := range list {
+		instance := cfg.Instance
+
+		// If the instance is specified in the static list don't do anything:
+		// it's already open and should stay open.
+		if _, ok := w.static[instance]; ok {
+			continue
+		}
+
+		w.client.SetInstanceMaxConnections(instance, cfg.MaxConnections)
+		w.client.SetInstanceApplicationName(instance, cfg.ApplicationName)
+		if l, ok := w.dynamic[instance]; ok {
+			delete(w.dynamic, instance)
+			stillOpen[instance] = l
+			continue
+		}
+
+		l, err := listenInstance(w.dst, cfg)
+		if err != nil {
+			logging.Errorf("Couldn't open socket for %q: %v", instance, err)
+			continue
+		}
+		logging.Infof("Listening on %s for %s", listenAddress(l), instance)
+		stillOpen[instance] = l
+	}
+
+	// Any instance in dynamicInstances was not in the most recent update.
+	// Clean up those instances' sockets by closing them, and give their
+	// connections drainTimeout to finish.
+	for instance, listener := range w.dynamic {
+		logging.Infof("Closing socket for instance %v; waiting up to %v for its connections to finish", instance, w.drainTimeout)
+		listener.Close()
+		go func(instance string) {
+			if err := w.client.DrainInstance(instance, w.drainTimeout); err != nil {
+				logging.Errorf("%v", err)
+			}
+		}(instance)
+	}
+
+	w.dynamic = stillOpen
+}
+
+// reload replaces the static instances with cfgs. The sockets of instances
+// whose configuration is unchanged are left open.
+func (w *instanceWatcher) reload(cfgs []instanceConfig) {
+	stillOpen := make(map[string]instanceListener)
+	for _, cfg := range cfgs {
+		instance := cfg.Instance
+		w.client.SetInstanceMaxConnections(instance, cfg.MaxConnections)
+		w.client.SetInstanceApplicationName(instance, cfg.ApplicationName)
+		if v, ok := w.static[instance]; ok {
+			delete(w.static, instance)
+			if v.cfg.Network == cfg.Network && v.cfg.Address == cfg.Address && v.cfg.Pipe == cfg.Pipe {
+				stillOpen[instance] = instanceListener{cfg, v.l}
 				continue
 			}
-			stillOpen[instance] = l
+			// The instance moved to a new socket; its existing connections
+			// are unaffected.
+			logging.Infof("Closing socket %v for instance %v", v.l.Addr(), instance)
+			v.l.Close()
+		}
+		if l, ok := w.dynamic[instance]; ok {
+			delete(w.dynamic, instance)
+			l.Close()
 		}
 
-		// Any instance in dynamicInstances was not in the most recent metadata
-		// update. Clean up those instances' sockets by closing them; note that
-		// this does not affect any existing connections instance.
-		for instance, listener := range dynamicInstances {
-			logging.Infof("Closing socket for instance %v", instance)
-			listener.Close()
+		l, err := listenInstance(w.dst, cfg)
+		if err != nil {
+			logging.Errorf("Couldn't open socket for %q: %v", instance, err)
+			continue
 		}
+		logging.Infof("Listening on %s for %s", listenAddress(l), instance)
+		stillOpen[instance] = instanceListener{cfg, l}
+	}
 
-		dynamicInstances = stillOpen
+	for instance, v := range w.static {
+		logging.Infof("Closing socket for removed instance %v; waiting up to %v for its connections to finish", instance, w.drainTimeout)
+		v.l.Close()
+		go func(instance string) {
+			if err := w.client.DrainInstance(instance, w.drainTimeout); err != nil {
+				logging.Errorf("%v", err)
+			}
+		}(instance)
 	}
 
-	for _, v := range static {
-		if err := v.Close(); err != nil {
-			logging.Errorf("Error closing %q: %v", v.Addr(), err)
+	w.static = stillOpen
+}
+
+// writePorts writes the TCP port of each instance listening on one to
+// portFile, and the address of every instance to discoveryFile, if they are
+// set.
+func (w *instanceWatcher) writePorts() {
+	if portFile == "" && discoveryFile == "" {
+		return
+	}
+	ls := make(map[string]net.Listener, len(w.static)+len(w.dynamic))
+	for inst, v := range w.static {
+		ls[inst] = v.l
+	}
+	for inst, l := range w.dynamic {
+		ls[inst] = l
+	}
+	if portFile != "" {
+		if err := writePortFile(portFile, ls); err != nil {
+			logging.Errorf("Failed to write -port_file: %v", err)
 		}
 	}
-	for _, v := range dynamicInstances {
-		if err := v.Close(); err != nil {
-			logging.Errorf("Error closing %q: %v", v.Addr(), err)
+	if discoveryFile != "" {
+		if err := writeDiscoveryFile(discoveryFile, ls); err != nil {
+			logging.Errorf("Failed to write -discovery_file: %v", err)
 		}
 	}
 }
 
+// writePortFile writes a line to path for each listener in ls, keyed by
+// instance, which listens on TCP, giving the instance and its port, e.g.
+// "my-project:my-region:my-instance 54321". The file is replaced atomically,
+// so that readers never see it partially written.
+func writePortFile(path string, ls map[string]net.Listener) error {
+	var insts []string
+	for inst := range ls {
+		insts = append(insts, inst)
+	}
+	sort.Strings(insts)
+	var b bytes.Buffer
+	for _, inst := range insts {
+		if addr, ok := ls[inst].Addr().(*net.TCPAddr); ok {
+			fmt.Fprintf(&b, "%s %d\n", inst, addr.Port)
+		}
+	}
+	return replaceFile(path, b.Bytes())
+}
+
+// discoveredAddress is an instance's entry in the -discovery_file.
+type discoveredAddress struct {
+	// Network is "unix" or "tcp", or "pipe" for a Windows named pipe.
+	Network string `json:"network"`
+	// Address is the socket's path, or the host and port listened on.
+	Address string `json:"address"`
+}
+
+// writeDiscoveryFile writes a JSON object to path, keyed by instance, giving
+// the network and address each listener in ls listens on, e.g.
+// {"my-project:my-region:my-instance": {"network": "tcp", "address":
+// "127.0.0.1:54321"}}. An instance listening on several sockets is given the
+// first. The file is replaced atomically.
+func writeDiscoveryFile(path string, ls map[string]net.Listener) error {
+	out := make(map[string]discoveredAddress, len(ls))
+	for inst, l := range ls {
+		if m, ok := l.(multiListener); ok {
+			l = m[0]
+		}
+		if ll, ok := l.(linkedListener); ok {
+			// Applications connect through the pool's symlink.
+			out[inst] = discoveredAddress{Network: "unix", Address: ll.link}
+			continue
+		}
+		out[inst] = discoveredAddress{Network: l.Addr().Network(), Address: l.Addr().String()}
+	}
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, append(b, '\n'))
+}
+
+// replaceFile replaces the contents of path with b atomically, by writing a
+// .tmp file and renaming it, so that readers never see it partially written.
+func replaceFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// isAbstractSocket reports whether addr names a Unix socket in the Linux
+// abstract namespace. Such sockets are introduced by "@" (which the net
+// package translates to a leading NUL byte) or by a NUL byte, have no file in
+// the filesystem, and disappear when the proxy exits.
+func isAbstractSocket(addr string) bool {
+	return strings.HasPrefix(addr, "@") || strings.HasPrefix(addr, "\x00")
+}
+
 func remove(path string) {
+	if isAbstractSocket(path) {
+		return
+	}
 	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 		logging.Infof("Remove(%q) error: %v", path, err)
 	}
 }
 
+// socketPerm is the permissions of the Unix sockets created by
+// listenInstance, set by -socket_permissions.
+var socketPerm os.FileMode = 0777
+
+// socketPool is the number of Unix sockets, each with a goroutine of its own
+// accepting connections, for each instance listening on a socket file, set by
+// -socket_pool_size.
+var socketPool = 1
+
+// listenerGoroutines is the number of listeners, each with a goroutine of its
+// own accepting connections, for each TCP address, set by
+// -listener_goroutines.
+var listenerGoroutines = 1
+
+// listenBacklog, if positive, is the backlog of connections waiting to be
+// accepted on each socket listenInstance opens, set by -max_conn_backlog.
+var listenBacklog int
+
+// portFile is the file to which the TCP ports of the instances are written
+// each time they change, set by -port_file. It is empty if they are not
+// written.
+var portFile string
+
+// discoveryFile is the file to which the address of every instance is
+// written each time they change, set by -discovery_file. It is empty if they
+// are not written.
+var discoveryFile string
+
+// inheritedSockets holds the sockets passed to the proxy by systemd socket
+// activation, or by the proxy process it replaces with -upgrade_socket, which
+// have not yet been used by listenInstance.
+var inheritedSockets *systemd.Sockets
+
+// handoverSockets holds the sockets listenInstance is listening on, mapped to
+// their instance, which -upgrade_socket hands over to a new proxy process.
+// Sockets are removed once acceptInstance stops accepting on them.
+var handoverSockets sync.Map
+
 // listenInstance starts listening on a new unix socket in dir to connect to the
-// specified instance. New connections to this socket are sent to dst.
+// specified instance, and on its named pipe if it has one. New connections to
+// this socket are sent to dst. A socket inherited from systemd or a previous
+// proxy process on the instance's address is used instead of a new one.
 func listenInstance(dst chan<- proxy.Conn, cfg instanceConfig) (net.Listener, error) {
-	unix := cfg.Network == "unix"
-	if unix {
-		remove(cfg.Address)
+	var ls multiListener
+	if cfg.Network != "" {
+		var socks []net.Listener
+		if l := inheritedSockets.Take(cfg.Network, cfg.Address); l != nil {
+			logging.Verbosef("Using inherited socket on %s for %s", l.Addr(), cfg.Instance)
+			socks = []net.Listener{l}
+		} else if cfg.Network == "unix" && socketPool > 1 && !isAbstractSocket(cfg.Address) {
+			var err error
+			if socks, err = listenUnixPool(cfg.Address, socketPool); err != nil {
+				return nil, err
+			}
+		} else if cfg.Network == "unix" {
+			l, err := listenUnix(cfg.Address)
+			if err != nil {
+				return nil, err
+			}
+			socks = []net.Listener{l}
+		} else {
+			var err error
+			if socks, err = listenTCP(cfg.Network, cfg.Address, listenerGoroutines); err != nil {
+				return nil, err
+			}
+		}
+		if listenBacklog > 0 {
+			for _, l := range socks {
+				if err := setBacklog(l, listenBacklog); err != nil {
+					logging.Errorf("WARNING: couldn't set the listen backlog of %s to %d: %v", l.Addr(), listenBacklog, err)
+				}
+			}
+		}
+		// The address listened on has the port chosen by the system if
+		// cfg.Address has port 0.
+		addr := socks[0].Addr().String()
+		for _, l := range socks {
+			handoverSockets.Store(l, cfg.Instance)
+			go acceptInstance(dst, cfg, l, addr)
+		}
+		ls = append(ls, socks...)
+		logging.Verbosef("Listening on %s for %s", addr, cfg.Instance)
 	}
-	l, err := net.Listen(cfg.Network, cfg.Address)
+	if cfg.Pipe != "" {
+		l, err := listenPipe(cfg.Pipe, *namedPipeSDDL)
+		if err != nil {
+			ls.Close()
+			return nil, err
+		}
+		go acceptInstance(dst, cfg, l, cfg.Pipe)
+		ls = append(ls, l)
+		logging.Verbosef("Listening on %s for %s", cfg.Pipe, cfg.Instance)
+	}
+	if len(ls) == 1 {
+		return ls[0], nil
+	}
+	return ls, nil
+}
+
+// listenUnix listens on the Unix socket at path, replacing any file already
+// there.
+func listenUnix(path string) (net.Listener, error) {
+	remove(path)
+	l, err := net.Listen("unix", path)
 	if err != nil {
 		return nil, err
 	}
-	if unix {
-		if err := os.Chmod(cfg.Address, 0777|os.ModeSocket); err != nil {
-			logging.Errorf("couldn't update permissions for socket file %q: %v; other users may not be unable to connect", cfg.Address, err)
+	if !isAbstractSocket(path) {
+		// The mode a socket is created with depends on the umask, so set it
+		// explicitly.
+		if err := os.Chmod(path, socketPerm|os.ModeSocket); err != nil {
+			logging.Errorf("couldn't update permissions for socket file %q to %v: %v", path, socketPerm, err)
 		}
 	}
+	return l, nil
+}
 
-	go func() {
-		for {
-			start := time.Now()
-			c, err := l.Accept()
-			if err != nil {
-				logging.Errorf("Error in accept for %q on %v: %v", cfg, cfg.Address, err)
-				if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-					d := 10*time.Millisecond - time.Since(start)
-					if d > 0 {
-						time.Sleep(d)
-					}
-					continue
-				}
-				l.Close()
-				return
-			}
-			logging.Verbosef("New connection for %q", cfg.Instance)
+// listenUnixPool listens on n Unix sockets, at path with the suffixes .0 to
+// .n-1, and makes path a symlink to the first of them so that applications
+// unaware of the pool can still connect. The symlink is removed when the
+// first listener is closed.
+func listenUnixPool(path string, n int) ([]net.Listener, error) {
+	var ls multiListener
+	for i := 0; i < n; i++ {
+		l, err := listenUnix(fmt.Sprintf("%s.%d", path, i))
+		if err != nil {
+			ls.Close()
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	remove(path)
+	// The link is relative, so that it still resolves where the directory
+	// is mounted at another path, as in a container.
+	if err := os.Symlink(filepath.Base(path)+".0", path); err != nil {
+		ls.Close()
+		return nil, err
+	}
+	ls[0] = linkedListener{Listener: ls[0], link: path}
+	return ls, nil
+}
 
-			switch clientConn := c.(type) {
-			case *net.TCPConn:
-				clientConn.SetKeepAlive(true)
-				clientConn.SetKeepAlivePeriod(1 * time.Minute)
+// linkedListener is a listener whose socket is also reachable through a
+// symlink, which is removed when the listener is closed.
+type linkedListener struct {
+	net.Listener
+	link string
+}
 
-			}
-			dst <- proxy.Conn{cfg.Instance, c}
+func (l linkedListener) Close() error {
+	remove(l.link)
+	return l.Listener.Close()
+}
+
+// multiListener is the set of listeners for an instance with both a socket
+// and a named pipe, or with several listeners on one TCP address. Connections
+// are accepted by acceptInstance; it is only closed as a whole.
+type multiListener []net.Listener
+
+func (ls multiListener) Accept() (net.Conn, error) {
+	return nil, errors.New("multiListener does not accept connections")
+}
+
+func (ls multiListener) Close() error {
+	var err error
+	for _, l := range ls {
+		if cerr := l.Close(); err == nil {
+			err = cerr
 		}
-	}()
+	}
+	return err
+}
 
-	logging.Infof("Listening on %s for %s", cfg.Address, cfg.Instance)
-	return l, nil
+func (ls multiListener) Addr() net.Addr {
+	return ls[0].Addr()
+}
+
+// acceptInstance sends the connections accepted by l, which listens on addr for
+// the instance configured by cfg, to dst.
+func acceptInstance(dst chan<- proxy.Conn, cfg instanceConfig, l net.Listener, addr string) {
+	for {
+		start := time.Now()
+		c, err := l.Accept()
+		if err != nil {
+			logging.Errorf("Error in accept for %q on %v: %v", cfg, addr, err)
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				d := 10*time.Millisecond - time.Since(start)
+				if d > 0 {
+					time.Sleep(d)
+				}
+				continue
+			}
+			handoverSockets.Delete(l)
+			l.Close()
+			return
+		}
+		logging.Verbosef("New connection for %q", cfg.Instance)
+		dst <- proxy.Conn{cfg.Instance, c}
+	}
 }
 
 type instanceConfig struct {
 	Instance         string
 	Network, Address string
+	// MaxConnections limits the number of simultaneous connections to the
+	// instance. 0 means no limit.
+	MaxConnections uint64
+	// PSC is set if the instance should be reached through its Private
+	// Service Connect endpoint, whatever -ip_address_types says.
+	PSC bool
+	// IPType, if set, is the only type of IP address, e.g. "PRIVATE", used
+	// to reach the instance, whatever -ip_address_types says.
+	IPType string
+	// Pipe, if set, is the path of a Windows named pipe to listen on, in
+	// addition to Network and Address if they are set.
+	Pipe string
+	// ApplicationName, if set, overrides -application_name for the
+	// instance's sessions.
+	ApplicationName string
+	// CredentialFile, if set, is the path to a credentials file used for the
+	// instance in place of the proxy's default credentials.
+	CredentialFile string
+	// ImpersonateServiceAccount, if set, is the email address of a service
+	// account impersonated to connect to the instance.
+	ImpersonateServiceAccount string
 }
 
 // loopbackForNet maps a network (e.g. tcp6) to the loopback address for that
@@ -225,31 +624,84 @@ var validNets = func() map[string]bool {
 
 func parseInstanceConfig(dir, instance string, cl *http.Client) (instanceConfig, error) {
 	var ret instanceConfig
-	args := strings.Split(instance, "=")
-	if len(args) > 2 {
-		return instanceConfig{}, fmt.Errorf("invalid instance argument: must be either form - `<instance_connection_string>` or `<instance_connection_string>=<options>`; invalid arg was %q", instance)
+	instance, err := canonicalInstance(instance)
+	if err != nil {
+		return instanceConfig{}, err
 	}
-	// Parse the instance connection name - everything before the "=".
+	args := strings.Split(instance, "=")
+	// Parse the instance connection name - everything before the first "=".
 	ret.Instance = args[0]
 	proj, region, name := util.SplitName(ret.Instance)
 	regionName := fmt.Sprintf("%s~%s", region, name)
 	if proj == "" || region == "" || name == "" {
 		return instanceConfig{}, fmt.Errorf("invalid instance connection string: must be in the form `project:region:instance-name`; invalid name was %q", args[0])
 	}
-	if len(args) == 1 {
-		// Default to listening via unix socket in specified directory
-		ret.Network = "unix"
-		ret.Address = filepath.Join(dir, instance)
-	} else {
-		// Parse the instance options if present.
-		opts := strings.SplitN(args[1], ":", 2)
+	// Parse the instance options if present. Each option is introduced by
+	// an "=", e.g. "project:region:instance=tcp:3306=maxconns:10=psc:true".
+	for _, arg := range args[1:] {
+		opts := strings.SplitN(arg, ":", 2)
 		if len(opts) != 2 {
-			return instanceConfig{}, fmt.Errorf("invalid instance options: must be in the form `unix:/path/to/socket`, `tcp:port`, `tcp:host:port`; invalid option was %q", strings.Join(opts, ":"))
+			return instanceConfig{}, fmt.Errorf("invalid instance options: must be in the form `unix:/path/to/socket`, `tcp:port`, `tcp:host:port`, `pipe:name`, `maxconns:N`, `psc:true`, `ip:private`, `appname:name`, `credentials:/path/to/file`, or `impersonate:SA_EMAIL`; invalid option was %q", strings.Join(opts, ":"))
+		}
+		if opts[0] == "maxconns" {
+			n, err := strconv.ParseUint(opts[1], 10, 64)
+			if err != nil || n == 0 {
+				return instanceConfig{}, fmt.Errorf("invalid %q: maxconns must be a positive integer, got %q", instance, opts[1])
+			}
+			ret.MaxConnections = n
+			continue
+		}
+		if opts[0] == "pipe" {
+			if runtime.GOOS != "windows" {
+				return instanceConfig{}, fmt.Errorf("invalid %q: named pipes are only supported on Windows", instance)
+			}
+			ret.Pipe = pipePath(opts[1])
+			continue
+		}
+		if opts[0] == "appname" {
+			ret.ApplicationName = opts[1]
+			continue
+		}
+		if opts[0] == "ip" {
+			switch t := strings.ToUpper(opts[1]); t {
+			case "PUBLIC", "PRIVATE":
+				ret.IPType = t
+			default:
+				return instanceConfig{}, fmt.Errorf("invalid %q: ip must be public or private, got %q", instance, opts[1])
+			}
+			continue
+		}
+		if opts[0] == "credentials" {
+			ret.CredentialFile = opts[1]
+			continue
+		}
+		if opts[0] == "impersonate" {
+			if !strings.Contains(opts[1], "@") {
+				return instanceConfig{}, fmt.Errorf("invalid %q: impersonate must be a service account email address, got %q", instance, opts[1])
+			}
+			ret.ImpersonateServiceAccount = opts[1]
+			continue
+		}
+		if opts[0] == "psc" {
+			psc, err := strconv.ParseBool(opts[1])
+			if err != nil {
+				return instanceConfig{}, fmt.Errorf("invalid %q: psc must be true or false, got %q", instance, opts[1])
+			}
+			ret.PSC = psc
+			continue
+		}
+		if ret.Network != "" {
+			return instanceConfig{}, fmt.Errorf("invalid %q: only one of `unix:...` or `tcp:...` may be specified", instance)
 		}
 		ret.Network = opts[0]
 		var err error
 		if ret.Network == "unix" {
-			if strings.HasPrefix(opts[1], "/") {
+			if isAbstractSocket(opts[1]) {
+				if runtime.GOOS != "linux" {
+					return instanceConfig{}, fmt.Errorf("invalid %q: abstract Unix sockets are only supported on Linux", instance)
+				}
+				ret.Address = opts[1]
+			} else if strings.HasPrefix(opts[1], "/") {
 				ret.Address = opts[1] // Root path.
 			} else {
 				ret.Address = filepath.Join(dir, opts[1])
@@ -261,6 +713,47 @@ func parseInstanceConfig(dir, instance string, cl *http.Client) (instanceConfig,
 			return instanceConfig{}, err
 		}
 	}
+	if ret.PSC && ret.IPType != "" {
+		return instanceConfig{}, fmt.Errorf("invalid %q: only one of `psc:true` or `ip:...` may be specified", instance)
+	}
+	if ret.Pipe == "" && *namedPipes {
+		ret.Pipe = pipePath(`cloudsql\` + ret.Instance)
+	}
+	if ret.Network == "" && ret.Pipe == "" && *cloudRunSidecar {
+		// Listen on the engine's usual port, which is only known once the
+		// instance has been looked up.
+		ret.Network = "tcp"
+	}
+	if ret.Network == "" && (ret.Pipe == "" || *namedPipes) {
+		// Default to listening via unix socket in specified directory, or
+		// else on a TCP port chosen by the system.
+		var reason string
+		switch {
+		case !validNets["unix"]:
+			reason = "Unix sockets are not supported on " + runtime.GOOS
+		case dir == "":
+			reason = "-dir is not set"
+		default:
+			ret.Network = "unix"
+			ret.Address = filepath.Join(dir, ret.Instance)
+		}
+		if reason != "" {
+			ret.Network = "tcp"
+			ret.Address = net.JoinHostPort(loopbackForNet["tcp"], "0")
+			logging.Infof("Listening for %s on a TCP port chosen by the system, as %s; give the instance a tcp: option to choose the port, and see -discovery_file to find it", ret.Instance, reason)
+		}
+	}
+
+	if ret.Network != "" && !validNets[ret.Network] {
+		return ret, fmt.Errorf("invalid %q: unsupported network: %v", instance, ret.Network)
+	}
+	// With -lazy, the instance is first looked up when a client connects to
+	// it, unless its database engine is needed to name its Unix socket or
+	// choose its port.
+	needsPort := ret.Network == "tcp" && ret.Address == ""
+	if *lazy && ret.Network != "unix" && !needsPort {
+		return ret, nil
+	}
 
 	// Use the SQL Admin API to verify compatibility with the instance.
 	sql, err := sqladmin.New(cl)
@@ -278,20 +771,94 @@ func parseInstanceConfig(dir, instance string, cl *http.Client) (instanceConfig,
 		logging.Errorf("WARNING: proxy client does not support first generation Cloud SQL instances.")
 		return instanceConfig{}, fmt.Errorf("%q is a first generation instance", instance)
 	}
+	if needsPort {
+		if ret.Address, err = sidecarAddress(inst.DatabaseVersion); err != nil {
+			return instanceConfig{}, fmt.Errorf("invalid %q: %v; set a port with `tcp:port`", instance, err)
+		}
+	}
 	// Postgres instances use a special suffix on the unix socket.
 	// See https://www.postgresql.org/docs/11/runtime-config-connection.html
 	if ret.Network == "unix" && strings.HasPrefix(strings.ToLower(inst.DatabaseVersion), "postgres") {
-		// Verify the directory exists.
-		if err := os.MkdirAll(ret.Address, 0755); err != nil {
-			return instanceConfig{}, err
+		// Verify the directory exists. Abstract sockets have no directory.
+		if !isAbstractSocket(ret.Address) {
+			if err := os.MkdirAll(ret.Address, 0755); err != nil {
+				return instanceConfig{}, err
+			}
 		}
 		ret.Address = filepath.Join(ret.Address, ".s.PGSQL.5432")
 	}
+	return ret, nil
+}
 
-	if !validNets[ret.Network] {
-		return ret, fmt.Errorf("invalid %q: unsupported network: %v", instance, ret.Network)
+// instanceURIScheme introduces an instance given as a URI, e.g.
+// "cloudsql://project:region:instance/dbname".
+const instanceURIScheme = "cloudsql://"
+
+// canonicalInstance returns instance, a value of the -instances flag, with an
+// instance given as a cloudsql:// URI replaced by its instance connection
+// name, e.g. "cloudsql://proj:region:inst/db=tcp:5432" becomes
+// "proj:region:inst=tcp:5432". Other values are returned unchanged. The
+// database in the URI's path is accepted so that URIs from application
+// settings can be used as they are, but does not affect the proxy: clients
+// choose the database when they connect.
+func canonicalInstance(instance string) (string, error) {
+	if !strings.HasPrefix(instance, instanceURIScheme) {
+		return instance, nil
 	}
-	return ret, nil
+	parts := strings.SplitN(instance, "=", 2)
+	uri := parts[0]
+	rest := strings.TrimPrefix(uri, instanceURIScheme)
+	if strings.ContainsAny(rest, "?#") {
+		return "", fmt.Errorf("invalid instance URI %q: query parameters and fragments are not supported", uri)
+	}
+	name := rest
+	if i := strings.Index(rest, "/"); i >= 0 {
+		name = rest[:i]
+		if db := rest[i+1:]; strings.Contains(db, "/") {
+			return "", fmt.Errorf("invalid instance URI %q: the path may only name a database, got %q", uri, db)
+		}
+	}
+	if name == "" {
+		return "", fmt.Errorf("invalid instance URI %q: must be in the form `cloudsql://project:region:instance-name[/database]`", uri)
+	}
+	if !util.ValidName(name) {
+		return "", fmt.Errorf("invalid instance URI %q: %q is not an instance connection name in the form `project:region:instance-name`", uri, name)
+	}
+	if len(parts) == 2 {
+		return name + "=" + parts[1], nil
+	}
+	return name, nil
+}
+
+// pipePath returns the path of the named pipe called name.
+func pipePath(name string) string {
+	if strings.HasPrefix(name, `\\.\pipe\`) {
+		return name
+	}
+	return `\\.\pipe\` + name
+}
+
+// instanceCredentials returns the instance connection name of instance, a
+// value of the -instances flag, the path given by its credentials option and
+// the service account given by its impersonate option, if any.
+func instanceCredentials(instance string) (name, path, impersonate string) {
+	if c, err := canonicalInstance(instance); err == nil {
+		instance = c
+	}
+	args := strings.Split(instance, "=")
+	for _, arg := range args[1:] {
+		opts := strings.SplitN(arg, ":", 2)
+		if len(opts) != 2 {
+			continue
+		}
+		switch opts[0] {
+		case "credentials":
+			path = opts[1]
+		case "impersonate":
+			impersonate = opts[1]
+		}
+	}
+	return args[0], path, impersonate
 }
 
 // parseTCPOpts parses the instance options when specifying tcp port options.
@@ -307,17 +874,261 @@ func parseTCPOpts(ntwk, addrOpt string) (string, error) {
 	return net.JoinHostPort(addr, addrOpt), nil
 }
 
+// parseCIDRs parses a comma-separated list of networks in CIDR notation.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range stringList(s) {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parseMetricLabels parses the -metric_labels flag, a comma-separated list of
+// key=value labels.
+func parseMetricLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, v := range stringList(s) {
+		kv := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("labels must be in the form key=value, got %q", v)
+		}
+		if _, ok := labels[kv[0]]; ok {
+			return nil, fmt.Errorf("label %q is given more than once", kv[0])
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
+// parseProjectMaxConns parses the -project_max_connections flag, a
+// comma-separated list of project=N limits.
+func parseProjectMaxConns(s string) (map[string]uint64, error) {
+	limits := make(map[string]uint64)
+	for _, v := range stringList(s) {
+		kv := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("limits must be in the form project=N, got %q", v)
+		}
+		n, err := strconv.ParseUint(kv[1], 10, 64)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("limit for project %q must be a positive integer, got %q", kv[0], kv[1])
+		}
+		if _, ok := limits[kv[0]]; ok {
+			return nil, fmt.Errorf("project %q is given more than once", kv[0])
+		}
+		limits[kv[0]] = n
+	}
+	return limits, nil
+}
+
+// parseProxyAddress parses the -proxy_address flag. An address without a
+// scheme is taken to be an HTTP proxy. An empty string is returned as nil.
+func parseProxyAddress(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, want http, https or socks5", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("proxy address %q has no host", s)
+	}
+	return u, nil
+}
+
+// socks5URL returns the URL of the SOCKS5 proxy given by the -socks5_proxy,
+// -socks5_username and -socks5_password flags. An empty addr is returned as
+// nil, in which case no credentials may be given.
+func socks5URL(addr, user, pass string) (*url.URL, error) {
+	if addr == "" {
+		if user != "" || pass != "" {
+			return nil, errors.New("a username or password requires -socks5_proxy")
+		}
+		return nil, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("proxy address %q must be host:port", addr)
+	}
+	u := &url.URL{Scheme: "socks5", Host: addr}
+	if user != "" || pass != "" {
+		u.User = url.UserPassword(user, pass)
+	}
+	return u, nil
+}
+
+// tlsVersions maps the names accepted by -tls_min_version to TLS versions.
+var tlsVersions = map[string]uint16{
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses the -tls_min_version flag. An empty string selects
+// Go's default minimum version and is returned as 0.
+func parseTLSVersion(s string) (uint16, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[strings.ToUpper(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, want TLS12 or TLS13", s)
+	}
+	return v, nil
+}
+
+// bandwidthUnits maps the suffixes accepted by parseBandwidth to the number of
+// bytes they stand for.
+var bandwidthUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	// Longer suffixes come first so that e.g. "MiB" is not taken for "B".
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+	{"K", 1e3}, {"M", 1e6}, {"G", 1e9},
+	{"B", 1},
+}
+
+// parseBackoff returns the backoff configured by -retry_initial_delay,
+// -retry_max_delay and -retry_multiplier.
+func parseBackoff(initial, max time.Duration, mult float64) (certs.Backoff, error) {
+	switch {
+	case initial <= 0:
+		return certs.Backoff{}, fmt.Errorf("-retry_initial_delay must be positive, got %v", initial)
+	case max < initial:
+		return certs.Backoff{}, fmt.Errorf("-retry_max_delay (%v) must be at least -retry_initial_delay (%v)", max, initial)
+	case mult < 1:
+		return certs.Backoff{}, fmt.Errorf("-retry_multiplier must be at least 1, got %v", mult)
+	}
+	return certs.Backoff{InitialDelay: initial, MaxDelay: max, Multiplier: mult}, nil
+}
+
+// parseSocketPermissions parses the value of -socket_permissions, an octal
+// file mode such as "0660".
+func parseSocketPermissions(s string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0777 {
+		return 0, fmt.Errorf("%q is not an octal file mode between 0000 and 0777", s)
+	}
+	return os.FileMode(n), nil
+}
+
+// parseBandwidth parses a rate in bytes per second, such as "500000",
+// "10MB" or "1.5MiB". An empty string means no limit and is returned as 0.
+func parseBandwidth(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	num, mult := s, int64(1)
+	for _, u := range bandwidthUnits {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(u.suffix)) {
+			num, mult = strings.TrimSpace(s[:len(s)-len(u.suffix)]), u.bytes
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f <= 0 || f*float64(mult) < 1 || f*float64(mult) > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid bandwidth %q, want a positive number of bytes per second such as 500000 or 10MB", s)
+	}
+	return int64(f * float64(mult)), nil
+}
+
+// parseCipherSuites parses a comma-separated list of cipher suite names, as
+// reported by tls.CipherSuiteName, into their IDs. Only secure TLS 1.0-1.2
+// suites are accepted; TLS 1.3 suites cannot be configured.
+func parseCipherSuites(s string) ([]uint16, error) {
+	valid := make(map[string]uint16)
+	var names []string
+	for _, cs := range tls.CipherSuites() {
+		if len(cs.SupportedVersions) == 1 && cs.SupportedVersions[0] == tls.VersionTLS13 {
+			continue
+		}
+		valid[cs.Name] = cs.ID
+		names = append(names, cs.Name)
+	}
+	var ids []uint16
+	for _, v := range stringList(s) {
+		name := strings.TrimSpace(v)
+		id, ok := valid[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported cipher suite %q; valid cipher suites are %v", name, strings.Join(names, ", "))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
 // parseInstanceConfigs calls parseInstanceConfig for each instance in the
 // provided slice, collecting errors along the way. There may be valid
-// instanceConfigs returned even if there's an error.
-func parseInstanceConfigs(dir string, instances []string, cl *http.Client, skipFailedInstanceConfigs bool) ([]instanceConfig, error) {
+// instanceConfigs returned even if there's an error. Instances with an entry
+// in instClients are looked up using that client rather than cl; instances
+// with a credentials option must have one.
+//
+// The instance connection names are checked first, and unless
+// skipFailedInstanceConfigs is set, no instance is looked up if any name is
+// malformed.
+func parseInstanceConfigs(dir string, instances []string, cl *http.Client, instClients map[string]*http.Client, skipFailedInstanceConfigs bool) ([]instanceConfig, error) {
 	errs := new(bytes.Buffer)
-	var cfg []instanceConfig
-	for _, v := range instances {
+	invalid := make(map[int]bool)
+	for i, v := range instances {
 		if v == "" {
 			continue
 		}
-		if c, err := parseInstanceConfig(dir, v, cl); err != nil {
+		var err error
+		if c, uriErr := canonicalInstance(v); uriErr != nil {
+			err = fmt.Errorf("invalid instance at position %d: %v", i+1, uriErr)
+		} else if name := strings.SplitN(c, "=", 2)[0]; !util.ValidName(name) {
+			err = fmt.Errorf("invalid instance connection name %q at position %d: must be in the form `project:region:instance-name`, or `domain:project:region:instance-name` for a domain-scoped project", name, i+1)
+		}
+		if err != nil {
+			if skipFailedInstanceConfigs {
+				logging.Infof("There was a problem when parsing an instance configuration but ignoring due to the configuration. Error: %v", err)
+			} else {
+				fmt.Fprintf(errs, "\n\t%v", err)
+			}
+			invalid[i] = true
+		}
+	}
+	if errs.Len() > 0 {
+		return nil, fmt.Errorf("errors parsing config:%s", errs)
+	}
+
+	var cfg []instanceConfig
+	for i, v := range instances {
+		if v == "" || invalid[i] {
+			continue
+		}
+		name, credFile, impersonate := instanceCredentials(v)
+		instCl, ok := instClients[name]
+		if !ok {
+			instCl = cl
+		}
+		var c instanceConfig
+		var err error
+		if (credFile != "" || impersonate != "") && !ok {
+			// Credentials are only loaded for instances given by
+			// -instances or the config file, not those listed in metadata.
+			err = fmt.Errorf("invalid %q: credentials and impersonate may only be set with -instances or -config_file", v)
+		} else {
+			c, err = parseInstanceConfig(dir, v, instCl)
+		}
+		if err != nil {
 			if skipFailedInstanceConfigs {
 				logging.Infof("There was a problem when parsing an instance configuration but ignoring due to the configuration. Error: %v", err)
 			} else {
@@ -336,16 +1147,46 @@ func parseInstanceConfigs(dir string, instances []string, cl *http.Client, skipF
 	return cfg, err
 }
 
+// createSocketDir creates dir, along with any missing parents, if it does
+// not already exist. Directories created by the proxy are only accessible to
+// the user running it.
+func createSocketDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("could not create directory %q for -dir: %v; check the permissions of its parent directories", dir, err)
+	}
+	return nil
+}
+
+// metadataInstancesPath returns the metadata path watched for -instances_metadata
+// src: src itself if it is a path, e.g. "project/attributes/sql-instances", or
+// otherwise the path of the custom instance attribute src.
+func metadataInstancesPath(src string) string {
+	if strings.Contains(src, "/") {
+		return src
+	}
+	return "instance/attributes/" + src
+}
+
 // CreateInstanceConfigs verifies that the parameters passed to it are valid
 // for the proxy for the platform and system and then returns a slice of valid
 // instanceConfig. It is possible for the instanceConfig to be empty if no valid
 // configurations were specified, however `err` will be set.
-func CreateInstanceConfigs(dir string, useFuse bool, instances []string, instancesSrc string, cl *http.Client, skipFailedInstanceConfigs bool) ([]instanceConfig, error) {
+func CreateInstanceConfigs(dir string, useFuse bool, instances []string, instancesSrc, instancesDNS string, cl *http.Client, instClients map[string]*http.Client, skipFailedInstanceConfigs bool) ([]instanceConfig, error) {
 	if useFuse && !fuse.Supported() {
 		return nil, errors.New("FUSE not supported on this system")
 	}
 
-	cfgs, err := parseInstanceConfigs(dir, instances, cl, skipFailedInstanceConfigs)
+	if dir != "" {
+		if err := createSocketDir(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	if instancesSrc != "" && instancesDNS != "" {
+		return nil, errors.New("-instances_metadata is not compatible with -instances_dns")
+	}
+
+	cfgs, err := parseInstanceConfigs(dir, instances, cl, instClients, skipFailedInstanceConfigs)
 	if err != nil {
 		return nil, err
 	}
@@ -353,15 +1194,17 @@ func CreateInstanceConfigs(dir string, useFuse bool, instances []string, instanc
 	if dir == "" {
 		// Reasons to set '-dir':
 		//    - Using -fuse
-		//    - Using the metadata to get a list of instances
+		//    - Using the metadata or DNS to get a list of instances
 		//    - Having an instance that uses a 'unix' network
 		if useFuse {
 			return nil, errors.New("must set -dir because -fuse was set")
 		} else if instancesSrc != "" {
 			return nil, errors.New("must set -dir because -instances_metadata was set")
+		} else if instancesDNS != "" {
+			return nil, errors.New("must set -dir because -instances_dns was set")
 		} else {
 			for _, v := range cfgs {
-				if v.Network == "unix" {
+				if v.Network == "unix" && !isAbstractSocket(v.Address) {
 					return nil, fmt.Errorf("must set -dir: using a unix socket for %v", v.Instance)
 				}
 			}
@@ -370,21 +1213,21 @@ func CreateInstanceConfigs(dir string, useFuse bool, instances []string, instanc
 	}
 
 	if useFuse {
-		if len(instances) != 0 || instancesSrc != "" {
-			return nil, errors.New("-fuse is not compatible with -projects, -instances, or -instances_metadata")
+		if len(instances) != 0 || instancesSrc != "" || instancesDNS != "" {
+			return nil, errors.New("-fuse is not compatible with -projects, -instances, -instances_metadata, or -instances_dns")
 		}
 		return nil, nil
 	}
 	// FUSE disabled.
-	if len(instances) == 0 && instancesSrc == "" {
+	if len(instances) == 0 && instancesSrc == "" && instancesDNS == "" {
 		// Failure to specifying instance can be caused by following reasons.
 		// 1. not enough information is provided by flags
 		// 2. failed to invoke gcloud
 		var flags string
 		if fuse.Supported() {
-			flags = "-projects, -fuse, -instances or -instances_metadata"
+			flags = "-projects, -fuse, -instances, -instances_metadata or -instances_dns"
 		} else {
-			flags = "-projects, -instances or -instances_metadata"
+			flags = "-projects, -instances, -instances_metadata or -instances_dns"
 		}
 
 		errStr := fmt.Sprintf("no instance selected because none of %s is specified", flags)
@@ -392,3 +1235,45 @@ func CreateInstanceConfigs(dir string, useFuse bool, instances []string, instanc
 	}
 	return cfgs, nil
 }
+
+// instanceCertSource is a proxy.CertSource which uses a dedicated CertSource
+// for some instances, e.g. those configured with their own credentials, and
+// the embedded CertSource for all others.
+type instanceCertSource struct {
+	proxy.CertSource
+
+	mu         sync.RWMutex
+	byInstance map[string]proxy.CertSource
+}
+
+// set makes src the CertSource for instance. If src is nil, the embedded
+// CertSource is used.
+func (s *instanceCertSource) set(instance string, src proxy.CertSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if src == nil {
+		delete(s.byInstance, instance)
+		return
+	}
+	s.byInstance[instance] = src
+}
+
+func (s *instanceCertSource) source(instance string) proxy.CertSource {
+	s.mu.RLock()
+	src, ok := s.byInstance[instance]
+	s.mu.RUnlock()
+	if ok {
+		return src
+	}
+	return s.CertSource
+}
+
+// Local implements proxy.CertSource.
+func (s *instanceCertSource) Local(instance string) (tls.Certificate, error) {
+	return s.source(instance).Local(instance)
+}
+
+// Remote implements proxy.CertSource.
+func (s *instanceCertSource) Remote(instance string) (*x509.Certificate, string, string, string, error) {
+	return s.source(instance).Remote(instance)
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file contains code for resolving hostnames with the DNS server and
+// search domains given by -dns_resolver and -dns_search_domains.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// parseDNSResolver returns the address of the DNS server given by
+// -dns_resolver, an IP address with an optional port, which defaults to 53.
+func parseDNSResolver(s string) (string, error) {
+	host, port := s, "53"
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host, port = h, p
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("%q is not an IP address, optionally with a port", s)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// useDNSResolver makes every lookup through net.DefaultResolver, which the
+// proxy's connections and API requests use, query the DNS server at addr.
+func useDNSResolver(addr string) {
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// dnsSearch qualifies hostnames with a list of search domains.
+type dnsSearch []string
+
+// names returns the names to look up for host, in order. As with the search
+// list of resolv.conf, names ending in a dot are used as they are, names
+// containing a dot are tried before the search domains, and other names
+// after them.
+func (s dnsSearch) names(host string) []string {
+	if len(s) == 0 || strings.HasSuffix(host, ".") || net.ParseIP(host) != nil {
+		return []string{host}
+	}
+	var names []string
+	for _, d := range s {
+		names = append(names, host+"."+strings.Trim(d, "."))
+	}
+	if strings.Contains(host, ".") {
+		return append([]string{host}, names...)
+	}
+	return append(names, host)
+}
+
+// notFound reports whether err means a name doesn't exist, so that the next
+// search domain should be tried.
+func notFound(err error) bool {
+	e, ok := err.(*net.DNSError)
+	if !ok {
+		if op, isOp := err.(*net.OpError); isOp {
+			e, ok = op.Err.(*net.DNSError)
+		}
+	}
+	return ok && e.IsNotFound
+}
+
+// dialer returns a dial function which tries dial with each name of the
+// address's host in turn, until one of them is found.
+func (s dnsSearch) dialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return dial(ctx, network, addr)
+		}
+		var conn net.Conn
+		for _, name := range s.names(host) {
+			conn, err = dial(ctx, network, net.JoinHostPort(name, port))
+			if !notFound(err) {
+				break
+			}
+		}
+		return conn, err
+	}
+}
+
+// lookupTXT returns the TXT records of the first name of host which is found.
+func (s dnsSearch) lookupTXT(lookup func(string) ([]string, error)) func(string) ([]string, error) {
+	return func(host string) ([]string, error) {
+		var (
+			records []string
+			err     error
+		)
+		for _, name := range s.names(host) {
+			records, err = lookup(name)
+			if !notFound(err) {
+				break
+			}
+		}
+		return records, err
+	}
+}
+
+// configureDNS applies -dns_resolver and -dns_search_domains. Search domains
+// apply to requests to the Admin API and other Google APIs, and to the
+// lookups of -instances_dns; the addresses of instances are IP addresses and
+// aren't looked up.
+func configureDNS() error {
+	if *dnsResolver != "" {
+		addr, err := parseDNSResolver(*dnsResolver)
+		if err != nil {
+			return fmt.Errorf("invalid -dns_resolver: %v", err)
+		}
+		useDNSResolver(addr)
+	}
+	search := dnsSearch(stringList(*dnsSearchDomains))
+	if len(search) == 0 {
+		return nil
+	}
+	for _, d := range search {
+		if strings.Trim(d, ".") == "" || strings.ContainsAny(d, " /:") {
+			return fmt.Errorf("invalid -dns_search_domains: %q is not a domain name", d)
+		}
+	}
+	t := http.DefaultTransport.(*http.Transport)
+	// The same settings as http.DefaultTransport's own dialer.
+	d := net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	t.DialContext = search.dialer(d.DialContext)
+	lookupTXT = search.lookupTXT(lookupTXT)
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseDNSResolver(t *testing.T) {
+	for _, v := range []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "10.0.0.2", want: "10.0.0.2:53"},
+		{in: "10.0.0.2:5353", want: "10.0.0.2:5353"},
+		{in: "[fd00::2]:53", want: "[fd00::2]:53"},
+		{in: "fd00::2", want: "[fd00::2]:53"},
+		{in: "dns.example.com:53", wantErr: true},
+		{in: "", wantErr: true},
+	} {
+		got, err := parseDNSResolver(v.in)
+		if v.wantErr {
+			if err == nil {
+				t.Errorf("parseDNSResolver(%q) = %q, want error", v.in, got)
+			}
+			continue
+		}
+		if err != nil || got != v.want {
+			t.Errorf("parseDNSResolver(%q) = %q, %v; want %q", v.in, got, err, v.want)
+		}
+	}
+}
+
+func TestDNSSearchNames(t *testing.T) {
+	s := dnsSearch{"corp.example.com", "example.com."}
+	for _, v := range []struct {
+		host string
+		want []string
+	}{
+		{"db", []string{"db.corp.example.com", "db.example.com", "db"}},
+		{"db.internal", []string{"db.internal", "db.internal.corp.example.com", "db.internal.example.com"}},
+		{"db.example.com.", []string{"db.example.com."}},
+		{"10.0.0.1", []string{"10.0.0.1"}},
+	} {
+		if got := s.names(v.host); !reflect.DeepEqual(got, v.want) {
+			t.Errorf("names(%q) = %v, want %v", v.host, got, v.want)
+		}
+	}
+	if got := (dnsSearch{}).names("db"); !reflect.DeepEqual(got, []string{"db"}) {
+		t.Errorf("names without search domains = %v, want [db]", got)
+	}
+}
+
+func TestDNSSearchDialer(t *testing.T) {
+	var dialed []string
+	dial := dnsSearch{"a.example", "b.example"}.dialer(func(_ context.Context, _, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if addr == "db.b.example:443" {
+			return nil, errors.New("connection refused")
+		}
+		return nil, &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}}
+	})
+	_, err := dial(context.Background(), "tcp", "db:443")
+	if err == nil || notFound(err) {
+		t.Errorf("dial returned %v, want the error of the name which was found", err)
+	}
+	if want := []string{"db.a.example:443", "db.b.example:443"}; !reflect.DeepEqual(dialed, want) {
+		t.Errorf("dialed %v, want %v", dialed, want)
+	}
+}
+
+func TestDNSSearchLookupTXT(t *testing.T) {
+	lookup := dnsSearch{"example.com"}.lookupTXT(func(name string) ([]string, error) {
+		if name == "db.example.com" {
+			return []string{"proj:reg:db"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	})
+	got, err := lookup("db")
+	if err != nil || !reflect.DeepEqual(got, []string{"proj:reg:db"}) {
+		t.Errorf("lookupTXT(db) = %v, %v; want [proj:reg:db]", got, err)
+	}
+	if _, err := lookup("other"); !notFound(err) {
+		t.Errorf("lookupTXT(other) returned %v, want a not found error", err)
+	}
+}
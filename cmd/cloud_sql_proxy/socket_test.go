@@ -0,0 +1,60 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+)
+
+func TestSocketPermissions(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "socketperm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// A permissive umask would otherwise leave the socket accessible to
+	// everyone, and a strict one to no one but its owner.
+	for _, umask := range []int{0, 0022, 0077} {
+		for _, perm := range []os.FileMode{0600, 0660, 0777} {
+			old := syscall.Umask(umask)
+			socketPerm = perm
+			cfg := instanceConfig{Instance: "proj:reg:inst", Network: "unix", Address: filepath.Join(tmp, "sock")}
+			l, err := listenInstance(make(chan proxy.Conn), cfg)
+			syscall.Umask(old)
+			socketPerm = 0777
+			if err != nil {
+				t.Fatalf("listenInstance: %v", err)
+			}
+			fi, err := os.Stat(cfg.Address)
+			l.Close()
+			if err != nil {
+				t.Fatalf("os.Stat: %v", err)
+			}
+			if got := fi.Mode().Perm(); got != perm {
+				t.Errorf("with umask %#o, socket has permissions %v, want %v", umask, got, perm)
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+)
+
+// statsDump is the summary written by dumpStats.
+type statsDump struct {
+	Time              time.Time             `json:"time"`
+	ActiveConnections uint64                `json:"active_connections"`
+	Instances         []proxy.InstanceStats `json:"instances"`
+}
+
+// writeStats writes a JSON summary of c's activity for instances, and any
+// other instances it has connected to, to w.
+func writeStats(w io.Writer, c *proxy.Client, instances []string) error {
+	d := statsDump{
+		Time:      time.Now(),
+		Instances: c.Stats(instances...),
+	}
+	for _, s := range d.Instances {
+		d.ActiveConnections += s.ActiveConnections
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// dumpStats writes a summary of c's activity to the file at path, replacing
+// its contents, or to stderr if path is empty.
+func dumpStats(path string, c *proxy.Client, instances []string) error {
+	if path == "" {
+		return writeStats(os.Stderr, c, instances)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeStats(f, c, instances); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file contains code for the log entry summarizing the instances the
+// proxy listens for at startup.
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/certs"
+)
+
+// instanceSummary describes an instance in the startup summary.
+type instanceSummary struct {
+	Instance string `json:"instance"`
+	// Address is the addresses listened on for the instance, separated by
+	// commas if there are several.
+	Address string `json:"address"`
+	// IPType is the preferred type of the instance's IP address: "public",
+	// "private", "psc", or "auto" with -auto_ip_type.
+	IPType string `json:"ip_type"`
+	// CredentialsSource is where the credentials used for the instance come
+	// from, as described by credentialsSource.
+	CredentialsSource string `json:"credentials_source"`
+}
+
+// listenAddress returns the addresses l listens on, separated by commas.
+func listenAddress(l net.Listener) string {
+	ls, ok := l.(multiListener)
+	if !ok {
+		return l.Addr().String()
+	}
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, l := range ls {
+		if a := l.Addr().String(); !seen[a] {
+			seen[a] = true
+			addrs = append(addrs, a)
+		}
+	}
+	return strings.Join(addrs, ",")
+}
+
+// summarizeInstance describes the instance configured by cfg, listening on
+// l.
+func summarizeInstance(cfg instanceConfig, l net.Listener) instanceSummary {
+	ipType := "auto"
+	switch {
+	case cfg.PSC:
+		ipType = certs.PSCIPAddrType
+	case cfg.IPType != "":
+		ipType = cfg.IPType
+	case !*autoIPType:
+		ipType = ipAddrTypes()[0]
+	}
+	if ipType = strings.ToLower(ipType); ipType == "primary" {
+		ipType = "public"
+	}
+	creds := credentialsSource
+	if cfg.CredentialFile != "" {
+		creds = "file"
+	}
+	return instanceSummary{
+		Instance:          cfg.Instance,
+		Address:           listenAddress(l),
+		IPType:            ipType,
+		CredentialsSource: creds,
+	}
+}
+
+// logStartupSummary logs a single entry holding a JSON array which describes
+// each instance in ls, sorted by instance.
+func logStartupSummary(ls map[string]instanceListener) {
+	if len(ls) == 0 {
+		return
+	}
+	summary := make([]instanceSummary, 0, len(ls))
+	for _, v := range ls {
+		summary = append(summary, summarizeInstance(v.cfg, v.l))
+	}
+	sort.Slice(summary, func(i, j int) bool { return summary[i].Instance < summary[j].Instance })
+	b, err := json.Marshal(summary)
+	if err != nil {
+		logging.Errorf("Couldn't summarize the configured instances: %v", err)
+		return
+	}
+	logging.Infof("Listening for instances: %s", b)
+}
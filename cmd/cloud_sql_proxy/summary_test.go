@@ -0,0 +1,92 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// fakeListener is a net.Listener with an address and nothing else.
+type fakeListener struct {
+	net.Listener
+	addr net.Addr
+}
+
+func (l fakeListener) Addr() net.Addr { return l.addr }
+
+func TestSummarizeInstance(t *testing.T) {
+	defer func(old string) { credentialsSource = old }(credentialsSource)
+	defer func(old string) { *ipAddressTypes = old }(*ipAddressTypes)
+	credentialsSource = "metadata"
+	*ipAddressTypes = "PRIVATE,PUBLIC"
+
+	tcp := fakeListener{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5432}}
+	unix := fakeListener{addr: &net.UnixAddr{Name: "/cloudsql/proj:reg:db", Net: "unix"}}
+	for _, v := range []struct {
+		desc string
+		cfg  instanceConfig
+		l    net.Listener
+		want instanceSummary
+	}{
+		{
+			desc: "default settings",
+			cfg:  instanceConfig{Instance: "proj:reg:db"},
+			l:    unix,
+			want: instanceSummary{"proj:reg:db", "/cloudsql/proj:reg:db", "private", "metadata"},
+		},
+		{
+			desc: "own IP type and credentials",
+			cfg:  instanceConfig{Instance: "proj:reg:db", IPType: "PUBLIC", CredentialFile: "key.json"},
+			l:    tcp,
+			want: instanceSummary{"proj:reg:db", "127.0.0.1:5432", "public", "file"},
+		},
+		{
+			desc: "PSC and several listeners",
+			cfg:  instanceConfig{Instance: "proj:reg:db", PSC: true},
+			l:    multiListener{tcp, tcp, unix},
+			want: instanceSummary{"proj:reg:db", "127.0.0.1:5432,/cloudsql/proj:reg:db", "psc", "metadata"},
+		},
+	} {
+		if got := summarizeInstance(v.cfg, v.l); got != v.want {
+			t.Errorf("%s: summarizeInstance = %+v, want %+v", v.desc, got, v.want)
+		}
+	}
+}
+
+func TestLogStartupSummary(t *testing.T) {
+	defer func(old func(string, ...interface{})) { logging.Infof = old }(logging.Infof)
+	defer func(old string) { credentialsSource = old }(credentialsSource)
+	credentialsSource = "file"
+
+	var logged []string
+	logging.Infof = func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	l := fakeListener{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3306}}
+	logStartupSummary(map[string]instanceListener{
+		"proj:reg:b": {instanceConfig{Instance: "proj:reg:b", IPType: "PRIVATE"}, l},
+		"proj:reg:a": {instanceConfig{Instance: "proj:reg:a", IPType: "PUBLIC"}, l},
+	})
+	want := `Listening for instances: [` +
+		`{"instance":"proj:reg:a","address":"127.0.0.1:3306","ip_type":"public","credentials_source":"file"},` +
+		`{"instance":"proj:reg:b","address":"127.0.0.1:3306","ip_type":"private","credentials_source":"file"}]`
+	if len(logged) != 1 || logged[0] != want {
+		t.Errorf("logStartupSummary logged %q, want a single entry %q", logged, want)
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+// This file contains code for handing the proxy's listening sockets over to a
+// new proxy process during an upgrade, as set by -upgrade_socket.
+//
+// The running proxy listens on the upgrade socket. A new proxy connects to
+// it, and is sent the file descriptors of every socket the running proxy
+// listens on for an instance, with SCM_RIGHTS, in messages of one byte each:
+// upgradeSockets for a batch of descriptors, then upgradeEnd. Once the new
+// proxy is listening on those sockets, it sends upgradeReady. The running
+// proxy then stops accepting connections, closes the upgrade socket, and
+// drains its connections as on SIGTERM, while the new proxy listens on the
+// upgrade socket in its place. If the new proxy exits before sending
+// upgradeReady, the running proxy carries on as before.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+const (
+	upgradeSockets byte = 's'
+	upgradeEnd     byte = 'e'
+	upgradeReady   byte = 'r'
+
+	// maxFDsPerMessage is the number of file descriptors sent in each
+	// message, below Linux's limit of 253.
+	maxFDsPerMessage = 250
+	// upgradeTimeout bounds each exchange other than the wait for the new
+	// proxy to start.
+	upgradeTimeout = 30 * time.Second
+)
+
+// receiveSockets connects to the proxy listening on the upgrade socket at
+// path and receives its listening sockets. The returned connection is used to
+// tell it, with takeOver, once they are in use. If no proxy is listening on
+// path, it returns a nil connection and no sockets.
+func receiveSockets(path string) (*net.UnixConn, []net.Listener, error) {
+	c, err := net.DialTimeout("unix", path, upgradeTimeout)
+	if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := c.(*net.UnixConn)
+	conn.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	var ls []net.Listener
+	fail := func(err error) (*net.UnixConn, []net.Listener, error) {
+		conn.Close()
+		for _, l := range ls {
+			l.Close()
+		}
+		return nil, nil, err
+	}
+	msg := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4*maxFDsPerMessage))
+	for {
+		n, oobn, _, _, err := conn.ReadMsgUnix(msg, oob)
+		if err != nil {
+			return fail(fmt.Errorf("receiving sockets: %v", err))
+		}
+		if n == 1 && msg[0] == upgradeEnd {
+			break
+		}
+		if n != 1 || msg[0] != upgradeSockets {
+			return fail(errors.New("receiving sockets: unexpected message"))
+		}
+		cmsgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return fail(fmt.Errorf("receiving sockets: %v", err))
+		}
+		for _, cmsg := range cmsgs {
+			fds, err := syscall.ParseUnixRights(&cmsg)
+			if err != nil {
+				return fail(fmt.Errorf("receiving sockets: %v", err))
+			}
+			for _, fd := range fds {
+				f := os.NewFile(uintptr(fd), "upgrade socket")
+				l, err := net.FileListener(f)
+				f.Close()
+				if err != nil {
+					return fail(fmt.Errorf("receiving sockets: %v", err))
+				}
+				ls = append(ls, l)
+			}
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	return conn, ls, nil
+}
+
+// takeOver tells the proxy which sent the sockets on conn that this proxy is
+// listening on them, and waits for it to close the upgrade socket.
+func takeOver(conn *net.UnixConn) error {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := conn.Write([]byte{upgradeReady}); err != nil {
+		return err
+	}
+	// The previous proxy closes the connection once it has stopped listening
+	// on the upgrade socket.
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		return fmt.Errorf("waiting for the previous proxy to stop: %v", err)
+	}
+	return nil
+}
+
+// serveUpgrades listens on the upgrade socket at path, and hands the sockets
+// in handoverSockets over to the first new proxy which takes them over. It
+// then stops accepting connections on them, and calls upgraded.
+func serveUpgrades(path string, upgraded func()) error {
+	remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		conn := c.(*net.UnixConn)
+		n, err := handOver(conn)
+		if err != nil {
+			logging.Errorf("A new proxy did not take over the sockets on %s: %v", path, err)
+			conn.Close()
+			continue
+		}
+		// Closing the upgrade socket removes its file, so the new proxy
+		// waits for this before listening on it.
+		l.Close()
+		closeHandedOver()
+		conn.Close()
+		logging.Infof("Handed %d sockets over to a new proxy process", n)
+		upgraded()
+		return nil
+	}
+}
+
+// handOver sends the sockets in handoverSockets on conn, and waits for the
+// new proxy to report that it is listening on them. It returns the number of
+// sockets sent.
+func handOver(conn *net.UnixConn) (int, error) {
+	conn.SetDeadline(time.Now().Add(upgradeTimeout))
+	var fds []int
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	// Several listeners may share an address with -listener_goroutines; the
+	// new proxy uses one socket for each address.
+	addrs := make(map[string]bool)
+	handoverSockets.Range(func(k, _ interface{}) bool {
+		l := k.(net.Listener)
+		a := l.Addr().Network() + " " + l.Addr().String()
+		if addrs[a] {
+			return true
+		}
+		f, err := listenerFile(l)
+		if err != nil {
+			logging.Errorf("WARNING: couldn't hand over the socket on %s: %v", l.Addr(), err)
+			return true
+		}
+		addrs[a] = true
+		files = append(files, f)
+		fds = append(fds, int(f.Fd()))
+		return true
+	})
+	for i := 0; i < len(fds); i += maxFDsPerMessage {
+		batch := fds[i:]
+		if len(batch) > maxFDsPerMessage {
+			batch = batch[:maxFDsPerMessage]
+		}
+		if _, _, err := conn.WriteMsgUnix([]byte{upgradeSockets}, syscall.UnixRights(batch...), nil); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := conn.Write([]byte{upgradeEnd}); err != nil {
+		return 0, err
+	}
+	// The new proxy reports that it is ready once it has started, which may
+	// take up to its -startup_timeout.
+	conn.SetDeadline(time.Time{})
+	msg := make([]byte, 1)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return 0, err
+	}
+	if msg[0] != upgradeReady {
+		return 0, errors.New("unexpected message")
+	}
+	return len(fds), nil
+}
+
+// listenerFile returns a copy of the file descriptor of l.
+func listenerFile(l net.Listener) (*os.File, error) {
+	switch l := l.(type) {
+	case linkedListener:
+		return listenerFile(l.Listener)
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		return l.File()
+	}
+	return nil, fmt.Errorf("%T cannot be handed over", l)
+}
+
+// closeHandedOver stops accepting connections on the sockets in
+// handoverSockets, which the new proxy now listens on. Socket files and
+// symlinks are left in place for it.
+func closeHandedOver() {
+	handoverSockets.Range(func(k, _ interface{}) bool {
+		l := k.(net.Listener)
+		if ll, ok := l.(linkedListener); ok {
+			l = ll.Listener
+		}
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		l.Close()
+		return true
+	})
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+)
+
+func TestReceiveSocketsWithoutProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conn, ls, err := receiveSockets(filepath.Join(dir, "upgrade.sock"))
+	if conn != nil || ls != nil || err != nil {
+		t.Errorf("receiveSockets with no proxy listening = %v, %v, %v, want nothing", conn, ls, err)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The old proxy listens for two instances.
+	conns := make(chan proxy.Conn)
+	tcpCfg := instanceConfig{Instance: "proj:reg:tcp", Network: "tcp", Address: "127.0.0.1:0"}
+	tcpL, err := listenInstance(conns, tcpCfg)
+	if err != nil {
+		t.Fatalf("listenInstance: %v", err)
+	}
+	defer tcpL.Close()
+	unixCfg := instanceConfig{Instance: "proj:reg:unix", Network: "unix", Address: filepath.Join(dir, "proj:reg:unix")}
+	unixL, err := listenInstance(conns, unixCfg)
+	if err != nil {
+		t.Fatalf("listenInstance: %v", err)
+	}
+	defer unixL.Close()
+
+	path := filepath.Join(dir, "upgrade.sock")
+	upgraded := make(chan bool, 1)
+	served := make(chan error, 1)
+	go func() { served <- serveUpgrades(path, func() { upgraded <- true }) }()
+	var conn *net.UnixConn
+	var ls []net.Listener
+	for deadline := time.Now().Add(5 * time.Second); conn == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the old proxy did not listen for upgrades")
+		}
+		if conn, ls, err = receiveSockets(path); err != nil {
+			t.Fatalf("receiveSockets: %v", err)
+		}
+	}
+	for _, l := range ls {
+		defer l.Close()
+	}
+
+	var got []string
+	for _, l := range ls {
+		got = append(got, l.Addr().String())
+	}
+	sort.Strings(got)
+	want := []string{tcpL.Addr().String(), unixCfg.Address}
+	sort.Strings(want)
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("received sockets on %v, want %v", got, want)
+	}
+	select {
+	case <-upgraded:
+		t.Fatal("the old proxy stopped before the new one took over")
+	default:
+	}
+
+	if err := takeOver(conn); err != nil {
+		t.Fatalf("takeOver: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serveUpgrades: %v", err)
+	}
+	select {
+	case <-upgraded:
+	default:
+		t.Error("the old proxy was not told that it has been replaced")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the upgrade socket remains after the handover: %v", err)
+	}
+
+	// The sockets now accept connections for the new proxy only, and the
+	// Unix socket's file remains.
+	for _, l := range ls {
+		c, err := net.Dial(l.Addr().Network(), l.Addr().String())
+		if err != nil {
+			t.Fatalf("net.Dial(%v): %v", l.Addr(), err)
+		}
+		c.Close()
+		ac, err := l.Accept()
+		if err != nil {
+			t.Fatalf("Accept on %v: %v", l.Addr(), err)
+		}
+		ac.Close()
+	}
+	select {
+	case c := <-conns:
+		t.Errorf("the old proxy accepted a connection for %q after the handover", c.Instance)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
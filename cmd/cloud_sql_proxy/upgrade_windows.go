@@ -0,0 +1,38 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errUpgradeUnsupported = errors.New("-upgrade_socket is not supported on Windows")
+
+// receiveSockets always fails, as sockets cannot be passed between processes
+// on Windows.
+func receiveSockets(path string) (*net.UnixConn, []net.Listener, error) {
+	return nil, nil, errUpgradeUnsupported
+}
+
+// takeOver always fails; see receiveSockets.
+func takeOver(conn *net.UnixConn) error {
+	return errUpgradeUnsupported
+}
+
+// serveUpgrades always fails; see receiveSockets.
+func serveUpgrades(path string, upgraded func()) error {
+	return errUpgradeUnsupported
+}
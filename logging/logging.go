@@ -59,6 +59,32 @@ func DisableLogging() {
 // EnableStructuredLogs replaces all logging functions with structured logging
 // variants.
 func EnableStructuredLogs(logDebugStdout, verbose bool) (func(), error) {
+	// Lock wraps a WriteSyncer in a mutex to make it safe for concurrent use. In
+	// particular, *os.File types must be locked before use.
+	consoleErrors := zapcore.Lock(os.Stderr)
+	consoleDebugging := consoleErrors
+	if logDebugStdout {
+		consoleDebugging = zapcore.Lock(os.Stdout)
+	}
+	return enableStructuredLogs(consoleErrors, consoleDebugging, verbose), nil
+}
+
+// encoderConfig uses the field names recognized by Cloud Logging, so that
+// entries are parsed correctly when collected from a container's output. See
+// https://cloud.google.com/logging/docs/structured-logging.
+func encoderConfig() zapcore.EncoderConfig {
+	cfg := zap.NewProductionEncoderConfig()
+	cfg.LevelKey = "severity"
+	cfg.EncodeLevel = zapcore.CapitalLevelEncoder
+	cfg.TimeKey = "timestamp"
+	cfg.EncodeTime = zapcore.RFC3339NanoTimeEncoder
+	cfg.MessageKey = "message"
+	return cfg
+}
+
+// enableStructuredLogs replaces all logging functions with ones writing JSON
+// to the provided writers: errors go to errW and everything else to debugW.
+func enableStructuredLogs(errW, debugW zapcore.WriteSyncer, verbose bool) func() {
 	// Configuration of zap is based on its Advanced Configuration example.
 	// See: https://pkg.go.dev/go.uber.org/zap#example-package-AdvancedConfiguration
 
@@ -70,18 +96,10 @@ func EnableStructuredLogs(logDebugStdout, verbose bool) (func(), error) {
 		return lvl < zapcore.ErrorLevel
 	})
 
-	// Lock wraps a WriteSyncer in a mutex to make it safe for concurrent use. In
-	// particular, *os.File types must be locked before use.
-	consoleErrors := zapcore.Lock(os.Stderr)
-	consoleDebugging := consoleErrors
-	if logDebugStdout {
-		consoleDebugging = zapcore.Lock(os.Stdout)
-	}
-
-	consoleEncoder := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	consoleEncoder := zapcore.NewJSONEncoder(encoderConfig())
 	core := zapcore.NewTee(
-		zapcore.NewCore(consoleEncoder, consoleErrors, highPriority),
-		zapcore.NewCore(consoleEncoder, consoleDebugging, lowPriority),
+		zapcore.NewCore(consoleEncoder, errW, highPriority),
+		zapcore.NewCore(consoleEncoder, debugW, lowPriority),
 	)
 
 	// By default, caller and stacktrace are not included, so add them here
@@ -97,5 +115,5 @@ func EnableStructuredLogs(logDebugStdout, verbose bool) (func(), error) {
 
 	return func() {
 		logger.Sync()
-	}, nil
+	}
 }
@@ -0,0 +1,84 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// saveLoggers returns a func which restores the current logging functions.
+func saveLoggers() func() {
+	v, i, e := Verbosef, Infof, Errorf
+	return func() {
+		Verbosef, Infof, Errorf = v, i, e
+	}
+}
+
+func decode(t *testing.T, b *bytes.Buffer) map[string]interface{} {
+	var entry map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &entry); err != nil {
+		t.Fatalf("log output %q is not JSON: %v", b, err)
+	}
+	return entry
+}
+
+func TestStructuredLogs(t *testing.T) {
+	defer saveLoggers()()
+	var errs, debug bytes.Buffer
+	cleanup := enableStructuredLogs(zapcore.AddSync(&errs), zapcore.AddSync(&debug), true)
+	defer cleanup()
+
+	Infof("hello %s", "world")
+	entry := decode(t, &debug)
+	if got, want := entry["severity"], "INFO"; got != want {
+		t.Errorf("severity = %v, want %v", got, want)
+	}
+	if got, want := entry["message"], "hello world"; got != want {
+		t.Errorf("message = %v, want %v", got, want)
+	}
+	ts, ok := entry["timestamp"].(string)
+	if !ok {
+		t.Fatalf("timestamp = %v, want a string", entry["timestamp"])
+	}
+	if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+		t.Errorf("timestamp %q is not in RFC 3339 format: %v", ts, err)
+	}
+	if errs.Len() != 0 {
+		t.Errorf("info message was written to the error output: %q", errs.String())
+	}
+
+	Errorf("oh no")
+	entry = decode(t, &errs)
+	if got, want := entry["severity"], "ERROR"; got != want {
+		t.Errorf("severity = %v, want %v", got, want)
+	}
+}
+
+func TestStructuredLogsNotVerbose(t *testing.T) {
+	defer saveLoggers()()
+	var errs, debug bytes.Buffer
+	cleanup := enableStructuredLogs(zapcore.AddSync(&errs), zapcore.AddSync(&debug), false)
+	defer cleanup()
+
+	Verbosef("new connection")
+	if debug.Len() != 0 {
+		t.Errorf("verbose message should be discarded, got %q", debug.String())
+	}
+}
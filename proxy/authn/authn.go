@@ -0,0 +1,61 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package authn logs clients in to Cloud SQL instances as IAM database users
+// by answering the server's request for a password with an OAuth2 access
+// token, and labels their sessions with an application name.
+//
+// The functions in this package sit between a local client connection and a
+// connection to the instance during the authentication phase of the database
+// protocol. They forward the client's startup messages, adding the
+// application name if the client did not supply one, intercept the server's
+// request for a cleartext password, which is how Cloud SQL authenticates IAM
+// database users, and reply with a token. When they return without error,
+// authentication has completed (or been left to the client) and the two
+// connections may be copied to each other as usual.
+package authn
+
+import (
+	"fmt"
+
+	"golang.org/x/oauth2"
+)
+
+// maxMessageSize bounds the size of the protocol messages read while
+// authenticating.
+const maxMessageSize = 1 << 20
+
+// Options configures how a connection is set up on a client's behalf.
+type Options struct {
+	// TokenSource, if set, supplies the access tokens used as passwords for
+	// IAM database users. If nil, authentication is left to the client.
+	TokenSource oauth2.TokenSource
+	// ApplicationName, if set, labels the session in the instance's logs and
+	// activity views: it is sent as the Postgres application_name parameter
+	// or the MySQL program_name connection attribute, unless the client sets
+	// that itself.
+	ApplicationName string
+	// OverrideApplicationName, if set, sends ApplicationName in place of any
+	// name the client sets itself.
+	OverrideApplicationName bool
+}
+
+// token returns a current access token from ts.
+func token(ts oauth2.TokenSource) (string, error) {
+	tok, err := ts.Token()
+	if err != nil {
+		return "", fmt.Errorf("couldn't get IAM authentication token: %v", err)
+	}
+	return tok.AccessToken, nil
+}
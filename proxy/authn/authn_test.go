@@ -0,0 +1,436 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+const testToken = "iam-token"
+
+var testTokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: testToken})
+
+type errTokenSource struct{}
+
+func (errTokenSource) Token() (*oauth2.Token, error) {
+	return nil, errors.New("no token")
+}
+
+// run calls fn with the client-facing end of one pipe and the server-facing
+// end of another, returning the other ends and a channel receiving fn's
+// result.
+func run(fn func(client, server net.Conn) error) (client, server net.Conn, done chan error) {
+	client, proxyClient := net.Pipe()
+	proxyServer, server := net.Pipe()
+	done = make(chan error, 1)
+	go func() {
+		done <- fn(proxyClient, proxyServer)
+	}()
+	return client, server, done
+}
+
+func readFull(t *testing.T, conn net.Conn, n int) []byte {
+	b := make([]byte, n)
+	read := 0
+	for read < n {
+		m, err := conn.Read(b[read:])
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		read += m
+	}
+	return b
+}
+
+func write(t *testing.T, conn net.Conn, b []byte) {
+	if _, err := conn.Write(b); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+func pgStartup(code uint32, body string) []byte {
+	msg := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(msg, uint32(8+len(body)))
+	binary.BigEndian.PutUint32(msg[4:], code)
+	return append(msg, body...)
+}
+
+func pgAuth(code uint32) []byte {
+	msg := []byte{'R', 0, 0, 0, 8, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[5:], code)
+	return msg
+}
+
+func TestPostgres(t *testing.T) {
+	client, server, done := run(func(c, s net.Conn) error {
+		return Postgres(c, s, Options{TokenSource: testTokenSource})
+	})
+	defer client.Close()
+	defer server.Close()
+
+	write(t, client, pgStartup(pgSSLRequest, ""))
+	if got := readFull(t, client, 1); got[0] != 'N' {
+		t.Fatalf("SSLRequest answered with %q, want 'N'", got)
+	}
+	startup := pgStartup(196608, "user\x00alice@example.com\x00\x00")
+	write(t, client, startup)
+	if got := readFull(t, server, len(startup)); !bytes.Equal(got, startup) {
+		t.Fatalf("server got startup message %q, want %q", got, startup)
+	}
+
+	write(t, server, pgAuth(pgAuthCleartextPassword))
+	want := postgresPasswordMessage(testToken)
+	if got := readFull(t, server, len(want)); !bytes.Equal(got, want) {
+		t.Fatalf("server got password message %q, want %q", got, want)
+	}
+	ok := pgAuth(0)
+	write(t, server, ok)
+	if got := readFull(t, client, len(ok)); !bytes.Equal(got, ok) {
+		t.Fatalf("client got %q, want AuthenticationOk", got)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Postgres: %v", err)
+	}
+}
+
+func TestPostgresOtherAuthentication(t *testing.T) {
+	client, server, done := run(func(c, s net.Conn) error {
+		return Postgres(c, s, Options{TokenSource: testTokenSource})
+	})
+	defer client.Close()
+	defer server.Close()
+
+	startup := pgStartup(196608, "user\x00postgres\x00\x00")
+	write(t, client, startup)
+	readFull(t, server, len(startup))
+
+	// An MD5 password request is left for the client to answer.
+	md5 := append(pgAuth(5), 1, 2, 3, 4)
+	binary.BigEndian.PutUint32(md5[1:], 12)
+	write(t, server, md5)
+	if got := readFull(t, client, len(md5)); !bytes.Equal(got, md5) {
+		t.Fatalf("client got %q, want %q", got, md5)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Postgres: %v", err)
+	}
+}
+
+func TestPostgresTokenError(t *testing.T) {
+	client, server, done := run(func(c, s net.Conn) error {
+		return Postgres(c, s, Options{TokenSource: errTokenSource{}})
+	})
+	defer client.Close()
+	defer server.Close()
+
+	startup := pgStartup(196608, "user\x00alice@example.com\x00\x00")
+	write(t, client, startup)
+	readFull(t, server, len(startup))
+	write(t, server, pgAuth(pgAuthCleartextPassword))
+	if err := <-done; err == nil {
+		t.Fatal("Postgres succeeded without a token")
+	}
+}
+
+func mysqlPacketBytes(seq byte, payload []byte) []byte {
+	var b bytes.Buffer
+	writeMySQLPacket(&b, mysqlPacket{seq: seq, payload: payload})
+	return b.Bytes()
+}
+
+// mysqlGreeting returns an initial handshake payload advertising caps.
+func mysqlGreeting(caps uint16) []byte {
+	p := []byte{10}
+	p = append(p, "8.0.18\x00"...)
+	p = append(p, 1, 0, 0, 0)                // connection ID
+	p = append(p, 1, 2, 3, 4, 5, 6, 7, 8, 0) // auth plugin data, filler
+	p = append(p, byte(caps), byte(caps>>8))
+	return append(p, 33, 2, 0) // character set, status flags
+}
+
+func TestMySQL(t *testing.T) {
+	client, server, done := run(func(c, s net.Conn) error {
+		return MySQL(c, s, Options{TokenSource: testTokenSource})
+	})
+	defer client.Close()
+	defer server.Close()
+
+	write(t, server, mysqlPacketBytes(0, mysqlGreeting(0xffff)))
+	greeting := mysqlPacketBytes(0, mysqlGreeting(0xffff&^mysqlClientSSL))
+	if got := readFull(t, client, len(greeting)); !bytes.Equal(got, greeting) {
+		t.Fatalf("client got greeting %x, want %x without CLIENT_SSL", got, greeting)
+	}
+
+	resp := mysqlPacketBytes(1, []byte("handshake response"))
+	write(t, client, resp)
+	if got := readFull(t, server, len(resp)); !bytes.Equal(got, resp) {
+		t.Fatalf("server got %q, want %q", got, resp)
+	}
+
+	write(t, server, mysqlPacketBytes(2, []byte("\xfemysql_clear_password\x00")))
+	want := mysqlPacketBytes(3, []byte(testToken+"\x00"))
+	if got := readFull(t, server, len(want)); !bytes.Equal(got, want) {
+		t.Fatalf("server got %q, want token %q", got, want)
+	}
+
+	write(t, server, mysqlPacketBytes(4, []byte{0, 0, 0, 2, 0, 0, 0}))
+	ok := mysqlPacketBytes(2, []byte{0, 0, 0, 2, 0, 0, 0})
+	if got := readFull(t, client, len(ok)); !bytes.Equal(got, ok) {
+		t.Fatalf("client got %x, want OK packet %x", got, ok)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("MySQL: %v", err)
+	}
+}
+
+func TestMySQLOtherAuthentication(t *testing.T) {
+	client, server, done := run(func(c, s net.Conn) error {
+		return MySQL(c, s, Options{TokenSource: testTokenSource})
+	})
+	defer client.Close()
+	defer server.Close()
+
+	write(t, server, mysqlPacketBytes(0, mysqlGreeting(0)))
+	readFull(t, client, len(mysqlPacketBytes(0, mysqlGreeting(0))))
+	resp := mysqlPacketBytes(1, []byte("handshake response"))
+	write(t, client, resp)
+	readFull(t, server, len(resp))
+
+	// A switch to another method is left for the client to answer.
+	sw := mysqlPacketBytes(2, []byte("\xfecaching_sha2_password\x00salt"))
+	write(t, server, sw)
+	if got := readFull(t, client, len(sw)); !bytes.Equal(got, sw) {
+		t.Fatalf("client got %q, want %q", got, sw)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("MySQL: %v", err)
+	}
+}
+
+func TestMySQLServerError(t *testing.T) {
+	client, server, done := run(func(c, s net.Conn) error {
+		return MySQL(c, s, Options{TokenSource: testTokenSource})
+	})
+	defer client.Close()
+	defer server.Close()
+
+	errPacket := mysqlPacketBytes(0, []byte("\xff\x10\x04Too many connections"))
+	write(t, server, errPacket)
+	if got := readFull(t, client, len(errPacket)); !bytes.Equal(got, errPacket) {
+		t.Fatalf("client got %q, want %q", got, errPacket)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("MySQL: %v", err)
+	}
+}
+
+func TestSetPostgresParameter(t *testing.T) {
+	tcs := []struct {
+		desc     string
+		in       []byte
+		want     []byte
+		override bool
+	}{
+		{
+			desc: "added",
+			in:   pgStartup(196608, "user\x00alice\x00\x00"),
+			want: pgStartup(196608, "user\x00alice\x00application_name\x00proxy\x00\x00"),
+		},
+		{
+			desc: "no other parameters",
+			in:   pgStartup(196608, "\x00"),
+			want: pgStartup(196608, "application_name\x00proxy\x00\x00"),
+		},
+		{
+			desc: "set by the client",
+			in:   pgStartup(196608, "application_name\x00psql\x00user\x00alice\x00\x00"),
+			want: pgStartup(196608, "application_name\x00psql\x00user\x00alice\x00\x00"),
+		},
+		{
+			desc:     "overriding the client",
+			in:       pgStartup(196608, "application_name\x00psql\x00user\x00alice\x00\x00"),
+			want:     pgStartup(196608, "user\x00alice\x00application_name\x00proxy\x00\x00"),
+			override: true,
+		},
+		{
+			desc:     "override with no name from the client",
+			in:       pgStartup(196608, "user\x00alice\x00\x00"),
+			want:     pgStartup(196608, "user\x00alice\x00application_name\x00proxy\x00\x00"),
+			override: true,
+		},
+		{
+			desc: "cancel request",
+			in:   pgStartup(pgCancelRequest, "\x00\x00\x00\x01\x00\x00\x00\x02"),
+			want: pgStartup(pgCancelRequest, "\x00\x00\x00\x01\x00\x00\x00\x02"),
+		},
+	}
+	for _, tc := range tcs {
+		if got := setPostgresParameter(tc.in, "application_name", "proxy", tc.override); !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestPostgresApplicationName(t *testing.T) {
+	client, server, done := run(func(c, s net.Conn) error {
+		return Postgres(c, s, Options{ApplicationName: "proxy"})
+	})
+	defer client.Close()
+	defer server.Close()
+
+	// Without a token source, encryption requests are left to the server.
+	sslRequest := pgStartup(pgSSLRequest, "")
+	write(t, client, sslRequest)
+	if got := readFull(t, server, len(sslRequest)); !bytes.Equal(got, sslRequest) {
+		t.Fatalf("server got %q, want SSLRequest", got)
+	}
+	write(t, server, []byte{'N'})
+	if got := readFull(t, client, 1); got[0] != 'N' {
+		t.Fatalf("SSLRequest answered with %q, want the server's 'N'", got)
+	}
+
+	write(t, client, pgStartup(196608, "user\x00postgres\x00\x00"))
+	want := pgStartup(196608, "user\x00postgres\x00application_name\x00proxy\x00\x00")
+	if got := readFull(t, server, len(want)); !bytes.Equal(got, want) {
+		t.Fatalf("server got startup message %q, want %q", got, want)
+	}
+	// Without a token source, authentication is left to the client.
+	if err := <-done; err != nil {
+		t.Fatalf("Postgres: %v", err)
+	}
+}
+
+func TestPostgresApplicationNameSSL(t *testing.T) {
+	client, server, done := run(func(c, s net.Conn) error {
+		return Postgres(c, s, Options{ApplicationName: "proxy"})
+	})
+	defer client.Close()
+	defer server.Close()
+
+	sslRequest := pgStartup(pgSSLRequest, "")
+	write(t, client, sslRequest)
+	readFull(t, server, len(sslRequest))
+	write(t, server, []byte{'S'})
+	if got := readFull(t, client, 1); got[0] != 'S' {
+		t.Fatalf("SSLRequest answered with %q, want the server's 'S'", got)
+	}
+	// The client's TLS handshake follows, which is left alone.
+	if err := <-done; err != nil {
+		t.Fatalf("Postgres: %v", err)
+	}
+}
+
+// mysqlResponse returns a handshake response payload for a client
+// advertising caps, followed by attrs if it is not nil.
+func mysqlResponse(caps uint32, attrs []byte) []byte {
+	p := make([]byte, 32)
+	binary.LittleEndian.PutUint32(p, caps)
+	p[8] = 33 // character set
+	p = append(p, "alice\x00"...)
+	p = append(p, 4, 1, 2, 3, 4) // auth response
+	p = append(p, "db\x00"...)
+	p = append(p, "mysql_native_password\x00"...)
+	if attrs != nil {
+		p = appendLenencInt(p, uint64(len(attrs)))
+		p = append(p, attrs...)
+	}
+	return p
+}
+
+func TestSetMySQLConnectAttr(t *testing.T) {
+	const caps = mysqlClientProtocol41 | mysqlClientSecureConnection | mysqlClientConnectWithDB | mysqlClientPluginAuth
+	attr := func(kvs ...string) []byte {
+		var b []byte
+		for _, s := range kvs {
+			b = appendLenencString(b, s)
+		}
+		return b
+	}
+	tcs := []struct {
+		desc     string
+		in       []byte
+		want     []byte
+		override bool
+	}{
+		{
+			desc: "no attributes",
+			in:   mysqlResponse(caps, nil),
+			want: mysqlResponse(caps|mysqlClientConnectAttrs, attr("program_name", "proxy")),
+		},
+		{
+			desc: "other attributes",
+			in:   mysqlResponse(caps|mysqlClientConnectAttrs, attr("_os", "linux")),
+			want: mysqlResponse(caps|mysqlClientConnectAttrs, attr("_os", "linux", "program_name", "proxy")),
+		},
+		{
+			desc: "set by the client",
+			in:   mysqlResponse(caps|mysqlClientConnectAttrs, attr("program_name", "mysql")),
+			want: mysqlResponse(caps|mysqlClientConnectAttrs, attr("program_name", "mysql")),
+		},
+		{
+			desc:     "overriding the client",
+			in:       mysqlResponse(caps|mysqlClientConnectAttrs, attr("program_name", "mysql", "_os", "linux")),
+			want:     mysqlResponse(caps|mysqlClientConnectAttrs, attr("_os", "linux", "program_name", "proxy")),
+			override: true,
+		},
+		{
+			desc: "SSL request",
+			in:   mysqlResponse(caps|mysqlClientSSL, nil)[:32],
+			want: mysqlResponse(caps|mysqlClientSSL, nil)[:32],
+		},
+		{
+			desc: "truncated",
+			in:   mysqlResponse(caps, nil)[:40],
+			want: mysqlResponse(caps, nil)[:40],
+		},
+	}
+	for _, tc := range tcs {
+		if got := setMySQLConnectAttr(tc.in, "program_name", "proxy", tc.override); !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestMySQLApplicationName(t *testing.T) {
+	client, server, done := run(func(c, s net.Conn) error {
+		return MySQL(c, s, Options{ApplicationName: "proxy"})
+	})
+	defer client.Close()
+	defer server.Close()
+
+	// The server advertises CLIENT_CONNECT_ATTRS in the upper capabilities.
+	greeting := append(mysqlGreeting(0xffff), byte(mysqlClientConnectAttrs>>16), byte(mysqlClientConnectAttrs>>24))
+	write(t, server, mysqlPacketBytes(0, greeting))
+	// Without a token source, CLIENT_SSL is still advertised.
+	if got, want := readFull(t, client, len(greeting)+4), mysqlPacketBytes(0, greeting); !bytes.Equal(got, want) {
+		t.Fatalf("client got greeting %x, want %x", got, want)
+	}
+
+	const caps = mysqlClientProtocol41 | mysqlClientSecureConnection | mysqlClientConnectWithDB | mysqlClientPluginAuth
+	write(t, client, mysqlPacketBytes(1, mysqlResponse(caps, nil)))
+	want := mysqlPacketBytes(1, mysqlResponse(caps|mysqlClientConnectAttrs, appendLenencString(appendLenencString(nil, "program_name"), "proxy")))
+	if got := readFull(t, server, len(want)); !bytes.Equal(got, want) {
+		t.Fatalf("server got %q, want %q", got, want)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("MySQL: %v", err)
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MySQL capability flags.
+const (
+	mysqlClientConnectWithDB        = 0x00000008
+	mysqlClientProtocol41           = 0x00000200
+	mysqlClientSSL                  = 0x00000800
+	mysqlClientSecureConnection     = 0x00008000
+	mysqlClientPluginAuth           = 0x00080000
+	mysqlClientConnectAttrs         = 0x00100000
+	mysqlClientPluginAuthLenencData = 0x00200000
+)
+
+const (
+	mysqlAuthSwitch = 0xfe
+	mysqlErr        = 0xff
+
+	mysqlClearPassword = "mysql_clear_password"
+	mysqlProgramName   = "program_name"
+)
+
+// mysqlPacket is a single MySQL protocol packet.
+type mysqlPacket struct {
+	seq     byte
+	payload []byte
+}
+
+func readMySQLPacket(r io.Reader) (mysqlPacket, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return mysqlPacket{}, err
+	}
+	n := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if n > maxMessageSize {
+		return mysqlPacket{}, fmt.Errorf("invalid packet length %d", n)
+	}
+	p := mysqlPacket{seq: header[3], payload: make([]byte, n)}
+	_, err := io.ReadFull(r, p.payload)
+	return p, err
+}
+
+func writeMySQLPacket(w io.Writer, p mysqlPacket) error {
+	n := len(p.payload)
+	_, err := w.Write(append([]byte{byte(n), byte(n >> 8), byte(n >> 16), p.seq}, p.payload...))
+	return err
+}
+
+// MySQL sets up a MySQL connection on behalf of client.
+//
+// The server's initial handshake is forwarded to client, without the
+// CLIENT_SSL capability if opts.TokenSource is set, as the connection to the
+// instance is already encrypted. The client's handshake response is forwarded
+// to server, with a program_name connection attribute added if
+// opts.ApplicationName is set, server accepts connection attributes and the
+// client neither supplied one, unless opts.OverrideApplicationName is also
+// set, nor requested SSL. If opts.TokenSource is set
+// and server then asks to switch to the mysql_clear_password authentication
+// method, a token is sent in reply instead of forwarding the request to
+// client. Other packets are forwarded to client, which then completes
+// authentication itself.
+func MySQL(client, server io.ReadWriter, opts Options) error {
+	greeting, err := readMySQLPacket(server)
+	if err != nil {
+		return fmt.Errorf("reading initial handshake: %v", err)
+	}
+	var serverCaps uint32
+	if len(greeting.payload) > 0 && greeting.payload[0] != mysqlErr {
+		if serverCaps, err = mysqlCapabilities(greeting.payload, opts.TokenSource != nil); err != nil {
+			return err
+		}
+	}
+	if err := writeMySQLPacket(client, greeting); err != nil {
+		return err
+	}
+	if len(greeting.payload) > 0 && greeting.payload[0] == mysqlErr {
+		return nil
+	}
+
+	resp, err := readMySQLPacket(client)
+	if err != nil {
+		return fmt.Errorf("reading handshake response: %v", err)
+	}
+	if opts.ApplicationName != "" && serverCaps&mysqlClientConnectAttrs != 0 {
+		resp.payload = setMySQLConnectAttr(resp.payload, mysqlProgramName, opts.ApplicationName, opts.OverrideApplicationName)
+	}
+	if err := writeMySQLPacket(server, resp); err != nil {
+		return err
+	}
+	if opts.TokenSource == nil {
+		return nil
+	}
+
+	// Packets sent to server on the client's behalf advance the sequence
+	// number, which must be hidden from client.
+	var skipped byte
+	for {
+		p, err := readMySQLPacket(server)
+		if err != nil {
+			return fmt.Errorf("reading authentication response: %v", err)
+		}
+		if len(p.payload) > 1 && p.payload[0] == mysqlAuthSwitch {
+			plugin := p.payload[1:]
+			if i := bytes.IndexByte(plugin, 0); i >= 0 {
+				plugin = plugin[:i]
+			}
+			if string(plugin) == mysqlClearPassword {
+				tok, err := token(opts.TokenSource)
+				if err != nil {
+					return err
+				}
+				reply := mysqlPacket{seq: p.seq + 1, payload: append([]byte(tok), 0)}
+				if err := writeMySQLPacket(server, reply); err != nil {
+					return err
+				}
+				skipped += 2
+				continue
+			}
+		}
+		// An OK or error packet, or a request for another form of
+		// authentication which the client must handle.
+		p.seq -= skipped
+		return writeMySQLPacket(client, p)
+	}
+}
+
+// mysqlCapabilities returns the capabilities advertised in an initial
+// handshake packet. If clearSSL is set, CLIENT_SSL is removed from the
+// packet.
+func mysqlCapabilities(payload []byte, clearSSL bool) (uint32, error) {
+	// The protocol version is followed by the NUL-terminated server version,
+	// a 4 byte connection ID, 8 bytes of auth plugin data, and a filler byte,
+	// before the lower 2 bytes of the capability flags. The upper 2 bytes
+	// follow the character set and status flags, if present.
+	if len(payload) == 0 || payload[0] != 10 {
+		return 0, errors.New("unsupported MySQL protocol version")
+	}
+	end := bytes.IndexByte(payload[1:], 0)
+	if end < 0 {
+		return 0, errors.New("malformed initial handshake")
+	}
+	flags := 1 + end + 1 + 4 + 8 + 1
+	if len(payload) < flags+2 {
+		return 0, errors.New("malformed initial handshake")
+	}
+	caps := uint32(binary.LittleEndian.Uint16(payload[flags:]))
+	if len(payload) >= flags+7 {
+		caps |= uint32(binary.LittleEndian.Uint16(payload[flags+5:])) << 16
+	}
+	if clearSSL {
+		payload[flags+1] &^= mysqlClientSSL >> 8
+	}
+	return caps, nil
+}
+
+// setMySQLConnectAttr returns the handshake response payload with the
+// connection attribute key set to value. If payload already sets key, it is
+// returned unchanged unless override is set, in which case the value is
+// replaced. Responses which cannot be parsed, such as those from clients too
+// old to support connection attributes, are returned unchanged.
+func setMySQLConnectAttr(payload []byte, key, value string, override bool) []byte {
+	// The capabilities, maximum packet size, character set and 23 byte
+	// filler are followed by the NUL-terminated user name, the auth response,
+	// the database and auth plugin names if their capabilities are set, and
+	// the connection attributes.
+	if len(payload) < 32 {
+		return payload
+	}
+	caps := binary.LittleEndian.Uint32(payload)
+	if caps&mysqlClientProtocol41 == 0 || caps&mysqlClientSSL != 0 {
+		return payload
+	}
+	r := mysqlReader{b: payload, off: 32}
+	r.nulString()
+	switch {
+	case caps&mysqlClientPluginAuthLenencData != 0:
+		r.lenencString()
+	case caps&mysqlClientSecureConnection != 0:
+		if r.off < len(r.b) {
+			r.skip(int(r.b[r.off]) + 1)
+		} else {
+			r.err = true
+		}
+	default:
+		r.nulString()
+	}
+	if caps&mysqlClientConnectWithDB != 0 {
+		r.nulString()
+	}
+	if caps&mysqlClientPluginAuth != 0 {
+		r.nulString()
+	}
+	if r.err {
+		return payload
+	}
+	attrsStart := r.off
+
+	var attrs []byte
+	if caps&mysqlClientConnectAttrs != 0 {
+		n := r.lenencInt()
+		in := r.bytes(int(n))
+		if r.err {
+			return payload
+		}
+		a := mysqlReader{b: in}
+		for a.off < len(a.b) && !a.err {
+			k := a.lenencString()
+			v := a.lenencString()
+			if a.err {
+				break
+			}
+			if string(k) != key {
+				attrs = appendLenencString(appendLenencString(attrs, string(k)), string(v))
+				continue
+			}
+			if !override {
+				return payload
+			}
+		}
+		if a.err {
+			return payload
+		}
+	}
+	rest := payload[r.off:]
+
+	attrs = appendLenencString(attrs, key)
+	attrs = appendLenencString(attrs, value)
+	out := make([]byte, 0, len(payload)+len(key)+len(value)+16)
+	out = append(out, payload[:attrsStart]...)
+	binary.LittleEndian.PutUint32(out, caps|mysqlClientConnectAttrs)
+	out = appendLenencInt(out, uint64(len(attrs)))
+	out = append(out, attrs...)
+	return append(out, rest...)
+}
+
+// mysqlReader reads the fields of a MySQL packet from b. Reading past the end
+// of b sets err instead of panicking.
+type mysqlReader struct {
+	b   []byte
+	off int
+	err bool
+}
+
+func (r *mysqlReader) skip(n int) {
+	if r.err || n < 0 || r.off+n > len(r.b) {
+		r.err = true
+		return
+	}
+	r.off += n
+}
+
+func (r *mysqlReader) bytes(n int) []byte {
+	start := r.off
+	r.skip(n)
+	if r.err {
+		return nil
+	}
+	return r.b[start:r.off]
+}
+
+func (r *mysqlReader) nulString() []byte {
+	if r.err {
+		return nil
+	}
+	i := bytes.IndexByte(r.b[r.off:], 0)
+	if i < 0 {
+		r.err = true
+		return nil
+	}
+	s := r.b[r.off : r.off+i]
+	r.off += i + 1
+	return s
+}
+
+// lenencInt reads a length-encoded integer.
+func (r *mysqlReader) lenencInt() uint64 {
+	if r.err || r.off >= len(r.b) {
+		r.err = true
+		return 0
+	}
+	first := r.b[r.off]
+	r.off++
+	var size int
+	switch first {
+	case 0xfc:
+		size = 2
+	case 0xfd:
+		size = 3
+	case 0xfe:
+		size = 8
+	default:
+		if first > 0xfe {
+			r.err = true
+			return 0
+		}
+		return uint64(first)
+	}
+	b := r.bytes(size)
+	var n uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		n = n<<8 | uint64(b[i])
+	}
+	return n
+}
+
+// lenencString reads a string prefixed by its length-encoded length.
+func (r *mysqlReader) lenencString() []byte {
+	n := r.lenencInt()
+	if n > uint64(len(r.b)) {
+		r.err = true
+		return nil
+	}
+	return r.bytes(int(n))
+}
+
+// appendLenencInt appends n to b as a length-encoded integer.
+func appendLenencInt(b []byte, n uint64) []byte {
+	switch {
+	case n < 0xfb:
+		return append(b, byte(n))
+	case n < 1<<16:
+		return append(b, 0xfc, byte(n), byte(n>>8))
+	case n < 1<<24:
+		return append(b, 0xfd, byte(n), byte(n>>8), byte(n>>16))
+	}
+	b = append(b, 0xfe)
+	for i := 0; i < 8; i++ {
+		b = append(b, byte(n>>(8*i)))
+	}
+	return b
+}
+
+// appendLenencString appends s to b prefixed by its length-encoded length.
+func appendLenencString(b []byte, s string) []byte {
+	return append(appendLenencInt(b, uint64(len(s))), s...)
+}
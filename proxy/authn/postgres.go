@@ -0,0 +1,211 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	pgSSLRequest    = 80877103
+	pgGSSENCRequest = 80877104
+	pgCancelRequest = 80877102
+	// pgProtocol3 is the major version of the protocol in a StartupMessage.
+	pgProtocol3 = 3
+
+	pgApplicationName = "application_name"
+
+	pgAuthCleartextPassword = 3
+)
+
+// Postgres sets up a Postgres connection on behalf of client.
+//
+// If opts.TokenSource is set, requests from client for SSL or GSS encryption
+// are declined, as the connection to the instance is already encrypted;
+// otherwise they are forwarded to server, and if it accepts one the connection
+// is left to client from then on. The client's
+// StartupMessage is forwarded to server, with an application_name parameter
+// added if opts.ApplicationName is set and the client did not supply one, or
+// replacing the client's if opts.OverrideApplicationName is also set. If
+// opts.TokenSource is set and server requests a cleartext password, a token
+// is sent in reply instead of forwarding the request to client. Any other
+// authentication request is forwarded to client, which then completes
+// authentication itself.
+func Postgres(client, server io.ReadWriter, opts Options) error {
+	msg, err := readPostgresStartup(client)
+	for err == nil && isEncryptionRequest(msg) {
+		if opts.TokenSource == nil {
+			// Only the application name is being set, so leave the
+			// decision to server as usual.
+			encrypted, err := forwardEncryptionRequest(client, server, msg)
+			if err != nil || encrypted {
+				// The rest of the session is encrypted by client and
+				// cannot be modified.
+				return err
+			}
+		} else if _, err := client.Write([]byte{'N'}); err != nil {
+			return err
+		}
+		msg, err = readPostgresStartup(client)
+	}
+	if err != nil {
+		return fmt.Errorf("reading startup message: %v", err)
+	}
+	if opts.ApplicationName != "" {
+		msg = setPostgresParameter(msg, pgApplicationName, opts.ApplicationName, opts.OverrideApplicationName)
+	}
+	if _, err := server.Write(msg); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(msg[4:8]) == pgCancelRequest {
+		// Cancel requests are sent on a connection of their own, which is
+		// not authenticated.
+		return nil
+	}
+	if opts.TokenSource == nil {
+		return nil
+	}
+
+	for {
+		msg, err := readPostgresMessage(server)
+		if err != nil {
+			return fmt.Errorf("reading authentication response: %v", err)
+		}
+		if msg[0] != 'R' || len(msg) < 9 {
+			// Most likely an ErrorResponse; leave it to the client.
+			_, err := client.Write(msg)
+			return err
+		}
+		if binary.BigEndian.Uint32(msg[5:9]) != pgAuthCleartextPassword {
+			// AuthenticationOk, or another form of authentication, e.g. for
+			// a built-in database user with a password.
+			_, err := client.Write(msg)
+			return err
+		}
+		tok, err := token(opts.TokenSource)
+		if err != nil {
+			return err
+		}
+		if _, err := server.Write(postgresPasswordMessage(tok)); err != nil {
+			return err
+		}
+	}
+}
+
+// isEncryptionRequest reports whether the startup message msg requests SSL or
+// GSS encryption.
+func isEncryptionRequest(msg []byte) bool {
+	code := binary.BigEndian.Uint32(msg[4:8])
+	return code == pgSSLRequest || code == pgGSSENCRequest
+}
+
+// forwardEncryptionRequest forwards the SSLRequest or GSSENCRequest msg to
+// server and relays its one byte response to client, reporting whether server
+// accepted the request.
+func forwardEncryptionRequest(client, server io.ReadWriter, msg []byte) (bool, error) {
+	if _, err := server.Write(msg); err != nil {
+		return false, err
+	}
+	var resp [1]byte
+	if _, err := io.ReadFull(server, resp[:]); err != nil {
+		return false, fmt.Errorf("reading encryption response: %v", err)
+	}
+	if _, err := client.Write(resp[:]); err != nil {
+		return false, err
+	}
+	return resp[0] != 'N', nil
+}
+
+// setPostgresParameter returns the StartupMessage msg with the parameter key
+// set to value. If msg already sets key, it is returned unchanged unless
+// override is set, in which case its value is replaced. Messages other than a
+// version 3 StartupMessage, such as a CancelRequest, are returned unchanged.
+func setPostgresParameter(msg []byte, key, value string, override bool) []byte {
+	if binary.BigEndian.Uint32(msg[4:8])>>16 != pgProtocol3 {
+		return msg
+	}
+	// The parameters are pairs of NUL-terminated names and values, followed
+	// by a terminating NUL.
+	params := msg[8:]
+	if len(params) == 0 || params[len(params)-1] != 0 {
+		return msg
+	}
+	out := make([]byte, 0, len(msg)+len(key)+len(value)+2)
+	out = append(out, msg[:8]...)
+	fields := bytes.Split(params[:len(params)-1], []byte{0})
+	for i := 0; i+1 < len(fields); i += 2 {
+		if string(fields[i]) != key {
+			out = append(out, fields[i]...)
+			out = append(out, 0)
+			out = append(out, fields[i+1]...)
+			out = append(out, 0)
+			continue
+		}
+		if !override {
+			return msg
+		}
+	}
+	out = append(out, key...)
+	out = append(out, 0)
+	out = append(out, value...)
+	out = append(out, 0, 0)
+	binary.BigEndian.PutUint32(out, uint32(len(out)))
+	return out
+}
+
+// readPostgresStartup reads a startup message, which has no type byte.
+func readPostgresStartup(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n < 8 || n > maxMessageSize {
+		return nil, fmt.Errorf("invalid message length %d", n)
+	}
+	msg := make([]byte, n)
+	copy(msg, header[:])
+	_, err := io.ReadFull(r, msg[4:])
+	return msg, err
+}
+
+// readPostgresMessage reads a message consisting of a type byte, a length,
+// and a body.
+func readPostgresMessage(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n < 4 || n > maxMessageSize {
+		return nil, fmt.Errorf("invalid message length %d", n)
+	}
+	msg := make([]byte, 1+n)
+	copy(msg, header[:])
+	_, err := io.ReadFull(r, msg[5:])
+	return msg, err
+}
+
+// postgresPasswordMessage returns a PasswordMessage holding password.
+func postgresPasswordMessage(password string) []byte {
+	msg := make([]byte, 5, 5+len(password)+1)
+	msg[0] = 'p'
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(password)+1))
+	msg = append(msg, password...)
+	return append(msg, 0)
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package broker lets gRPC clients connect to Cloud SQL instances through the
+// proxy, using the Broker service defined in broker.proto.
+//
+// Each ConnectToInstance stream is handed to a proxy.Client as a connection,
+// so it is subject to the same limits, authentication and metrics as
+// connections accepted on the proxy's sockets. Go clients can use the
+// generated NewBrokerClient to call the service.
+package broker
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative broker.proto
+
+import (
+	"net"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// readSize is the most data sent to a client in a single response.
+const readSize = 32 * 1024
+
+// NewConnSrc registers the Broker service on s and returns a chan which
+// receives a connection for each ConnectToInstance stream, in the form
+// expected by proxy.Client.Run. The chan is never closed.
+func NewConnSrc(s grpc.ServiceRegistrar) <-chan proxy.Conn {
+	ch := make(chan proxy.Conn)
+	RegisterBrokerServer(s, &server{conns: ch})
+	return ch
+}
+
+type server struct {
+	UnimplementedBrokerServer
+	conns chan<- proxy.Conn
+}
+
+func (s *server) ConnectToInstance(stream Broker_ConnectToInstanceServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if req.Instance == "" {
+		return status.Error(codes.InvalidArgument, "the first request must name an instance")
+	}
+
+	// The proxy reads from and writes to one end of a pipe, while this
+	// stream relays the other end to the client.
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := streamConn{Conn: local}
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		conn.remote = p.Addr
+	}
+	select {
+	case s.conns <- proxy.Conn{Instance: req.Instance, Conn: conn}:
+	case <-stream.Context().Done():
+		local.Close()
+		return status.FromContextError(stream.Context().Err()).Err()
+	}
+
+	go func() {
+		// Closing remote once the client stops sending tells the proxy
+		// that the connection is finished.
+		defer remote.Close()
+		data := req.Data
+		for {
+			if len(data) > 0 {
+				if _, err := remote.Write(data); err != nil {
+					return
+				}
+			}
+			req, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			data = req.Data
+		}
+	}()
+
+	buf := make([]byte, readSize)
+	for {
+		n, err := remote.Read(buf)
+		if n > 0 {
+			// Messages must not be modified once sent, so buf cannot be
+			// reused for them.
+			if err := stream.Send(&Bytes{Data: append([]byte(nil), buf[:n]...)}); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			// Either the proxy closed its end, or the client finished.
+			return nil
+		}
+	}
+}
+
+// streamConn is the proxy's end of the pipe for a stream, reporting the
+// address of the gRPC client as its remote address so that the proxy's
+// network restrictions still apply.
+type streamConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c streamConn) LocalAddr() net.Addr {
+	return brokerAddr{}
+}
+
+func (c streamConn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return brokerAddr{}
+	}
+	return c.remote
+}
+
+type brokerAddr struct{}
+
+func (brokerAddr) Network() string { return "grpc" }
+
+func (brokerAddr) String() string { return "grpc broker" }
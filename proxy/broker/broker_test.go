@@ -0,0 +1,144 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const instance = "proj:region:inst"
+
+// startBroker serves the Broker service in memory, returning a client for it,
+// the connections it receives, and a func to stop it.
+func startBroker(t *testing.T) (BrokerClient, <-chan proxy.Conn, func()) {
+	l := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	conns := NewConnSrc(s)
+	go s.Serve(l)
+
+	cc, err := grpc.Dial("bufnet",
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return l.Dial()
+		}),
+	)
+	if err != nil {
+		t.Fatalf("grpc.Dial: %v", err)
+	}
+	stop := func() {
+		cc.Close()
+		s.Stop()
+	}
+	return NewBrokerClient(cc), conns, stop
+}
+
+func TestConnectToInstance(t *testing.T) {
+	client, conns, stop := startBroker(t)
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.ConnectToInstance(ctx)
+	if err != nil {
+		t.Fatalf("ConnectToInstance: %v", err)
+	}
+	if err := stream.Send(&ConnectRequest{Instance: instance, Data: []byte("hello")}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	conn := <-conns
+	if conn.Instance != instance {
+		t.Errorf("got connection to %q, want %q", conn.Instance, instance)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn.Conn, buf); err != nil {
+		t.Fatalf("reading from connection: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("read %q, want %q", buf, "hello")
+	}
+
+	if _, err := conn.Conn.Write([]byte("world")); err != nil {
+		t.Fatalf("writing to connection: %v", err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if string(resp.Data) != "world" {
+		t.Errorf("received %q, want %q", resp.Data, "world")
+	}
+
+	// Closing the connection, as the proxy does once the instance closes
+	// it, ends the stream.
+	conn.Conn.Close()
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("Recv after close returned %v, want io.EOF", err)
+	}
+}
+
+func TestConnectToInstanceClientClose(t *testing.T) {
+	client, conns, stop := startBroker(t)
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.ConnectToInstance(ctx)
+	if err != nil {
+		t.Fatalf("ConnectToInstance: %v", err)
+	}
+	if err := stream.Send(&ConnectRequest{Instance: instance}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	conn := <-conns
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("CloseSend: %v", err)
+	}
+	if _, err := conn.Conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read after CloseSend returned %v, want io.EOF", err)
+	}
+}
+
+func TestConnectToInstanceNoInstance(t *testing.T) {
+	client, conns, stop := startBroker(t)
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.ConnectToInstance(ctx)
+	if err != nil {
+		t.Fatalf("ConnectToInstance: %v", err)
+	}
+	if err := stream.Send(&ConnectRequest{Data: []byte("hello")}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	_, err = stream.Recv()
+	if got := status.Code(err); got != codes.InvalidArgument {
+		t.Errorf("Recv returned %v, want code %v", err, codes.InvalidArgument)
+	}
+	select {
+	case c := <-conns:
+		t.Errorf("got connection to %q, want none", c.Instance)
+	default:
+	}
+}
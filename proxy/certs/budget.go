@@ -0,0 +1,84 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// The API call budget of each instance is a token bucket holding up to
+// apiBudgetBurst calls, refilled at apiBudgetRate calls per second.
+const (
+	apiBudgetRate  = 1
+	apiBudgetBurst = 5
+)
+
+// ErrAPIBudgetExceeded is wrapped by the error returned when a call is not
+// made because its instance's API call budget is exhausted and no previous
+// call has failed.
+var ErrAPIBudgetExceeded = errors.New("too many Cloud SQL Admin API calls")
+
+// apiBudget limits the rate of sqladmin API calls made for each instance, so
+// that many callers retrying at once while an instance is unreachable do not
+// exhaust the project's API quota. The zero value is ready to use.
+type apiBudget struct {
+	mu sync.Mutex
+	// limiters holds each instance's token bucket.
+	limiters map[string]*rate.Limiter
+	// lastErr holds the error from each instance's most recent API call, if
+	// it failed. It is returned to callers in place of a call when the
+	// budget is exhausted.
+	lastErr map[string]error
+}
+
+// allow reports whether an API call for instance may be made now. If not, it
+// also returns the error to report instead.
+func (b *apiBudget) allow(instance string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l, ok := b.limiters[instance]
+	if !ok {
+		if b.limiters == nil {
+			b.limiters = make(map[string]*rate.Limiter)
+		}
+		l = rate.NewLimiter(apiBudgetRate, apiBudgetBurst)
+		b.limiters[instance] = l
+	}
+	if l.Allow() {
+		return true, nil
+	}
+	if err := b.lastErr[instance]; err != nil {
+		return false, err
+	}
+	return false, fmt.Errorf("%w for %s; try again later", ErrAPIBudgetExceeded, instance)
+}
+
+// record saves the result of an API call for instance.
+func (b *apiBudget) record(instance string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.lastErr, instance)
+		return
+	}
+	if b.lastErr == nil {
+		b.lastErr = make(map[string]error)
+	}
+	b.lastErr[instance] = err
+}
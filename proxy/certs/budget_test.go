@@ -0,0 +1,63 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestAPIBudget(t *testing.T) {
+	s := &RemoteCertSource{}
+	calls := 0
+	notFound := func() error {
+		calls++
+		return &googleapi.Error{Code: 404}
+	}
+
+	var first error
+	for i := 0; i < apiBudgetBurst; i++ {
+		first = s.backoffAPIRetry("get instance", "p:r:a", notFound)
+	}
+	if calls != apiBudgetBurst {
+		t.Fatalf("made %d calls within the budget, want %d", calls, apiBudgetBurst)
+	}
+	err := s.backoffAPIRetry("get instance", "p:r:a", notFound)
+	if calls != apiBudgetBurst {
+		t.Errorf("made a call after the budget was exhausted")
+	}
+	if err == nil || err.Error() != first.Error() {
+		t.Errorf("over budget, got error %v, want the previous error %v", err, first)
+	}
+
+	// Other instances have budgets of their own.
+	if err := s.backoffAPIRetry("get instance", "p:r:b", func() error { return nil }); err != nil {
+		t.Errorf("call for another instance failed: %v", err)
+	}
+}
+
+func TestAPIBudgetWithoutError(t *testing.T) {
+	var b apiBudget
+	for i := 0; i < apiBudgetBurst; i++ {
+		b.allow("p:r:a")
+		b.record("p:r:a", nil)
+	}
+	ok, err := b.allow("p:r:a")
+	if ok || !errors.Is(err, ErrAPIBudgetExceeded) {
+		t.Errorf("allow() = %v, %v; want false and ErrAPIBudgetExceeded", ok, err)
+	}
+}
@@ -27,9 +27,11 @@ import (
 	mrand "math/rand"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/metrics"
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/util"
 	"golang.org/x/oauth2"
 	"google.golang.org/api/googleapi"
@@ -38,6 +40,11 @@ import (
 
 const defaultUserAgent = "custom cloud_sql_proxy version >= 1.10"
 
+// PSCIPAddrType is the type of the address of an instance's Private Service
+// Connect endpoint. Connections to it are authenticated with the instance's
+// server CA like any other.
+const PSCIPAddrType = "PSC"
+
 // NewCertSource returns a CertSource which can be used to authenticate using
 // the provided client, which must not be nil.
 //
@@ -67,7 +74,8 @@ type RemoteOpts struct {
 	// sqladmin API.
 	UserAgent string
 
-	// IP address type options
+	// IP address type options, in order of preference, e.g. "PUBLIC",
+	// "PRIVATE" or PSCIPAddrType.
 	IPAddrTypeOpts []string
 
 	// Enable IAM proxy db authentication
@@ -75,6 +83,20 @@ type RemoteOpts struct {
 
 	// Token source for token information used in cert creation
 	TokenSource oauth2.TokenSource
+
+	// Metrics, if set, records failed calls to the sqladmin API.
+	Metrics *metrics.Metrics
+
+	// Backoff configures the delays between retries of failed sqladmin API
+	// calls. If unset, DefaultBackoff is used.
+	Backoff Backoff
+
+	// LocalNetwork, if set, is the VPC network of the machine the proxy runs
+	// on, e.g. "projects/my-project/global/networks/default". Instances on
+	// that network are reached through their private IP address, and others
+	// through their public IP address, falling back to the other type if the
+	// instance has no address of the chosen one. IPAddrTypeOpts is ignored.
+	LocalNetwork string
 }
 
 // NewCertSourceOpts returns a CertSource configured with the provided Opts.
@@ -112,7 +134,18 @@ func NewCertSourceOpts(c *http.Client, opts RemoteOpts) *RemoteCertSource {
 		}
 	}
 
-	return &RemoteCertSource{pkey, serv, !opts.IgnoreRegion, opts.IPAddrTypeOpts, opts.EnableIAMLogin, opts.TokenSource}
+	return &RemoteCertSource{
+		key:            pkey,
+		serv:           serv,
+		checkRegion:    !opts.IgnoreRegion,
+		IPAddrTypes:    opts.IPAddrTypeOpts,
+		EnableIAMLogin: opts.EnableIAMLogin,
+		TokenSource:    opts.TokenSource,
+		metrics:        opts.Metrics,
+		backoff:        opts.Backoff,
+		localNetwork:   opts.LocalNetwork,
+		client:         c,
+	}
 }
 
 // RemoteCertSource implements a CertSource, using Cloud SQL APIs to
@@ -134,38 +167,112 @@ type RemoteCertSource struct {
 	EnableIAMLogin bool
 	// token source for the token information used in cert creation
 	TokenSource oauth2.TokenSource
+	// metrics records failed API calls. It may be nil.
+	metrics *metrics.Metrics
+	// budget limits the rate of API calls for each instance.
+	budget apiBudget
+	// backoff configures the delays between retries of failed API calls.
+	backoff Backoff
+	// localNetwork, if set, chooses the type of IP address used for each
+	// instance; see RemoteOpts.LocalNetwork.
+	localNetwork string
+	// chosen holds the address last chosen for each instance with
+	// localNetwork set, so that the choice is logged when it changes.
+	chosen sync.Map
+	// regions holds the region last reported by the Admin API for each
+	// instance; see Region.
+	regions sync.Map
+	// client is the client API calls are made with.
+	client *http.Client
+	// account is the email of TokenSource's account, once looked up; see
+	// tokenAccount.
+	account     string
+	accountOnce sync.Once
 }
 
-// Constants for backoffAPIRetry. These cause the retry logic to scale the
-// backoff delay from 200ms to around 3.5s.
-const (
-	baseBackoff    = float64(200 * time.Millisecond)
-	backoffMult    = 1.618
-	backoffRetries = 5
-)
+// backoffRetries is the number of attempts backoffAPIRetry makes.
+const backoffRetries = 5
+
+// Backoff configures the delays between attempts of a failed API call. The
+// nth retry waits InitialDelay * Multiplier^(n-1), increased by a random
+// factor of up to Multiplier, and at most MaxDelay. Zero fields take their
+// values from DefaultBackoff.
+type Backoff struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+}
+
+// DefaultBackoff scales the delay between retries from around 300ms to 4s.
+var DefaultBackoff = Backoff{
+	InitialDelay: 300 * time.Millisecond,
+	MaxDelay:     4 * time.Second,
+	Multiplier:   1.618,
+}
+
+// Delay returns how long to wait before retry n, counting from 1.
+func (b Backoff) Delay(n int) time.Duration {
+	if b.InitialDelay == 0 {
+		b.InitialDelay = DefaultBackoff.InitialDelay
+	}
+	if b.MaxDelay == 0 {
+		b.MaxDelay = DefaultBackoff.MaxDelay
+	}
+	if b.Multiplier == 0 {
+		b.Multiplier = DefaultBackoff.Multiplier
+	}
+	exp := float64(n-1) + mrand.Float64()
+	d := float64(b.InitialDelay) * math.Pow(b.Multiplier, exp)
+	if d > float64(b.MaxDelay) {
+		return b.MaxDelay
+	}
+	return time.Duration(d)
+}
 
-func backoffAPIRetry(desc, instance string, do func() error) error {
+// backoffAPIRetry calls do, which makes a sqladmin API call for instance,
+// retrying server errors with exponential backoff. Each attempt is taken from
+// the instance's API call budget; once that is exhausted, the error from the
+// instance's most recent call is returned without calling do again.
+func (s *RemoteCertSource) backoffAPIRetry(desc, instance string, do func() error) error {
+	err := s.retryAPI(desc, instance, do)
+	s.budget.record(instance, err)
+	return err
+}
+
+func (s *RemoteCertSource) retryAPI(desc, instance string, do func() error) error {
 	var err error
 	for i := 0; i < backoffRetries; i++ {
+		allowed, budgetErr := s.budget.allow(instance)
+		s.metrics.APIBudget(instance, allowed)
+		if !allowed {
+			logging.Verbosef("API call budget exhausted for %s; not calling %s", instance, desc)
+			if err != nil {
+				// Stop retrying, returning the error from the last attempt.
+				return err
+			}
+			return budgetErr
+		}
 		err = do()
 		gErr, ok := err.(*googleapi.Error)
+		if ok {
+			s.metrics.APIError(gErr.Code)
+		} else if err != nil {
+			s.metrics.APIError(0)
+		}
 		switch {
 		case !ok:
 			// 'ok' will also be false if err is nil.
 			return err
-		case gErr.Code == 403 && len(gErr.Errors) > 0 && gErr.Errors[0].Reason == "insufficientPermissions":
-			// The case where the admin API has not yet been enabled.
-			return fmt.Errorf("ensure that the Cloud SQL API is enabled for your project (https://console.cloud.google.com/flows/enableapi?apiid=sqladmin). Error during %s %s: %v", desc, instance, err)
-		case gErr.Code == 404 || gErr.Code == 403:
-			return fmt.Errorf("ensure that the account has access to %q (and make sure there's no typo in that name). Error during %s %s: %v", instance, desc, instance, err)
+		case gErr.Code == 403:
+			return forbiddenError(desc, instance, s.tokenAccount(), gErr)
+		case gErr.Code == 404:
+			return fmt.Errorf("ensure that the account has access to %q (and make sure there's no typo in that name). Error during %s %s: %w", instance, desc, instance, err)
 		case gErr.Code < 500:
 			// Only Server-level HTTP errors are immediately retryable.
 			return err
 		}
 
-		// sleep = baseBackoff * backoffMult^(retries + randomFactor)
-		exp := float64(i+1) + mrand.Float64()
-		sleep := time.Duration(baseBackoff * math.Pow(backoffMult, exp))
+		sleep := s.backoff.Delay(i + 1)
 		logging.Errorf("Error in %s %s: %v; retrying in %v", desc, instance, err, sleep)
 		time.Sleep(sleep)
 	}
@@ -216,7 +323,7 @@ func (s *RemoteCertSource) Local(instance string) (tls.Certificate, error) {
 	req := s.serv.SslCerts.CreateEphemeral(p, regionName, &createEphemeralRequest)
 
 	var data *sqladmin.SslCert
-	err = backoffAPIRetry("createEphemeral for", instance, func() error {
+	err = s.backoffAPIRetry("createEphemeral for", instance, func() error {
 		data, err = req.Do()
 		return err
 	})
@@ -251,7 +358,13 @@ func parseCert(pemCert string) (*x509.Certificate, error) {
 
 // Find the first matching IP address by user input IP address types
 func (s *RemoteCertSource) findIPAddr(data *sqladmin.DatabaseInstance, instance string) (ipAddrInUse string, err error) {
-	for _, eachIPAddrTypeByUser := range s.IPAddrTypes {
+	return findIPAddrOfTypes(data, instance, s.IPAddrTypes)
+}
+
+// findIPAddrOfTypes returns the instance's first IP address of one of types,
+// in order of preference.
+func findIPAddrOfTypes(data *sqladmin.DatabaseInstance, instance string, types []string) (ipAddrInUse string, err error) {
+	for _, eachIPAddrTypeByUser := range types {
 		for _, eachIPAddrTypeOfInstance := range data.IpAddresses {
 			if strings.ToUpper(eachIPAddrTypeOfInstance.Type) == strings.ToUpper(eachIPAddrTypeByUser) {
 				ipAddrInUse = eachIPAddrTypeOfInstance.IpAddress
@@ -265,9 +378,69 @@ func (s *RemoteCertSource) findIPAddr(data *sqladmin.DatabaseInstance, instance
 		ipAddrTypesOfInstance += fmt.Sprintf("(TYPE=%v, IP_ADDR=%v)", eachIPAddrTypeOfInstance.Type, eachIPAddrTypeOfInstance.IpAddress)
 	}
 
-	ipAddrTypeOfUser := fmt.Sprintf("%v", s.IPAddrTypes)
+	ipAddrTypeOfUser := fmt.Sprintf("%v", types)
+
+	return "", fmt.Errorf("instance %v has no IP address of the types %v; the instance's IP addresses are %v", instance, ipAddrTypeOfUser, ipAddrTypesOfInstance)
+}
+
+// autoIPAddr returns the instance's private IP address if its private network
+// is s.localNetwork, and its public IP address otherwise. The choice, and the
+// reason for it, are logged whenever the address changes.
+func (s *RemoteCertSource) autoIPAddr(data *sqladmin.DatabaseInstance, instance string) (string, error) {
+	var privateNet string
+	if data.Settings != nil && data.Settings.IpConfiguration != nil {
+		privateNet = data.Settings.IpConfiguration.PrivateNetwork
+	}
+	types := []string{"PRIMARY", "PRIVATE"}
+	var reason string
+	switch {
+	case privateNet == "":
+		reason = "the instance has no private IP address"
+	case sameNetwork(privateNet, s.localNetwork):
+		types = []string{"PRIVATE", "PRIMARY"}
+		reason = fmt.Sprintf("the proxy's network %v is the instance's private network", s.localNetwork)
+	default:
+		reason = fmt.Sprintf("the proxy's network %v is not the instance's private network %v", s.localNetwork, privateNet)
+	}
+	addr, err := findIPAddrOfTypes(data, instance, types)
+	if err != nil {
+		return "", err
+	}
+	if old, ok := s.chosen.Load(instance); !ok || old.(string) != addr {
+		s.chosen.Store(instance, addr)
+		kind := "public"
+		for _, m := range data.IpAddresses {
+			if m.IpAddress == addr && strings.ToUpper(m.Type) == "PRIVATE" {
+				kind = "private"
+			}
+		}
+		if (kind == "private") != (types[0] == "PRIVATE") {
+			reason += ", but it has no address of that type"
+		}
+		logging.Infof("Connecting to %v through its %v IP address %v: %v", instance, kind, addr, reason)
+	}
+	return addr, nil
+}
+
+// sameNetwork reports whether two VPC network names, of the form
+// "projects/PROJECT/global/networks/NETWORK", refer to the same network. The
+// "global" segment is optional.
+func sameNetwork(a, b string) bool {
+	norm := func(n string) string {
+		return strings.ToLower(strings.Replace(n, "/global/", "/", 1))
+	}
+	return norm(a) == norm(b)
+}
 
-	return "", fmt.Errorf("User input IP address type %v does not match the instance %v, the instance's IP addresses are %v ", ipAddrTypeOfUser, instance, ipAddrTypesOfInstance)
+// Region returns the region the Admin API last reported for the specified
+// instance, which may differ from the region in its connection name. It is
+// empty if the instance has not been retrieved.
+func (s *RemoteCertSource) Region(instance string) string {
+	r, ok := s.regions.Load(instance)
+	if !ok {
+		return ""
+	}
+	return r.(string)
 }
 
 // Remote returns the specified instance's CA certificate, address, and name.
@@ -277,7 +450,7 @@ func (s *RemoteCertSource) Remote(instance string) (cert *x509.Certificate, addr
 	req := s.serv.Instances.Get(p, regionName)
 
 	var data *sqladmin.DatabaseInstance
-	err = backoffAPIRetry("get instance", instance, func() error {
+	err = s.backoffAPIRetry("get instance", instance, func() error {
 		data, err = req.Do()
 		return err
 	})
@@ -289,6 +462,7 @@ func (s *RemoteCertSource) Remote(instance string) (cert *x509.Certificate, addr
 	if data.Region == "us-central" {
 		data.Region = "us-central1"
 	}
+	s.regions.Store(instance, data.Region)
 	if data.Region != region {
 		if region == "" {
 			err = fmt.Errorf("instance %v doesn't provide region", instance)
@@ -312,7 +486,11 @@ func (s *RemoteCertSource) Remote(instance string) (cert *x509.Certificate, addr
 
 	// Find the first matching IP address by user input IP address types
 	ipAddrInUse := ""
-	ipAddrInUse, err = s.findIPAddr(data, instance)
+	if s.localNetwork != "" {
+		ipAddrInUse, err = s.autoIPAddr(data, instance)
+	} else {
+		ipAddrInUse, err = s.findIPAddr(data, instance)
+	}
 	if err != nil {
 		return nil, "", "", "", err
 	}
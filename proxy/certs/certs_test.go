@@ -0,0 +1,114 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"testing"
+	"time"
+
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second, Multiplier: 2}
+	for i := 0; i < 20; i++ {
+		// Each delay is between InitialDelay * Multiplier^(n-1) and one more
+		// factor of Multiplier.
+		if d := b.Delay(1); d < 100*time.Millisecond || d > 200*time.Millisecond {
+			t.Errorf("Delay(1) = %v, want between 100ms and 200ms", d)
+		}
+		if d := b.Delay(3); d < 400*time.Millisecond || d > 800*time.Millisecond {
+			t.Errorf("Delay(3) = %v, want between 400ms and 800ms", d)
+		}
+		if d := b.Delay(5); d != time.Second {
+			t.Errorf("Delay(5) = %v, want MaxDelay", d)
+		}
+	}
+
+	// Zero fields take their default values.
+	var zero Backoff
+	if d := zero.Delay(1); d < DefaultBackoff.InitialDelay || d > DefaultBackoff.MaxDelay {
+		t.Errorf("zero Backoff Delay(1) = %v, want between %v and %v", d, DefaultBackoff.InitialDelay, DefaultBackoff.MaxDelay)
+	}
+	// A multiplier of 1 gives a constant delay.
+	constant := Backoff{InitialDelay: 50 * time.Millisecond, Multiplier: 1}
+	if d := constant.Delay(4); d != 50*time.Millisecond {
+		t.Errorf("Delay(4) with Multiplier 1 = %v, want 50ms", d)
+	}
+}
+
+func TestFindIPAddrPrivateOnly(t *testing.T) {
+	s := &RemoteCertSource{IPAddrTypes: []string{"PRIVATE"}}
+	public := &sqladmin.IpMapping{Type: "PRIMARY", IpAddress: "203.0.113.1"}
+	private := &sqladmin.IpMapping{Type: "PRIVATE", IpAddress: "10.0.0.1"}
+
+	got, err := s.findIPAddr(&sqladmin.DatabaseInstance{IpAddresses: []*sqladmin.IpMapping{public, private}}, "p:r:i")
+	if err != nil || got != private.IpAddress {
+		t.Errorf("findIPAddr = %q, %v; want %q", got, err, private.IpAddress)
+	}
+	// An instance with only a public IP address is an error rather than a
+	// fallback to the public address.
+	if got, err := s.findIPAddr(&sqladmin.DatabaseInstance{IpAddresses: []*sqladmin.IpMapping{public}}, "p:r:i"); err == nil {
+		t.Errorf("findIPAddr = %q with no private IP address, want error", got)
+	}
+}
+
+func TestAutoIPAddr(t *testing.T) {
+	const local = "projects/proj/global/networks/default"
+	s := &RemoteCertSource{localNetwork: local}
+	public := &sqladmin.IpMapping{Type: "PRIMARY", IpAddress: "203.0.113.1"}
+	private := &sqladmin.IpMapping{Type: "PRIVATE", IpAddress: "10.0.0.1"}
+	onNetwork := func(n string) *sqladmin.Settings {
+		return &sqladmin.Settings{IpConfiguration: &sqladmin.IpConfiguration{PrivateNetwork: n}}
+	}
+
+	tcs := []struct {
+		desc string
+		data *sqladmin.DatabaseInstance
+		want string
+	}{
+		{
+			desc: "same network",
+			data: &sqladmin.DatabaseInstance{IpAddresses: []*sqladmin.IpMapping{public, private}, Settings: onNetwork(local)},
+			want: private.IpAddress,
+		},
+		{
+			desc: "same network without global",
+			data: &sqladmin.DatabaseInstance{IpAddresses: []*sqladmin.IpMapping{public, private}, Settings: onNetwork("projects/proj/networks/default")},
+			want: private.IpAddress,
+		},
+		{
+			desc: "other network",
+			data: &sqladmin.DatabaseInstance{IpAddresses: []*sqladmin.IpMapping{public, private}, Settings: onNetwork("projects/other/global/networks/default")},
+			want: public.IpAddress,
+		},
+		{
+			desc: "no private IP",
+			data: &sqladmin.DatabaseInstance{IpAddresses: []*sqladmin.IpMapping{public}},
+			want: public.IpAddress,
+		},
+		{
+			desc: "other network without public IP",
+			data: &sqladmin.DatabaseInstance{IpAddresses: []*sqladmin.IpMapping{private}, Settings: onNetwork("projects/other/global/networks/default")},
+			want: private.IpAddress,
+		},
+	}
+	for _, tc := range tcs {
+		got, err := s.autoIPAddr(tc.data, "p:r:i")
+		if err != nil || got != tc.want {
+			t.Errorf("%v: autoIPAddr = %q, %v; want %q", tc.desc, got, err, tc.want)
+		}
+	}
+}
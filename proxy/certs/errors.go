@@ -0,0 +1,109 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+)
+
+// tokenInfoURL is the endpoint describing an access token. It is replaced in
+// tests.
+var tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+const (
+	// sqlAdminScope and cloudPlatformScope are the OAuth2 scopes which allow
+	// calls to the Cloud SQL Admin API.
+	sqlAdminScope      = "https://www.googleapis.com/auth/sqlservice.admin"
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// errorReasons returns the reasons given for gErr, both in its list of errors
+// and in the ErrorInfo of its details.
+func errorReasons(gErr *googleapi.Error) []string {
+	var reasons []string
+	for _, e := range gErr.Errors {
+		reasons = append(reasons, e.Reason)
+	}
+	for _, d := range gErr.Details {
+		if m, ok := d.(map[string]interface{}); ok {
+			if r, ok := m["reason"].(string); ok {
+				reasons = append(reasons, r)
+			}
+		}
+	}
+	return reasons
+}
+
+// forbiddenError explains gErr, a 403 response to the API call desc for
+// instance, by its most likely cause. account is the account whose
+// credentials made the call, or empty if it is unknown.
+func forbiddenError(desc, instance, account string, gErr *googleapi.Error) error {
+	if account == "" {
+		account = "the proxy's account"
+	}
+	for _, r := range errorReasons(gErr) {
+		switch r {
+		case "accessNotConfigured", "SERVICE_DISABLED":
+			return fmt.Errorf("ensure that the Cloud SQL API is enabled for your project (https://console.cloud.google.com/flows/enableapi?apiid=sqladmin). Error during %s %s: %w", desc, instance, gErr)
+		case "insufficientPermissions", "ACCESS_TOKEN_SCOPE_INSUFFICIENT":
+			return fmt.Errorf("the credentials of %s lack the OAuth2 scope needed for the Cloud SQL Admin API. "+
+				"Ensure that they have the %s or %s scope, e.g. that a Compute Engine VM is created with one of them in its --scopes. "+
+				"Error during %s %s: %w", account, sqlAdminScope, cloudPlatformScope, desc, instance, gErr)
+		}
+	}
+	return fmt.Errorf("%s may not connect to %q. "+
+		"Ensure that it has the cloudsql.instances.connect permission on the instance's project, e.g. through the Cloud SQL Client role (roles/cloudsql.client), "+
+		"and that there is no typo in the instance name. Error during %s %s: %w", account, instance, desc, instance, gErr)
+}
+
+// tokenAccount returns the email of the account whose credentials the source
+// uses, as reported by the tokeninfo endpoint, or the empty string if it is
+// unknown. It is looked up once, the first time it is needed.
+func (s *RemoteCertSource) tokenAccount() string {
+	s.accountOnce.Do(func() {
+		if s.TokenSource == nil {
+			return
+		}
+		tok, err := s.TokenSource.Token()
+		if err != nil {
+			return
+		}
+		cl := s.client
+		if cl == nil {
+			cl = http.DefaultClient
+		}
+		// The token is sent in the request body so that it does not appear in
+		// any request logs.
+		resp, err := cl.PostForm(tokenInfoURL, url.Values{"access_token": {tok.AccessToken}})
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		var info struct {
+			Email string `json:"email"`
+		}
+		if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&info) != nil {
+			return
+		}
+		s.account = strings.TrimSpace(info.Email)
+	})
+	return s.account
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+func TestForbiddenError(t *testing.T) {
+	for _, v := range []struct {
+		desc string
+		err  *googleapi.Error
+		want []string
+	}{
+		{
+			desc: "insufficient scopes",
+			err: &googleapi.Error{Code: 403, Message: "Request had insufficient authentication scopes.",
+				Errors: []googleapi.ErrorItem{{Reason: "insufficientPermissions"}}},
+			want: []string{"sa@proj.iam.gserviceaccount.com", sqlAdminScope, "--scopes"},
+		},
+		{
+			desc: "insufficient scopes in details",
+			err: &googleapi.Error{Code: 403,
+				Details: []interface{}{map[string]interface{}{"reason": "ACCESS_TOKEN_SCOPE_INSUFFICIENT"}}},
+			want: []string{sqlAdminScope},
+		},
+		{
+			desc: "API disabled",
+			err: &googleapi.Error{Code: 403,
+				Errors: []googleapi.ErrorItem{{Reason: "accessNotConfigured"}}},
+			want: []string{"Cloud SQL API is enabled"},
+		},
+		{
+			desc: "permission denied",
+			err: &googleapi.Error{Code: 403, Message: "The client is not authorized to make this request.",
+				Errors: []googleapi.ErrorItem{{Reason: "notAuthorized"}}},
+			want: []string{"sa@proj.iam.gserviceaccount.com", `"proj:reg:db"`, "cloudsql.instances.connect"},
+		},
+	} {
+		err := forbiddenError("get instance", "proj:reg:db", "sa@proj.iam.gserviceaccount.com", v.err)
+		for _, w := range v.want {
+			if !strings.Contains(err.Error(), w) {
+				t.Errorf("%s: error %q does not mention %q", v.desc, err, w)
+			}
+		}
+		var gErr *googleapi.Error
+		if !errors.As(err, &gErr) {
+			t.Errorf("%s: error %q does not wrap the API error", v.desc, err)
+		}
+	}
+}
+
+func TestTokenAccount(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.PostFormValue("access_token") != "my-token" {
+			http.Error(w, `{"error_description": "Invalid Value"}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"email": "sa@proj.iam.gserviceaccount.com"}`)
+	}))
+	defer srv.Close()
+	defer func(old string) { tokenInfoURL = old }(tokenInfoURL)
+	tokenInfoURL = srv.URL
+
+	s := NewCertSourceOpts(http.DefaultClient, RemoteOpts{
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "my-token"}),
+	})
+	for i := 0; i < 2; i++ {
+		if got, want := s.tokenAccount(), "sa@proj.iam.gserviceaccount.com"; got != want {
+			t.Errorf("tokenAccount = %q, want %q", got, want)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("tokeninfo was called %d times, want once", calls)
+	}
+
+	s = NewCertSourceOpts(http.DefaultClient, RemoteOpts{
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "bad-token"}),
+	})
+	if got := s.tokenAccount(); got != "" {
+		t.Errorf("tokenAccount with a rejected token = %q, want none", got)
+	}
+}
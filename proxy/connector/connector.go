@@ -0,0 +1,185 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package connector lets Go programs connect to a Cloud SQL instance directly,
+// without running the proxy as a separate process.
+//
+// A Connector authenticates with the Cloud SQL Admin API, caches and refreshes
+// the instance's ephemeral certificate, and returns TLS connections to the
+// instance in the same way as the cloud_sql_proxy binary. Its Dial methods
+// can be given to a database driver in place of a network dialer; see the
+// examples. A DialerFunc, returned by NewDialer, does the same for any
+// instance, named by the address it is asked to dial. OpenDB returns a
+// database/sql DB for a MySQL or Postgres instance in one call.
+package connector
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/certs"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/util"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// serverProxyPort is the port on which Cloud SQL instances accept
+// connections from the proxy.
+const serverProxyPort = 3307
+
+// An Option configures a Connector.
+type Option func(*config)
+
+type config struct {
+	credentialsFile string
+	tokenSource     oauth2.TokenSource
+	timeout         time.Duration
+	ipAddrTypes     []string
+}
+
+// WithCredentialsFile authenticates using the service account or external
+// account credentials in the JSON file at path.
+func WithCredentialsFile(path string) Option {
+	return func(c *config) {
+		c.credentialsFile = path
+	}
+}
+
+// WithTokenSource authenticates using tokens from ts, which must have the
+// https://www.googleapis.com/auth/sqlservice.admin scope. It takes precedence
+// over WithCredentialsFile.
+func WithTokenSource(ts oauth2.TokenSource) Option {
+	return func(c *config) {
+		c.tokenSource = ts
+	}
+}
+
+// WithTimeout bounds the time taken by each dial, including fetching a
+// certificate if none is cached and the TLS handshake. By default, dials are
+// limited only by their context.
+func WithTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.timeout = d
+	}
+}
+
+// WithIPAddressTypes sets the types of the instance's IP addresses to connect
+// to, in order of preference, e.g. "PRIVATE" or "PUBLIC". The default is
+// "PUBLIC", then "PRIVATE".
+func WithIPAddressTypes(types ...string) Option {
+	return func(c *config) {
+		c.ipAddrTypes = types
+	}
+}
+
+// Connector dials a single Cloud SQL instance. It is safe for concurrent use.
+type Connector struct {
+	instance string
+	timeout  time.Duration
+	client   *proxy.Client
+}
+
+// NewConnector returns a Connector for instance, which must be given as
+// "project:region:instance".
+//
+// Unless credentials are provided with an Option, Application Default
+// Credentials are used. ctx is used to find credentials and to refresh
+// tokens, so it should not be cancelled while the Connector is in use.
+func NewConnector(ctx context.Context, instance string, opts ...Option) (*Connector, error) {
+	if project, region, name := util.SplitName(instance); project == "" || region == "" || name == "" {
+		return nil, fmt.Errorf("invalid instance connection name %q, want \"project:region:instance\"", instance)
+	}
+	cfg, client, err := newClient(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Connector{
+		instance: instance,
+		timeout:  cfg.timeout,
+		client:   client,
+	}, nil
+}
+
+// newClient returns the configuration given by opts and a proxy.Client using
+// it.
+func newClient(ctx context.Context, opts []Option) (config, *proxy.Client, error) {
+	var cfg config
+	for _, o := range opts {
+		o(&cfg)
+	}
+	ts, err := tokenSource(ctx, cfg)
+	if err != nil {
+		return config{}, nil, err
+	}
+	src := certs.NewCertSourceOpts(oauth2.NewClient(ctx, ts), certs.RemoteOpts{
+		IPAddrTypeOpts: cfg.ipAddrTypes,
+		TokenSource:    ts,
+	})
+	return cfg, &proxy.Client{
+		Port:  serverProxyPort,
+		Certs: src,
+	}, nil
+}
+
+func tokenSource(ctx context.Context, cfg config) (oauth2.TokenSource, error) {
+	switch {
+	case cfg.tokenSource != nil:
+		return cfg.tokenSource, nil
+	case cfg.credentialsFile != "":
+		b, err := ioutil.ReadFile(cfg.credentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading credentials file: %v", err)
+		}
+		creds, err := google.CredentialsFromJSON(ctx, b, proxy.SQLScope)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credentials file %q: %v", cfg.credentialsFile, err)
+		}
+		return creds.TokenSource, nil
+	default:
+		ts, err := google.DefaultTokenSource(ctx, proxy.SQLScope)
+		if err != nil {
+			return nil, fmt.Errorf("finding default credentials: %v", err)
+		}
+		return ts, nil
+	}
+}
+
+// DialContext returns a new connection to the instance. The network and
+// address are ignored, so that DialContext can be used wherever a dial
+// function is expected. Errors may be checked for the types defined by the
+// proxy package, such as *proxy.AuthError, with errors.As.
+func (c *Connector) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	return c.client.DialContext(ctx, c.instance)
+}
+
+// Dial is like DialContext, using a background context.
+func (c *Connector) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// DialTimeout is like DialContext, giving up after timeout.
+func (c *Connector) DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.DialContext(ctx, network, addr)
+}
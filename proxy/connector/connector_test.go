@@ -0,0 +1,183 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connector
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+var staticTokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"})
+
+func TestNewConnector(t *testing.T) {
+	c, err := NewConnector(context.Background(), "proj:region:inst",
+		WithTokenSource(staticTokenSource),
+		WithTimeout(time.Second),
+	)
+	if err != nil {
+		t.Fatalf("NewConnector: %v", err)
+	}
+	if c.instance != "proj:region:inst" || c.timeout != time.Second {
+		t.Fatalf("NewConnector returned %+v", c)
+	}
+	if c.client.Port != serverProxyPort {
+		t.Fatalf("client.Port = %d, want %d", c.client.Port, serverProxyPort)
+	}
+}
+
+func TestNewConnectorInvalidInstance(t *testing.T) {
+	for _, inst := range []string{"", "inst", "proj:inst", "proj::inst"} {
+		if _, err := NewConnector(context.Background(), inst, WithTokenSource(staticTokenSource)); err == nil {
+			t.Errorf("NewConnector(%q) succeeded, want error", inst)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	var cfg config
+	for _, o := range []Option{
+		WithCredentialsFile("key.json"),
+		WithTokenSource(staticTokenSource),
+		WithTimeout(time.Minute),
+		WithIPAddressTypes("PRIVATE", "PUBLIC"),
+	} {
+		o(&cfg)
+	}
+	want := config{
+		credentialsFile: "key.json",
+		tokenSource:     staticTokenSource,
+		timeout:         time.Minute,
+		ipAddrTypes:     []string{"PRIVATE", "PUBLIC"},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("options produced %+v, want %+v", cfg, want)
+	}
+}
+
+func TestTokenSourcePrecedence(t *testing.T) {
+	ts, err := tokenSource(context.Background(), config{
+		credentialsFile: "does-not-exist.json",
+		tokenSource:     staticTokenSource,
+	})
+	if err != nil {
+		t.Fatalf("tokenSource: %v", err)
+	}
+	if ts != staticTokenSource {
+		t.Fatal("WithTokenSource did not take precedence over WithCredentialsFile")
+	}
+}
+
+func TestCredentialsFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "connector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(invalid, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		path, wantErr string
+	}{
+		{filepath.Join(dir, "missing.json"), "reading credentials file"},
+		{invalid, "invalid credentials file"},
+	}
+	for _, tc := range tcs {
+		_, err := NewConnector(context.Background(), "proj:region:inst", WithCredentialsFile(tc.path))
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("NewConnector(WithCredentialsFile(%q)) error = %v, want error containing %q", tc.path, err, tc.wantErr)
+		}
+	}
+}
+
+func TestInstanceFromAddr(t *testing.T) {
+	tcs := []struct {
+		addr, want string
+	}{
+		{"proj:region:inst", "proj:region:inst"},
+		{"example.com:proj:region:inst", "example.com:proj:region:inst"},
+		{"[proj:region:inst]:5432", "proj:region:inst"},
+		{"[example.com:proj:region:inst]:3306", "example.com:proj:region:inst"},
+	}
+	for _, tc := range tcs {
+		got, err := instanceFromAddr(tc.addr)
+		if err != nil {
+			t.Errorf("instanceFromAddr(%q): %v", tc.addr, err)
+		} else if got != tc.want {
+			t.Errorf("instanceFromAddr(%q) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+	for _, addr := range []string{"", "inst", "proj:inst", "127.0.0.1:5432", "[proj::inst]:5432"} {
+		if _, err := instanceFromAddr(addr); err == nil {
+			t.Errorf("instanceFromAddr(%q) succeeded, want error", addr)
+		}
+	}
+}
+
+func TestNewDialerInvalidAddr(t *testing.T) {
+	dial, err := NewDialer(context.Background(), WithTokenSource(staticTokenSource))
+	if err != nil {
+		t.Fatalf("NewDialer: %v", err)
+	}
+	if _, err := dial(context.Background(), "tcp", "localhost:5432"); err == nil || !strings.Contains(err.Error(), "invalid instance connection name") {
+		t.Errorf("dial with a host address returned %v, want invalid instance error", err)
+	}
+}
+
+func TestOpenDB(t *testing.T) {
+	ctx := context.Background()
+	for _, driverName := range []string{"mysql", "postgres", "pgx"} {
+		db, err := OpenDB(ctx, "proj:region:inst", driverName, "user=u dbname=d", WithTokenSource(staticTokenSource))
+		if driverName == "mysql" {
+			// Not a MySQL DSN.
+			if err == nil {
+				db.Close()
+				t.Errorf("OpenDB(%q) with a Postgres DSN succeeded, want error", driverName)
+			}
+			db, err = OpenDB(ctx, "proj:region:inst", driverName, "u:p@/d", WithTokenSource(staticTokenSource))
+		}
+		if err != nil {
+			t.Errorf("OpenDB(%q): %v", driverName, err)
+			continue
+		}
+		if got := db.Stats().MaxOpenConnections; got != DefaultMaxOpenConns {
+			t.Errorf("OpenDB(%q) allows %d open connections, want %d", driverName, got, DefaultMaxOpenConns)
+		}
+		db.Close()
+	}
+}
+
+func TestOpenDBErrors(t *testing.T) {
+	ctx := context.Background()
+	if _, err := OpenDB(ctx, "proj:region:inst", "sqlserver", "", WithTokenSource(staticTokenSource)); err == nil || !strings.Contains(err.Error(), "unsupported driver") {
+		t.Errorf("OpenDB with an unsupported driver returned %v, want unsupported driver error", err)
+	}
+	if _, err := OpenDB(ctx, "proj:inst", "postgres", "", WithTokenSource(staticTokenSource)); err == nil {
+		t.Error("OpenDB with an invalid instance succeeded, want error")
+	}
+	if _, err := OpenDB(ctx, "proj:region:inst", "postgres", "postgres://%zz", WithTokenSource(staticTokenSource)); err == nil {
+		t.Error("OpenDB with an invalid Postgres URL succeeded, want error")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connector
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// DefaultMaxOpenConns is the limit OpenDB sets on the number of open
+// connections to the instance, so that a busy program does not use up the
+// instance's connections. It may be changed with the SetMaxOpenConns method
+// of the returned DB.
+const DefaultMaxOpenConns = 5
+
+// mysqlNets counts the dial functions registered with the MySQL driver, each
+// under a network name of its own.
+var mysqlNets uint64
+
+// OpenDB returns a DB whose connections are made to instance through a
+// Connector created with opts. driverName selects the database engine:
+// "mysql" connects with github.com/go-sql-driver/mysql, and "postgres" or
+// "pgx" with github.com/lib/pq. dsn configures the driver as it would for
+// sql.Open, e.g. "user=postgres dbname=postgres" or "user:password@/dbname";
+// any host and port in it are ignored.
+//
+// The connection to the instance is already encrypted, so Postgres
+// connections are made with sslmode=disable, and MySQL DSNs should not enable
+// TLS. The DB is limited to DefaultMaxOpenConns open connections.
+func OpenDB(ctx context.Context, instance, driverName, dsn string, opts ...Option) (*sql.DB, error) {
+	var open func(*Connector) (driver.Connector, error)
+	switch driverName {
+	case "postgres", "pgx":
+		if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+			var err error
+			if dsn, err = pq.ParseURL(dsn); err != nil {
+				return nil, err
+			}
+		}
+		// Later settings take precedence over earlier ones.
+		dsn += " sslmode=disable"
+		open = func(c *Connector) (driver.Connector, error) {
+			return pgConnector{c: c, dsn: dsn}, nil
+		}
+	case "mysql":
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		open = func(c *Connector) (driver.Connector, error) {
+			// Registered dial functions cannot be removed, so each is
+			// registered under a new name.
+			cfg.Net = fmt.Sprintf("cloudsql-connector-%d", atomic.AddUint64(&mysqlNets, 1))
+			mysql.RegisterDialContext(cfg.Net, func(ctx context.Context, addr string) (net.Conn, error) {
+				return c.DialContext(ctx, "tcp", addr)
+			})
+			cfg.Addr = instance
+			return mysql.NewConnector(cfg)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported driver %q, want \"mysql\", \"postgres\" or \"pgx\"", driverName)
+	}
+
+	c, err := NewConnector(ctx, instance, opts...)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := open(c)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(dc)
+	db.SetMaxOpenConns(DefaultMaxOpenConns)
+	return db, nil
+}
+
+// pgConnector is a driver.Connector for Postgres which dials through a
+// Connector.
+type pgConnector struct {
+	c   *Connector
+	dsn string
+}
+
+func (pc pgConnector) Connect(context.Context) (driver.Conn, error) {
+	return pq.DialOpen(pc.c, pc.dsn)
+}
+
+func (pc pgConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
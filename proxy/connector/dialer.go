@@ -0,0 +1,69 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connector
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/util"
+)
+
+// DialerFunc dials the Cloud SQL instance named by addr, ignoring network. It
+// has the signature of net.Dialer's DialContext, so it can be given to
+// database drivers which accept a dial function, such as the DialFunc of a
+// pgconn.Config, or registered with mysql.RegisterDialContext.
+type DialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// NewDialer returns a DialerFunc which connects to any instance the
+// credentials have access to. It accepts the same Options as NewConnector,
+// and certificates are cached and refreshed for each instance it dials.
+//
+// addr must be the instance connection name, e.g. "project:region:instance".
+// As drivers often add a port to the host they are configured with, a name
+// with a port, such as "[project:region:instance]:5432", is also accepted;
+// the port is ignored.
+func NewDialer(ctx context.Context, opts ...Option) (DialerFunc, error) {
+	cfg, client, err := newClient(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		instance, err := instanceFromAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, cfg.timeout)
+			defer cancel()
+		}
+		return client.DialContext(ctx, instance)
+	}, nil
+}
+
+// instanceFromAddr returns the instance connection name given as addr,
+// without any port added by a driver.
+func instanceFromAddr(addr string) (string, error) {
+	instance := addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		instance = host
+	}
+	if project, region, name := util.SplitName(instance); project == "" || region == "" || name == "" {
+		return "", fmt.Errorf("invalid instance connection name %q, want \"project:region:instance\"", addr)
+	}
+	return instance, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connector_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/connector"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// ExampleNewConnector_mysql shows how to open a MySQL database through a
+// Connector with sql.OpenDB.
+func ExampleNewConnector_mysql() {
+	ctx := context.Background()
+	c, err := connector.NewConnector(ctx, "project:region:instance-name",
+		connector.WithTimeout(10*time.Second),
+		connector.WithIPAddressTypes("PRIVATE"),
+	)
+	if err != nil {
+		panic("couldn't create connector: " + err.Error())
+	}
+	mysql.RegisterDialContext("cloudsql", func(ctx context.Context, addr string) (net.Conn, error) {
+		return c.DialContext(ctx, "tcp", addr)
+	})
+
+	cfg := mysql.NewConfig()
+	cfg.Net = "cloudsql"
+	cfg.Addr = "project:region:instance-name"
+	cfg.User = "user"
+	cfg.DBName = "DB_1"
+	mc, err := mysql.NewConnector(cfg)
+	if err != nil {
+		panic(err)
+	}
+	db := sql.OpenDB(mc)
+	defer db.Close()
+
+	var now time.Time
+	fmt.Println(db.QueryRow("SELECT NOW()").Scan(&now))
+	fmt.Println(now)
+}
+
+// ExampleNewDialer shows how to connect to any instance through a DialerFunc,
+// naming the instance as the address in a MySQL DSN.
+func ExampleNewDialer() {
+	dial, err := connector.NewDialer(context.Background())
+	if err != nil {
+		panic("couldn't create dialer: " + err.Error())
+	}
+	mysql.RegisterDialContext("cloudsql", func(ctx context.Context, addr string) (net.Conn, error) {
+		return dial(ctx, "tcp", addr)
+	})
+
+	db, err := sql.Open("mysql", "user@cloudsql(project:region:instance-name)/DB_1?parseTime=true")
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	var now time.Time
+	fmt.Println(db.QueryRow("SELECT NOW()").Scan(&now))
+	fmt.Println(now)
+}
+
+// pgConnector is a driver.Connector for Postgres which dials through a
+// Connector.
+type pgConnector struct {
+	c   *connector.Connector
+	dsn string
+}
+
+func (pc pgConnector) Connect(context.Context) (driver.Conn, error) {
+	return pq.DialOpen(pc.c, pc.dsn)
+}
+
+func (pc pgConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// ExampleNewConnector_postgres shows how to open a Postgres database through
+// a Connector with sql.OpenDB.
+func ExampleNewConnector_postgres() {
+	ctx := context.Background()
+	c, err := connector.NewConnector(ctx, "project:region:instance-name",
+		connector.WithCredentialsFile("/path/to/key.json"),
+	)
+	if err != nil {
+		panic("couldn't create connector: " + err.Error())
+	}
+	// The connection to the instance is already encrypted.
+	db := sql.OpenDB(pgConnector{c: c, dsn: "user=postgres dbname=postgres sslmode=disable"})
+	defer db.Close()
+
+	var now time.Time
+	fmt.Println(db.QueryRow("SELECT NOW()").Scan(&now))
+	fmt.Println(now)
+}
+
+// ExampleOpenDB shows how to open a Postgres database in one call.
+func ExampleOpenDB() {
+	db, err := connector.OpenDB(context.Background(), "project:region:instance-name", "postgres",
+		"user=postgres dbname=postgres")
+	if err != nil {
+		panic("couldn't open database: " + err.Error())
+	}
+	defer db.Close()
+
+	var now time.Time
+	fmt.Println(db.QueryRow("SELECT NOW()").Scan(&now))
+	fmt.Println(now)
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package limits
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Environment variables which a Kubernetes pod spec can populate with the
+// container's resource limits using the Downward API, e.g.
+//
+//	env:
+//	- name: CONTAINER_CPU_LIMIT
+//	  valueFrom:
+//	    resourceFieldRef:
+//	      resource: limits.cpu
+//	- name: CONTAINER_MEMORY_LIMIT
+//	  valueFrom:
+//	    resourceFieldRef:
+//	      resource: limits.memory
+const (
+	CPULimitEnv    = "CONTAINER_CPU_LIMIT"
+	MemoryLimitEnv = "CONTAINER_MEMORY_LIMIT"
+)
+
+const (
+	// baseMemory is the memory reserved for the proxy itself when deriving a
+	// connection limit from the container's memory limit.
+	baseMemory = 32 << 20
+	// connectionMemory is a generous estimate of the memory used by each
+	// proxied connection: its goroutines, copy buffers and TLS state.
+	connectionMemory = 128 << 10
+)
+
+// For overriding in unittests.
+var lookupEnv = os.LookupEnv
+
+// SetMaxProcsFromContainer sets GOMAXPROCS to the container's CPU limit, as
+// given by CONTAINER_CPU_LIMIT, rounded down to a whole number of CPUs but no
+// less than one. It does nothing if the GOMAXPROCS environment variable is
+// set or the limit is not. It returns the new value of GOMAXPROCS, or 0 if it
+// was left unchanged.
+func SetMaxProcsFromContainer() (int, error) {
+	if _, ok := lookupEnv("GOMAXPROCS"); ok {
+		return 0, nil
+	}
+	v, ok := lookupEnv(CPULimitEnv)
+	if !ok || v == "" {
+		return 0, nil
+	}
+	cpus, err := parseCPULimit(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", CPULimitEnv, v, err)
+	}
+	procs := int(math.Floor(cpus))
+	if procs < 1 {
+		procs = 1
+	}
+	runtime.GOMAXPROCS(procs)
+	return procs, nil
+}
+
+// MaxConnectionsFromContainer returns a limit on simultaneous connections
+// which keeps the proxy within the container's memory limit, as given by
+// CONTAINER_MEMORY_LIMIT. It returns 0 if the limit is not set.
+func MaxConnectionsFromContainer() (uint64, error) {
+	v, ok := lookupEnv(MemoryLimitEnv)
+	if !ok || v == "" {
+		return 0, nil
+	}
+	mem, err := parseMemoryLimit(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", MemoryLimitEnv, v, err)
+	}
+	if mem <= baseMemory+connectionMemory {
+		return 1, nil
+	}
+	return (mem - baseMemory) / connectionMemory, nil
+}
+
+// parseCPULimit parses a number of CPUs, either as a plain number, as written
+// by the Downward API with the default divisor, or in millicores, e.g.
+// "500m".
+func parseCPULimit(s string) (float64, error) {
+	scale := 1.0
+	if strings.HasSuffix(s, "m") {
+		s, scale = strings.TrimSuffix(s, "m"), 1e-3
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if f <= 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, errors.New("must be positive")
+	}
+	return f * scale, nil
+}
+
+// memorySuffixes are the Kubernetes quantity suffixes accepted by
+// parseMemoryLimit. Binary suffixes are listed first so that "Mi" is not
+// mistaken for "M".
+var memorySuffixes = []struct {
+	suffix string
+	scale  uint64
+}{
+	{"Ki", 1 << 10},
+	{"Mi", 1 << 20},
+	{"Gi", 1 << 30},
+	{"Ti", 1 << 40},
+	{"k", 1e3},
+	{"K", 1e3},
+	{"M", 1e6},
+	{"G", 1e9},
+	{"T", 1e12},
+}
+
+// parseMemoryLimit parses a number of bytes, either as a plain number, as
+// written by the Downward API with the default divisor, or with a Kubernetes
+// quantity suffix, e.g. "512Mi".
+func parseMemoryLimit(s string) (uint64, error) {
+	scale := uint64(1)
+	for _, m := range memorySuffixes {
+		if strings.HasSuffix(s, m.suffix) {
+			s, scale = strings.TrimSuffix(s, m.suffix), m.scale
+			break
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, errors.New("must be positive")
+	}
+	if n > math.MaxUint64/scale {
+		return 0, errors.New("too large")
+	}
+	return n * scale, nil
+}
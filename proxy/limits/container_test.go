@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package limits
+
+import (
+	"runtime"
+	"testing"
+)
+
+func fakeEnv(env map[string]string) func(string) (string, bool) {
+	return func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+}
+
+func TestParseCPULimit(t *testing.T) {
+	for in, want := range map[string]float64{"2": 2, "1.5": 1.5, "500m": 0.5, "2500m": 2.5} {
+		if got, err := parseCPULimit(in); err != nil || got != want {
+			t.Errorf("parseCPULimit(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "0", "-1", "m", "two", "Inf"} {
+		if _, err := parseCPULimit(in); err == nil {
+			t.Errorf("parseCPULimit(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func TestParseMemoryLimit(t *testing.T) {
+	for in, want := range map[string]uint64{
+		"536870912": 512 << 20,
+		"512Mi":     512 << 20,
+		"1Gi":       1 << 30,
+		"500M":      500e6,
+		"64k":       64e3,
+	} {
+		if got, err := parseMemoryLimit(in); err != nil || got != want {
+			t.Errorf("parseMemoryLimit(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "0", "-1", "1.5Gi", "Mi", "99999999999Ti"} {
+		if _, err := parseMemoryLimit(in); err == nil {
+			t.Errorf("parseMemoryLimit(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func TestSetMaxProcsFromContainer(t *testing.T) {
+	defer func(old int) { runtime.GOMAXPROCS(old) }(runtime.GOMAXPROCS(0))
+	defer func(old func(string) (string, bool)) { lookupEnv = old }(lookupEnv)
+	tests := []struct {
+		env  map[string]string
+		want int
+	}{
+		{map[string]string{}, 0},
+		{map[string]string{CPULimitEnv: "3"}, 3},
+		{map[string]string{CPULimitEnv: "2500m"}, 2},
+		{map[string]string{CPULimitEnv: "250m"}, 1},
+		{map[string]string{CPULimitEnv: "3", "GOMAXPROCS": "8"}, 0},
+	}
+	for _, tc := range tests {
+		lookupEnv = fakeEnv(tc.env)
+		got, err := SetMaxProcsFromContainer()
+		if err != nil || got != tc.want {
+			t.Errorf("SetMaxProcsFromContainer() with %v = %v, %v; want %v", tc.env, got, err, tc.want)
+		}
+		if got != 0 && runtime.GOMAXPROCS(0) != got {
+			t.Errorf("GOMAXPROCS = %v, want %v", runtime.GOMAXPROCS(0), got)
+		}
+	}
+	lookupEnv = fakeEnv(map[string]string{CPULimitEnv: "lots"})
+	if _, err := SetMaxProcsFromContainer(); err == nil {
+		t.Error("SetMaxProcsFromContainer() with an invalid limit succeeded, want error")
+	}
+}
+
+func TestMaxConnectionsFromContainer(t *testing.T) {
+	defer func(old func(string) (string, bool)) { lookupEnv = old }(lookupEnv)
+	tests := []struct {
+		env  map[string]string
+		want uint64
+	}{
+		{map[string]string{}, 0},
+		{map[string]string{MemoryLimitEnv: "512Mi"}, (512<<20 - baseMemory) / connectionMemory},
+		{map[string]string{MemoryLimitEnv: "16Mi"}, 1},
+	}
+	for _, tc := range tests {
+		lookupEnv = fakeEnv(tc.env)
+		got, err := MaxConnectionsFromContainer()
+		if err != nil || got != tc.want {
+			t.Errorf("MaxConnectionsFromContainer() with %v = %v, %v; want %v", tc.env, got, err, tc.want)
+		}
+	}
+}
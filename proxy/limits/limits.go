@@ -20,6 +20,9 @@ package limits
 
 import (
 	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
@@ -29,8 +32,16 @@ var (
 	// For overriding in unittests.
 	syscallGetrlimit = syscall.Getrlimit
 	syscallSetrlimit = syscall.Setrlimit
+
+	// cgroupMemoryMaxPath holds the memory limit of the process's cgroup
+	// under cgroup v2.
+	cgroupMemoryMaxPath = "/sys/fs/cgroup/memory.max"
 )
 
+// fdMemory is roughly the memory used by the socket buffers of each file
+// descriptor used for a proxied connection.
+const fdMemory = 16384
+
 // Each connection handled by the proxy requires two file descriptors, one
 // for the local end of the connection and one for the remote. So, the proxy
 // process should be able to open at least 8K file descriptors if it is to
@@ -40,7 +51,15 @@ const ExpectedFDs = 8500
 // SetupFDLimits ensures that the process running the Cloud SQL proxy can have
 // at least wantFDs number of open file descriptors. It returns an error if it
 // cannot ensure the same.
+//
+// If the process's cgroup v2 memory limit cannot accommodate the socket buffers
+// of wantFDs connections, the limit is used to lower wantFDs instead.
 func SetupFDLimits(wantFDs uint64) error {
+	if max := cgroupFDLimit(); max > 0 && max < wantFDs {
+		logging.Infof("reducing wanted FDs rlimit from %d to %d to fit the cgroup memory limit", wantFDs, max)
+		wantFDs = max
+	}
+
 	rlim := &syscall.Rlimit{}
 	if err := syscallGetrlimit(syscall.RLIMIT_NOFILE, rlim); err != nil {
 		return fmt.Errorf("failed to read rlimit for max file descriptors: %v", err)
@@ -86,3 +105,23 @@ connections. To hide this message, please request a limit within the available r
 	logging.Verbosef("Rlimits for file descriptors set to {Current = %v, Max = %v}", rlim.Cur, rlim.Max)
 	return nil
 }
+
+// cgroupFDLimit returns the number of file descriptors whose socket buffers fit
+// in the cgroup v2 memory limit. It returns 0 if there is no limit, or it
+// cannot be read.
+func cgroupFDLimit() uint64 {
+	b, err := ioutil.ReadFile(cgroupMemoryMaxPath)
+	if err != nil {
+		return 0
+	}
+	v := strings.TrimSpace(string(b))
+	if v == "max" {
+		return 0
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		logging.Verbosef("ignoring cgroup memory limit %q: %v", v, err)
+		return 0
+	}
+	return n / fdMemory
+}
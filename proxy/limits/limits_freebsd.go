@@ -20,6 +20,7 @@ package limits
 
 import (
 	"fmt"
+	"math"
 	"syscall"
 
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
@@ -41,6 +42,13 @@ const ExpectedFDs = 8500
 // at least wantFDs number of open file descriptors. It returns an error if it
 // cannot ensure the same.
 func SetupFDLimits(wantFDs uint64) error {
+	// FreeBSD's rlimits are signed, so larger values would wrap around to
+	// negative limits.
+	if wantFDs > math.MaxInt64 {
+		logging.Errorf("WARNING: reducing wanted FDs rlimit from %d to %d, the largest rlimit FreeBSD supports", wantFDs, int64(math.MaxInt64))
+		wantFDs = math.MaxInt64
+	}
+
 	rlim := &syscall.Rlimit{}
 	if err := syscallGetrlimit(syscall.RLIMIT_NOFILE, rlim); err != nil {
 		return fmt.Errorf("failed to read rlimit for max file descriptors: %v", err)
@@ -0,0 +1,66 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build freebsd
+
+package limits
+
+import (
+	"errors"
+	"math"
+	"syscall"
+	"testing"
+)
+
+func TestSetupFDLimits(t *testing.T) {
+	oldGetFunc, oldSetFunc := syscallGetrlimit, syscallSetrlimit
+	defer func() {
+		syscallGetrlimit, syscallSetrlimit = oldGetFunc, oldSetFunc
+	}()
+
+	tests := []struct {
+		desc             string
+		cur, max         int64
+		wantFDs          uint64
+		setErr           bool
+		wantCur, wantMax int64
+	}{
+		{desc: "soft limit raised", cur: 128, max: 512, wantFDs: 256, wantCur: 256, wantMax: 512},
+		{desc: "both limits raised", cur: 128, max: 512, wantFDs: 1024, wantCur: 1024, wantMax: 1024},
+		{desc: "enough already", cur: 1024, max: 1024, wantFDs: 512, wantCur: -1, wantMax: -1},
+		{desc: "wanted more than an int64", cur: 128, max: math.MaxInt64, wantFDs: math.MaxUint64, wantCur: math.MaxInt64, wantMax: math.MaxInt64},
+		{desc: "Setrlimit fails", cur: 128, max: 512, wantFDs: 256, setErr: true, wantCur: 256, wantMax: 512},
+	}
+	for _, test := range tests {
+		syscallGetrlimit = func(_ int, rlim *syscall.Rlimit) error {
+			rlim.Cur, rlim.Max = test.cur, test.max
+			return nil
+		}
+		gotCur, gotMax := int64(-1), int64(-1)
+		syscallSetrlimit = func(_ int, rlim *syscall.Rlimit) error {
+			gotCur, gotMax = rlim.Cur, rlim.Max
+			if test.setErr {
+				return errors.New("operation not permitted")
+			}
+			return nil
+		}
+		err := SetupFDLimits(test.wantFDs)
+		if (err != nil) != test.setErr {
+			t.Errorf("%s: SetupFDLimits(%d) returned error %v, want error %v", test.desc, test.wantFDs, err, test.setErr)
+		}
+		if gotCur != test.wantCur || gotMax != test.wantMax {
+			t.Errorf("%s: SetupFDLimits(%d) set rlimit {%d %d}, want {%d %d}", test.desc, test.wantFDs, gotCur, gotMax, test.wantCur, test.wantMax)
+		}
+	}
+}
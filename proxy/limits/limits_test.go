@@ -12,13 +12,16 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build !windows
+// +build !windows,!freebsd
 
 package limits
 
 import (
 	"errors"
+	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
 	"syscall"
 	"testing"
 )
@@ -114,6 +117,12 @@ func TestSetupFDLimits(t *testing.T) {
 		},
 	}
 
+	oldPath := cgroupMemoryMaxPath
+	cgroupMemoryMaxPath = filepath.Join("testdata", "does-not-exist")
+	defer func() {
+		cgroupMemoryMaxPath = oldPath
+	}()
+
 	for _, test := range tests {
 		oldGetFunc := syscallGetrlimit
 		syscallGetrlimit = test.getFunc
@@ -133,3 +142,50 @@ func TestSetupFDLimits(t *testing.T) {
 		}
 	}
 }
+
+func TestSetupFDLimitsCgroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldPath := cgroupMemoryMaxPath
+	cgroupMemoryMaxPath = filepath.Join(dir, "memory.max")
+	oldGetFunc, oldSetFunc := syscallGetrlimit, syscallSetrlimit
+	defer func() {
+		cgroupMemoryMaxPath = oldPath
+		syscallGetrlimit, syscallSetrlimit = oldGetFunc, oldSetFunc
+	}()
+
+	syscallGetrlimit = func(_ int, rlim *syscall.Rlimit) error {
+		rlim.Cur = 32
+		rlim.Max = 4096
+		return nil
+	}
+	tests := []struct {
+		memoryMax string
+		wantCur   uint64
+	}{
+		// 1MiB of memory fits the buffers of 64 file descriptors.
+		{"1048576\n", 64},
+		{"max\n", 1024},
+		{"1099511627776\n", 1024},
+		{"invalid\n", 1024},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(cgroupMemoryMaxPath, []byte(test.memoryMax), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var gotCur uint64
+		syscallSetrlimit = func(_ int, rlim *syscall.Rlimit) error {
+			gotCur = uint64(rlim.Cur)
+			return nil
+		}
+		if err := SetupFDLimits(1024); err != nil {
+			t.Errorf("memory.max %q: SetupFDLimits(1024) returned error %v", test.memoryMax, err)
+		}
+		if gotCur != test.wantCur {
+			t.Errorf("memory.max %q: SetupFDLimits(1024) set rlimit to %d, want %d", test.memoryMax, gotCur, test.wantCur)
+		}
+	}
+}
@@ -12,19 +12,36 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Package limits is a package stub for windows, and we currently don't support
-// setting limits in windows.
+// Package limits provides routines to check and enforce certain resource
+// limits on the Cloud SQL client proxy process.
 package limits
 
-import "errors"
+import (
+	"fmt"
 
-// We don't support limit on the number of file handles in windows.
-const ExpectedFDs = 0
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
 
+// Each connection handled by the proxy requires two handles, one for the
+// local end of the connection and one for the remote. So, the proxy process
+// should be able to open at least 8K handles if it is to handle 4K
+// connections to one instance.
+const ExpectedFDs = 8500
+
+// maxHandles is the number of handles a single Windows process may hold open.
+// Unlike RLIMIT_NOFILE on Unix systems, this limit is fixed by the kernel and
+// cannot be raised or lowered per process. Job Objects only expose limits on
+// memory, CPU and process counts, so there is no handle quota that needs to be
+// adjusted.
+const maxHandles = 1 << 24
+
+// SetupFDLimits ensures that the process running the Cloud SQL proxy can have
+// at least wantFDs number of open handles. It returns an error if it cannot
+// ensure the same.
 func SetupFDLimits(wantFDs uint64) error {
-	if wantFDs != 0 {
-		return errors.New("setting limits on the number of file handles is not supported")
+	if wantFDs > maxHandles {
+		return fmt.Errorf("requested %d handles, but Windows limits each process to %d handles", wantFDs, maxHandles)
 	}
-
+	logging.Verbosef("Windows allows up to %d handles per process, wanted limit is %d. Nothing to do here.", maxHandles, wantFDs)
 	return nil
 }
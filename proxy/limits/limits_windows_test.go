@@ -0,0 +1,37 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package limits
+
+import "testing"
+
+func TestSetupFDLimits(t *testing.T) {
+	tests := []struct {
+		desc    string
+		wantFDs uint64
+		wantErr bool
+	}{
+		{"zero", 0, false},
+		{"default", ExpectedFDs, false},
+		{"at the handle limit", maxHandles, false},
+		{"above the handle limit", maxHandles + 1, true},
+	}
+
+	for _, test := range tests {
+		gotErr := SetupFDLimits(test.wantFDs)
+		if (gotErr != nil) != test.wantErr {
+			t.Errorf("%s: limits.SetupFDLimits(%d) returned error %v, wantErr %v", test.desc, test.wantFDs, gotErr, test.wantErr)
+		}
+	}
+}
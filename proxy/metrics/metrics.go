@@ -0,0 +1,471 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics records Prometheus metrics describing the behavior of the
+// Cloud SQL Auth proxy.
+//
+// All collectors are registered against a registry owned by each Metrics
+// value rather than the global Prometheus registry, so multiple values (e.g.,
+// in tests) do not interfere with one another. A nil *Metrics is valid and
+// all of its methods are no-ops.
+//
+// Constant labels, e.g. env="prod", may be added to every metric, and labels
+// whose values differ between instances to every metric with an instance
+// label; see Options.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "cloudsql_proxy"
+
+// SetupLatencyBuckets are the upper bounds of the buckets in which connection
+// setup latencies are counted.
+var SetupLatencyBuckets = [...]time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// Options configure the labels of the metrics created by NewWithOptions.
+type Options struct {
+	// Labels are added to every metric.
+	Labels prometheus.Labels
+	// InstanceLabels names labels which are added to every metric with an
+	// instance label, and whose values are set for each instance with
+	// SetInstanceLabels. An instance's value for a name defaults to its value
+	// in Labels, if any, and is otherwise empty.
+	InstanceLabels []string
+}
+
+// labelName matches valid Prometheus label names. Names beginning with "__"
+// are reserved.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// builtinLabels are the names of the labels the proxy's metrics already have.
+var builtinLabels = map[string]bool{
+	"instance":  true,
+	"reason":    true,
+	"code":      true,
+	"direction": true,
+	"result":    true,
+	"le":        true,
+}
+
+func validLabelName(name string) error {
+	switch {
+	case !labelName.MatchString(name) || strings.HasPrefix(name, "__"):
+		return fmt.Errorf("invalid label name %q", name)
+	case builtinLabels[name]:
+		return fmt.Errorf("label name %q is used by the proxy's metrics", name)
+	}
+	return nil
+}
+
+// Metrics holds the collectors used to instrument the proxy.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	// instanceLabels and defaults hold Options.InstanceLabels and their
+	// default values.
+	instanceLabels []string
+	defaults       []string
+	// labels holds the values of instanceLabels for each instance with
+	// values set by SetInstanceLabels. It is protected by mu.
+	labels map[string][]string
+	mu     sync.RWMutex
+
+	activeConns      *prometheus.GaugeVec
+	connsEstablished *prometheus.CounterVec
+	connsRejected    *prometheus.CounterVec
+	refreshLatency   *prometheus.HistogramVec
+	apiErrors        *prometheus.CounterVec
+	circuitState     *prometheus.GaugeVec
+	bytes            *prometheus.CounterVec
+	setupLatency     *prometheus.HistogramVec
+	apiBudget        *prometheus.CounterVec
+	refreshInFlight  *prometheus.GaugeVec
+	refreshHung      *prometheus.CounterVec
+	connsFailed      *prometheus.CounterVec
+	refreshErrors    *prometheus.CounterVec
+}
+
+// New creates a Metrics with all of its collectors registered against a new
+// registry, and no labels besides their own.
+func New() *Metrics {
+	m, err := NewWithOptions(Options{})
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// NewWithOptions creates a Metrics with all of its collectors registered
+// against a new registry, labeled as described by opts. It returns an error
+// if a label name is invalid or already used by the proxy's metrics.
+func NewWithOptions(opts Options) (*Metrics, error) {
+	for name := range opts.Labels {
+		if err := validLabelName(name); err != nil {
+			return nil, err
+		}
+	}
+	// Labels whose values vary by instance are variable labels of the
+	// metrics with an instance label, so they are left out of the constant
+	// labels of those metrics.
+	instConst := make(prometheus.Labels)
+	for name, v := range opts.Labels {
+		instConst[name] = v
+	}
+	seen := make(map[string]bool)
+	var defaults []string
+	for _, name := range opts.InstanceLabels {
+		if err := validLabelName(name); err != nil {
+			return nil, err
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate instance label %q", name)
+		}
+		seen[name] = true
+		defaults = append(defaults, opts.Labels[name])
+		delete(instConst, name)
+	}
+	inst := func(names ...string) []string {
+		return append(append([]string{"instance"}, names...), opts.InstanceLabels...)
+	}
+
+	m := &Metrics{
+		registry:       prometheus.NewRegistry(),
+		instanceLabels: append([]string(nil), opts.InstanceLabels...),
+		defaults:       defaults,
+		activeConns: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_connections",
+			Help:      "Number of connections currently being proxied to an instance.",
+		}, inst()),
+		connsEstablished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_established_total",
+			Help:      "Total number of connections successfully established to an instance.",
+		}, inst()),
+		connsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_rejected_total",
+			Help:      "Total number of client connections refused by the proxy.",
+		}, inst("reason")),
+		refreshLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "cert_refresh_latency_seconds",
+			Help:      "Time taken to refresh the ephemeral certificate and instance metadata.",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+		}, inst()),
+		apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "api_errors_total",
+			Help:      "Total number of failed calls to the Cloud SQL Admin API, by HTTP status code.",
+		}, []string{"code"}),
+		circuitState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "circuit_state",
+			Help:      "State of the circuit breaker for an instance: 0 closed, 1 open, 2 half-open.",
+		}, inst()),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bytes_total",
+			Help:      "Total number of bytes proxied for an instance, by direction: in from clients, or out to them. Its rate is the bandwidth used.",
+		}, inst("direction")),
+		setupLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "connection_setup_latency_seconds",
+			Help:      "Time taken from accepting a client connection to forwarding its data to an instance, including the TLS handshake.",
+			Buckets:   setupLatencySeconds(),
+		}, inst()),
+		apiBudget: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "api_budget_calls_total",
+			Help:      "Total number of Cloud SQL Admin API calls for an instance checked against its call budget, by result: allowed, or denied because the budget was exhausted.",
+		}, inst("result")),
+		refreshInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cert_refreshes_in_flight",
+			Help:      "Number of certificate refreshes for an instance which have started but not yet finished.",
+		}, inst()),
+		refreshHung: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cert_refresh_hung_total",
+			Help:      "Total number of times an instance was found with more certificate refreshes in flight than expected, suggesting that refreshes are hanging.",
+		}, inst()),
+		connsFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_failed_total",
+			Help:      "Total number of accepted client connections which could not be connected to an instance.",
+		}, inst()),
+		refreshErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cert_refresh_errors_total",
+			Help:      "Total number of failed certificate refreshes for an instance.",
+		}, inst()),
+	}
+	// Only the API error counter has no instance label.
+	if err := prometheus.WrapRegistererWith(opts.Labels, m.registry).Register(m.apiErrors); err != nil {
+		return nil, err
+	}
+	reg := prometheus.WrapRegistererWith(instConst, m.registry)
+	for _, c := range []prometheus.Collector{
+		m.activeConns,
+		m.connsEstablished,
+		m.connsRejected,
+		m.refreshLatency,
+		m.circuitState,
+		m.bytes,
+		m.setupLatency,
+		m.apiBudget,
+		m.refreshInFlight,
+		m.refreshHung,
+		m.connsFailed,
+		m.refreshErrors,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// SetInstanceLabels sets the values of instance's labels named in
+// Options.InstanceLabels; names not in labels keep their default values. It
+// must be called before any metric is recorded for instance, and an
+// instance's labels may not be changed once set, as the series recorded
+// with the old values would be left behind.
+func (m *Metrics) SetInstanceLabels(instance string, labels map[string]string) error {
+	if m == nil {
+		return nil
+	}
+	known := make(map[string]bool)
+	for _, name := range m.instanceLabels {
+		known[name] = true
+	}
+	var unknown []string
+	for name := range labels {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("instance %v: unknown labels %q", instance, unknown)
+	}
+	vals := make([]string, len(m.instanceLabels))
+	for i, name := range m.instanceLabels {
+		v, ok := labels[name]
+		if !ok {
+			v = m.defaults[i]
+		}
+		vals[i] = v
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.labels[instance]; ok {
+		for i := range old {
+			if old[i] != vals[i] {
+				return fmt.Errorf("instance %v: labels may not change once set", instance)
+			}
+		}
+		return nil
+	}
+	if m.labels == nil {
+		m.labels = make(map[string][]string)
+	}
+	m.labels[instance] = vals
+	return nil
+}
+
+// values returns the values of the labels of a metric with an instance
+// label: instance, then rest, then the instance's labels.
+func (m *Metrics) values(instance string, rest ...string) []string {
+	vals := append([]string{instance}, rest...)
+	if len(m.instanceLabels) == 0 {
+		return vals
+	}
+	m.mu.RLock()
+	l, ok := m.labels[instance]
+	m.mu.RUnlock()
+	if !ok {
+		l = m.defaults
+	}
+	return append(vals, l...)
+}
+
+func setupLatencySeconds() []float64 {
+	b := make([]float64, len(SetupLatencyBuckets))
+	for i, d := range SetupLatencyBuckets {
+		b[i] = d.Seconds()
+	}
+	return b
+}
+
+// Registry returns the registry holding the proxy's collectors.
+func (m *Metrics) Registry() *prometheus.Registry {
+	if m == nil {
+		return nil
+	}
+	return m.registry
+}
+
+// Handler returns an http.Handler which serves the collected metrics in the
+// Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	if m == nil {
+		return http.NotFoundHandler()
+	}
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ConnOpened records that a new connection to instance was established.
+func (m *Metrics) ConnOpened(instance string) {
+	if m == nil {
+		return
+	}
+	m.activeConns.WithLabelValues(m.values(instance)...).Inc()
+	m.connsEstablished.WithLabelValues(m.values(instance)...).Inc()
+}
+
+// ConnClosed records that a connection previously reported to ConnOpened
+// has closed.
+func (m *Metrics) ConnClosed(instance string) {
+	if m == nil {
+		return
+	}
+	m.activeConns.WithLabelValues(m.values(instance)...).Dec()
+}
+
+// ConnRejected records that a client connection to instance was refused
+// for the provided reason.
+func (m *Metrics) ConnRejected(instance, reason string) {
+	if m == nil {
+		return
+	}
+	m.connsRejected.WithLabelValues(m.values(instance, reason)...).Inc()
+}
+
+// RefreshDone records how long a certificate refresh for instance took.
+func (m *Metrics) RefreshDone(instance string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.refreshLatency.WithLabelValues(m.values(instance)...).Observe(d.Seconds())
+}
+
+// APIError records a failed Cloud SQL Admin API call. A code of zero
+// indicates that the request failed without an HTTP response.
+func (m *Metrics) APIError(code int) {
+	if m == nil {
+		return
+	}
+	label := strconv.Itoa(code)
+	if code == 0 {
+		label = "unknown"
+	}
+	m.apiErrors.WithLabelValues(label).Inc()
+}
+
+// CircuitState records the state of the circuit breaker for instance, as a
+// proxy.CircuitState value.
+func (m *Metrics) CircuitState(instance string, state int) {
+	if m == nil {
+		return
+	}
+	m.circuitState.WithLabelValues(m.values(instance)...).Set(float64(state))
+}
+
+// BytesTransferred records that n bytes were proxied for instance in
+// direction, "in" for bytes read from a client or "out" for bytes written to
+// one.
+func (m *Metrics) BytesTransferred(instance, direction string, n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.bytes.WithLabelValues(m.values(instance, direction)...).Add(float64(n))
+}
+
+// ConnSetup records how long a connection to instance took to set up.
+func (m *Metrics) ConnSetup(instance string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.setupLatency.WithLabelValues(m.values(instance)...).Observe(d.Seconds())
+}
+
+// APIBudget records whether a Cloud SQL Admin API call for instance was
+// allowed by the instance's call budget.
+func (m *Metrics) APIBudget(instance string, allowed bool) {
+	if m == nil {
+		return
+	}
+	result := "allowed"
+	if !allowed {
+		result = "denied"
+	}
+	m.apiBudget.WithLabelValues(m.values(instance, result)...).Inc()
+}
+
+// RefreshesInFlight records the number of certificate refreshes for instance
+// which have started but not yet finished.
+func (m *Metrics) RefreshesInFlight(instance string, n int) {
+	if m == nil {
+		return
+	}
+	m.refreshInFlight.WithLabelValues(m.values(instance)...).Set(float64(n))
+}
+
+// RefreshHung records that instance was found with more certificate
+// refreshes in flight than expected.
+func (m *Metrics) RefreshHung(instance string) {
+	if m == nil {
+		return
+	}
+	m.refreshHung.WithLabelValues(m.values(instance)...).Inc()
+}
+
+// ConnFailed records that a client connection to instance was accepted but
+// could not be connected to the instance.
+func (m *Metrics) ConnFailed(instance string) {
+	if m == nil {
+		return
+	}
+	m.connsFailed.WithLabelValues(m.values(instance)...).Inc()
+}
+
+// RefreshFailed records that a certificate refresh for instance failed.
+func (m *Metrics) RefreshFailed(instance string) {
+	if m == nil {
+		return
+	}
+	m.refreshErrors.WithLabelValues(m.values(instance)...).Inc()
+}
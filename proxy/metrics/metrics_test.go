@@ -0,0 +1,171 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const instance = "proj:region:inst"
+
+func scrape(t *testing.T, m *Metrics) string {
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatalf("failed to read metrics: %v", err)
+	}
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	m.ConnOpened(instance)
+	m.ConnOpened(instance)
+	m.ConnClosed(instance)
+	m.ConnRejected(instance, "max_connections")
+	m.RefreshDone(instance, 100*time.Millisecond)
+	m.APIError(403)
+	m.APIError(0)
+	m.CircuitState(instance, 1)
+	m.BytesTransferred(instance, "in", 100)
+	m.BytesTransferred(instance, "in", 28)
+	m.BytesTransferred(instance, "out", 512)
+	m.ConnSetup(instance, 75*time.Millisecond)
+	m.APIBudget(instance, true)
+	m.APIBudget(instance, false)
+	m.RefreshesInFlight(instance, 3)
+	m.RefreshHung(instance)
+	m.ConnFailed(instance)
+	m.RefreshFailed(instance)
+	m.RefreshFailed(instance)
+
+	got := scrape(t, m)
+	for _, want := range []string{
+		`cloudsql_proxy_active_connections{instance="proj:region:inst"} 1`,
+		`cloudsql_proxy_connections_established_total{instance="proj:region:inst"} 2`,
+		`cloudsql_proxy_connections_rejected_total{instance="proj:region:inst",reason="max_connections"} 1`,
+		`cloudsql_proxy_cert_refresh_latency_seconds_count{instance="proj:region:inst"} 1`,
+		`cloudsql_proxy_api_errors_total{code="403"} 1`,
+		`cloudsql_proxy_api_errors_total{code="unknown"} 1`,
+		`cloudsql_proxy_circuit_state{instance="proj:region:inst"} 1`,
+		`cloudsql_proxy_bytes_total{direction="in",instance="proj:region:inst"} 128`,
+		`cloudsql_proxy_bytes_total{direction="out",instance="proj:region:inst"} 512`,
+		`cloudsql_proxy_connection_setup_latency_seconds_bucket{instance="proj:region:inst",le="0.05"} 0`,
+		`cloudsql_proxy_connection_setup_latency_seconds_bucket{instance="proj:region:inst",le="0.1"} 1`,
+		`cloudsql_proxy_connection_setup_latency_seconds_bucket{instance="proj:region:inst",le="5"} 1`,
+		`cloudsql_proxy_api_budget_calls_total{instance="proj:region:inst",result="allowed"} 1`,
+		`cloudsql_proxy_api_budget_calls_total{instance="proj:region:inst",result="denied"} 1`,
+		`cloudsql_proxy_cert_refreshes_in_flight{instance="proj:region:inst"} 3`,
+		`cloudsql_proxy_cert_refresh_hung_total{instance="proj:region:inst"} 1`,
+		`cloudsql_proxy_connections_failed_total{instance="proj:region:inst"} 1`,
+		`cloudsql_proxy_cert_refresh_errors_total{instance="proj:region:inst"} 2`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics output is missing %q, got:\n%s", want, got)
+		}
+	}
+}
+
+func TestMetricsAreIsolated(t *testing.T) {
+	a, b := New(), New()
+	a.ConnOpened(instance)
+
+	if got := scrape(t, b); strings.Contains(got, instance) {
+		t.Errorf("metrics recorded on one Metrics leaked into another:\n%s", got)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	// None of these should panic.
+	m.ConnOpened(instance)
+	m.ConnClosed(instance)
+	m.ConnRejected(instance, "max_connections")
+	m.RefreshDone(instance, time.Second)
+	m.APIError(500)
+	m.CircuitState(instance, 0)
+	m.BytesTransferred(instance, "in", 1)
+	m.ConnSetup(instance, time.Second)
+	m.APIBudget(instance, false)
+	m.RefreshesInFlight(instance, 1)
+	m.RefreshHung(instance)
+	m.ConnFailed(instance)
+	m.RefreshFailed(instance)
+	if err := m.SetInstanceLabels(instance, map[string]string{"team": "payments"}); err != nil {
+		t.Errorf("SetInstanceLabels on nil Metrics: %v", err)
+	}
+	if m.Registry() != nil {
+		t.Error("nil Metrics should have a nil Registry")
+	}
+}
+
+func TestLabels(t *testing.T) {
+	m, err := NewWithOptions(Options{
+		Labels:         map[string]string{"env": "prod", "team": "platform"},
+		InstanceLabels: []string{"team"},
+	})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	const other = "proj:region:other"
+	if err := m.SetInstanceLabels(instance, map[string]string{"team": "payments"}); err != nil {
+		t.Fatalf("SetInstanceLabels: %v", err)
+	}
+	m.ConnOpened(instance)
+	m.ConnOpened(other)
+	m.BytesTransferred(instance, "in", 10)
+	m.APIError(403)
+
+	got := scrape(t, m)
+	for _, want := range []string{
+		`cloudsql_proxy_active_connections{env="prod",instance="proj:region:inst",team="payments"} 1`,
+		`cloudsql_proxy_active_connections{env="prod",instance="proj:region:other",team="platform"} 1`,
+		`cloudsql_proxy_bytes_total{direction="in",env="prod",instance="proj:region:inst",team="payments"} 10`,
+		`cloudsql_proxy_api_errors_total{code="403",env="prod",team="platform"} 1`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics output is missing %q, got:\n%s", want, got)
+		}
+	}
+
+	if err := m.SetInstanceLabels(instance, map[string]string{"team": "payments"}); err != nil {
+		t.Errorf("SetInstanceLabels with unchanged labels: %v", err)
+	}
+	if err := m.SetInstanceLabels(instance, map[string]string{"team": "billing"}); err == nil {
+		t.Error("SetInstanceLabels succeeded in changing an instance's labels, want error")
+	}
+	if err := m.SetInstanceLabels(other, map[string]string{"env": "dev"}); err == nil {
+		t.Error("SetInstanceLabels succeeded with a label not in Options.InstanceLabels, want error")
+	}
+}
+
+func TestNewWithOptionsErrors(t *testing.T) {
+	for _, opts := range []Options{
+		{Labels: map[string]string{"instance": "x"}},
+		{Labels: map[string]string{"bad-name": "x"}},
+		{Labels: map[string]string{"__name": "x"}},
+		{InstanceLabels: []string{"direction"}},
+		{InstanceLabels: []string{"team", "team"}},
+	} {
+		if _, err := NewWithOptions(opts); err == nil {
+			t.Errorf("NewWithOptions(%+v) succeeded, want error", opts)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net"
+	"time"
+)
+
+// An Auditor is told about each connection a Client proxies, e.g. to keep an
+// audit trail of who connected to which instance. Its methods are called from
+// the goroutine handling the connection, so they should not block.
+type Auditor interface {
+	// ConnOpened is called at opened, once the connection from client to
+	// instance has been set up and before any data is proxied.
+	ConnOpened(instance string, client net.Addr, opened time.Time)
+	// ConnClosed is called once a connection passed to ConnOpened has been
+	// closed, with how long it was open, the number of bytes received from
+	// the client and the number of bytes sent to it.
+	ConnClosed(instance string, client net.Addr, d time.Duration, bytesIn, bytesOut uint64)
+}
+
+// clientAddr returns the address identifying the client on conn. Clients on
+// Unix sockets have no address of their own, so the socket's is used.
+func clientAddr(conn net.Conn) net.Addr {
+	if a := conn.RemoteAddr(); a != nil && a.String() != "" && a.String() != "@" {
+		return a
+	}
+	return conn.LocalAddr()
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingAuditor records the calls made to it.
+type recordingAuditor struct {
+	mu    sync.Mutex
+	calls []string
+	in    uint64
+	out   uint64
+}
+
+func (a *recordingAuditor) ConnOpened(instance string, client net.Addr, _ time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls = append(a.calls, "opened "+instance+" from "+client.String())
+}
+
+func (a *recordingAuditor) ConnClosed(instance string, client net.Addr, _ time.Duration, bytesIn, bytesOut uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls = append(a.calls, "closed "+instance+" from "+client.String())
+	a.in, a.out = bytesIn, bytesOut
+}
+
+func TestAuditor(t *testing.T) {
+	l, _, c := startTLSServer(t, instance, tlsServerOptions{})
+	defer l.Close()
+	a := &recordingAuditor{}
+	c.Auditor = a
+
+	local, remote := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		c.handleConn(Conn{Instance: instance, Conn: local})
+		close(done)
+	}()
+	// The server closes the connection after reading a byte.
+	if _, err := remote.Write([]byte{0}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+	remote.Close()
+
+	want := []string{"opened " + instance + " from pipe", "closed " + instance + " from pipe"}
+	if !reflect.DeepEqual(a.calls, want) {
+		t.Errorf("got calls %q, want %q", a.calls, want)
+	}
+	if a.in != 1 || a.out != 0 {
+		t.Errorf("got %d bytes in and %d out, want 1 and 0", a.in, a.out)
+	}
+}
+
+func TestAuditorNotCalledForFailedConnections(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	a := &recordingAuditor{}
+	c.Auditor = a
+
+	c.handleConn(Conn{Instance: instance, Conn: &dummyConn{}})
+	if len(a.calls) != 0 {
+		t.Errorf("got calls %q for a connection which failed to connect, want none", a.calls)
+	}
+}
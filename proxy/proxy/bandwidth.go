@@ -0,0 +1,111 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"math"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// newBandwidthLimiter returns a limiter allowing bytesPerSec bytes per second,
+// in bursts of up to one second's worth.
+func newBandwidthLimiter(bytesPerSec int64) *rate.Limiter {
+	burst := bytesPerSec
+	if burst > math.MaxInt32 {
+		burst = math.MaxInt32
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(burst))
+}
+
+// throttle returns conn limited to MaxConnBandwidth and MaxTotalBandwidth in
+// each direction, or conn itself if neither is set.
+func (c *Client) throttle(conn net.Conn) net.Conn {
+	var in, out []*rate.Limiter
+	if c.MaxConnBandwidth > 0 {
+		in = append(in, newBandwidthLimiter(c.MaxConnBandwidth))
+		out = append(out, newBandwidthLimiter(c.MaxConnBandwidth))
+	}
+	if c.MaxTotalBandwidth > 0 {
+		c.totalBandwidthOnce.Do(func() {
+			c.totalIn = newBandwidthLimiter(c.MaxTotalBandwidth)
+			c.totalOut = newBandwidthLimiter(c.MaxTotalBandwidth)
+		})
+		in = append(in, c.totalIn)
+		out = append(out, c.totalOut)
+	}
+	if len(in) == 0 {
+		return conn
+	}
+	return &throttledConn{Conn: conn, in: in, out: out}
+}
+
+// throttledConn limits the rate at which data is read from and written to a
+// client's connection. Reading is limited by in and writing by out.
+type throttledConn struct {
+	net.Conn
+	in, out []*rate.Limiter
+}
+
+// maxChunk returns the largest number of bytes, at most n, which may be
+// waited for at once on every limiter in ls.
+func maxChunk(ls []*rate.Limiter, n int) int {
+	for _, l := range ls {
+		if b := l.Burst(); b < n {
+			n = b
+		}
+	}
+	return n
+}
+
+// wait blocks until n bytes may pass every limiter in ls.
+func wait(ls []*rate.Limiter, n int) error {
+	for _, l := range ls {
+		if err := l.WaitN(context.Background(), n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b[:maxChunk(c.in, len(b))])
+	if n > 0 {
+		// Waiting after the read delays the next one, which is what
+		// pushes back on the sender.
+		if werr := wait(c.in, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n := maxChunk(c.out, len(b)-written)
+		if err := wait(c.out, n); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(b[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
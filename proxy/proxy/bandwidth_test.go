@@ -0,0 +1,84 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestThrottleDisabled(t *testing.T) {
+	c := &Client{}
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	if got := c.throttle(local); got != local {
+		t.Errorf("throttle returned %T, want the connection itself", got)
+	}
+}
+
+// timeTransfer returns how long it takes to write n bytes to conn and read
+// them from the other end of the pipe, or to write them to the other end and
+// read them from conn if read is set.
+func timeTransfer(t *testing.T, c *Client, n int, read bool) time.Duration {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	conn := c.throttle(a)
+
+	src, dst := conn, b
+	if read {
+		src, dst = b, conn
+	}
+	start := time.Now()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := src.Write(make([]byte, n))
+		errs <- err
+	}()
+	if _, err := io.CopyN(ioutil.Discard, dst, int64(n)); err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	return time.Since(start)
+}
+
+func TestThrottleConn(t *testing.T) {
+	// The first second's worth passes straight away, after which the
+	// remainder takes about half a second.
+	c := &Client{MaxConnBandwidth: 20000}
+	for _, read := range []bool{false, true} {
+		if d := timeTransfer(t, c, 30000, read); d < 400*time.Millisecond || d > 5*time.Second {
+			t.Errorf("transfer (read = %v) took %v, want about 500ms", read, d)
+		}
+	}
+}
+
+func TestThrottleTotal(t *testing.T) {
+	// Connections share the total limit, so the second is throttled by the
+	// first's use of the initial burst.
+	c := &Client{MaxTotalBandwidth: 20000}
+	if d := timeTransfer(t, c, 20000, false); d > 300*time.Millisecond {
+		t.Errorf("first transfer took %v, want it to pass within the burst", d)
+	}
+	if d := timeTransfer(t, c, 10000, false); d < 400*time.Millisecond {
+		t.Errorf("second transfer took %v, want about 500ms", d)
+	}
+}
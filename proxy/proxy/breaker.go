@@ -0,0 +1,150 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+const (
+	// DefaultBreakerMaxBackoff is the longest the circuit for an instance
+	// stays open if Client.BreakerMaxBackoff is not set.
+	DefaultBreakerMaxBackoff = time.Minute
+	// breakerBaseBackoff is how long the circuit stays open the first time it
+	// opens. Each further failure doubles it.
+	breakerBaseBackoff = time.Second
+)
+
+// CircuitState describes whether the Client is attempting connections to an
+// instance.
+type CircuitState int
+
+const (
+	// CircuitClosed is the normal state, in which every connection is
+	// attempted.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen means connections have failed repeatedly, and new
+	// connections are refused until a backoff period has passed.
+	CircuitOpen
+	// CircuitHalfOpen means the backoff period has passed, so the next
+	// connection is attempted as a trial. Other connections are refused until
+	// the trial succeeds, closing the circuit, or fails, opening it again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	}
+	return "unknown"
+}
+
+// breaker is the circuit breaker for a single instance.
+type breaker struct {
+	mu        sync.Mutex
+	state     CircuitState
+	failures  int
+	openUntil time.Time
+}
+
+func (c *Client) breakerFor(instance string) *breaker {
+	v, _ := c.breakers.LoadOrStore(instance, &breaker{})
+	return v.(*breaker)
+}
+
+func (c *Client) breakerMaxBackoff() time.Duration {
+	if c.BreakerMaxBackoff == 0 {
+		return DefaultBreakerMaxBackoff
+	}
+	return c.BreakerMaxBackoff
+}
+
+// breakerAllow reports whether a new connection to instance may be attempted.
+// If it returns true, the outcome must be reported to breakerRecord.
+func (c *Client) breakerAllow(instance string) bool {
+	if c.BreakerThreshold <= 0 {
+		return true
+	}
+	b := c.breakerFor(instance)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if time.Now().Before(b.openUntil) {
+			return false
+		}
+		b.state = CircuitHalfOpen
+		c.Metrics.CircuitState(instance, int(b.state))
+		return true
+	case CircuitHalfOpen:
+		return false
+	}
+	return true
+}
+
+// breakerRecord records the outcome of a connection attempt allowed by
+// breakerAllow.
+func (c *Client) breakerRecord(instance string, err error) {
+	if c.BreakerThreshold <= 0 {
+		return
+	}
+	b := c.breakerFor(instance)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.state != CircuitClosed {
+			logging.Infof("circuit for %q closed: connection succeeded", instance)
+		}
+		b.state, b.failures = CircuitClosed, 0
+		c.Metrics.CircuitState(instance, int(b.state))
+		return
+	}
+	b.failures++
+	if b.state != CircuitHalfOpen && b.failures < c.BreakerThreshold {
+		return
+	}
+	backoff := c.breakerMaxBackoff()
+	if n := b.failures - c.BreakerThreshold; n < 32 && breakerBaseBackoff<<uint(n) < backoff {
+		backoff = breakerBaseBackoff << uint(n)
+	}
+	b.state, b.openUntil = CircuitOpen, time.Now().Add(backoff)
+	c.Metrics.CircuitState(instance, int(b.state))
+	logging.Errorf("circuit for %q opened after %d consecutive failed connections; refusing connections for %v", instance, b.failures, backoff)
+}
+
+// CircuitState reports the state of the circuit breaker for instance. It is
+// always CircuitClosed if BreakerThreshold is not set.
+func (c *Client) CircuitState(instance string) CircuitState {
+	v, ok := c.breakers.Load(instance)
+	if !ok {
+		return CircuitClosed
+	}
+	b := v.(*breaker)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitOpen && !time.Now().Before(b.openUntil) {
+		// The next connection will be a trial.
+		return CircuitHalfOpen
+	}
+	return b.state
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// expireBreaker ends the backoff period of the open circuit for instance.
+func expireBreaker(c *Client, instance string) {
+	b := c.breakerFor(instance)
+	b.mu.Lock()
+	b.openUntil = time.Now()
+	b.mu.Unlock()
+}
+
+func TestBreaker(t *testing.T) {
+	c := &Client{BreakerThreshold: 2}
+
+	if !c.breakerAllow(instance) {
+		t.Fatal("closed circuit refused a connection")
+	}
+	c.breakerRecord(instance, sentinelError)
+	if got := c.CircuitState(instance); got != CircuitClosed {
+		t.Fatalf("circuit is %v after one failure, want closed", got)
+	}
+	c.breakerRecord(instance, sentinelError)
+	if got := c.CircuitState(instance); got != CircuitOpen {
+		t.Fatalf("circuit is %v after two failures, want open", got)
+	}
+	if c.breakerAllow(instance) {
+		t.Fatal("open circuit allowed a connection")
+	}
+
+	expireBreaker(c, instance)
+	if got := c.CircuitState(instance); got != CircuitHalfOpen {
+		t.Fatalf("circuit is %v after its backoff, want half_open", got)
+	}
+	if !c.breakerAllow(instance) {
+		t.Fatal("half-open circuit refused the trial connection")
+	}
+	if c.breakerAllow(instance) {
+		t.Fatal("half-open circuit allowed a second connection during the trial")
+	}
+	c.breakerRecord(instance, nil)
+	if got := c.CircuitState(instance); got != CircuitClosed {
+		t.Fatalf("circuit is %v after a successful trial, want closed", got)
+	}
+	if !c.breakerAllow(instance) {
+		t.Fatal("closed circuit refused a connection")
+	}
+}
+
+func TestBreakerBackoff(t *testing.T) {
+	c := &Client{BreakerThreshold: 1, BreakerMaxBackoff: 5 * time.Second}
+
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if !c.breakerAllow(instance) {
+			t.Fatal("connection refused after the backoff expired")
+		}
+		c.breakerRecord(instance, sentinelError)
+		b := c.breakerFor(instance)
+		b.mu.Lock()
+		got := time.Until(b.openUntil)
+		b.mu.Unlock()
+		if got > want || got < want-time.Second/2 {
+			t.Errorf("circuit opened for %v, want %v", got, want)
+		}
+		expireBreaker(c, instance)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	c := &Client{}
+	for i := 0; i < 10; i++ {
+		if !c.breakerAllow(instance) {
+			t.Fatal("connection refused with the circuit breaker disabled")
+		}
+		c.breakerRecord(instance, sentinelError)
+	}
+	if got := c.CircuitState(instance); got != CircuitClosed {
+		t.Fatalf("circuit is %v with the circuit breaker disabled, want closed", got)
+	}
+}
+
+func TestBreakerRefusesConnections(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	c.BreakerThreshold = 1
+	var dials int32
+	c.Dialer = func(string, string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, sentinelError
+	}
+
+	for i := 0; i < 3; i++ {
+		conn := &closeRecorder{}
+		c.handleConn(Conn{Instance: instance, Conn: conn})
+		if !conn.isClosed() {
+			t.Fatalf("connection %d was not closed", i)
+		}
+	}
+	if got := atomic.LoadInt32(&dials); got != 1 {
+		t.Fatalf("got %d dials, want 1 before the circuit opened", got)
+	}
+}
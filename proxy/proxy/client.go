@@ -20,13 +20,24 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
-	"golang.org/x/net/proxy"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/authn"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/certs"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/metrics"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/util"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/googleapi"
 )
 
 const (
@@ -36,7 +47,18 @@ const (
 	// IAMLoginRefreshThrottle is the time a refresh attempt must wait since the
 	// last attempt when using IAM login.
 	IAMLoginRefreshThrottle = 30 * time.Second
-	keepAlivePeriod         = time.Minute
+	// keepAlivePeriod is the default KeepAliveInterval.
+	keepAlivePeriod = time.Minute
+	// maxConcurrentRefreshes is the most certificate refreshes which may be
+	// in progress at once, e.g. while fetching the certificates of many
+	// instances at startup.
+	maxConcurrentRefreshes = 10
+	// sessionCacheSize is the number of TLS sessions kept for resumption by
+	// the tls.Config of each of an instance's certificates.
+	sessionCacheSize = 64
+	// authnTimeout bounds the exchange of startup messages performed on a
+	// client's behalf when IAMAuthnTokenSource or ApplicationName is set.
+	authnTimeout = 30 * time.Second
 	// DefaultRefreshCfgBuffer is the minimum amount of time for which a
 	// certificate must be valid to ensure the next refresh attempt has adequate
 	// time to complete.
@@ -71,6 +93,12 @@ type CertSource interface {
 	Remote(instance string) (cert *x509.Certificate, addr, name, version string, err error)
 }
 
+// regionSource is implemented by CertSources which report the region of the
+// instances they retrieve, such as certs.RemoteCertSource.
+type regionSource interface {
+	Region(instance string) string
+}
+
 // Client is a type to handle connecting to a Server. All fields are required
 // unless otherwise specified.
 type Client struct {
@@ -96,6 +124,170 @@ type Client struct {
 	ContextDialer func(ctx context.Context, net, addr string) (net.Conn, error)
 	// Dialer should return a new connection to the provided address. It will be used only if ContextDialer is nil.
 	Dialer func(net, addr string) (net.Conn, error)
+	// ProxyURL optionally routes connections to instances through an HTTP or
+	// HTTPS proxy using the CONNECT method, or through a SOCKS5 proxy for a
+	// "socks5" URL. Credentials in the URL are sent to the proxy. It is used
+	// only if ContextDialer and Dialer are nil. If ProxyURL is nil too, the
+	// ALL_PROXY environment variable is used if set, and otherwise
+	// HTTPS_PROXY and NO_PROXY.
+	ProxyURL *url.URL
+	// AllowedNetworks optionally restricts the clients which may connect over
+	// TCP to those with an address in one of the networks. Connections from
+	// other addresses are closed immediately. Connections over other networks,
+	// such as Unix sockets, are not restricted.
+	AllowedNetworks []*net.IPNet
+	// MaxNewConnsPerIP, if set, limits the new TCP connections accepted from
+	// each client IP address to this many per second. Connections beyond the
+	// limit are refused with a "too many connections" error.
+	MaxNewConnsPerIP int
+	// Optionally records metrics about connections and certificate refreshes.
+	// If nil, no metrics are recorded.
+	Metrics *metrics.Metrics
+	// Optionally traces each proxied connection, including the certificate
+	// fetch and TLS handshake. If nil, no spans are created.
+	TracerProvider trace.TracerProvider
+	// WarmConnections is the number of connections to each instance which are
+	// established in advance, once the instance's first certificate has been
+	// fetched, and handed to new client connections so that they need not
+	// wait for a TLS handshake. 0 disables warm connections.
+	WarmConnections int
+	// WarmIdleTimeout is how long a warm connection may remain unused before
+	// it is closed. Database servers close connections which do not begin
+	// authenticating promptly, so this should be shorter than the server's
+	// timeout. If not set, it defaults to DefaultWarmIdleTimeout.
+	WarmIdleTimeout time.Duration
+	// IAMAuthnTokenSource, if set, is used to log clients in to Cloud SQL as
+	// IAM database users: when an instance asks a client for a cleartext
+	// password during authentication, the proxy answers with an access token
+	// from this source instead. Clients need not supply a password. If nil,
+	// authentication is left entirely to the client.
+	IAMAuthnTokenSource oauth2.TokenSource
+	// ApplicationName, if set, labels each proxied session so that it can be
+	// identified in the instance's logs and Cloud Audit Logs: it is sent as
+	// the Postgres application_name parameter or the MySQL program_name
+	// connection attribute unless the client sets that itself. It may be
+	// overridden for a single instance with SetInstanceApplicationName.
+	ApplicationName string
+	// OverrideApplicationName, if set, sends the application name in place
+	// of any the client sets itself.
+	OverrideApplicationName bool
+	// MinTLSVersion, if set, is the minimum TLS version used for connections
+	// to instances, e.g. tls.VersionTLS13. If not set, the crypto/tls
+	// default is used.
+	MinTLSVersion uint16
+	// CipherSuites, if set, restricts the cipher suites used for TLS 1.2
+	// connections to instances. See tls.Config.CipherSuites.
+	CipherSuites []uint16
+	// BreakerThreshold is the number of consecutive failed connections to an
+	// instance after which the Client stops attempting new connections to it
+	// for a while, refusing them instead. The wait starts at one second and
+	// doubles with each further failure, up to BreakerMaxBackoff; one
+	// successful connection resets it. 0 disables the circuit breaker.
+	BreakerThreshold int
+	// MaxConnBandwidth, if set, limits the rate in bytes per second at which
+	// each proxied connection transfers data, separately in each direction.
+	MaxConnBandwidth int64
+	// MaxTotalBandwidth, if set, limits the combined rate in bytes per second
+	// at which all proxied connections transfer data, separately in each
+	// direction.
+	MaxTotalBandwidth int64
+	// IdleTimeout, if set, closes proxied connections through which no data
+	// has passed in either direction for this long.
+	IdleTimeout time.Duration
+	// MaxConnAge, if set, closes proxied connections once they have been
+	// open for this long, so that clients reconnect.
+	MaxConnAge time.Duration
+	// RotationDrainTimeout, if set, drains the connections to an instance
+	// made with its previous certificate whenever a new one is retrieved:
+	// each is closed once it is idle between transactions, or after this
+	// long if it has not become idle.
+	RotationDrainTimeout time.Duration
+	// KeepAliveInterval is how long a TCP connection, on either side of a
+	// proxied connection, may be idle before keepalive probes are sent, and
+	// the interval between probes. If not set, it defaults to one minute.
+	KeepAliveInterval time.Duration
+	// KeepAliveCount, if set, is the number of unanswered keepalive probes
+	// after which a connection is dropped. If not set, the system default is
+	// used. Setting it is not supported on Windows.
+	KeepAliveCount int
+	// TCPUserTimeout, if set, is how long data sent on a TCP connection, on
+	// either side of a proxied connection, may go unacknowledged before the
+	// connection is closed. It is only supported on Linux, and is ignored
+	// elsewhere.
+	TCPUserTimeout time.Duration
+	// HandshakeTimeout, if set, bounds the time taken to set up the
+	// connection to an instance for a new client connection: waiting for the
+	// instance's certificate, dialing the instance and completing the TLS
+	// handshake. The client connection is closed if it is exceeded.
+	HandshakeTimeout time.Duration
+	// DialRetries is the number of times a failed TCP dial to an instance is
+	// retried, waiting between attempts as configured by DialBackoff. 0
+	// disables retries.
+	DialRetries int
+	// DialBackoff configures the delays between retries of a failed dial.
+	// If unset, certs.DefaultBackoff is used.
+	DialBackoff certs.Backoff
+	// BreakerMaxBackoff is the longest the Client waits before attempting a
+	// connection to a repeatedly failing instance. If not set, it defaults to
+	// DefaultBreakerMaxBackoff.
+	BreakerMaxBackoff time.Duration
+	// Auditor, if set, is told about every connection proxied to an
+	// instance when it opens and when it closes.
+	Auditor Auditor
+
+	// closing is set to 1 once Shutdown has been called, after which new
+	// connections are refused. It must be accessed atomically.
+	closing uint32
+	// shutdown is closed once Shutdown has been called, stopping the
+	// goroutines which wait to refresh certificates. It is created by
+	// shutdownOnce; use shutdownCh.
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	// handled counts the connections handled since the Client started, so
+	// that WaitIdle can tell that connections came and went between its
+	// checks. It must be accessed atomically, and may wrap.
+	handled uint32
+
+	// sources enforces MaxNewConnsPerIP.
+	sources sourceLimiter
+
+	// active maps each connection currently being proxied to the name of its
+	// instance, so that Shutdown can close connections which outlive its
+	// timeout.
+	active sync.Map
+	// rotating holds each *rotatingConn currently being proxied; see
+	// RotationDrainTimeout.
+	rotating sync.Map
+
+	// instanceLimits holds an *instanceLimit for each instance with a
+	// connection limit, keyed by instance. It is populated by
+	// SetInstanceMaxConnections.
+	instanceLimits sync.Map
+	// projectLimits holds an *instanceLimit for each project with a limit on
+	// the connections to all of its instances, keyed by project. It is
+	// populated by SetProjectMaxConnections.
+	projectLimits sync.Map
+
+	// appNames holds the application name of each instance with one set by
+	// SetInstanceApplicationName, keyed by instance.
+	appNames sync.Map
+
+	// warm holds a *warmPool of ready connections for each instance when
+	// WarmConnections is set.
+	warm sync.Map
+
+	// breakers holds a *breaker for each instance when BreakerThreshold is
+	// set.
+	breakers sync.Map
+
+	// totalIn and totalOut enforce MaxTotalBandwidth across connections.
+	// They are created by totalBandwidthOnce.
+	totalIn, totalOut  *rate.Limiter
+	totalBandwidthOnce sync.Once
+
+	// stats holds the *connStats for each instance which has had a
+	// connection proxied to it.
+	stats sync.Map
 
 	// The cfgCache holds the most recent connection configuration keyed by
 	// instance. Relevant functions are refreshCfg and cachedCfg. It is
@@ -103,8 +295,16 @@ type Client struct {
 	cfgCache map[string]cacheEntry
 	cacheL   sync.RWMutex
 
-	// refreshCfgL prevents multiple goroutines from contacting the Cloud SQL API at once.
-	refreshCfgL sync.Mutex
+	// inFlight counts the refreshes of each instance which have started but
+	// not yet finished. It is protected by cacheL, and checked by the
+	// refresh watchdog, which is started by watchdogOnce.
+	inFlight     map[string]int
+	watchdogOnce sync.Once
+
+	// refreshSem limits the number of goroutines contacting the Cloud SQL API
+	// at once to maxConcurrentRefreshes. It is created by refreshSemOnce.
+	refreshSem     chan struct{}
+	refreshSemOnce sync.Once
 
 	// RefreshCfgThrottle is the amount of time to wait between configuration
 	// refreshes. If not set, it defaults to 1 minute.
@@ -116,16 +316,118 @@ type Client struct {
 	// RefreshCertBuffer is the amount of time before the configuration expires
 	// to attempt to refresh it. If not set, it defaults to 5 minutes. When IAM
 	// Login is enabled, this value should be set to IAMLoginRefreshCfgBuffer.
+	//
+	// The previous configuration continues to be used for new connections
+	// until the refresh completes; connections already established are never
+	// affected by a refresh.
 	RefreshCfgBuffer time.Duration
 }
 
+// instanceLimit tracks the connections to a single instance, or to all the
+// instances in a project, so that they may be limited independently of
+// Client.MaxConnections.
+type instanceLimit struct {
+	// max is the maximum number of simultaneous connections; 0 means no limit.
+	max uint64
+	// active is the number of connections currently being handled.
+	active uint64
+}
+
+// SetInstanceMaxConnections limits the number of simultaneous connections
+// that will be proxied to instance. Connections beyond the limit are closed
+// immediately. A max of 0 removes the limit. It is safe to call while the
+// Client is running.
+func (c *Client) SetInstanceMaxConnections(instance string, max uint64) {
+	setLimit(&c.instanceLimits, instance, max)
+}
+
+// SetProjectMaxConnections limits the number of simultaneous connections
+// that will be proxied to all the instances in project together, so that the
+// instances of one busy project cannot starve those of others. Connections
+// beyond the limit are closed immediately. A max of 0 removes the limit. It
+// is safe to call while the Client is running.
+func (c *Client) SetProjectMaxConnections(project string, max uint64) {
+	setLimit(&c.projectLimits, project, max)
+}
+
+// setLimit sets the limit for key in limits, a map of *instanceLimit.
+func setLimit(limits *sync.Map, key string, max uint64) {
+	if v, ok := limits.Load(key); ok {
+		atomic.StoreUint64(&v.(*instanceLimit).max, max)
+		return
+	}
+	if max == 0 {
+		return
+	}
+	v, loaded := limits.LoadOrStore(key, &instanceLimit{max: max})
+	if loaded {
+		atomic.StoreUint64(&v.(*instanceLimit).max, max)
+	}
+}
+
+// SetInstanceApplicationName sets the application name sent for connections
+// to instance, overriding ApplicationName. An empty name removes the
+// override. It is safe to call while the Client is running.
+func (c *Client) SetInstanceApplicationName(instance, name string) {
+	if name == "" {
+		c.appNames.Delete(instance)
+		return
+	}
+	c.appNames.Store(instance, name)
+}
+
+// applicationName returns the application name sent for connections to
+// instance.
+func (c *Client) applicationName(instance string) string {
+	if v, ok := c.appNames.Load(instance); ok {
+		return v.(string)
+	}
+	return c.ApplicationName
+}
+
+// acquireInstance reserves a connection slot for instance. If the instance's
+// limit has been reached ok is false. The returned release func must always
+// be called.
+func (c *Client) acquireInstance(instance string) (release func(), ok bool) {
+	return acquireLimit(&c.instanceLimits, instance)
+}
+
+// acquireProject reserves a connection slot for instance in the limit of its
+// project, as acquireInstance does for the instance itself. It also returns
+// the project.
+func (c *Client) acquireProject(instance string) (project string, release func(), ok bool) {
+	project, _, _ = util.SplitName(instance)
+	release, ok = acquireLimit(&c.projectLimits, project)
+	return project, release, ok
+}
+
+// acquireLimit reserves a slot in the limit for key in limits, a map of
+// *instanceLimit.
+func acquireLimit(limits *sync.Map, key string) (release func(), ok bool) {
+	v, found := limits.Load(key)
+	if !found {
+		return func() {}, true
+	}
+	l := v.(*instanceLimit)
+	active := atomic.AddUint64(&l.active, 1)
+	release = func() { atomic.AddUint64(&l.active, ^uint64(0)) }
+	max := atomic.LoadUint64(&l.max)
+	return release, max == 0 || active <= max
+}
+
 type cacheEntry struct {
 	lastRefreshed time.Time
+	// lastSuccess is when a new configuration was last retrieved without
+	// error. It is zero if no refresh has succeeded.
+	lastSuccess time.Time
 	// If err is not nil, the addr and cfg are not valid.
 	err     error
 	addr    string
 	version string
 	cfg     *tls.Config
+	// generation counts the certificates successfully retrieved for the
+	// instance.
+	generation uint64
 	// done represents the status of any pending refresh operation related to this instance.
 	// If unset the op hasn't started, if open the op is still pending, and if closed the op has finished.
 	done chan struct{}
@@ -144,39 +446,177 @@ func (c *Client) Run(connSrc <-chan Conn) {
 }
 
 func (c *Client) handleConn(conn Conn) {
+	accepted := time.Now()
+	if atomic.LoadUint32(&c.closing) == 1 {
+		logging.Verbosef("refusing new connection to %q: proxy is shutting down", conn.Instance)
+		c.Metrics.ConnRejected(conn.Instance, "shutting_down")
+		conn.Conn.Close()
+		return
+	}
+
+	if !c.allowed(conn.Conn) {
+		logging.Errorf("WARNING: refusing connection from %v to %q: address is not in an allowed network", conn.Conn.RemoteAddr(), conn.Instance)
+		c.Metrics.ConnRejected(conn.Instance, "not_allowed")
+		conn.Conn.Close()
+		return
+	}
+
+	if !c.allowNewConn(conn.Conn) {
+		logging.Verbosef("refusing connection from %v to %q: too many new connections from its address", conn.Conn.RemoteAddr(), conn.Instance)
+		c.rejectConn(conn, "rate_limited")
+		return
+	}
+
 	active := atomic.AddUint64(&c.ConnectionsCounter, 1)
+	atomic.AddUint32(&c.handled, 1)
 
 	// Deferred decrement of ConnectionsCounter upon connection closing
 	defer atomic.AddUint64(&c.ConnectionsCounter, ^uint64(0))
 
 	if c.MaxConnections > 0 && active > c.MaxConnections {
 		logging.Errorf("too many open connections (max %d)", c.MaxConnections)
+		c.rejectConn(conn, "max_connections")
+		return
+	}
+
+	release, ok := c.acquireInstance(conn.Instance)
+	defer release()
+	if !ok {
+		logging.Errorf("too many open connections to %q", conn.Instance)
+		c.rejectConn(conn, "instance_max_connections")
+		return
+	}
+
+	project, releaseProject, ok := c.acquireProject(conn.Instance)
+	defer releaseProject()
+	if !ok {
+		logging.Errorf("too many open connections to instances in project %q; refusing connection to %q", project, conn.Instance)
+		c.rejectConn(conn, "project_max_connections")
+		return
+	}
+
+	if !c.breakerAllow(conn.Instance) {
+		logging.Verbosef("refusing new connection to %q: circuit is open after repeated failures", conn.Instance)
+		c.Metrics.ConnRejected(conn.Instance, "circuit_open")
 		conn.Conn.Close()
 		return
 	}
 
-	server, err := c.Dial(conn.Instance)
+	ctx, end := c.startSpan(context.Background(), connSpan, conn.Instance)
+	var err error
+	// The generation is read before dialing, so that a refresh during the
+	// dial leaves the connection counted as made with the older certificate.
+	gen := c.certGeneration(conn.Instance)
+	server := c.takeWarm(conn.Instance)
+	if server == nil {
+		server, err = c.dialWithTimeout(ctx, conn.Instance)
+	}
+	c.breakerRecord(conn.Instance, err)
 	if err != nil {
 		logging.Errorf("couldn't connect to %q: %v", conn.Instance, err)
+		c.Metrics.ConnFailed(conn.Instance)
+		end(err)
 		conn.Conn.Close()
 		return
 	}
+	if err := c.authenticate(conn.Conn, server, conn.Instance); err != nil {
+		logging.Errorf("couldn't authenticate connection to %q: %v", conn.Instance, err)
+		c.Metrics.ConnFailed(conn.Instance)
+		end(err)
+		server.Close()
+		conn.Conn.Close()
+		return
+	}
+	stats := c.statsFor(conn.Instance)
+	setup := time.Since(accepted)
+	stats.recordSetup(setup)
+	c.Metrics.ConnSetup(conn.Instance, setup)
+	c.Metrics.ConnOpened(conn.Instance)
+	defer c.Metrics.ConnClosed(conn.Instance)
+	c.active.Store(conn.Conn, conn.Instance)
+	defer c.active.Delete(conn.Conn)
+
+	atomic.AddUint64(&stats.active, 1)
+	atomic.AddUint64(&stats.opened, 1)
+	defer atomic.AddUint64(&stats.active, ^uint64(0))
 
+	c.keepAlive(conn.Conn)
 	c.Conns.Add(conn.Instance, conn.Conn)
-	copyThenClose(server, conn.Conn, conn.Instance, "local connection on "+conn.Conn.LocalAddr().String())
+	var bytes connBytes
+	rotating, untrack := c.trackRotation(conn.Conn, conn.Instance, gen)
+	defer untrack()
+	local := c.throttle(countingConn{Conn: c.closeIdle(c.limitAge(rotating, conn.Instance), conn.Instance), s: stats, conn: &bytes, instance: conn.Instance, m: c.Metrics})
+	opened := time.Now()
+	if c.Auditor != nil {
+		c.Auditor.ConnOpened(conn.Instance, clientAddr(conn.Conn), opened)
+	}
+	copyThenClose(server, local, conn.Instance, "local connection on "+conn.Conn.LocalAddr().String())
+	end(nil)
+	if c.Auditor != nil {
+		c.Auditor.ConnClosed(conn.Instance, clientAddr(conn.Conn), time.Since(opened), atomic.LoadUint64(&bytes.in), atomic.LoadUint64(&bytes.out))
+	}
 
 	if err := c.Conns.Remove(conn.Instance, conn.Conn); err != nil {
 		logging.Errorf("%s", err)
 	}
 }
 
+// authenticate sets up the session of the client connected on client with
+// instance over server: it logs the client in as an IAM database user if
+// IAMAuthnTokenSource is set, and labels the session with its application
+// name.
+func (c *Client) authenticate(client, server net.Conn, instance string) error {
+	opts := authn.Options{
+		TokenSource:             c.IAMAuthnTokenSource,
+		ApplicationName:         c.applicationName(instance),
+		OverrideApplicationName: c.OverrideApplicationName,
+	}
+	if opts.TokenSource == nil && opts.ApplicationName == "" {
+		return nil
+	}
+	var login func(client, server io.ReadWriter, opts authn.Options) error
+	switch version := c.cachedVersion(instance); {
+	case strings.HasPrefix(version, "MYSQL"):
+		login = authn.MySQL
+	case strings.HasPrefix(version, "POSTGRES"):
+		login = authn.Postgres
+	default:
+		logging.Verbosef("IAM database authentication and application names are not supported for %q (%v); leaving the session to the client", instance, version)
+		return nil
+	}
+	deadline := time.Now().Add(authnTimeout)
+	client.SetDeadline(deadline)
+	server.SetDeadline(deadline)
+	defer client.SetDeadline(time.Time{})
+	defer server.SetDeadline(time.Time{})
+	return login(client, server, opts)
+}
+
+// allowed reports whether the client connection conn may be proxied.
+func (c *Client) allowed(conn net.Conn) bool {
+	if len(c.AllowedNetworks) == 0 {
+		return true
+	}
+	tcp, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	for _, n := range c.AllowedNetworks {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
 // refreshCfg uses the CertSource inside the Client to find the instance's
 // address as well as construct a new tls.Config to connect to the instance.
 // This function should only be called from the scope of "cachedCfg", which
 // controls the logic around throttling.
 func (c *Client) refreshCfg(instance string) (addr string, cfg *tls.Config, version string, err error) {
-	c.refreshCfgL.Lock()
-	defer c.refreshCfgL.Unlock()
+	c.refreshSemOnce.Do(func() { c.refreshSem = make(chan struct{}, maxConcurrentRefreshes) })
+	c.refreshSem <- struct{}{}
+	defer func() { <-c.refreshSem }()
 	logging.Verbosef("refreshing ephemeral certificate for instance %s", instance)
 
 	mycert, err := c.Certs.Local(instance)
@@ -188,6 +628,10 @@ func (c *Client) refreshCfg(instance string) (addr string, cfg *tls.Config, vers
 	if err != nil {
 		return "", nil, "", err
 	}
+	// The instance's server CA, retrieved over the authenticated channel to
+	// the Cloud SQL API, is the only certificate trusted for the instance:
+	// the system's roots are never consulted, so a server certificate
+	// issued by any other CA is rejected.
 	certs := x509.NewCertPool()
 	certs.AddCert(scert)
 
@@ -204,6 +648,14 @@ func (c *Client) refreshCfg(instance string) (addr string, cfg *tls.Config, vers
 		// that will verify that the certificate is OK.
 		InsecureSkipVerify:    true,
 		VerifyPeerCertificate: genVerifyPeerCertificateFunc(name, certs),
+		MinVersion:            c.MinTLSVersion,
+		CipherSuites:          c.CipherSuites,
+		// Connections made with the same ephemeral certificate resume an
+		// earlier TLS session where the instance allows it, which saves the
+		// certificate exchange of a full handshake. Each refresh creates a
+		// new cache, so sessions never outlive the certificate they were
+		// established with.
+		ClientSessionCache: tls.NewLRUClientSessionCache(sessionCacheSize),
 	}
 
 	return fmt.Sprintf("%s:%d", addr, c.Port), cfg, version, nil
@@ -211,7 +663,13 @@ func (c *Client) refreshCfg(instance string) (addr string, cfg *tls.Config, vers
 
 // refreshCertAfter refreshes the epehemeral certificate of the instance after timeToRefresh.
 func (c *Client) refreshCertAfter(instance string, timeToRefresh time.Duration) {
-	<-time.After(timeToRefresh)
+	t := time.NewTimer(timeToRefresh)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-c.shutdownCh():
+		return
+	}
 	logging.Verbosef("ephemeral certificate for instance %s will expire soon, refreshing now.", instance)
 	if _, _, _, err := c.cachedCfg(context.Background(), instance); err != nil {
 		logging.Errorf("failed to refresh the ephemeral certificate for %s before expiring: %v", instance, err)
@@ -255,28 +713,54 @@ func isExpired(cfg *tls.Config) bool {
 // should only be called from the scope of "cachedCfg", which controls the logic around throttling refreshes.
 func (c *Client) startRefresh(instance string, refreshCfgBuffer time.Duration) chan struct{} {
 	done := make(chan struct{})
+	c.refreshStarted(instance)
 	go func() {
 		defer close(done)
+		start := time.Now()
 		addr, cfg, ver, err := c.refreshCfg(instance)
+		c.Metrics.RefreshDone(instance, time.Since(start))
+		if err != nil {
+			c.Metrics.RefreshFailed(instance)
+			atomic.AddUint64(&c.statsFor(instance).refreshErrors, 1)
+		}
+		err = classifyError(instance, err)
 
 		c.cacheL.Lock()
+		c.refreshFinished(instance)
 		old := c.cfgCache[instance]
+		lastSuccess, gen := old.lastSuccess, old.generation
+		if err == nil {
+			lastSuccess = time.Now()
+			gen++
+		}
 		// if we failed to refresh cfg do not throw out potentially valid one
 		if err != nil && !isExpired(old.cfg) {
 			logging.Errorf("failed to refresh the ephemeral certificate for %s, returning previous cert instead: %v", instance, err)
 			addr, cfg, ver, err = old.addr, old.cfg, old.version, old.err
+		} else if err != nil && old.cfg != nil {
+			err = certificateExpired(instance, old.cfg.Certificates[0].Leaf.NotAfter, err)
 		}
 		e := cacheEntry{
 			lastRefreshed: time.Now(),
+			lastSuccess:   lastSuccess,
 			err:           err,
 			addr:          addr,
 			version:       ver,
 			cfg:           cfg,
+			generation:    gen,
 			done:          done,
 		}
 		c.cfgCache[instance] = e
 		c.cacheL.Unlock()
 
+		if old.lastSuccess.IsZero() && !lastSuccess.IsZero() {
+			// The first certificate for this instance has been fetched.
+			go c.fillWarm(instance)
+		}
+		if gen > old.generation && old.generation > 0 && c.RotationDrainTimeout > 0 {
+			go c.drainRotated(instance, gen)
+		}
+
 		if !isValid(e) {
 			// Note: Future refreshes will not be scheduled unless another
 			// connection attempt is made.
@@ -358,8 +842,9 @@ func (c *Client) cachedCfg(ctx context.Context, instance string) (string, *tls.C
 		c.cacheL.Unlock()
 	}
 
-	if !isValid(e) {
-		// if the previous result was invalid, wait for the next result to complete
+	if !isValid(e) || isExpired(e.cfg) {
+		// if the previous result was invalid, or has expired while the next
+		// refresh was in flight, wait for the next result to complete
 		select {
 		case <-ctx.Done():
 			return "", nil, "", ctx.Err()
@@ -371,20 +856,42 @@ func (c *Client) cachedCfg(ctx context.Context, instance string) (string, *tls.C
 		e = c.cfgCache[instance]
 		c.cacheL.RUnlock()
 	}
+	if e.err == nil && e.cfg != nil && isExpired(e.cfg) {
+		return "", nil, "", certificateExpired(instance, e.cfg.Certificates[0].Leaf.NotAfter, nil)
+	}
 	return e.addr, e.cfg, e.version, e.err
 }
 
 // DialContext uses the configuration stored in the client to connect to an instance.
 // If this func returns a nil error the connection is correctly authenticated
-// to connect to the instance.
+// to connect to the instance. Errors fetching the instance's configuration
+// may be an *AuthError, *InstanceNotFoundError, *RateLimitError or
+// *CertificateExpiredError.
 func (c *Client) DialContext(ctx context.Context, instance string) (net.Conn, error) {
-	addr, cfg, _, err := c.cachedCfg(ctx, instance)
+	certCtx, end := c.startSpan(ctx, certSpan, instance)
+	addr, cfg, _, err := c.cachedCfg(certCtx, instance)
+	end(err)
 	if err != nil {
 		return nil, err
 	}
 
 	// TODO: attempt an early refresh if an connect fails?
-	return c.tryConnect(ctx, addr, cfg)
+	return c.tryConnect(ctx, instance, addr, cfg)
+}
+
+// dialWithTimeout calls DialContext, giving up after HandshakeTimeout if it
+// is set.
+func (c *Client) dialWithTimeout(ctx context.Context, instance string) (net.Conn, error) {
+	if c.HandshakeTimeout <= 0 {
+		return c.DialContext(ctx, instance)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.HandshakeTimeout)
+	defer cancel()
+	conn, err := c.DialContext(ctx, instance)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("connection setup did not complete within %v: %v", c.HandshakeTimeout, err)
+	}
+	return conn, err
 }
 
 // Dial does the same as DialContext but using context.Background() as the context.
@@ -392,36 +899,35 @@ func (c *Client) Dial(instance string) (net.Conn, error) {
 	return c.DialContext(context.Background(), instance)
 }
 
-func (c *Client) tryConnect(ctx context.Context, addr string, cfg *tls.Config) (net.Conn, error) {
-	dial := c.selectDialer()
-	conn, err := dial(ctx, "tcp", addr)
+func (c *Client) tryConnect(ctx context.Context, instance, addr string, cfg *tls.Config) (net.Conn, error) {
+	conn, err := c.dialRetrying(ctx, c.selectDialer(), instance, addr)
 	if err != nil {
 		return nil, err
 	}
-	type setKeepAliver interface {
-		SetKeepAlive(keepalive bool) error
-		SetKeepAlivePeriod(d time.Duration) error
-	}
-
-	if s, ok := conn.(setKeepAliver); ok {
-		if err := s.SetKeepAlive(true); err != nil {
-			logging.Verbosef("Couldn't set KeepAlive to true: %v", err)
-		} else if err := s.SetKeepAlivePeriod(keepAlivePeriod); err != nil {
-			logging.Verbosef("Couldn't set KeepAlivePeriod to %v", keepAlivePeriod)
-		}
-	} else {
+	if !c.keepAlive(conn) {
 		logging.Verbosef("KeepAlive not supported: long-running tcp connections may be killed by the OS.")
 	}
 
 	ret := tls.Client(conn, cfg)
-	if err := ret.Handshake(); err != nil {
+	// The handshake must not outlive ctx.
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		ret.SetDeadline(deadline)
+	}
+	_, end := c.startSpan(ctx, handshakeSpan, instance)
+	err = ret.Handshake()
+	end(err)
+	if err != nil {
 		ret.Close()
 		return nil, err
 	}
+	if hasDeadline {
+		ret.SetDeadline(time.Time{})
+	}
 	return ret, nil
 }
 
-func (c *Client) selectDialer() func(context.Context, string, string) (net.Conn, error) {
+func (c *Client) selectDialer() dialFunc {
 	if c.ContextDialer != nil {
 		return c.ContextDialer
 	}
@@ -432,16 +938,11 @@ func (c *Client) selectDialer() func(context.Context, string, string) (net.Conn,
 		}
 	}
 
-	dialer := proxy.FromEnvironment()
-	if ctxDialer, ok := dialer.(proxy.ContextDialer); ok {
-		// although proxy.FromEnvironment() returns a Dialer interface which only has a Dial method,
-		// it happens in fact that method often returns ContextDialers.
-		return ctxDialer.DialContext
+	if c.ProxyURL != nil {
+		return proxyDialer(c.ProxyURL)
 	}
 
-	return func(_ context.Context, net, addr string) (net.Conn, error) {
-		return dialer.Dial(net, addr)
-	}
+	return environmentDialer()
 }
 
 // NewConnSrc returns a chan which can be used to receive connections
@@ -473,6 +974,136 @@ func NewConnSrc(instance string, l net.Listener) <-chan Conn {
 	return ch
 }
 
+// RefreshStatus describes the state of an instance's cached configuration.
+type RefreshStatus struct {
+	// LastRefresh is when the instance's certificate was last retrieved
+	// successfully. It is zero if no certificate has been retrieved.
+	LastRefresh time.Time
+	// Healthy is true if the Client holds a valid, unexpired certificate for
+	// the instance.
+	Healthy bool
+	// DatabaseVersion is the instance's database version, such as
+	// POSTGRES_14, as of the last retrieval. It is empty if the instance has
+	// not been retrieved.
+	DatabaseVersion string
+	// Region is the instance's region as reported by the Admin API. It is
+	// empty if the instance has not been retrieved, or if the CertSource does
+	// not report regions.
+	Region string
+}
+
+// RefreshStatus reports the state of the Client's cached configuration for
+// instance. It does not start a refresh.
+func (c *Client) RefreshStatus(instance string) RefreshStatus {
+	c.cacheL.RLock()
+	e := c.cfgCache[instance]
+	c.cacheL.RUnlock()
+	s := RefreshStatus{
+		LastRefresh:     e.lastSuccess,
+		Healthy:         isValid(e) && !isExpired(e.cfg),
+		DatabaseVersion: e.version,
+	}
+	if r, ok := c.Certs.(regionSource); ok {
+		s.Region = r.Region(instance)
+	}
+	return s
+}
+
+// Prefetch retrieves and caches the configuration for instance so that the
+// first connection to it does not wait for a certificate refresh.
+func (c *Client) Prefetch(ctx context.Context, instance string) error {
+	_, _, _, err := c.cachedCfg(ctx, instance)
+	return err
+}
+
+// PrefetchAll retrieves and caches the configuration for each of instances
+// concurrently, as with Prefetch. If any retrieval fails with an error which
+// retrying would not fix, such as a missing instance or a lack of permission,
+// PrefetchAll returns that error without waiting for the others, which carry
+// on in the background. Otherwise it returns once every retrieval has
+// finished, with an error describing those which failed, if any.
+func (c *Client) PrefetchAll(ctx context.Context, instances []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		instance string
+		err      error
+	}
+	results := make(chan result, len(instances))
+	for _, inst := range instances {
+		go func(inst string) {
+			results <- result{inst, c.Prefetch(ctx, inst)}
+		}(inst)
+	}
+
+	var failed []string
+	for range instances {
+		r := <-results
+		if r.err == nil {
+			continue
+		}
+		if !isRetryable(r.err) {
+			return fmt.Errorf("fetching certificate for %q: %v", r.instance, r.err)
+		}
+		failed = append(failed, fmt.Sprintf("%q: %v", r.instance, r.err))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("fetching certificates failed for %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Verify checks that instance can be reached by connecting to it: the
+// connection's TLS handshake is completed, proving that the instance's
+// certificates are valid and that no firewall blocks the way, and the
+// connection is then closed cleanly without sending any database traffic.
+func (c *Client) Verify(ctx context.Context, instance string) error {
+	conn, err := c.DialContext(ctx, instance)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// VerifyAll verifies each of instances concurrently, as with Verify, and
+// returns an error describing those which could not be reached, if any.
+func (c *Client) VerifyAll(ctx context.Context, instances []string) error {
+	errs := make([]error, len(instances))
+	var wg sync.WaitGroup
+	for i, inst := range instances {
+		wg.Add(1)
+		go func(i int, inst string) {
+			defer wg.Done()
+			errs[i] = c.Verify(ctx, inst)
+		}(i, inst)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%q: %v", instances[i], err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("connecting failed for %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// isRetryable reports whether an error retrieving an instance's configuration
+// may be resolved by trying again later, as with server errors and network
+// problems, rather than by changing the proxy's configuration.
+func isRetryable(err error) bool {
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return gErr.Code >= 500 || gErr.Code == http.StatusTooManyRequests
+	}
+	var nErr net.Error
+	return errors.As(err, &nErr)
+}
+
 // InstanceVersionContext uses client cache to return instance version string.
 //
 // Deprecated: Use Client.InstanceVersionContext instead.
@@ -489,10 +1120,15 @@ func (c *Client) InstanceVersionContext(ctx context.Context, instance string) (s
 	return version, nil
 }
 
-// Shutdown waits up to a given amount of time for all active connections to
-// close. Returns an error if there are still active connections after waiting
-// for the whole length of the timeout.
+// Shutdown stops the Client from proxying new connections and waits up to a
+// given amount of time for all active connections to close. Any connections
+// still open after the timeout are closed, and an error is returned. Scheduled
+// certificate refreshes are cancelled.
 func (c *Client) Shutdown(termTimeout time.Duration) error {
+	if atomic.SwapUint32(&c.closing, 1) == 0 {
+		close(c.shutdownCh())
+	}
+	c.closeWarm()
 	term, ticker := time.After(termTimeout), time.NewTicker(100*time.Millisecond)
 	defer ticker.Stop()
 	for {
@@ -510,5 +1146,87 @@ func (c *Client) Shutdown(termTimeout time.Duration) error {
 	if active == 0 {
 		return nil
 	}
+	c.active.Range(func(k, v interface{}) bool {
+		conn := k.(net.Conn)
+		logging.Errorf("WARNING: closing connection for %q on %v which did not close within %v", v, conn.LocalAddr(), termTimeout)
+		conn.Close()
+		return true
+	})
 	return fmt.Errorf("%d active connections still exist after waiting for %v", active, termTimeout)
 }
+
+// shutdownCh returns a channel which is closed once Shutdown has been called.
+func (c *Client) shutdownCh() chan struct{} {
+	c.shutdownOnce.Do(func() { c.shutdown = make(chan struct{}) })
+	return c.shutdown
+}
+
+// WaitIdle blocks until the Client has handled at least one connection and
+// then had no open connections for idle.
+func (c *Client) WaitIdle(idle time.Duration) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	var since time.Time
+	var handled uint32
+	for range ticker.C {
+		n := atomic.LoadUint32(&c.handled)
+		if n == 0 || atomic.LoadUint64(&c.ConnectionsCounter) > 0 {
+			since = time.Time{}
+			continue
+		}
+		if since.IsZero() || n != handled {
+			// Connections may have opened and closed since the last check.
+			since, handled = time.Now(), n
+			continue
+		}
+		if time.Since(since) >= idle {
+			return
+		}
+	}
+}
+
+// DrainInstance waits up to timeout for the connections currently being
+// proxied to instance to close, and then closes any which remain. Connections
+// to instance made after DrainInstance is called are not affected, so callers
+// should first stop accepting new connections for the instance. An error is
+// returned if any connections were closed.
+func (c *Client) DrainInstance(instance string, timeout time.Duration) error {
+	var conns []net.Conn
+	c.active.Range(func(k, v interface{}) bool {
+		if v.(string) == instance {
+			conns = append(conns, k.(net.Conn))
+		}
+		return true
+	})
+	open := func() []net.Conn {
+		var still []net.Conn
+		for _, conn := range conns {
+			if _, ok := c.active.Load(conn); ok {
+				still = append(still, conn)
+			}
+		}
+		return still
+	}
+
+	term, ticker := time.After(timeout), time.NewTicker(100*time.Millisecond)
+	defer ticker.Stop()
+	for len(conns) > 0 {
+		select {
+		case <-ticker.C:
+			conns = open()
+			continue
+		case <-term:
+		}
+		break
+	}
+
+	conns = open()
+	if len(conns) == 0 {
+		return nil
+	}
+	for _, conn := range conns {
+		logging.Errorf("WARNING: closing connection for %q on %v which did not close within %v", instance, conn.LocalAddr(), timeout)
+		conn.Close()
+	}
+	return fmt.Errorf("%d connections to %q still existed after waiting for %v", len(conns), instance, timeout)
+}
@@ -16,16 +16,26 @@ package proxy
 
 import (
 	"context"
+	"crypto/ecdsa"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 	"unsafe"
+
+	"github.com/lib/pq"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
 )
 
 const instance = "instance-name"
@@ -205,6 +215,78 @@ func TestMaximumConnectionsCount(t *testing.T) {
 	}
 }
 
+func TestInstanceMaxConnections(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	c.SetInstanceMaxConnections(instance, 1)
+
+	release, ok := c.acquireInstance(instance)
+	if !ok {
+		t.Fatal("first connection should be allowed")
+	}
+	if r, ok := c.acquireInstance(instance); ok {
+		t.Error("second connection should be refused when the instance limit is 1")
+	} else {
+		r()
+	}
+	if r, ok := c.acquireInstance("other-instance"); !ok {
+		t.Error("connections to an instance without a limit should be allowed")
+	} else {
+		r()
+	}
+	release()
+
+	r, ok := c.acquireInstance(instance)
+	if !ok {
+		t.Error("connection should be allowed after the first was released")
+	}
+	r()
+
+	// Removing the limit allows any number of connections.
+	c.SetInstanceMaxConnections(instance, 0)
+	for i := 0; i < 3; i++ {
+		r, ok := c.acquireInstance(instance)
+		if !ok {
+			t.Errorf("connection %d should be allowed after the limit was removed", i)
+		}
+		defer r()
+	}
+}
+
+func TestProjectMaxConnections(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	c.SetProjectMaxConnections("proj", 2)
+
+	var releases []func()
+	for _, inst := range []string{"proj:region:a", "proj:region:b"} {
+		_, r, ok := c.acquireProject(inst)
+		if !ok {
+			t.Fatalf("connection to %q should be allowed", inst)
+		}
+		releases = append(releases, r)
+	}
+	if project, r, ok := c.acquireProject("proj:region:c"); ok {
+		t.Error("third connection should be refused when the project limit is 2")
+	} else {
+		if project != "proj" {
+			t.Errorf("acquireProject returned project %q, want proj", project)
+		}
+		r()
+	}
+	if _, r, ok := c.acquireProject("other:region:a"); !ok {
+		t.Error("connections to a project without a limit should be allowed")
+	} else {
+		r()
+	}
+	releases[0]()
+
+	_, r, ok := c.acquireProject("proj:region:c")
+	if !ok {
+		t.Error("connection should be allowed after another in the project was released")
+	}
+	r()
+	releases[1]()
+}
+
 func TestShutdownTerminatesEarly(t *testing.T) {
 	cs := newCertSource(&fakeCerts{}, forever)
 	c := newClient(cs)
@@ -229,6 +311,191 @@ func TestShutdownTerminatesEarly(t *testing.T) {
 	}
 }
 
+// closeRecorder is a net.Conn which records whether it has been closed.
+type closeRecorder struct {
+	net.Conn
+	closed uint32
+}
+
+func (c *closeRecorder) Close() error {
+	atomic.StoreUint32(&c.closed, 1)
+	return nil
+}
+
+func (c *closeRecorder) LocalAddr() net.Addr {
+	return &net.UnixAddr{Name: "fake", Net: "unix"}
+}
+
+func (c *closeRecorder) isClosed() bool {
+	return atomic.LoadUint32(&c.closed) == 1
+}
+
+func TestShutdownClosesStragglers(t *testing.T) {
+	defer waitForGoroutineCount(t, runtime.NumGoroutine(), 5*time.Second)
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+
+	// Simulate a connection which never finishes on its own.
+	straggler := &closeRecorder{}
+	atomic.AddUint64(&c.ConnectionsCounter, 1)
+	c.active.Store(straggler, instance)
+
+	if err := c.Shutdown(10 * time.Millisecond); err == nil {
+		t.Error("Shutdown should return an error when connections did not close in time")
+	}
+	if !straggler.isClosed() {
+		t.Error("Shutdown should close connections which outlive the timeout")
+	}
+}
+
+func TestDrainInstance(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+
+	straggler, other, finished := &closeRecorder{}, &closeRecorder{}, &closeRecorder{}
+	c.active.Store(straggler, instance)
+	c.active.Store(other, "other:region:instance")
+	c.active.Store(finished, instance)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.active.Delete(finished)
+	}()
+
+	if err := c.DrainInstance(instance, 200*time.Millisecond); err == nil {
+		t.Error("DrainInstance should return an error when connections did not close in time")
+	}
+	if !straggler.isClosed() {
+		t.Error("DrainInstance should close connections which outlive the timeout")
+	}
+	if finished.isClosed() {
+		t.Error("DrainInstance closed a connection which finished in time")
+	}
+	if other.isClosed() {
+		t.Error("DrainInstance closed a connection to another instance")
+	}
+	if err := c.DrainInstance("none:region:instance", time.Hour); err != nil {
+		t.Errorf("DrainInstance with no connections failed: %v", err)
+	}
+}
+
+func TestShutdownRefusesNewConnections(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	c.Dialer = func(string, string) (net.Conn, error) {
+		t.Error("no connections should be dialed after Shutdown")
+		return nil, sentinelError
+	}
+	if err := c.Shutdown(0); err != nil {
+		t.Fatalf("Shutdown with no connections failed: %v", err)
+	}
+
+	conn := &closeRecorder{}
+	c.handleConn(Conn{Instance: instance, Conn: conn})
+	if !conn.isClosed() {
+		t.Error("connections made after Shutdown should be closed immediately")
+	}
+}
+
+// remoteConn is a closeRecorder with the provided remote address.
+type remoteConn struct {
+	closeRecorder
+	remote net.Addr
+}
+
+func (c *remoteConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestAllowedNetworks(t *testing.T) {
+	_, allowed, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := []struct {
+		desc      string
+		remote    net.Addr
+		wantDials uint64
+	}{
+		{"allowed address", &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}, 1},
+		{"other address", &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234}, 0},
+		{"unix socket", &net.UnixAddr{Name: "@", Net: "unix"}, 1},
+	}
+	for _, tc := range tcs {
+		c := newClient(newCertSource(&fakeCerts{}, forever))
+		c.AllowedNetworks = []*net.IPNet{allowed}
+		var dials uint64
+		c.Dialer = func(string, string) (net.Conn, error) {
+			atomic.AddUint64(&dials, 1)
+			return nil, sentinelError
+		}
+
+		conn := &remoteConn{remote: tc.remote}
+		c.handleConn(Conn{Instance: instance, Conn: conn})
+		if dials != tc.wantDials {
+			t.Errorf("%v: got %d dials, want %d", tc.desc, dials, tc.wantDials)
+		}
+		if !conn.isClosed() {
+			t.Errorf("%v: client connection was not closed", tc.desc)
+		}
+	}
+}
+
+func TestMaxNewConnsPerIP(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	c.MaxNewConnsPerIP = 2
+	var dials uint64
+	c.Dialer = func(string, string) (net.Conn, error) {
+		atomic.AddUint64(&dials, 1)
+		return nil, sentinelError
+	}
+
+	tcs := []struct {
+		desc      string
+		remote    net.Addr
+		conns     int
+		wantDials uint64
+	}{
+		{"busy address", &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}, 5, 2},
+		{"other address", &net.TCPAddr{IP: net.ParseIP("10.1.2.4"), Port: 1234}, 1, 1},
+		{"unix socket", &net.UnixAddr{Name: "@", Net: "unix"}, 5, 5},
+	}
+	for _, tc := range tcs {
+		atomic.StoreUint64(&dials, 0)
+		for i := 0; i < tc.conns; i++ {
+			conn := &remoteConn{remote: tc.remote}
+			c.handleConn(Conn{Instance: instance, Conn: conn})
+			if !conn.isClosed() {
+				t.Errorf("%v: client connection was not closed", tc.desc)
+			}
+		}
+		if dials != tc.wantDials {
+			t.Errorf("%v: got %d dials, want %d", tc.desc, dials, tc.wantDials)
+		}
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	c.HandshakeTimeout = 50 * time.Millisecond
+	c.ContextDialer = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		// An instance which never answers.
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	conn := &remoteConn{remote: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}}
+	done := make(chan struct{})
+	go func() {
+		c.handleConn(Conn{Instance: instance, Conn: conn})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleConn did not give up after HandshakeTimeout")
+	}
+	if !conn.isClosed() {
+		t.Error("client connection was not closed")
+	}
+}
+
 func TestRefreshTimer(t *testing.T) {
 	timeToExpire := 2 * time.Second
 	certCreated := time.Now()
@@ -262,6 +529,48 @@ func TestRefreshTimer(t *testing.T) {
 	}
 }
 
+func TestExpiredCertWaitsForRefresh(t *testing.T) {
+	expired := &tls.Config{Certificates: []tls.Certificate{{Leaf: &x509.Certificate{NotAfter: time.Now().Add(-time.Second)}}}}
+	fresh := &tls.Config{Certificates: []tls.Certificate{{Leaf: &x509.Certificate{NotAfter: forever}}}}
+	done := make(chan struct{})
+	c := &Client{cfgCache: map[string]cacheEntry{
+		instance: {lastRefreshed: time.Now(), addr: "old", cfg: expired, done: done},
+	}}
+	// Simulate the in-flight refresh completing.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		c.cacheL.Lock()
+		c.cfgCache[instance] = cacheEntry{lastRefreshed: time.Now(), addr: "new", cfg: fresh, done: done}
+		c.cacheL.Unlock()
+		close(done)
+	}()
+
+	addr, cfg, _, err := c.cachedCfg(context.Background(), instance)
+	if err != nil {
+		t.Fatalf("cachedCfg: %v", err)
+	}
+	if addr != "new" || cfg != fresh {
+		t.Fatalf("cachedCfg returned %q, want the refreshed configuration", addr)
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	c.MinTLSVersion = tls.VersionTLS13
+	c.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+
+	_, cfg, _, err := c.refreshCfg(instance)
+	if err != nil {
+		t.Fatalf("refreshCfg: %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS13 {
+		t.Errorf("MinVersion = %x, want TLS 1.3", cfg.MinVersion)
+	}
+	if len(cfg.CipherSuites) != 1 || cfg.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("CipherSuites = %v, want %v", cfg.CipherSuites, c.CipherSuites)
+	}
+}
+
 func TestSyncAtomicAlignment(t *testing.T) {
 	// The sync/atomic pkg has a bug that requires the developer to guarantee
 	// 64-bit alignment when using 64-bit functions on 32-bit systems.
@@ -290,3 +599,240 @@ func TestRemoteCertError(t *testing.T) {
 	}
 
 }
+
+func TestIAMAuthnPostgres(t *testing.T) {
+	defer waitForGoroutineCount(t, runtime.NumGoroutine(), 5*time.Second)
+	c := &Client{
+		IAMAuthnTokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}),
+		cfgCache:            map[string]cacheEntry{instance: {version: "POSTGRES_13"}},
+	}
+	// The fake instance accepts only the token as a cleartext password.
+	serveInstance := func(conn net.Conn) {
+		defer conn.Close()
+		var n uint32
+		if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+			return
+		}
+		if _, err := io.CopyN(ioutil.Discard, conn, int64(n)-4); err != nil {
+			return
+		}
+		conn.Write([]byte{'R', 0, 0, 0, 8, 0, 0, 0, 3})
+		var typ byte
+		binary.Read(conn, binary.BigEndian, &typ)
+		binary.Read(conn, binary.BigEndian, &n)
+		pw := make([]byte, n-4)
+		io.ReadFull(conn, pw)
+		if typ != 'p' || string(pw) != "token\x00" {
+			t.Errorf("instance got password message %q %q, want the token", typ, pw)
+			return
+		}
+		conn.Write([]byte{'R', 0, 0, 0, 8, 0, 0, 0, 0})
+		conn.Write([]byte{'Z', 0, 0, 0, 5, 'I'})
+		io.Copy(ioutil.Discard, conn)
+	}
+	d := pipeDialer{serve: func(client net.Conn) {
+		proxySide, instanceSide := net.Pipe()
+		go serveInstance(instanceSide)
+		defer proxySide.Close()
+		if err := c.authenticate(client, proxySide, instance); err != nil {
+			t.Errorf("authenticate: %v", err)
+			return
+		}
+		go func() {
+			io.Copy(proxySide, client)
+			proxySide.Close()
+		}()
+		io.Copy(client, proxySide)
+	}}
+
+	conn, err := pq.DialOpen(d, "host=instance user=user@example.com dbname=db sslmode=disable")
+	if err != nil {
+		t.Fatalf("DialOpen: %v", err)
+	}
+	conn.Close()
+}
+
+func TestIAMAuthnDisabled(t *testing.T) {
+	c := &Client{cfgCache: map[string]cacheEntry{instance: {version: "POSTGRES_13"}}}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	// Nothing is read or written, so this would block on the pipe otherwise.
+	if err := c.authenticate(client, server, instance); err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+}
+
+func TestSetInstanceApplicationName(t *testing.T) {
+	c := &Client{ApplicationName: "default"}
+	c.SetInstanceApplicationName(instance, "override")
+	if got := c.applicationName(instance); got != "override" {
+		t.Errorf("applicationName(%q) = %q, want the override", instance, got)
+	}
+	if got := c.applicationName("p:r:other"); got != "default" {
+		t.Errorf("applicationName of another instance = %q, want the default", got)
+	}
+	c.SetInstanceApplicationName(instance, "")
+	if got := c.applicationName(instance); got != "default" {
+		t.Errorf("applicationName(%q) after removing the override = %q, want the default", instance, got)
+	}
+}
+
+// prefetchCertSource is a CertSource whose Remote calls are handled by remote.
+type prefetchCertSource struct {
+	remote func(instance string) error
+}
+
+func (cs *prefetchCertSource) Local(instance string) (tls.Certificate, error) {
+	return tls.Certificate{Leaf: &x509.Certificate{NotAfter: forever}}, nil
+}
+
+func (cs *prefetchCertSource) Remote(instance string) (*x509.Certificate, string, string, string, error) {
+	if err := cs.remote(instance); err != nil {
+		return nil, "", "", "", err
+	}
+	return &x509.Certificate{}, "fake address", "fake name", "fake version", nil
+}
+
+func TestPrefetchAllConcurrent(t *testing.T) {
+	instances := []string{"p:r:a", "p:r:b", "p:r:c", "p:r:d"}
+	var mu sync.Mutex
+	arrived := 0
+	all := make(chan struct{})
+	c := newClient(&prefetchCertSource{remote: func(string) error {
+		// Every fetch waits for the others to start.
+		mu.Lock()
+		arrived++
+		if arrived == len(instances) {
+			close(all)
+		}
+		mu.Unlock()
+		select {
+		case <-all:
+			return nil
+		case <-time.After(5 * time.Second):
+			return errors.New("fetches were not concurrent")
+		}
+	}})
+
+	if err := c.PrefetchAll(context.Background(), instances); err != nil {
+		t.Fatalf("PrefetchAll: %v", err)
+	}
+	for _, inst := range instances {
+		if !c.RefreshStatus(inst).Healthy {
+			t.Errorf("RefreshStatus(%q) is not healthy after PrefetchAll", inst)
+		}
+	}
+}
+
+func TestPrefetchAllFailsFast(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	c := newClient(&prefetchCertSource{remote: func(inst string) error {
+		if inst == "p:r:missing" {
+			return errors.New("instance does not exist")
+		}
+		<-block
+		return nil
+	}})
+
+	done := make(chan error)
+	go func() { done <- c.PrefetchAll(context.Background(), []string{"p:r:slow", "p:r:missing"}) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("PrefetchAll succeeded, want error for p:r:missing")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("PrefetchAll waited for other fetches after a non-retryable error")
+	}
+}
+
+func TestPrefetchAllRetryable(t *testing.T) {
+	c := newClient(&prefetchCertSource{remote: func(inst string) error {
+		if inst == "p:r:unavailable" {
+			return &googleapi.Error{Code: 503}
+		}
+		return nil
+	}})
+
+	err := c.PrefetchAll(context.Background(), []string{"p:r:ok", "p:r:unavailable"})
+	if err == nil || !strings.Contains(err.Error(), "p:r:unavailable") {
+		t.Errorf("PrefetchAll error = %v, want error naming p:r:unavailable", err)
+	}
+	if !c.RefreshStatus("p:r:ok").Healthy {
+		t.Error("PrefetchAll did not fetch p:r:ok")
+	}
+}
+
+func TestVerifyAll(t *testing.T) {
+	l, handshakes, c := startTLSServer(t, instance, tlsServerOptions{})
+	if err := c.VerifyAll(context.Background(), []string{instance}); err != nil {
+		t.Fatalf("VerifyAll: %v", err)
+	}
+	waitFor(t, "handshake", func() bool { return atomic.LoadInt32(handshakes) == 1 })
+
+	// Once the instance is unreachable, verification fails even though its
+	// certificate is cached.
+	l.Close()
+	err := c.VerifyAll(context.Background(), []string{instance})
+	if err == nil || !strings.Contains(err.Error(), instance) {
+		t.Errorf("VerifyAll error = %v, want error naming %v", err, instance)
+	}
+}
+
+func TestWaitIdle(t *testing.T) {
+	c := &Client{}
+	done := make(chan struct{})
+	go func() {
+		c.WaitIdle(200 * time.Millisecond)
+		close(done)
+	}()
+	notDone := func(why string) {
+		select {
+		case <-done:
+			t.Fatalf("WaitIdle returned %s", why)
+		case <-time.After(400 * time.Millisecond):
+		}
+	}
+
+	notDone("before any connection was handled")
+	// Simulate a connection being handled, as handleConn does.
+	atomic.AddUint64(&c.ConnectionsCounter, 1)
+	atomic.AddUint32(&c.handled, 1)
+	notDone("while a connection was open")
+
+	closed := time.Now()
+	atomic.AddUint64(&c.ConnectionsCounter, ^uint64(0))
+	select {
+	case <-done:
+		if d := time.Since(closed); d < 200*time.Millisecond {
+			t.Errorf("WaitIdle returned after %v idle, want at least 200ms", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitIdle did not return after the last connection closed")
+	}
+}
+
+func TestVerifyPeerCertificateTrustsOnlyServerCA(t *testing.T) {
+	const name = "proj:inst"
+	ca, caCert := newTestCert(t, "root", 1, nil, nil)
+	caKey := caCert.PrivateKey.(*ecdsa.PrivateKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	verify := genVerifyPeerCertificateFunc(name, pool)
+
+	_, good := newTestCert(t, name, 2, ca, caKey)
+	if err := verify(good.Certificate, nil); err != nil {
+		t.Errorf("certificate issued by the instance's server CA was rejected: %v", err)
+	}
+	// A certificate for the instance from another CA, even one with the
+	// same name as the server CA, is rejected.
+	other, otherCert := newTestCert(t, "root", 1, nil, nil)
+	if _, c := newTestCert(t, name, 2, other, otherCert.PrivateKey.(*ecdsa.PrivateKey)); verify(c.Certificate, nil) == nil {
+		t.Error("certificate issued by another CA was accepted")
+	}
+	if _, c := newTestCert(t, "proj:other", 3, ca, caKey); verify(c.Certificate, nil) == nil {
+		t.Error("certificate for another instance was accepted")
+	}
+}
@@ -52,6 +52,10 @@ func myCopy(dst io.Writer, src io.Reader) (readErr bool, err error) {
 }
 
 func copyError(readDesc, writeDesc string, readErr bool, err error) {
+	if err == errIdleTimeout || err == errMaxConnAge {
+		// Already logged when the connection was closed.
+		return
+	}
 	var desc string
 	if readErr {
 		desc = "Reading data from " + readDesc
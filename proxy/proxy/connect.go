@@ -0,0 +1,163 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// dialFunc is the signature shared by every way of connecting to an
+// instance: directly, through an HTTP CONNECT proxy, or through a SOCKS5
+// proxy.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// directDialer connects to instances without a proxy.
+func directDialer() dialFunc {
+	var d net.Dialer
+	return d.DialContext
+}
+
+// proxyDialer returns a dialFunc connecting through the proxy at u, which
+// may be an HTTP or HTTPS proxy supporting the CONNECT method or a SOCKS5
+// proxy. Credentials in u are sent to the proxy.
+func proxyDialer(u *url.URL) dialFunc {
+	switch u.Scheme {
+	case "http", "https":
+		return func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialConnect(ctx, u, addr)
+		}
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		d, err := proxy.FromURL(u, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		if cd, ok := d.(proxy.ContextDialer); ok {
+			return cd.DialContext(ctx, network, addr)
+		}
+		return d.Dial(network, addr)
+	}
+}
+
+// dialConnect connects to addr by way of an HTTP CONNECT request to the proxy
+// at u.
+func dialConnect(ctx context.Context, u *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(u.Hostname(), port)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+	}
+	// Don't wait on the proxy for longer than ctx allows.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		p, _ := u.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + p))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %v: %v", u.Host, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %v: reading CONNECT response: %v", u.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %v refused CONNECT to %v: %v", u.Host, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		// The instance spoke before the TLS handshake began, which it should
+		// not, but don't lose what it said.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose reads are served from r first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// environmentDialer returns a dial function which honors the proxy
+// environment variables. ALL_PROXY, which may name a SOCKS5 proxy, is used if
+// set; otherwise connections are made through the HTTPS_PROXY, subject to
+// NO_PROXY.
+func environmentDialer() dialFunc {
+	if os.Getenv("ALL_PROXY") != "" || os.Getenv("all_proxy") != "" {
+		dialer := proxy.FromEnvironment()
+		if ctxDialer, ok := dialer.(proxy.ContextDialer); ok {
+			// although proxy.FromEnvironment() returns a Dialer interface which only has a Dial method,
+			// it happens in fact that method often returns ContextDialers.
+			return ctxDialer.DialContext
+		}
+		return func(_ context.Context, net, addr string) (net.Conn, error) {
+			return dialer.Dial(net, addr)
+		}
+	}
+
+	proxyFor := httpproxy.FromEnvironment().ProxyFunc()
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		u, err := proxyFor(&url.URL{Scheme: "https", Host: addr})
+		if err != nil {
+			return nil, err
+		}
+		if u == nil {
+			return directDialer()(ctx, network, addr)
+		}
+		return proxyDialer(u)(ctx, network, addr)
+	}
+}
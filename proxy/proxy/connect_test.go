@@ -0,0 +1,258 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startConnectProxy starts an HTTP proxy which accepts CONNECT requests with
+// the given Proxy-Authorization header, if not empty, and then echoes
+// everything it reads. It returns the proxy's URL and a channel receiving the
+// target of each CONNECT request.
+func startConnectProxy(t *testing.T, wantAuth string) (*url.URL, chan string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				targets <- req.Host
+				if req.Method != "CONNECT" || req.Header.Get("Proxy-Authorization") != wantAuth {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				io.Copy(conn, br)
+			}()
+		}
+	}()
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}, targets, func() { l.Close() }
+}
+
+func echo(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("read %q through the proxy, want %q", buf, "hello")
+	}
+}
+
+func TestDialConnect(t *testing.T) {
+	u, targets, stop := startConnectProxy(t, "")
+	defer stop()
+
+	c := &Client{ProxyURL: u}
+	conn, err := c.selectDialer()(context.Background(), "tcp", "10.0.0.1:3307")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if got := <-targets; got != "10.0.0.1:3307" {
+		t.Errorf("proxy got CONNECT to %q, want 10.0.0.1:3307", got)
+	}
+	echo(t, conn)
+}
+
+func TestDialConnectAuth(t *testing.T) {
+	// "user:pass", base64-encoded.
+	u, _, stop := startConnectProxy(t, "Basic dXNlcjpwYXNz")
+	defer stop()
+
+	u.User = url.UserPassword("user", "pass")
+	conn, err := proxyDialer(u)(context.Background(), "tcp", "10.0.0.1:3307")
+	if err != nil {
+		t.Fatalf("dial with credentials: %v", err)
+	}
+	conn.Close()
+
+	u.User = url.UserPassword("user", "wrong")
+	_, err = proxyDialer(u)(context.Background(), "tcp", "10.0.0.1:3307")
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("dial with wrong credentials: got error %v, want 407", err)
+	}
+}
+
+// setenv sets the environment variable key for the rest of a test, returning
+// a function restoring it.
+func setenv(key, value string) func() {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestDialHTTPSProxyEnvironment(t *testing.T) {
+	u, targets, stop := startConnectProxy(t, "")
+	defer stop()
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	for _, k := range []string{"ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy", "REQUEST_METHOD"} {
+		defer setenv(k, "")()
+	}
+	os.Setenv("HTTPS_PROXY", u.String())
+	os.Setenv("NO_PROXY", "10.1.0.0/16")
+
+	c := &Client{}
+	conn, err := c.selectDialer()(context.Background(), "tcp", "10.0.0.1:3307")
+	if err != nil {
+		t.Fatalf("dial through HTTPS_PROXY: %v", err)
+	}
+	if got := <-targets; got != "10.0.0.1:3307" {
+		t.Errorf("proxy got CONNECT to %q, want 10.0.0.1:3307", got)
+	}
+	echo(t, conn)
+
+	// Addresses matching NO_PROXY are dialed directly.
+	os.Setenv("NO_PROXY", "127.0.0.1")
+	conn, err = c.selectDialer()(context.Background(), "tcp", target.Addr().String())
+	if err != nil {
+		t.Fatalf("dial direct: %v", err)
+	}
+	select {
+	case got := <-targets:
+		t.Errorf("proxy got CONNECT to %q for an address in NO_PROXY", got)
+	default:
+	}
+	echo(t, conn)
+}
+
+// startSOCKS5Proxy starts a SOCKS5 proxy which requires the given username
+// and password, if user is not empty, and then echoes everything it reads.
+// It returns the proxy's address and a channel receiving the target of each
+// connection.
+func startSOCKS5Proxy(t *testing.T, user, pass string) (string, chan string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := make(chan string, 10)
+	read := func(r io.Reader, n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil
+		}
+		return b
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// Greeting: version, number of methods, methods.
+				h := read(conn, 2)
+				if h == nil || read(conn, int(h[1])) == nil {
+					return
+				}
+				if user == "" {
+					conn.Write([]byte{5, 0})
+				} else {
+					conn.Write([]byte{5, 2})
+					// Username/password: version, ulen, user, plen, pass.
+					h := read(conn, 2)
+					if h == nil {
+						return
+					}
+					u := read(conn, int(h[1]))
+					pl := read(conn, 1)
+					if pl == nil {
+						return
+					}
+					p := read(conn, int(pl[0]))
+					if string(u) != user || string(p) != pass {
+						conn.Write([]byte{1, 1})
+						return
+					}
+					conn.Write([]byte{1, 0})
+				}
+				// Request: version, CONNECT, reserved, IPv4 address, port.
+				req := read(conn, 10)
+				if req == nil || req[1] != 1 || req[3] != 1 {
+					return
+				}
+				targets <- net.JoinHostPort(net.IP(req[4:8]).String(), strconv.Itoa(int(req[8])<<8|int(req[9])))
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String(), targets, func() { l.Close() }
+}
+
+func TestDialSOCKS5(t *testing.T) {
+	addr, targets, stop := startSOCKS5Proxy(t, "user", "pass")
+	defer stop()
+
+	c := &Client{ProxyURL: &url.URL{Scheme: "socks5", Host: addr, User: url.UserPassword("user", "pass")}}
+	conn, err := c.selectDialer()(context.Background(), "tcp", "10.0.0.1:3307")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if got := <-targets; got != "10.0.0.1:3307" {
+		t.Errorf("proxy got connection to %q, want 10.0.0.1:3307", got)
+	}
+	echo(t, conn)
+
+	c.ProxyURL.User = url.UserPassword("user", "wrong")
+	if _, err := c.selectDialer()(context.Background(), "tcp", "10.0.0.1:3307"); err == nil {
+		t.Fatal("dial with wrong credentials succeeded")
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// dialRetrying dials addr, the address of instance, with dial, retrying up to
+// DialRetries times with the delays given by DialBackoff. It stops early,
+// returning the last error, if ctx is done or the Client is shut down.
+func (c *Client) dialRetrying(ctx context.Context, dial dialFunc, instance, addr string) (net.Conn, error) {
+	for n := 1; ; n++ {
+		conn, err := dial(ctx, "tcp", addr)
+		if err == nil || n > c.DialRetries || ctx.Err() != nil {
+			return conn, err
+		}
+		sleep := c.DialBackoff.Delay(n)
+		logging.Verbosef("Dialing %s at %s failed: %v; retrying in %v", instance, addr, err, sleep)
+		t := time.NewTimer(sleep)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		case <-c.shutdownCh():
+			t.Stop()
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/certs"
+)
+
+// failingDialer returns a dialFunc which fails the first failures dials, and
+// the number of dials made so far.
+func failingDialer(failures int) (dialFunc, *int) {
+	var dials int
+	return func(context.Context, string, string) (net.Conn, error) {
+		dials++
+		if dials <= failures {
+			return nil, errors.New("connection refused")
+		}
+		local, _ := net.Pipe()
+		return local, nil
+	}, &dials
+}
+
+func TestDialRetrying(t *testing.T) {
+	fast := certs.Backoff{InitialDelay: time.Millisecond, MaxDelay: time.Millisecond, Multiplier: 1}
+	tcs := []struct {
+		retries, failures int
+		wantDials         int
+		wantErr           bool
+	}{
+		{retries: 0, failures: 1, wantDials: 1, wantErr: true},
+		{retries: 2, failures: 2, wantDials: 3},
+		{retries: 2, failures: 5, wantDials: 3, wantErr: true},
+		{retries: 3, failures: 0, wantDials: 1},
+	}
+	for _, tc := range tcs {
+		c := &Client{DialRetries: tc.retries, DialBackoff: fast}
+		dial, dials := failingDialer(tc.failures)
+		conn, err := c.dialRetrying(context.Background(), dial, instance, "127.0.0.1:3307")
+		if conn != nil {
+			conn.Close()
+		}
+		if (err != nil) != tc.wantErr || *dials != tc.wantDials {
+			t.Errorf("with %d retries and %d failures: got %d dials, error %v; want %d dials, error %v",
+				tc.retries, tc.failures, *dials, err, tc.wantDials, tc.wantErr)
+		}
+	}
+}
+
+func TestDialRetryingStopsWithContext(t *testing.T) {
+	c := &Client{DialRetries: 5, DialBackoff: certs.Backoff{InitialDelay: time.Minute, MaxDelay: time.Minute, Multiplier: 1}}
+	dial, dials := failingDialer(10)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.dialRetrying(ctx, dial, instance, "127.0.0.1:3307"); err == nil {
+		t.Fatal("dialRetrying succeeded, want error")
+	}
+	if d := time.Since(start); d > 5*time.Second || *dials != 1 {
+		t.Errorf("dialRetrying returned after %v and %d dials, want it to stop with the context after 1", d, *dials)
+	}
+}
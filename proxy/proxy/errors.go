@@ -0,0 +1,123 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/certs"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// The errors returned by Client.Dial and Client.DialContext for some common
+// failures have the types below, which may be checked with errors.As. Each
+// wraps the error which caused it, and reports the same message.
+
+// AuthError is returned when the proxy's credentials could not be used to
+// fetch an instance's configuration, e.g. because a token could not be
+// obtained or the account lacks permission to connect.
+type AuthError struct {
+	Instance string
+	Err      error
+}
+
+func (e *AuthError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the underlying error.
+func (e *AuthError) Unwrap() error { return e.Err }
+
+// InstanceNotFoundError is returned when the Cloud SQL Admin API reports that
+// an instance does not exist.
+type InstanceNotFoundError struct {
+	Instance string
+	Err      error
+}
+
+func (e *InstanceNotFoundError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the underlying error.
+func (e *InstanceNotFoundError) Unwrap() error { return e.Err }
+
+// RateLimitError is returned when an instance's configuration could not be
+// fetched because of the Cloud SQL Admin API's quota, or because the proxy's
+// own limit on API calls for the instance was reached. Trying again later may
+// succeed.
+type RateLimitError struct {
+	Instance string
+	Err      error
+}
+
+func (e *RateLimitError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the underlying error.
+func (e *RateLimitError) Unwrap() error { return e.Err }
+
+// CertificateExpiredError is returned when the only ephemeral certificate
+// available for an instance has expired, e.g. because refreshing it failed.
+type CertificateExpiredError struct {
+	Instance string
+	// Expiry is when the certificate expired.
+	Expiry time.Time
+	Err    error
+}
+
+func (e *CertificateExpiredError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the underlying error.
+func (e *CertificateExpiredError) Unwrap() error { return e.Err }
+
+// classifyError returns err, from fetching the configuration of instance,
+// wrapped in the error type matching its cause, or err itself if there is
+// none.
+func classifyError(instance string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var rErr *oauth2.RetrieveError
+	if errors.As(err, &rErr) {
+		return &AuthError{Instance: instance, Err: err}
+	}
+	if errors.Is(err, certs.ErrAPIBudgetExceeded) {
+		return &RateLimitError{Instance: instance, Err: err}
+	}
+	var gErr *googleapi.Error
+	if !errors.As(err, &gErr) {
+		return err
+	}
+	switch gErr.Code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &AuthError{Instance: instance, Err: err}
+	case http.StatusNotFound:
+		return &InstanceNotFoundError{Instance: instance, Err: err}
+	case http.StatusTooManyRequests:
+		return &RateLimitError{Instance: instance, Err: err}
+	}
+	return err
+}
+
+// certificateExpired returns a CertificateExpiredError for instance's
+// certificate, which expired at expiry. If cause is set, it is the error from
+// the most recent attempt to refresh the certificate.
+func certificateExpired(instance string, expiry time.Time, cause error) error {
+	err := fmt.Errorf("ephemeral certificate for %q expired at %v", instance, expiry)
+	if cause != nil {
+		err = fmt.Errorf("%v: %w", err, cause)
+	}
+	return &CertificateExpiredError{Instance: instance, Expiry: expiry, Err: err}
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/certs"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+func TestClassifyError(t *testing.T) {
+	apiErr := func(code int) error {
+		// As returned by the certs package.
+		return fmt.Errorf("error during get instance: %w", &googleapi.Error{Code: code})
+	}
+	tcs := []struct {
+		desc string
+		err  error
+		want interface{}
+	}{
+		{"unauthorized", apiErr(401), &AuthError{}},
+		{"forbidden", apiErr(403), &AuthError{}},
+		{"token", &oauth2.RetrieveError{Response: &http.Response{Status: "400 Bad Request"}}, &AuthError{}},
+		{"not found", apiErr(404), &InstanceNotFoundError{}},
+		{"quota", apiErr(429), &RateLimitError{}},
+		{"budget", fmt.Errorf("%w for p:r:i", certs.ErrAPIBudgetExceeded), &RateLimitError{}},
+		{"server error", apiErr(500), nil},
+		{"other", sentinelError, nil},
+	}
+	for _, tc := range tcs {
+		got := classifyError(instance, tc.err)
+		if got.Error() != tc.err.Error() {
+			t.Errorf("%v: classifyError changed the message to %q, want %q", tc.desc, got, tc.err)
+		}
+		if !errors.Is(got, tc.err) {
+			t.Errorf("%v: classifyError(%v) does not wrap the original error", tc.desc, tc.err)
+		}
+		if tc.want == nil {
+			if got != tc.err {
+				t.Errorf("%v: classifyError(%v) = %T, want the error itself", tc.desc, tc.err, got)
+			}
+		} else if reflect.TypeOf(got) != reflect.TypeOf(tc.want) {
+			t.Errorf("%v: classifyError(%v) = %T, want %T", tc.desc, tc.err, got, tc.want)
+		}
+	}
+	if err := classifyError(instance, nil); err != nil {
+		t.Errorf("classifyError(nil) = %v, want nil", err)
+	}
+}
+
+// errCertSource is a CertSource which fails with err.
+type errCertSource struct{ err error }
+
+func (cs errCertSource) Local(string) (tls.Certificate, error) {
+	return tls.Certificate{}, cs.err
+}
+
+func (cs errCertSource) Remote(string) (*x509.Certificate, string, string, string, error) {
+	return nil, "", "", "", cs.err
+}
+
+func TestDialInstanceNotFound(t *testing.T) {
+	c := newClient(errCertSource{fmt.Errorf("get instance: %w", &googleapi.Error{Code: 404})})
+	_, err := c.DialContext(context.Background(), instance)
+	var nfErr *InstanceNotFoundError
+	if !errors.As(err, &nfErr) {
+		t.Fatalf("DialContext returned %v, want an *InstanceNotFoundError", err)
+	}
+	if nfErr.Instance != instance {
+		t.Errorf("InstanceNotFoundError.Instance = %q, want %q", nfErr.Instance, instance)
+	}
+	var gErr *googleapi.Error
+	if !errors.As(err, &gErr) || gErr.Code != 404 {
+		t.Errorf("DialContext returned %v, want it to wrap the API error", err)
+	}
+}
+
+func TestCertificateExpired(t *testing.T) {
+	expiry := time.Now().Add(-time.Minute)
+	cause := &AuthError{Instance: instance, Err: errors.New("no token")}
+	err := certificateExpired(instance, expiry, cause)
+	var ceErr *CertificateExpiredError
+	if !errors.As(err, &ceErr) || !ceErr.Expiry.Equal(expiry) {
+		t.Fatalf("certificateExpired returned %v, want a *CertificateExpiredError expiring at %v", err, expiry)
+	}
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Errorf("certificateExpired returned %v, want it to wrap the refresh error", err)
+	}
+}
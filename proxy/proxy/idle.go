@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// errIdleTimeout is returned by an idleConn once its connection has gone
+// without any data for the Client's IdleTimeout. It has already been logged.
+var errIdleTimeout = errors.New("connection closed after idle timeout")
+
+// closeIdle returns conn, a client's connection to instance, failing once no
+// data has been read from or written to it for IdleTimeout, or conn itself if
+// IdleTimeout is not set.
+func (c *Client) closeIdle(conn net.Conn, instance string) net.Conn {
+	if c.IdleTimeout <= 0 {
+		return conn
+	}
+	ic := &idleConn{Conn: conn, instance: instance, timeout: c.IdleTimeout}
+	ic.extend()
+	return ic
+}
+
+// idleConn extends the deadline of a client's connection whenever data passes
+// in either direction. As every byte proxied to or from the instance passes
+// through the client's connection, the deadline only expires once the whole
+// session is idle.
+type idleConn struct {
+	net.Conn
+	instance string
+	timeout  time.Duration
+	// logged is set to 1 once the timeout has been logged.
+	logged uint32
+}
+
+func (c *idleConn) extend() {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+}
+
+// check returns errIdleTimeout in place of err if it is a timeout.
+func (c *idleConn) check(err error) error {
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		return err
+	}
+	if atomic.CompareAndSwapUint32(&c.logged, 0, 1) {
+		logging.Infof("Closing connection to %q after %v without any data transferred", c.instance, c.timeout)
+	}
+	return errIdleTimeout
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.extend()
+	}
+	return n, c.check(err)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.extend()
+	}
+	return n, c.check(err)
+}
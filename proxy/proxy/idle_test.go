@@ -0,0 +1,73 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCloseIdleDisabled(t *testing.T) {
+	c := &Client{}
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	if got := c.closeIdle(local, "proj:reg:inst"); got != local {
+		t.Errorf("closeIdle returned %T, want the connection itself", got)
+	}
+}
+
+func TestCloseIdle(t *testing.T) {
+	defer waitForGoroutineCount(t, runtime.NumGoroutine(), 5*time.Second)
+	c := &Client{IdleTimeout: 100 * time.Millisecond}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	conn := c.closeIdle(a, "proj:reg:inst")
+
+	// Data written to the connection keeps a pending read alive past the
+	// timeout.
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	go io.Copy(ioutil.Discard, b)
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := conn.Write([]byte{0}); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-readErr:
+		t.Fatalf("Read returned %v while data was being written", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	start := time.Now()
+	if err := <-readErr; err != errIdleTimeout {
+		t.Fatalf("Read returned %v, want errIdleTimeout", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Read returned %v after the last write, want about 100ms", d)
+	}
+}
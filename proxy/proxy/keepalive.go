@@ -0,0 +1,60 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// keepAlive enables TCP keepalives on conn, which is either a client's
+// connection or a connection to an instance, so that NAT gateways and
+// firewalls do not drop it while it is idle. Probes are sent after the
+// connection has been idle for KeepAliveInterval, and then at that interval,
+// until KeepAliveCount probes have gone unanswered. On Linux, it also sets
+// conn's TCPUserTimeout. It reports whether conn supports keepalives.
+func (c *Client) keepAlive(conn net.Conn) bool {
+	type setKeepAliver interface {
+		SetKeepAlive(keepalive bool) error
+		SetKeepAlivePeriod(d time.Duration) error
+	}
+	s, ok := conn.(setKeepAliver)
+	if !ok {
+		return false
+	}
+
+	interval := c.KeepAliveInterval
+	if interval <= 0 {
+		interval = keepAlivePeriod
+	}
+	if err := s.SetKeepAlive(true); err != nil {
+		logging.Verbosef("Couldn't set KeepAlive to true: %v", err)
+		return true
+	}
+	if err := s.SetKeepAlivePeriod(interval); err != nil {
+		logging.Verbosef("Couldn't set KeepAlivePeriod to %v: %v", interval, err)
+	}
+	if err := setKeepAliveProbes(conn, interval, c.KeepAliveCount); err != nil {
+		logging.Verbosef("Couldn't configure keepalive probes: %v", err)
+	}
+	if c.TCPUserTimeout > 0 {
+		if err := setUserTimeout(conn, c.TCPUserTimeout); err != nil {
+			logging.Verbosef("Couldn't set TCP_USER_TIMEOUT to %v: %v", c.TCPUserTimeout, err)
+		}
+	}
+	return true
+}
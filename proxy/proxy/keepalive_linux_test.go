@@ -0,0 +1,61 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestKeepAliveOptions(t *testing.T) {
+	conn, cleanup := tcpConn(t)
+	defer cleanup()
+	c := &Client{KeepAliveInterval: 30 * time.Second, KeepAliveCount: 3, TCPUserTimeout: 20 * time.Second}
+	c.keepAlive(conn)
+
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn: %v", err)
+	}
+	tcs := []struct {
+		name  string
+		level int
+		opt   int
+		want  int
+	}{
+		{"SO_KEEPALIVE", unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1},
+		{"TCP_KEEPIDLE", unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, 30},
+		{"TCP_KEEPINTVL", unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, 30},
+		{"TCP_KEEPCNT", unix.IPPROTO_TCP, unix.TCP_KEEPCNT, 3},
+		{"TCP_USER_TIMEOUT", unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, 20000},
+	}
+	for _, tc := range tcs {
+		var got int
+		var gerr error
+		if err := rc.Control(func(fd uintptr) {
+			got, gerr = unix.GetsockoptInt(int(fd), tc.level, tc.opt)
+		}); err != nil {
+			t.Fatalf("Control: %v", err)
+		}
+		if gerr != nil {
+			t.Errorf("getting %s: %v", tc.name, gerr)
+		} else if got != tc.want {
+			t.Errorf("%s = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
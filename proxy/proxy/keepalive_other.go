@@ -0,0 +1,33 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!dragonfly
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// setKeepAliveProbes only supports the default count of probes on this
+// platform, where SetKeepAlivePeriod also sets the interval between them.
+func setKeepAliveProbes(conn net.Conn, interval time.Duration, count int) error {
+	if count > 0 {
+		return errors.New("setting the number of probes is not supported on this platform")
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+// tcpConn returns a connected TCP connection on the loopback interface.
+func tcpConn(t *testing.T) (net.Conn, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+		close(accepted)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Fatalf("net.Dial: %v", err)
+	}
+	return conn, func() {
+		conn.Close()
+		if c, ok := <-accepted; ok {
+			c.Close()
+		}
+		l.Close()
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	c := &Client{KeepAliveCount: 3}
+	conn, cleanup := tcpConn(t)
+	defer cleanup()
+	if !c.keepAlive(conn) {
+		t.Errorf("keepAlive reported a TCP connection as unsupported")
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if c.keepAlive(a) {
+		t.Errorf("keepAlive reported a pipe as supported")
+	}
+}
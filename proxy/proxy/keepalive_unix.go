@@ -0,0 +1,52 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || darwin || freebsd || netbsd || dragonfly
+// +build linux darwin freebsd netbsd dragonfly
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setKeepAliveProbes sets the interval between the keepalive probes sent on
+// conn, and, if count is positive, the number of unanswered probes after
+// which the system drops it. SetKeepAlivePeriod only sets the idle time
+// before the first probe on some versions of Go.
+func setKeepAliveProbes(conn net.Conn, interval time.Duration, count int) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("connection does not expose its socket")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	secs := int((interval + time.Second - 1) / time.Second)
+	if cerr := rc.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, secs)
+		if err == nil && count > 0 {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPCNT, count)
+		}
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+// waitForGoroutineCount polls the number of goroutines until it is at most
+// baseline, failing the test with a dump of the remaining goroutines if it is
+// not within timeout. Deferring it first, with the count from the start of a
+// test, checks that everything the test started has stopped once the rest of
+// its teardown has run.
+func waitForGoroutineCount(t *testing.T, baseline int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	n := runtime.NumGoroutine()
+	for n > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Errorf("%d goroutines still running %v after the test, want at most %d:\n%s", n, timeout, baseline, buf)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		n = runtime.NumGoroutine()
+	}
+}
+
+func TestWaitForGoroutineCount(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	stop := make(chan struct{})
+	go func() { <-stop }()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(stop)
+	}()
+	waitForGoroutineCount(t, baseline, 5*time.Second)
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// errMaxConnAge is returned by an agedConn once its connection has reached the
+// Client's MaxConnAge. It has already been logged.
+var errMaxConnAge = errors.New("connection closed after reaching its maximum age")
+
+// limitAge returns conn, a client's connection to instance, failing once it
+// has been open for MaxConnAge, or conn itself if MaxConnAge is not set.
+func (c *Client) limitAge(conn net.Conn, instance string) net.Conn {
+	if c.MaxConnAge <= 0 {
+		return conn
+	}
+	ac := &agedConn{Conn: conn}
+	ac.timer = time.AfterFunc(c.MaxConnAge, func() {
+		logging.Infof("Closing connection to %q after %v: it has reached its maximum age", instance, c.MaxConnAge)
+		ac.expire()
+	})
+	return ac
+}
+
+// agedConn is a client's connection which is closed once it expires. Closing
+// is graceful: a write already in progress, e.g. of a query's results, is
+// allowed to finish, and any further read or write fails with errMaxConnAge,
+// after which the proxy closes both sides of the connection.
+type agedConn struct {
+	net.Conn
+	timer *time.Timer
+	// expired is set to 1 once the connection has reached its maximum age.
+	expired uint32
+	// writing is held for the duration of every Write.
+	writing sync.Mutex
+}
+
+// expire marks the connection as expired and wakes any pending Read.
+func (c *agedConn) expire() {
+	atomic.StoreUint32(&c.expired, 1)
+	// Waiting for writes gives a response already being written a chance to
+	// reach the client.
+	c.writing.Lock()
+	c.writing.Unlock()
+	c.Conn.SetReadDeadline(time.Unix(1, 0))
+}
+
+func (c *agedConn) isExpired() bool {
+	return atomic.LoadUint32(&c.expired) == 1
+}
+
+func (c *agedConn) Read(b []byte) (int, error) {
+	if c.isExpired() {
+		return 0, errMaxConnAge
+	}
+	n, err := c.Conn.Read(b)
+	if err != nil && c.isExpired() {
+		err = errMaxConnAge
+	}
+	return n, err
+}
+
+func (c *agedConn) Write(b []byte) (int, error) {
+	c.writing.Lock()
+	defer c.writing.Unlock()
+	if c.isExpired() {
+		return 0, errMaxConnAge
+	}
+	return c.Conn.Write(b)
+}
+
+// SetDeadline keeps the read deadline in the past once the connection has
+// expired, so that extending the deadline, e.g. by an idleConn, cannot keep a
+// pending Read from returning.
+func (c *agedConn) SetDeadline(t time.Time) error {
+	err := c.Conn.SetDeadline(t)
+	if c.isExpired() {
+		c.Conn.SetReadDeadline(time.Unix(1, 0))
+	}
+	return err
+}
+
+func (c *agedConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestLimitAgeDisabled(t *testing.T) {
+	c := &Client{}
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	if got := c.limitAge(local, "proj:reg:inst"); got != local {
+		t.Errorf("limitAge returned %T, want the connection itself", got)
+	}
+}
+
+func TestLimitAge(t *testing.T) {
+	defer waitForGoroutineCount(t, runtime.NumGoroutine(), 5*time.Second)
+	// The idle timeout extends the deadline on every write, which must not
+	// keep the expired connection open.
+	c := &Client{MaxConnAge: 100 * time.Millisecond, IdleTimeout: time.Minute}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	conn := c.closeIdle(c.limitAge(a, "proj:reg:inst"), "proj:reg:inst")
+	go io.Copy(ioutil.Discard, b)
+
+	start := time.Now()
+	if _, err := conn.Write([]byte{0}); err != nil {
+		t.Fatalf("Write before expiry: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != errMaxConnAge {
+		t.Fatalf("Read returned %v, want errMaxConnAge", err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || d > 2*time.Second {
+		t.Errorf("Read returned after %v, want about 100ms", d)
+	}
+	if _, err := conn.Write([]byte{0}); err != errMaxConnAge {
+		t.Errorf("Write after expiry returned %v, want errMaxConnAge", err)
+	}
+}
+
+func TestLimitAgeWaitsForWrite(t *testing.T) {
+	c := &Client{MaxConnAge: 50 * time.Millisecond}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	conn := c.limitAge(a, "proj:reg:inst")
+
+	// The write blocks until b reads, after the connection has expired, but
+	// still completes.
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		io.Copy(ioutil.Discard, b)
+	}()
+	if _, err := conn.Write(make([]byte, 10)); err != nil {
+		t.Fatalf("Write in progress at expiry returned %v", err)
+	}
+	if _, err := conn.Write(make([]byte, 10)); err != errMaxConnAge {
+		t.Errorf("Write after expiry returned %v, want errMaxConnAge", err)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// sourceIdleTimeout is how long a source address must go without a new
+// connection before its token bucket is forgotten. By then the bucket, which
+// refills within a second, is full again.
+const sourceIdleTimeout = time.Minute
+
+// sourceLimiter holds a token bucket of new connections for each client
+// source address. The zero value is ready to use.
+type sourceLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*sourceBucket
+	// swept is when buckets was last cleared of idle sources.
+	swept time.Time
+}
+
+type sourceBucket struct {
+	l    *rate.Limiter
+	seen time.Time
+}
+
+// allow reports whether a new connection from ip is within perSec, taking a
+// token from its bucket if so.
+func (s *sourceLimiter) allow(ip net.IP, perSec int) bool {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept) >= sourceIdleTimeout {
+		for k, b := range s.buckets {
+			if now.Sub(b.seen) >= sourceIdleTimeout {
+				delete(s.buckets, k)
+			}
+		}
+		s.swept = now
+	}
+
+	key := ip.String()
+	b, ok := s.buckets[key]
+	if !ok {
+		if s.buckets == nil {
+			s.buckets = make(map[string]*sourceBucket)
+		}
+		b = &sourceBucket{l: rate.NewLimiter(rate.Limit(perSec), perSec)}
+		s.buckets[key] = b
+	}
+	b.seen = now
+	return b.l.AllowN(now, 1)
+}
+
+// allowNewConn reports whether conn is within MaxNewConnsPerIP. Connections
+// over networks other than TCP are not limited.
+func (c *Client) allowNewConn(conn net.Conn) bool {
+	if c.MaxNewConnsPerIP <= 0 {
+		return true
+	}
+	tcp, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	return c.sources.allow(tcp.IP, c.MaxNewConnsPerIP)
+}
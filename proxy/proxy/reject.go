@@ -0,0 +1,154 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// rejectTimeout bounds the time spent telling a client that its connection
+// was refused.
+const rejectTimeout = 5 * time.Second
+
+const (
+	// mysqlTooManyConnections is the ER_CON_COUNT_ERROR error code.
+	mysqlTooManyConnections = 1040
+	// postgresTooManyConnections is the too_many_connections SQLSTATE.
+	postgresTooManyConnections = "53300"
+
+	postgresSSLRequest    = 80877103
+	postgresGSSENCRequest = 80877104
+)
+
+// rejectConn refuses conn because a connection limit has been reached. If the
+// database engine of the instance is known, an error the client reports as
+// "too many connections" is written to conn before it is closed.
+func (c *Client) rejectConn(conn Conn, reason string) {
+	c.Metrics.ConnRejected(conn.Instance, reason)
+	defer conn.Conn.Close()
+
+	if err := writeTooManyConnections(conn.Conn, c.cachedVersion(conn.Instance)); err != nil {
+		logging.Verbosef("couldn't notify client of refused connection to %q: %v", conn.Instance, err)
+	}
+}
+
+// cachedVersion returns the database version of instance if it is cached,
+// and an empty string otherwise. It never starts a refresh.
+func (c *Client) cachedVersion(instance string) string {
+	c.cacheL.RLock()
+	defer c.cacheL.RUnlock()
+	return c.cfgCache[instance].version
+}
+
+// writeTooManyConnections writes a "too many connections" error to conn in
+// the wire protocol of the database engine named by version, e.g.
+// "MYSQL_8_0" or "POSTGRES_13". Nothing is written for other engines.
+func writeTooManyConnections(conn net.Conn, version string) error {
+	switch {
+	case strings.HasPrefix(version, "MYSQL"):
+		conn.SetDeadline(time.Now().Add(rejectTimeout))
+		return writeMySQLError(conn, mysqlTooManyConnections, "Too many connections")
+	case strings.HasPrefix(version, "POSTGRES"):
+		conn.SetDeadline(time.Now().Add(rejectTimeout))
+		return writePostgresError(conn, postgresTooManyConnections, "sorry, too many clients already")
+	}
+	return nil
+}
+
+// writeMySQLError writes an ERR packet in place of the server's initial
+// handshake. No SQLSTATE is included, as the client has not yet negotiated
+// the capabilities that require one.
+func writeMySQLError(w io.Writer, code uint16, msg string) error {
+	payload := make([]byte, 3, 3+len(msg))
+	payload[0] = 0xff
+	binary.LittleEndian.PutUint16(payload[1:], code)
+	payload = append(payload, msg...)
+
+	// The packet header is a 3 byte length followed by a sequence number.
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), 0}
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// writePostgresError reads the client's startup message, declining any
+// request for SSL or GSS encryption, and replies with a FATAL ErrorResponse.
+func writePostgresError(rw io.ReadWriter, code, msg string) error {
+	for {
+		req, err := readPostgresStartup(rw)
+		if err != nil {
+			return err
+		}
+		if req != postgresSSLRequest && req != postgresGSSENCRequest {
+			break
+		}
+		// The proxy has already secured the connection to the instance, so
+		// encryption is never offered to local clients.
+		if _, err := rw.Write([]byte{'N'}); err != nil {
+			return err
+		}
+	}
+
+	var fields bytes.Buffer
+	for _, f := range []struct {
+		typ byte
+		val string
+	}{
+		{'S', "FATAL"},
+		{'V', "FATAL"},
+		{'C', code},
+		{'M', msg},
+	} {
+		fields.WriteByte(f.typ)
+		fields.WriteString(f.val)
+		fields.WriteByte(0)
+	}
+	fields.WriteByte(0)
+
+	resp := make([]byte, 5, 5+fields.Len())
+	resp[0] = 'E'
+	binary.BigEndian.PutUint32(resp[1:], uint32(4+fields.Len()))
+	_, err := rw.Write(append(resp, fields.Bytes()...))
+	return err
+}
+
+// maxPostgresStartup bounds the size of the startup message the proxy reads
+// from a client it is about to refuse.
+const maxPostgresStartup = 10000
+
+// readPostgresStartup reads a startup message from r and returns its request
+// code (the protocol version for a StartupMessage).
+func readPostgresStartup(r io.Reader) (uint32, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	n := binary.BigEndian.Uint32(header[:4])
+	if n < 8 || n > maxPostgresStartup {
+		return 0, fmt.Errorf("invalid startup message length %d", n)
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, int64(n-8)); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(header[4:]), nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// pipeDialer returns client ends of net.Pipe connections, and runs serve on
+// each server end.
+type pipeDialer struct {
+	serve func(net.Conn)
+}
+
+func (d pipeDialer) Dial(string, string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		d.serve(server)
+	}()
+	return client, nil
+}
+
+func (d pipeDialer) DialTimeout(network, addr string, _ time.Duration) (net.Conn, error) {
+	return d.Dial(network, addr)
+}
+
+func TestRejectMySQL(t *testing.T) {
+	d := pipeDialer{serve: func(c net.Conn) {
+		if err := writeTooManyConnections(c, "MYSQL_8_0"); err != nil {
+			t.Errorf("writeTooManyConnections: %v", err)
+		}
+	}}
+	mysql.RegisterDialContext("reject", func(context.Context, string) (net.Conn, error) {
+		return d.Dial("", "")
+	})
+	db, err := sql.Open("mysql", "user@reject(instance)/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Ping()
+	var mErr *mysql.MySQLError
+	if !errors.As(err, &mErr) || mErr.Number != mysqlTooManyConnections {
+		t.Fatalf("Ping() = %v, want MySQL error %d", err, mysqlTooManyConnections)
+	}
+}
+
+func TestRejectPostgres(t *testing.T) {
+	d := pipeDialer{serve: func(c net.Conn) {
+		if err := writeTooManyConnections(c, "POSTGRES_13"); err != nil {
+			t.Errorf("writeTooManyConnections: %v", err)
+		}
+	}}
+	conn, err := pq.DialOpen(d, "host=instance user=user dbname=db sslmode=disable")
+	if err == nil {
+		conn.Close()
+	}
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != postgresTooManyConnections {
+		t.Fatalf("DialOpen() = %v, want Postgres error %v", err, postgresTooManyConnections)
+	}
+}
+
+func TestRejectPostgresSSLRequest(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		if err := writeTooManyConnections(server, "POSTGRES_13"); err != nil {
+			t.Errorf("writeTooManyConnections: %v", err)
+		}
+	}()
+
+	startup := func(code uint32, body []byte) {
+		msg := make([]byte, 8, 8+len(body))
+		binary.BigEndian.PutUint32(msg, uint32(8+len(body)))
+		binary.BigEndian.PutUint32(msg[4:], code)
+		if _, err := client.Write(append(msg, body...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	startup(postgresSSLRequest, nil)
+	resp := make([]byte, 1)
+	if _, err := io.ReadFull(client, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp[0] != 'N' {
+		t.Fatalf("response to SSLRequest = %q, want 'N'", resp[0])
+	}
+
+	startup(3<<16, []byte("user\x00user\x00\x00"))
+	all, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) == 0 || all[0] != 'E' {
+		t.Fatalf("response to StartupMessage = %q, want an ErrorResponse", all)
+	}
+	if !bytes.Contains(all, []byte("C"+postgresTooManyConnections+"\x00")) {
+		t.Fatalf("ErrorResponse %q does not contain code %v", all, postgresTooManyConnections)
+	}
+}
+
+func TestRejectUnknownEngine(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	// net.Pipe is synchronous, so any write would block without a reader.
+	if err := writeTooManyConnections(server, ""); err != nil {
+		t.Fatalf("writeTooManyConnections: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"testing"
+)
+
+// startResumingServer starts a TLS server which, like an instance, requires
+// the client's certificate and sends each client a greeting, and returns a
+// Client for it.
+func startResumingServer(t testing.TB, sessionTickets bool) (*Client, func()) {
+	l, _, c := startTLSServer(t, instance, tlsServerOptions{clientCA: true, sessionTickets: sessionTickets, greeting: true})
+	return c, func() { l.Close() }
+}
+
+// dialGreeting connects to the instance and reads its greeting.
+func dialGreeting(t testing.TB, c *Client) *tls.Conn {
+	conn, err := c.Dial(instance)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		t.Fatalf("reading greeting: %v", err)
+	}
+	return conn.(*tls.Conn)
+}
+
+func TestSessionResumption(t *testing.T) {
+	c, stop := startResumingServer(t, true)
+	defer stop()
+
+	first := dialGreeting(t, c)
+	first.Close()
+	if first.ConnectionState().DidResume {
+		t.Errorf("first connection resumed a session")
+	}
+	second := dialGreeting(t, c)
+	second.Close()
+	if !second.ConnectionState().DidResume {
+		t.Errorf("second connection with the same certificate did not resume the session")
+	}
+}
+
+func BenchmarkDial(b *testing.B) {
+	for _, bc := range []struct {
+		name    string
+		resumed bool
+	}{
+		{"full handshake", false},
+		{"resumed", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			c, stop := startResumingServer(b, bc.resumed)
+			defer stop()
+			dialGreeting(b, c).Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				dialGreeting(b, c).Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// errCertRotated is returned by a rotatingConn once it has been drained after
+// its instance's certificate was replaced. It has already been logged.
+var errCertRotated = errors.New("connection closed after its certificate was replaced")
+
+// rotationIdle is how long a connection must go without data, after a
+// response was last written to the client, before it is taken to be between
+// transactions and is drained.
+const rotationIdle = time.Second
+
+// drainCheckInterval is how often draining connections are checked for
+// idleness.
+const drainCheckInterval = 100 * time.Millisecond
+
+// certGeneration returns the generation of instance's cached certificate: the
+// number of certificates successfully retrieved for it.
+func (c *Client) certGeneration(instance string) uint64 {
+	c.cacheL.RLock()
+	defer c.cacheL.RUnlock()
+	return c.cfgCache[instance].generation
+}
+
+// trackRotation returns conn, a client's connection to instance made with
+// the certificate of generation gen, so that it can be drained once the
+// certificate is replaced. It returns conn itself, and release does nothing,
+// if RotationDrainTimeout is not set. release must be called once the
+// connection has closed.
+func (c *Client) trackRotation(conn net.Conn, instance string, gen uint64) (tracked net.Conn, release func()) {
+	if c.RotationDrainTimeout <= 0 {
+		return conn, func() {}
+	}
+	rc := &rotatingConn{Conn: conn, instance: instance, generation: gen}
+	rc.touch()
+	c.rotating.Store(rc, struct{}{})
+	return rc, func() { c.rotating.Delete(rc) }
+}
+
+// drainRotated drains the connections to instance made with a certificate
+// older than generation gen. Each is closed gracefully once it has been idle
+// for rotationIdle, and any still open after RotationDrainTimeout are closed
+// regardless.
+func (c *Client) drainRotated(instance string, gen uint64) {
+	var conns []*rotatingConn
+	c.rotating.Range(func(k, _ interface{}) bool {
+		if rc := k.(*rotatingConn); rc.instance == instance && rc.generation < gen {
+			conns = append(conns, rc)
+		}
+		return true
+	})
+	if len(conns) == 0 {
+		return
+	}
+	logging.Infof("Draining %d connections to %q made with its previous certificate", len(conns), instance)
+
+	term, ticker := time.NewTimer(c.RotationDrainTimeout), time.NewTicker(drainCheckInterval)
+	defer term.Stop()
+	defer ticker.Stop()
+	for len(conns) > 0 {
+		select {
+		case <-ticker.C:
+			var busy []*rotatingConn
+			for _, rc := range conns {
+				if _, open := c.rotating.Load(rc); !open {
+					continue
+				}
+				if !rc.idle() {
+					busy = append(busy, rc)
+					continue
+				}
+				logging.Verbosef("Closing idle connection to %q on %v: its certificate has been replaced", instance, rc.LocalAddr())
+				rc.drain()
+			}
+			conns = busy
+		case <-term.C:
+			for _, rc := range conns {
+				logging.Infof("Closing connection to %q on %v: it was not idle within %v of its certificate being replaced", instance, rc.LocalAddr(), c.RotationDrainTimeout)
+				rc.drain()
+			}
+			return
+		case <-c.shutdownCh():
+			return
+		}
+	}
+}
+
+// rotatingConn is a client's connection which records the generation of the
+// certificate it was made with. Like an agedConn, it is closed gracefully once
+// drained: a write already in progress is allowed to finish, and any further
+// read or write fails with errCertRotated, after which the proxy closes both
+// sides of the connection.
+type rotatingConn struct {
+	net.Conn
+	instance   string
+	generation uint64
+	// last is the time, in Unix nanoseconds, that data last passed in either
+	// direction.
+	last int64
+	// awaiting is set to 1 while the client has sent data, e.g. a query, and
+	// no response has yet been written to it.
+	awaiting uint32
+	// drained is set to 1 once the connection has been drained.
+	drained uint32
+	// writing is held for the duration of every Write.
+	writing sync.Mutex
+}
+
+func (c *rotatingConn) touch() {
+	atomic.StoreInt64(&c.last, time.Now().UnixNano())
+}
+
+// idle reports whether the connection is waiting for the client: a response
+// was the last data to pass through it, at least rotationIdle ago.
+func (c *rotatingConn) idle() bool {
+	if atomic.LoadUint32(&c.awaiting) == 1 {
+		return false
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.last))) >= rotationIdle
+}
+
+// drain marks the connection as drained and wakes any pending Read.
+func (c *rotatingConn) drain() {
+	atomic.StoreUint32(&c.drained, 1)
+	c.writing.Lock()
+	c.writing.Unlock()
+	c.Conn.SetReadDeadline(time.Unix(1, 0))
+}
+
+func (c *rotatingConn) isDrained() bool {
+	return atomic.LoadUint32(&c.drained) == 1
+}
+
+func (c *rotatingConn) Read(b []byte) (int, error) {
+	if c.isDrained() {
+		return 0, errCertRotated
+	}
+	n, err := c.Conn.Read(b)
+	if c.isDrained() {
+		// Data read as the connection was drained is dropped rather than
+		// sent to an instance whose response could not be written back.
+		return 0, errCertRotated
+	}
+	if n > 0 {
+		atomic.StoreUint32(&c.awaiting, 1)
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *rotatingConn) Write(b []byte) (int, error) {
+	c.writing.Lock()
+	defer c.writing.Unlock()
+	if c.isDrained() {
+		return 0, errCertRotated
+	}
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		atomic.StoreUint32(&c.awaiting, 0)
+		c.touch()
+	}
+	return n, err
+}
+
+// SetDeadline keeps the read deadline in the past once the connection has
+// been drained; see agedConn.SetDeadline.
+func (c *rotatingConn) SetDeadline(t time.Time) error {
+	err := c.Conn.SetDeadline(t)
+	if c.isDrained() {
+		c.Conn.SetReadDeadline(time.Unix(1, 0))
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTrackRotationDisabled(t *testing.T) {
+	c := &Client{}
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	got, release := c.trackRotation(local, "proj:reg:inst", 1)
+	defer release()
+	if got != local {
+		t.Errorf("trackRotation returned %T, want the connection itself", got)
+	}
+}
+
+func TestCertGeneration(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	c.RotationDrainTimeout = time.Second
+	defer c.Shutdown(0)
+	if err := c.Prefetch(context.Background(), instance); err != nil {
+		t.Fatalf("Prefetch: %v", err)
+	}
+	if got := c.certGeneration(instance); got != 1 {
+		t.Errorf("certGeneration after the first retrieval = %d, want 1", got)
+	}
+	<-c.startRefresh(instance, 0)
+	if got := c.certGeneration(instance); got != 2 {
+		t.Errorf("certGeneration after a refresh = %d, want 2", got)
+	}
+}
+
+func TestRotatingConnDrain(t *testing.T) {
+	defer waitForGoroutineCount(t, runtime.NumGoroutine(), 5*time.Second)
+	// The idle timeout extends the deadline on every write, which must not
+	// keep the drained connection open.
+	c := &Client{RotationDrainTimeout: time.Minute, IdleTimeout: time.Minute}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	tracked, release := c.trackRotation(a, "proj:reg:inst", 1)
+	defer release()
+	conn := c.closeIdle(tracked, "proj:reg:inst")
+	go io.Copy(ioutil.Discard, b)
+
+	if _, err := conn.Write([]byte{0}); err != nil {
+		t.Fatalf("Write before draining: %v", err)
+	}
+	time.AfterFunc(100*time.Millisecond, tracked.(*rotatingConn).drain)
+	if _, err := conn.Read(make([]byte, 1)); err != errCertRotated {
+		t.Fatalf("Read returned %v, want errCertRotated", err)
+	}
+	if _, err := conn.Write([]byte{0}); err != errCertRotated {
+		t.Errorf("Write after draining returned %v, want errCertRotated", err)
+	}
+}
+
+func TestDrainRotated(t *testing.T) {
+	defer waitForGoroutineCount(t, runtime.NumGoroutine(), 5*time.Second)
+	const inst = "proj:reg:inst"
+	c := &Client{RotationDrainTimeout: time.Second}
+	track := func(instance string, gen uint64) *rotatingConn {
+		a, b := net.Pipe()
+		conn, release := c.trackRotation(a, instance, gen)
+		go func() {
+			io.Copy(ioutil.Discard, b)
+			a.Close()
+			release()
+		}()
+		return conn.(*rotatingConn)
+	}
+	// idle was last used to write a response to its client a while ago.
+	idle := track(inst, 1)
+	atomic.StoreInt64(&idle.last, time.Now().Add(-time.Minute).UnixNano())
+	// busy is waiting for the response to a query.
+	busy := track(inst, 1)
+	atomic.StoreUint32(&busy.awaiting, 1)
+	current := track(inst, 2)
+	other := track("proj:reg:other", 1)
+	defer func() {
+		for _, rc := range []*rotatingConn{idle, busy, current, other} {
+			rc.Conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		c.drainRotated(inst, 2)
+		close(done)
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	if !idle.isDrained() {
+		t.Error("idle connection with the old certificate was not drained")
+	}
+	if busy.isDrained() {
+		t.Error("busy connection was drained before the timeout")
+	}
+	<-done
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("drainRotated returned after %v, want at least the 1s timeout", d)
+	}
+	if !busy.isDrained() {
+		t.Error("busy connection with the old certificate was not drained after the timeout")
+	}
+	if current.isDrained() || other.isDrained() {
+		t.Error("connections with the current certificate, or to another instance, were drained")
+	}
+}
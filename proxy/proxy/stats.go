@@ -0,0 +1,197 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/metrics"
+)
+
+// InstanceStats is a snapshot of the Client's activity for one instance.
+type InstanceStats struct {
+	Instance string `json:"instance"`
+	// ActiveConnections is the number of connections currently being
+	// proxied to the instance.
+	ActiveConnections uint64 `json:"active_connections"`
+	// ConnectionsOpened is the total number of connections which have been
+	// proxied to the instance.
+	ConnectionsOpened uint64 `json:"connections_opened"`
+	// BytesIn is the total number of bytes read from clients and sent to
+	// the instance.
+	BytesIn uint64 `json:"bytes_in"`
+	// BytesOut is the total number of bytes received from the instance and
+	// written to clients.
+	BytesOut uint64 `json:"bytes_out"`
+	// LastRefresh is when the instance's certificate was last retrieved
+	// successfully. It is zero if no certificate has been retrieved.
+	LastRefresh time.Time `json:"last_refresh"`
+	// RefreshErrors is the total number of failed certificate refreshes.
+	RefreshErrors uint64 `json:"refresh_errors"`
+	// Error is the error from the most recent certificate refresh, if it
+	// failed.
+	Error string `json:"error,omitempty"`
+	// SetupLatency is the distribution of the time taken to set up each
+	// connection, from accepting it to forwarding its data to the instance,
+	// including the TLS handshake. It is nil if no connection has been set
+	// up.
+	SetupLatency *LatencyHistogram `json:"setup_latency,omitempty"`
+}
+
+// LatencyHistogram counts latencies by range, as a Prometheus histogram does.
+type LatencyHistogram struct {
+	// Count is the number of latencies recorded.
+	Count uint64 `json:"count"`
+	// Sum is the total of the latencies recorded.
+	Sum time.Duration `json:"sum_ns"`
+	// Buckets holds the number of latencies no greater than each of
+	// metrics.SetupLatencyBuckets, followed by Count.
+	Buckets []LatencyBucket `json:"buckets"`
+}
+
+// LatencyBucket is a bucket of a LatencyHistogram.
+type LatencyBucket struct {
+	// UpperBound is the greatest latency counted in the bucket, e.g. "100ms",
+	// or "+Inf" for the last bucket.
+	UpperBound string `json:"le"`
+	// Count is the number of latencies no greater than UpperBound.
+	Count uint64 `json:"count"`
+}
+
+// connStats holds the counters for a single instance. Its fields must be
+// accessed atomically.
+type connStats struct {
+	active        uint64
+	opened        uint64
+	bytesIn       uint64
+	bytesOut      uint64
+	refreshErrors uint64
+
+	// setup counts the connection setup latencies in each of
+	// metrics.SetupLatencyBuckets, and above the last of them. setupNanos is
+	// their sum.
+	setup      [len(metrics.SetupLatencyBuckets) + 1]uint64
+	setupNanos uint64
+}
+
+// recordSetup records that a connection took d to set up.
+func (s *connStats) recordSetup(d time.Duration) {
+	i := sort.Search(len(metrics.SetupLatencyBuckets), func(i int) bool { return d <= metrics.SetupLatencyBuckets[i] })
+	atomic.AddUint64(&s.setup[i], 1)
+	atomic.AddUint64(&s.setupNanos, uint64(d))
+}
+
+// setupLatency returns the connection setup latencies recorded in s, or nil
+// if there are none.
+func (s *connStats) setupLatency() *LatencyHistogram {
+	h := &LatencyHistogram{Sum: time.Duration(atomic.LoadUint64(&s.setupNanos))}
+	for i := range s.setup {
+		h.Count += atomic.LoadUint64(&s.setup[i])
+		le := "+Inf"
+		if i < len(metrics.SetupLatencyBuckets) {
+			le = metrics.SetupLatencyBuckets[i].String()
+		}
+		h.Buckets = append(h.Buckets, LatencyBucket{UpperBound: le, Count: h.Count})
+	}
+	if h.Count == 0 {
+		return nil
+	}
+	return h
+}
+
+func (c *Client) statsFor(instance string) *connStats {
+	v, _ := c.stats.LoadOrStore(instance, &connStats{})
+	return v.(*connStats)
+}
+
+// connBytes holds the byte counts of a single connection. Its fields must be
+// accessed atomically.
+type connBytes struct {
+	in, out uint64
+}
+
+// countingConn counts the bytes read from and written to a client's
+// connection to instance, in s, conn and m.
+type countingConn struct {
+	net.Conn
+	s        *connStats
+	conn     *connBytes
+	instance string
+	m        *metrics.Metrics
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.s.bytesIn, uint64(n))
+	atomic.AddUint64(&c.conn.in, uint64(n))
+	c.m.BytesTransferred(c.instance, "in", n)
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.s.bytesOut, uint64(n))
+	atomic.AddUint64(&c.conn.out, uint64(n))
+	c.m.BytesTransferred(c.instance, "out", n)
+	return n, err
+}
+
+// Stats reports the activity of each instance the Client has proxied
+// connections to or fetched a certificate for, as well as each of instances,
+// sorted by instance. It may be called from any goroutine, and the returned
+// values are copies which later activity does not change. The connection
+// counters are read without blocking connections which are being proxied.
+func (c *Client) Stats(instances ...string) []InstanceStats {
+	names := make(map[string]bool)
+	for _, inst := range instances {
+		names[inst] = true
+	}
+	c.stats.Range(func(k, _ interface{}) bool {
+		names[k.(string)] = true
+		return true
+	})
+	c.cacheL.RLock()
+	for inst := range c.cfgCache {
+		names[inst] = true
+	}
+	c.cacheL.RUnlock()
+
+	var stats []InstanceStats
+	for inst := range names {
+		s := InstanceStats{Instance: inst}
+		if v, ok := c.stats.Load(inst); ok {
+			cs := v.(*connStats)
+			s.ActiveConnections = atomic.LoadUint64(&cs.active)
+			s.ConnectionsOpened = atomic.LoadUint64(&cs.opened)
+			s.RefreshErrors = atomic.LoadUint64(&cs.refreshErrors)
+			s.BytesIn = atomic.LoadUint64(&cs.bytesIn)
+			s.BytesOut = atomic.LoadUint64(&cs.bytesOut)
+			s.SetupLatency = cs.setupLatency()
+		}
+		c.cacheL.RLock()
+		e := c.cfgCache[inst]
+		c.cacheL.RUnlock()
+		s.LastRefresh = e.lastSuccess
+		if e.err != nil {
+			s.Error = e.err.Error()
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Instance < stats[j].Instance })
+	return stats
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCountingConn(t *testing.T) {
+	c := &Client{}
+	client, local := net.Pipe()
+	defer client.Close()
+	conn := countingConn{Conn: local, s: c.statsFor(instance), conn: &connBytes{}, instance: instance}
+	defer conn.Close()
+
+	go client.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	go io.ReadFull(client, make([]byte, 2))
+	if _, err := conn.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := c.Stats()
+	if len(got) != 1 || got[0].BytesIn != 5 || got[0].BytesOut != 2 {
+		t.Fatalf("Stats() = %+v, want 5 bytes in and 2 out for %q", got, instance)
+	}
+}
+
+func TestStats(t *testing.T) {
+	refreshed := time.Now()
+	c := &Client{cfgCache: map[string]cacheEntry{
+		"proj:region:b": {lastSuccess: refreshed},
+		"proj:region:c": {err: errors.New("refresh failed")},
+	}}
+	c.statsFor("proj:region:b").active = 2
+	c.statsFor("proj:region:b").opened = 5
+	c.statsFor("proj:region:c").refreshErrors = 3
+
+	got := c.Stats("proj:region:a", "proj:region:b")
+	want := []InstanceStats{
+		{Instance: "proj:region:a"},
+		{Instance: "proj:region:b", ActiveConnections: 2, ConnectionsOpened: 5, LastRefresh: refreshed},
+		{Instance: "proj:region:c", RefreshErrors: 3, Error: "refresh failed"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Stats() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Stats()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSetupLatency(t *testing.T) {
+	c := &Client{}
+	s := c.statsFor(instance)
+	s.recordSetup(5 * time.Millisecond)
+	s.recordSetup(100 * time.Millisecond)
+	s.recordSetup(time.Minute)
+
+	got := c.Stats()[0].SetupLatency
+	if got == nil {
+		t.Fatal("Stats() has no setup latency")
+	}
+	if got.Count != 3 || got.Sum != 5*time.Millisecond+100*time.Millisecond+time.Minute {
+		t.Errorf("SetupLatency has count %d and sum %v, want 3 and the total", got.Count, got.Sum)
+	}
+	want := []LatencyBucket{
+		{"10ms", 1}, {"50ms", 1}, {"100ms", 2}, {"250ms", 2}, {"500ms", 2}, {"1s", 2}, {"5s", 2}, {"+Inf", 3},
+	}
+	if len(got.Buckets) != len(want) {
+		t.Fatalf("SetupLatency.Buckets = %+v, want %+v", got.Buckets, want)
+	}
+	for i := range want {
+		if got.Buckets[i] != want[i] {
+			t.Errorf("SetupLatency.Buckets[%d] = %+v, want %+v", i, got.Buckets[i], want[i])
+		}
+	}
+}
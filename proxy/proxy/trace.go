@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans created by this package.
+const tracerName = "github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+
+// Names of the spans recorded for each proxied connection.
+const (
+	connSpan      = "cloudsql.proxy.Connection"
+	certSpan      = "cloudsql.proxy.CertFetch"
+	handshakeSpan = "cloudsql.proxy.TLSHandshake"
+)
+
+// endSpan finishes a span started by startSpan, recording err if it is not
+// nil.
+type endSpan func(err error)
+
+func noopEndSpan(error) {}
+
+// startSpan starts a span with the provided name as a child of any span in
+// ctx. If the Client has no TracerProvider, ctx is returned unchanged and the
+// returned endSpan does nothing.
+func (c *Client) startSpan(ctx context.Context, name, instance string) (context.Context, endSpan) {
+	if c.TracerProvider == nil {
+		return ctx, noopEndSpan
+	}
+	ctx, span := c.TracerProvider.Tracer(tracerName).Start(ctx, name,
+		trace.WithAttributes(attribute.String("instance", instance)),
+	)
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordingTracerProvider records the names of all spans started by its
+// Tracers.
+type recordingTracerProvider struct {
+	mu    sync.Mutex
+	spans []string
+}
+
+func (p *recordingTracerProvider) Tracer(name string, _ ...trace.TracerOption) trace.Tracer {
+	return &recordingTracer{
+		Tracer: trace.NewNoopTracerProvider().Tracer(name),
+		p:      p,
+	}
+}
+
+func (p *recordingTracerProvider) names() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.spans...)
+}
+
+type recordingTracer struct {
+	trace.Tracer
+	p *recordingTracerProvider
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	t.p.mu.Lock()
+	t.p.spans = append(t.p.spans, name)
+	t.p.mu.Unlock()
+	return t.Tracer.Start(ctx, name, opts...)
+}
+
+func TestConnectionSpans(t *testing.T) {
+	tp := &recordingTracerProvider{}
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	c.TracerProvider = tp
+
+	c.handleConn(Conn{Instance: instance, Conn: &dummyConn{}})
+
+	// The fake dialer fails before a TLS handshake is attempted.
+	want := []string{connSpan, certSpan}
+	if got := tp.names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got spans %v, want %v", got, want)
+	}
+}
+
+func TestNoTracerProvider(t *testing.T) {
+	c := newClient(newCertSource(&fakeCerts{}, forever))
+	ctx := context.Background()
+
+	got, end := c.startSpan(ctx, connSpan, instance)
+	end(sentinelError)
+	if got != ctx {
+		t.Errorf("startSpan without a TracerProvider should return the original context")
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// DefaultWarmIdleTimeout is the default value of Client.WarmIdleTimeout. It
+// is shorter than MySQL's default connect_timeout of 10 seconds.
+const DefaultWarmIdleTimeout = 5 * time.Second
+
+// warmPool holds connections to an instance which have completed their TLS
+// handshake but have not yet been handed to a client.
+type warmPool struct {
+	mu sync.Mutex
+	// conns holds the ready connections, oldest first.
+	conns []net.Conn
+	// dialing is the number of connections being established.
+	dialing int
+}
+
+// remove takes conn out of the pool, reporting whether it was present.
+func (p *warmPool) remove(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.conns {
+		if c == conn {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) warmIdleTimeout() time.Duration {
+	if c.WarmIdleTimeout == 0 {
+		return DefaultWarmIdleTimeout
+	}
+	return c.WarmIdleTimeout
+}
+
+// fillWarm establishes connections to instance until WarmConnections are
+// ready or being dialed.
+func (c *Client) fillWarm(instance string) {
+	if c.WarmConnections <= 0 || atomic.LoadUint32(&c.closing) == 1 {
+		return
+	}
+	v, _ := c.warm.LoadOrStore(instance, &warmPool{})
+	p := v.(*warmPool)
+
+	p.mu.Lock()
+	need := c.WarmConnections - len(p.conns) - p.dialing
+	if need > 0 {
+		p.dialing += need
+	}
+	p.mu.Unlock()
+
+	for i := 0; i < need; i++ {
+		go func() {
+			conn, err := c.DialContext(context.Background(), instance)
+			p.mu.Lock()
+			p.dialing--
+			if err == nil {
+				p.conns = append(p.conns, conn)
+			}
+			p.mu.Unlock()
+			if err != nil {
+				logging.Verbosef("couldn't establish warm connection to %q: %v", instance, err)
+				return
+			}
+			if atomic.LoadUint32(&c.closing) == 1 {
+				// Shutdown may have emptied the pool before this connection
+				// was added to it.
+				if p.remove(conn) {
+					conn.Close()
+				}
+				return
+			}
+			// Idle connections are closed but not replaced, so the pool
+			// shrinks while no clients are connecting. It is refilled by
+			// the next call to takeWarm.
+			time.AfterFunc(c.warmIdleTimeout(), func() {
+				if p.remove(conn) {
+					logging.Verbosef("closing idle warm connection to %q", instance)
+					conn.Close()
+				}
+			})
+		}()
+	}
+}
+
+// takeWarm returns a ready connection to instance, or nil if there is none.
+// Either way, the pool is refilled for the connections that follow.
+func (c *Client) takeWarm(instance string) net.Conn {
+	v, ok := c.warm.Load(instance)
+	if !ok {
+		return nil
+	}
+	defer func() { go c.fillWarm(instance) }()
+
+	p := v.(*warmPool)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.conns) == 0 {
+		return nil
+	}
+	conn := p.conns[0]
+	p.conns = p.conns[1:]
+	return conn
+}
+
+// closeWarm closes every warm connection.
+func (c *Client) closeWarm() {
+	c.warm.Range(func(_, v interface{}) bool {
+		p := v.(*warmPool)
+		p.mu.Lock()
+		conns := p.conns
+		p.conns = nil
+		p.mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return true
+	})
+}
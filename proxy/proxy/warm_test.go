@@ -0,0 +1,239 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tlsCertSource is a CertSource for an instance served by a local TLS
+// server started with startTLSServer.
+type tlsCertSource struct {
+	serverCert *x509.Certificate
+	// clientCert is presented to the server if it requires a client
+	// certificate.
+	clientCert tls.Certificate
+}
+
+func (s *tlsCertSource) Local(string) (tls.Certificate, error) {
+	if s.clientCert.Leaf != nil {
+		return s.clientCert, nil
+	}
+	return tls.Certificate{Leaf: &x509.Certificate{NotAfter: forever}}, nil
+}
+
+func (s *tlsCertSource) Remote(instance string) (*x509.Certificate, string, string, string, error) {
+	return s.serverCert, "127.0.0.1", instance, "POSTGRES_13", nil
+}
+
+// tlsServerOptions configures the server started by startTLSServer.
+type tlsServerOptions struct {
+	// clientCA makes the server require a client certificate signed by its
+	// own certificate, which then acts as a CA, as an instance requires the
+	// proxy's ephemeral certificate.
+	clientCA bool
+	// sessionTickets lets clients resume sessions.
+	sessionTickets bool
+	// greeting makes the server write a byte to each client after the
+	// handshake, as a database would, which also delivers any session
+	// ticket.
+	greeting bool
+}
+
+// newTestCert returns a certificate for cn signed by parent and its key, or
+// self-signed if parent is nil.
+func newTestCert(t testing.TB, cn string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+// startTLSServer starts a TLS server for instance which completes handshakes
+// and then holds each connection open until the client sends a byte or the
+// listener is closed. It returns the listener, the number of handshakes
+// completed so far, and a Client configured to connect to it.
+func startTLSServer(t testing.TB, instance string, opts tlsServerOptions) (net.Listener, *int32, *Client) {
+	cert, server := newTestCert(t, instance, 1, nil, nil)
+	certs := &tlsCertSource{serverCert: cert}
+	cfg := &tls.Config{
+		Certificates:           []tls.Certificate{server},
+		SessionTicketsDisabled: !opts.sessionTickets,
+	}
+	if opts.clientCA {
+		_, certs.clientCert = newTestCert(t, "client", 2, cert, server.PrivateKey.(*ecdsa.PrivateKey))
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = x509.NewCertPool()
+		cfg.ClientCAs.AddCert(cert)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handshakes int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := conn.(*tls.Conn).Handshake(); err != nil {
+					return
+				}
+				atomic.AddInt32(&handshakes, 1)
+				if opts.greeting {
+					conn.Write([]byte{0})
+				}
+				buf := make([]byte, 1)
+				conn.Read(buf)
+			}()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	c := &Client{Port: p, Certs: certs}
+	return l, &handshakes, c
+}
+
+// waitFor polls cond until it returns true, failing the test after a few
+// seconds.
+func waitFor(t *testing.T, desc string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", desc)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func warmCount(c *Client, instance string) int {
+	v, ok := c.warm.Load(instance)
+	if !ok {
+		return 0
+	}
+	p := v.(*warmPool)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+func TestWarmConnections(t *testing.T) {
+	defer waitForGoroutineCount(t, runtime.NumGoroutine(), 5*time.Second)
+	l, handshakes, c := startTLSServer(t, instance, tlsServerOptions{})
+	defer l.Close()
+	c.WarmConnections = 2
+	c.WarmIdleTimeout = time.Minute
+
+	if _, _, _, err := c.cachedCfg(context.Background(), instance); err != nil {
+		t.Fatalf("cachedCfg: %v", err)
+	}
+	waitFor(t, "pool to fill", func() bool { return warmCount(c, instance) == 2 })
+
+	conn := c.takeWarm(instance)
+	if conn == nil {
+		t.Fatal("takeWarm returned no connection from a full pool")
+	}
+	defer conn.Close()
+	if got := atomic.LoadInt32(handshakes); got < 2 {
+		t.Fatalf("got %d handshakes before any connection was requested, want 2", got)
+	}
+	waitFor(t, "pool to refill", func() bool { return warmCount(c, instance) == 2 })
+
+	if err := c.Shutdown(0); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if n := warmCount(c, instance); n != 0 {
+		t.Fatalf("%d warm connections remain after Shutdown", n)
+	}
+}
+
+func TestWarmConnectionsIdleTimeout(t *testing.T) {
+	l, _, c := startTLSServer(t, instance, tlsServerOptions{})
+	defer l.Close()
+	c.WarmConnections = 2
+	c.WarmIdleTimeout = 50 * time.Millisecond
+
+	if _, _, _, err := c.cachedCfg(context.Background(), instance); err != nil {
+		t.Fatalf("cachedCfg: %v", err)
+	}
+	waitFor(t, "pool to fill", func() bool { return warmCount(c, instance) == 2 })
+	waitFor(t, "pool to shrink", func() bool { return warmCount(c, instance) == 0 })
+	// An idle pool stays empty until a connection is requested.
+	time.Sleep(100 * time.Millisecond)
+	if n := warmCount(c, instance); n != 0 {
+		t.Fatalf("idle pool was refilled with %d connections", n)
+	}
+	if conn := c.takeWarm(instance); conn != nil {
+		conn.Close()
+		t.Fatal("takeWarm returned a connection from an empty pool")
+	}
+	waitFor(t, "pool to refill", func() bool { return warmCount(c, instance) > 0 })
+}
+
+func TestNoWarmConnections(t *testing.T) {
+	l, handshakes, c := startTLSServer(t, instance, tlsServerOptions{})
+	defer l.Close()
+
+	if _, _, _, err := c.cachedCfg(context.Background(), instance); err != nil {
+		t.Fatalf("cachedCfg: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(handshakes); got != 0 {
+		t.Fatalf("got %d handshakes with warm connections disabled, want 0", got)
+	}
+	if conn := c.takeWarm(instance); conn != nil {
+		t.Fatal("takeWarm returned a connection with warm connections disabled")
+	}
+}
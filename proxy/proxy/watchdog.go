@@ -0,0 +1,106 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"sort"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/logging"
+)
+
+// maxRefreshesInFlight is the number of refreshes of one instance which may
+// be in flight at once before the refresh watchdog reports them as hung.
+// cachedCfg starts a refresh only once the previous one has finished, so
+// more than one suggests refreshes are being leaked.
+const maxRefreshesInFlight = 2
+
+// refreshWatchdogInterval is how often the refresh watchdog checks the
+// refreshes in flight. It is changed in tests.
+var refreshWatchdogInterval = time.Minute
+
+// refreshStarted records that a refresh of instance has started. c.cacheL
+// must be held.
+func (c *Client) refreshStarted(instance string) {
+	c.watchdogOnce.Do(func() { go c.watchRefreshes() })
+	if c.inFlight == nil {
+		c.inFlight = make(map[string]int)
+	}
+	c.inFlight[instance]++
+	c.Metrics.RefreshesInFlight(instance, c.inFlight[instance])
+}
+
+// refreshFinished records that a refresh of instance has finished. c.cacheL
+// must be held.
+func (c *Client) refreshFinished(instance string) {
+	n := c.inFlight[instance] - 1
+	if n > 0 {
+		c.inFlight[instance] = n
+	} else {
+		delete(c.inFlight, instance)
+		n = 0
+	}
+	c.Metrics.RefreshesInFlight(instance, n)
+}
+
+// watchRefreshes checks the refreshes in flight every
+// refreshWatchdogInterval until the Client is shut down.
+func (c *Client) watchRefreshes() {
+	reported := make(map[string]bool)
+	t := time.NewTicker(refreshWatchdogInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.checkRefreshes(reported)
+		case <-c.shutdownCh():
+			return
+		}
+	}
+}
+
+// checkRefreshes logs a warning about, and counts in the
+// cert_refresh_hung_total metric, each instance with more than
+// maxRefreshesInFlight refreshes in flight. An instance is reported once
+// until its refreshes catch up; reported holds the instances already
+// reported.
+func (c *Client) checkRefreshes(reported map[string]bool) {
+	hung := make(map[string]int)
+	c.cacheL.RLock()
+	for inst, n := range c.inFlight {
+		if n > maxRefreshesInFlight {
+			hung[inst] = n
+		}
+	}
+	c.cacheL.RUnlock()
+
+	for inst := range reported {
+		if _, ok := hung[inst]; !ok {
+			delete(reported, inst)
+		}
+	}
+	var insts []string
+	for inst := range hung {
+		if !reported[inst] {
+			insts = append(insts, inst)
+		}
+	}
+	sort.Strings(insts)
+	for _, inst := range insts {
+		reported[inst] = true
+		logging.Errorf("WARNING: %d certificate refreshes for %s have not finished; refreshes may be hanging", hung[inst], inst)
+		c.Metrics.RefreshHung(inst)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/metrics"
+)
+
+func inFlight(c *Client, instance string) int {
+	c.cacheL.RLock()
+	defer c.cacheL.RUnlock()
+	return c.inFlight[instance]
+}
+
+func TestRefreshesInFlight(t *testing.T) {
+	b := &fakeCerts{}
+	c := newClient(newCertSource(b, forever))
+
+	b.Lock()
+	errc := make(chan error)
+	go func() {
+		_, err := c.Dial(instance)
+		errc <- err
+	}()
+	waitFor(t, "refresh to start", func() bool { return inFlight(c, instance) == 1 })
+	b.Unlock()
+
+	if err := <-errc; err != sentinelError {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if n := inFlight(c, instance); n != 0 {
+		t.Errorf("%d refreshes in flight after the refresh finished, want 0", n)
+	}
+}
+
+func hungCount(t *testing.T, m *metrics.Metrics) string {
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatalf("failed to read metrics: %v", err)
+	}
+	for _, l := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(l, "cloudsql_proxy_cert_refresh_hung_total{") {
+			return l
+		}
+	}
+	return ""
+}
+
+func TestCheckRefreshes(t *testing.T) {
+	c := &Client{
+		Metrics:  metrics.New(),
+		inFlight: map[string]int{instance: maxRefreshesInFlight + 1, "other": 1},
+	}
+	reported := make(map[string]bool)
+	want := `cloudsql_proxy_cert_refresh_hung_total{instance="instance-name"} 1`
+
+	c.checkRefreshes(reported)
+	if got := hungCount(t, c.Metrics); got != want {
+		t.Errorf("after first check, got %q, want %q", got, want)
+	}
+	if !reported[instance] || reported["other"] {
+		t.Errorf("reported = %v, want only %v", reported, instance)
+	}
+
+	// An instance is counted once while its refreshes stay hung.
+	c.checkRefreshes(reported)
+	if got := hungCount(t, c.Metrics); got != want {
+		t.Errorf("after second check, got %q, want %q", got, want)
+	}
+
+	// Once its refreshes have caught up, it is counted again if they hang.
+	c.inFlight[instance] = 1
+	c.checkRefreshes(reported)
+	if len(reported) != 0 {
+		t.Errorf("reported = %v after refreshes caught up, want none", reported)
+	}
+	c.inFlight[instance] = maxRefreshesInFlight + 1
+	c.checkRefreshes(reported)
+	want = `cloudsql_proxy_cert_refresh_hung_total{instance="instance-name"} 2`
+	if got := hungCount(t, c.Metrics); got != want {
+		t.Errorf("after refreshes hung again, got %q, want %q", got, want)
+	}
+}
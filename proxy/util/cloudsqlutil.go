@@ -15,7 +15,21 @@
 // Package util contains utility functions for use throughout the Cloud SQL Auth proxy.
 package util
 
-import "strings"
+import (
+	"regexp"
+	"strings"
+)
+
+// instanceNameRE matches an instance connection name of the form
+// "project:region:instance", where the project may be domain-scoped, e.g.
+// "example.com:project".
+var instanceNameRE = regexp.MustCompile(`^(?:[a-z0-9-]+(?:\.[a-z0-9-]+)+:)?[a-z0-9][a-z0-9-]*:[a-z0-9][a-z0-9-]*:[a-z0-9][a-z0-9-]*$`)
+
+// ValidName reports whether instance is a well-formed instance connection
+// name. It does not check that the instance exists.
+func ValidName(instance string) bool {
+	return instanceNameRE.MatchString(instance)
+}
 
 // SplitName splits a fully qualified instance into its project, region, and
 // instance name components. While we make the transition to regionalized
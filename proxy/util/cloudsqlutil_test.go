@@ -21,6 +21,8 @@ func TestSplitName(t *testing.T) {
 		{"proj:region:my-db", "proj", "region", "my-db"},
 		{"google.com:project:region:instance", "google.com:project", "region", "instance"},
 		{"google.com:missing:part", "google.com:missing", "", "part"},
+		{"example.com:my-project:us-central1:my-db", "example.com:my-project", "us-central1", "my-db"},
+		{"my-project", "", "", "my-project"},
 	}
 
 	for _, test := range table {
@@ -36,3 +38,30 @@ func TestSplitName(t *testing.T) {
 		}
 	}
 }
+
+func TestValidName(t *testing.T) {
+	table := []struct {
+		in   string
+		want bool
+	}{
+		{"proj:region:my-db", true},
+		{"my-project:us-central1:my-db", true},
+		{"example.com:my-project:us-central1:my-db", true},
+		{"google.com:project:region:instance", true},
+		{"my-project/us-central1/my-db", false},
+		{"my-project:my-db", false},
+		{"google.com:missing:part", false},
+		{"proj::my-db", false},
+		{"proj:region:my-db:extra", false},
+		{"proj:region:my db", false},
+		{"Proj:region:my-db", false},
+		{"proj:region:my-db=tcp:5432", false},
+		{"", false},
+	}
+
+	for _, test := range table {
+		if got := ValidName(test.in); got != test.want {
+			t.Errorf("ValidName(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package integration tests a proxy.Client against a real Cloud SQL instance
+// of any database engine. The tests are skipped unless
+// CLOUDSQL_PROXY_TEST_INSTANCE is set, e.g.
+//
+//	CLOUDSQL_PROXY_TEST_INSTANCE=my-project:my-region:my-instance \
+//	CLOUDSQL_PROXY_TEST_USER=my-user CLOUDSQL_PROXY_TEST_PASS=my-password \
+//	go test ./tests/integration
+//
+// Application Default Credentials are used to connect to the instance.
+package integration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/certs"
+	"github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/proxy"
+	_ "github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+var (
+	instance = os.Getenv("CLOUDSQL_PROXY_TEST_INSTANCE")
+	user     = os.Getenv("CLOUDSQL_PROXY_TEST_USER")
+	password = os.Getenv("CLOUDSQL_PROXY_TEST_PASS")
+	// database defaults to the engine's default database if unset.
+	database = os.Getenv("CLOUDSQL_PROXY_TEST_DB")
+
+	// client and addr are the proxy started by TestMain, listening for
+	// connections to instance on addr.
+	client *proxy.Client
+	addr   string
+)
+
+func TestMain(m *testing.M) {
+	if instance == "" {
+		os.Exit(m.Run())
+	}
+
+	ctx := context.Background()
+	ts, err := google.DefaultTokenSource(ctx, proxy.SQLScope)
+	if err != nil {
+		log.Fatalf("finding default credentials: %v", err)
+	}
+	client = &proxy.Client{
+		Port:  3307,
+		Certs: certs.NewCertSourceOpts(oauth2.NewClient(ctx, ts), certs.RemoteOpts{TokenSource: ts}),
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("listening for connections: %v", err)
+	}
+	addr = l.Addr().String()
+	done := make(chan struct{})
+	go func() {
+		client.Run(proxy.NewConnSrc(instance, l))
+		close(done)
+	}()
+
+	rtn := m.Run()
+
+	// Closing the listener closes the source of connections, so Run
+	// returns once its connections are closed.
+	l.Close()
+	if err := client.Shutdown(30 * time.Second); err != nil {
+		log.Printf("shutting down proxy: %v", err)
+	}
+	<-done
+	os.Exit(rtn)
+}
+
+// requireInstance skips t unless an instance to test against is configured.
+func requireInstance(t *testing.T) {
+	if instance == "" {
+		t.Skip("CLOUDSQL_PROXY_TEST_INSTANCE not set")
+	}
+}
+
+// open returns a database handle connecting to the instance through the
+// proxy, using the driver for the instance's database engine.
+func open(ctx context.Context, t *testing.T) *sql.DB {
+	version, err := client.InstanceVersionContext(ctx, instance)
+	if err != nil {
+		t.Fatalf("InstanceVersionContext(%q): %v", instance, err)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("invalid proxy address %q: %v", addr, err)
+	}
+
+	var driver, dsn string
+	switch {
+	case strings.HasPrefix(version, "MYSQL"):
+		cfg := mysql.NewConfig()
+		cfg.User, cfg.Passwd, cfg.DBName = user, password, database
+		cfg.Net, cfg.Addr = "tcp", addr
+		driver, dsn = "mysql", cfg.FormatDSN()
+	case strings.HasPrefix(version, "POSTGRES"):
+		dsn = fmt.Sprintf("host=%s port=%s user=%s password=%s sslmode=disable", host, port, user, password)
+		if database != "" {
+			dsn += " dbname=" + database
+		}
+		driver = "postgres"
+	case strings.HasPrefix(version, "SQLSERVER"):
+		u := url.URL{Scheme: "sqlserver", User: url.UserPassword(user, password), Host: addr}
+		if database != "" {
+			u.RawQuery = url.Values{"database": {database}}.Encode()
+		}
+		driver, dsn = "sqlserver", u.String()
+	default:
+		t.Fatalf("unsupported database version %q", version)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("sql.Open(%q): %v", driver, err)
+	}
+	return db
+}
+
+func TestSelectOne(t *testing.T) {
+	requireInstance(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	db := open(ctx, t)
+	defer db.Close()
+	var got int
+	if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&got); err != nil {
+		t.Fatalf("SELECT 1: %v", err)
+	}
+	if got != 1 {
+		t.Errorf("SELECT 1 returned %d, want 1", got)
+	}
+}